@@ -0,0 +1,100 @@
+package grt_test
+
+import (
+	"fmt"
+	"github.com/alecthomas/grt"
+	"github.com/alecthomas/grt/grttest"
+	"testing"
+	"time"
+)
+
+// failures records failures reported by assertions under test.
+type failures struct {
+	testing.TB
+	messages []string
+}
+
+func (f *failures) Helper() {}
+
+func (f *failures) Errorf(format string, args ...interface{}) {
+	f.messages = append(f.messages, fmt.Sprintf(format, args...))
+}
+
+func abandoned(t *testing.T, q *grt.JobQueue, job string) []byte {
+	t.Helper()
+	if err := q.Submit(job); err != nil {
+		t.Fatal(err)
+	}
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.AbandonForTest()
+	return w.Key()
+}
+
+func TestAbandonRequiresStrictMode(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "abandon")
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPanic(t, "outside strict mode", w.AbandonForTest)
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAbandonReclaimedByCleanup(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "abandon", grt.WithStrict())
+	key := abandoned(t, q, "a")
+	// Redis is left as a crashed worker would leave it.
+	if d, err := q.DescribeKey(key); err != nil || d.State != grt.JobInProgress {
+		t.Fatalf("%+v %v", d, err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		if err := q.Cleanup(); err != nil {
+			t.Error(err)
+		}
+	}()
+	grttest.AssertReclaimedWithin(t, q, key, time.Second)
+	var job string
+	w, err := q.Get(&job)
+	if err != nil || job != "a" {
+		t.Fatal(job, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAbandonReclaimedByReaper(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "abandon-reaper", grt.WithStrict(), grt.WithVisibilityTimeout(20*time.Millisecond))
+	key := abandoned(t, q, "a")
+	if n, err := q.ReapExpired(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if n, err := q.ReapExpired(); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	grttest.AssertReclaimedWithin(t, q, key, time.Second)
+}
+
+func TestAssertReclaimedWithinFails(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "abandon", grt.WithStrict())
+	key := abandoned(t, q, "a")
+	f := &failures{TB: t}
+	grttest.AssertReclaimedWithin(f, q, key, 30*time.Millisecond)
+	if len(f.messages) != 1 || f.messages[0] != `"a" was not reclaimed within 30ms, state is in_progress` {
+		t.Fatal(f.messages)
+	}
+}
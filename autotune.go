@@ -0,0 +1,158 @@
+package grt
+
+import (
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+const (
+	// How often WithAutoConcurrency samples the process.
+	autotuneInterval = 5 * time.Second
+	// Fraction of a target below which usage counts as under it, so that
+	// concurrency does not oscillate around the target.
+	autotuneHeadroom = 0.8
+	// Consecutive samples under target before concurrency is raised.
+	autotuneUpSamples = 3
+)
+
+// concurrencySample is a measurement of the process's resource usage.
+type concurrencySample struct {
+	// Fraction of GOMAXPROCS spent on CPU since the last sample, or
+	// negative if unknown.
+	cpu float64
+	// Bytes of heap in use.
+	heap uint64
+}
+
+// autoConcurrency adjusts Run's concurrency to the process's resource usage.
+type autoConcurrency struct {
+	min, max  int
+	targetCPU float64
+	targetMem uint64
+	interval  time.Duration
+	sample    func() concurrencySample
+
+	lock sync.Mutex
+	// Consecutive samples under target.
+	calm int
+}
+
+// WithAutoConcurrency adjusts the number of workers of Run between min and
+// max, starting from Run's concurrency, according to the process's CPU and
+// heap usage sampled every five seconds. Concurrency is halved while the heap
+// exceeds targetMemBytes and lowered by one while CPU usage, as a fraction of
+// GOMAXPROCS, exceeds targetCPU; it is raised by one after three consecutive
+// samples with both comfortably under target. Either target may be zero to
+// ignore it. CPU usage is unavailable on some platforms, such as Windows.
+//
+// Lowering concurrency only stops workers from retrieving further jobs;
+// handlers in progress are never interrupted. The current concurrency is
+// reported by RunStats.
+func WithAutoConcurrency(min, max int, targetCPU float64, targetMemBytes uint64) Option {
+	return func(c *JobQueue) {
+		if min < 1 {
+			min = 1
+		}
+		if max < min {
+			max = min
+		}
+		c.autoConcurrency = &autoConcurrency{min: min, max: max, targetCPU: targetCPU, targetMem: targetMemBytes,
+			interval: autotuneInterval, sample: (&processSampler{}).sample}
+	}
+}
+
+func (a *autoConcurrency) clamp(concurrency int) int {
+	if concurrency < a.min {
+		return a.min
+	}
+	if concurrency > a.max {
+		return a.max
+	}
+	return concurrency
+}
+
+// adjust returns the concurrency to use after sample, given the current
+// concurrency: lowered quickly under pressure and raised slowly.
+func (a *autoConcurrency) adjust(concurrency int, sample concurrencySample) int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	overMem := a.targetMem > 0 && sample.heap > a.targetMem
+	overCPU := a.targetCPU > 0 && sample.cpu > a.targetCPU
+	underMem := a.targetMem == 0 || float64(sample.heap) < float64(a.targetMem)*autotuneHeadroom
+	underCPU := a.targetCPU == 0 || (sample.cpu >= 0 && sample.cpu < a.targetCPU*autotuneHeadroom)
+	switch {
+	case overMem:
+		a.calm = 0
+		concurrency /= 2
+	case overCPU:
+		a.calm = 0
+		concurrency--
+	case underMem && underCPU:
+		a.calm++
+		if a.calm >= autotuneUpSamples {
+			a.calm = 0
+			concurrency++
+		}
+	default:
+		a.calm = 0
+	}
+	return a.clamp(concurrency)
+}
+
+// autotune samples the process every interval, adjusting run's concurrency,
+// until stop is called.
+func (c *JobQueue) autotune(run *runState) (stop func()) {
+	a := c.autoConcurrency
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			sample := a.sample()
+			current := run.concurrency()
+			if next := a.adjust(current, sample); next != current {
+				c.log().Info("Adjusting concurrency", "queue", c.Queue, "from", current, "to", next,
+					"cpu", sample.cpu, "heap", sample.heap)
+				run.setConcurrency(next)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// processSampler measures the CPU usage of the process between samples, and
+// its heap.
+type processSampler struct {
+	cpu time.Duration
+	at  time.Time
+}
+
+func (p *processSampler) sample() concurrencySample {
+	sample := concurrencySample{cpu: -1}
+	heap := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(heap)
+	if heap[0].Value.Kind() == metrics.KindUint64 {
+		sample.heap = heap[0].Value.Uint64()
+	}
+	cpu, ok := processCPUTime()
+	now := time.Now()
+	if ok && !p.at.IsZero() && now.After(p.at) {
+		sample.cpu = float64(cpu-p.cpu) / float64(now.Sub(p.at)) / float64(runtime.GOMAXPROCS(0))
+	}
+	if ok {
+		p.cpu, p.at = cpu, now
+	}
+	return sample
+}
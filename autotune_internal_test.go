@@ -0,0 +1,103 @@
+package grt
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAutotunePolicy(t *testing.T) {
+	calm := concurrencySample{cpu: 0.1, heap: 100}
+	busy := concurrencySample{cpu: 0.9, heap: 100}
+	// Under target, but within the headroom.
+	near := concurrencySample{cpu: 0.45, heap: 100}
+	full := concurrencySample{cpu: 0.1, heap: 2000}
+	tests := []struct {
+		name    string
+		start   int
+		samples []concurrencySample
+		want    []int
+	}{
+		{"SlowUp", 4, []concurrencySample{calm, calm, calm, calm, calm, calm}, []int{4, 4, 5, 5, 5, 6}},
+		{"Hysteresis", 4, []concurrencySample{calm, calm, near, calm, calm, calm}, []int{4, 4, 4, 4, 4, 5}},
+		{"FastDownOnMemory", 9, []concurrencySample{full, full, full}, []int{4, 2, 2}},
+		{"DownOnCPU", 9, []concurrencySample{busy, busy}, []int{8, 7}},
+		{"PressureResetsCalm", 4, []concurrencySample{calm, calm, busy, calm, calm, calm}, []int{4, 4, 3, 3, 3, 4}},
+		{"UpperBound", 9, []concurrencySample{calm, calm, calm, calm, calm, calm}, []int{9, 9, 10, 10, 10, 10}},
+		{"UnknownCPU", 4, []concurrencySample{{cpu: -1}, {cpu: -1}, {cpu: -1}}, []int{4, 4, 4}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &autoConcurrency{min: 2, max: 10, targetCPU: 0.5, targetMem: 1000}
+			n := test.start
+			for i, sample := range test.samples {
+				if n = a.adjust(n, sample); n != test.want[i] {
+					t.Fatalf("after sample %d: concurrency %d, want %d", i, n, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAutotuneIgnoresUnsetTargets(t *testing.T) {
+	a := &autoConcurrency{min: 1, max: 4}
+	n := 1
+	for i := 0; i < 3; i++ {
+		n = a.adjust(n, concurrencySample{cpu: 1, heap: 1 << 40})
+	}
+	if n != 2 {
+		t.Fatal(n)
+	}
+}
+
+func TestAutotuneRun(t *testing.T) {
+	_, pool := newTestPool(t)
+	q := NewJobQueue(pool, "autotune", WithAutoConcurrency(1, 4, 0, 1000))
+	var heap atomic.Uint64
+	q.autoConcurrency.interval = 10 * time.Millisecond
+	q.autoConcurrency.sample = func() concurrencySample { return concurrencySample{heap: heap.Load()} }
+	if err := q.Submit("slow"); err != nil {
+		t.Fatal(err)
+	}
+	started, release, finished := make(chan struct{}), make(chan struct{}), make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Run(ctx, 1, func(ctx context.Context, w *Work, decode func(interface{}) error) error {
+			close(started)
+			<-release
+			finished <- ctx.Err()
+			return nil
+		})
+	}()
+	<-started
+	waitFor := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for q.RunStats().Concurrency != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("concurrency %d, want %d", q.RunStats().Concurrency, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitFor(4)
+	q.SetConcurrency(2)
+	if n := q.RunStats().Concurrency; n != 2 {
+		t.Fatal(n)
+	}
+	heap.Store(5000)
+	waitFor(1)
+	// The handler in progress is not interrupted by lowering concurrency.
+	close(release)
+	if err := <-finished; err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	<-done
+	if n := q.RunStats().Concurrency; n != 0 {
+		t.Fatal(n)
+	}
+}
@@ -0,0 +1,116 @@
+// Package backoff provides retry delay strategies shared by the grt
+// primitives.
+package backoff
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes the delay to wait before retry attempt number attempt.
+// Attempts are numbered from zero.
+type Backoff interface {
+	Next(attempt int) time.Duration
+}
+
+// Constant waits the same duration before every attempt.
+type Constant time.Duration
+
+// Next implements Backoff.
+func (c Constant) Next(attempt int) time.Duration {
+	return time.Duration(c)
+}
+
+func (c Constant) String() string {
+	return fmt.Sprintf("constant(%s)", time.Duration(c))
+}
+
+// Exponential grows the delay by Factor on each attempt, starting at Base and
+// never exceeding Max.
+type Exponential struct {
+	Base time.Duration
+	// Max caps the delay. Zero means no cap.
+	Max time.Duration
+	// Factor the delay is multiplied by on each attempt. Defaults to 2.
+	Factor float64
+	// Jitter is the fraction (0-1) of each delay that may be randomly
+	// subtracted from it, so delays fall within [d*(1-Jitter), d].
+	Jitter float64
+	// Rand is the source of jitter, returning values in [0, 1). Defaults to
+	// rand.Float64. Use a seeded source for deterministic delays in tests.
+	Rand func() float64
+}
+
+// Next implements Backoff.
+func (e Exponential) Next(attempt int) time.Duration {
+	factor := e.Factor
+	if factor == 0 {
+		factor = 2
+	}
+	d := float64(e.Base) * math.Pow(factor, float64(attempt))
+	return jitter(capped(d, e.Max), e.Jitter, e.Rand)
+}
+
+func (e Exponential) String() string {
+	return fmt.Sprintf("exponential(base=%s, max=%s, factor=%g, jitter=%g)", e.Base, e.Max, e.Factor, e.Jitter)
+}
+
+// Fibonacci grows the delay along the Fibonacci sequence (1, 1, 2, 3, 5, ...)
+// multiplied by Base, never exceeding Max.
+type Fibonacci struct {
+	Base time.Duration
+	// Max caps the delay. Zero means no cap.
+	Max time.Duration
+}
+
+// Next implements Backoff.
+func (f Fibonacci) Next(attempt int) time.Duration {
+	a, b := 1.0, 1.0
+	for i := 0; i < attempt && !math.IsInf(b, 1); i++ {
+		a, b = b, a+b
+	}
+	return capped(float64(f.Base)*a, f.Max)
+}
+
+func (f Fibonacci) String() string {
+	return fmt.Sprintf("fibonacci(base=%s, max=%s)", f.Base, f.Max)
+}
+
+// Sleep waits for the delay b gives for attempt, returning early with the
+// context's error if ctx is cancelled first.
+func Sleep(ctx context.Context, b Backoff, attempt int) error {
+	t := time.NewTimer(b.Next(attempt))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func capped(d float64, max time.Duration) time.Duration {
+	if max > 0 && d > float64(max) {
+		return max
+	}
+	if math.IsNaN(d) || d >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
+
+func jitter(d time.Duration, fraction float64, source func() float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	if source == nil {
+		source = rand.Float64
+	}
+	return d - time.Duration(float64(d)*fraction*source())
+}
@@ -0,0 +1,140 @@
+package backoff
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// strategies returns the unjittered strategies built from generated values.
+func strategies(base uint32, max uint32, factor uint8) []Backoff {
+	return []Backoff{
+		Constant(time.Duration(base)),
+		Exponential{Base: time.Duration(base), Max: time.Duration(max), Factor: 1 + float64(factor%40)/10},
+		Fibonacci{Base: time.Duration(base), Max: time.Duration(max)},
+	}
+}
+
+func TestMonotoneUpToCap(t *testing.T) {
+	property := func(base, max uint32, factor uint8) bool {
+		for _, b := range strategies(base, max, factor) {
+			previous := time.Duration(0)
+			for attempt := 0; attempt < 200; attempt++ {
+				d := b.Next(attempt)
+				if d < previous {
+					t.Logf("%s: attempt %d is %s after %s", b, attempt, d, previous)
+					return false
+				}
+				previous = d
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRespectsCap(t *testing.T) {
+	property := func(base, max uint32, factor uint8, jitter float64) bool {
+		if max == 0 {
+			max = 1
+		}
+		backoffs := append(strategies(base, max, factor)[1:],
+			Exponential{Base: time.Duration(base), Max: time.Duration(max), Jitter: jitter, Rand: rand.New(rand.NewSource(1)).Float64})
+		for _, b := range backoffs {
+			for attempt := 0; attempt < 200; attempt++ {
+				if d := b.Next(attempt); d < 0 || d > time.Duration(max) {
+					t.Logf("%s: attempt %d is %s", b, attempt, d)
+					return false
+				}
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUncappedDoesNotOverflow(t *testing.T) {
+	for _, b := range []Backoff{Exponential{Base: time.Second}, Fibonacci{Base: time.Second}} {
+		if d := b.Next(100000); d <= 0 {
+			t.Fatalf("%s: %s", b, d)
+		}
+	}
+}
+
+func TestJitterWithinBounds(t *testing.T) {
+	property := func(base, max uint32, fraction float64, seed int64) bool {
+		if fraction < 0 {
+			fraction = -fraction
+		}
+		for fraction > 1 {
+			fraction /= 2
+		}
+		plain := Exponential{Base: time.Duration(base), Max: time.Duration(max)}
+		jittered := plain
+		jittered.Jitter = fraction
+		jittered.Rand = rand.New(rand.NewSource(seed)).Float64
+		for attempt := 0; attempt < 100; attempt++ {
+			d, limit := jittered.Next(attempt), plain.Next(attempt)
+			if d > limit || float64(d) < float64(limit)*(1-fraction)-1 {
+				t.Logf("attempt %d with jitter %g is %s, outside %s", attempt, fraction, d, limit)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJitterDeterministicWithSeed(t *testing.T) {
+	delays := func(seed int64) []time.Duration {
+		b := Exponential{Base: time.Millisecond, Max: time.Minute, Jitter: 0.5, Rand: rand.New(rand.NewSource(seed)).Float64}
+		out := []time.Duration{}
+		for attempt := 0; attempt < 20; attempt++ {
+			out = append(out, b.Next(attempt))
+		}
+		return out
+	}
+	first, second, other := delays(42), delays(42), delays(43)
+	differs := false
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("attempt %d: %s != %s", i, first[i], second[i])
+		}
+		differs = differs || first[i] != other[i]
+	}
+	if !differs {
+		t.Fatal("different seeds gave the same delays")
+	}
+}
+
+func TestFibonacci(t *testing.T) {
+	b := Fibonacci{Base: time.Millisecond}
+	for attempt, want := range []time.Duration{1, 1, 2, 3, 5, 8, 13} {
+		if d := b.Next(attempt); d != want*time.Millisecond {
+			t.Fatalf("attempt %d: %s", attempt, d)
+		}
+	}
+}
+
+func TestSleep(t *testing.T) {
+	if err := Sleep(context.Background(), Constant(time.Millisecond), 0); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := Sleep(ctx, Constant(time.Hour), 0); err != context.Canceled {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("Sleep did not return on cancellation")
+	}
+}
@@ -0,0 +1,89 @@
+package grt
+
+import (
+	"errors"
+)
+
+// GetBatch retrieves up to n jobs, blocking until at least one is available.
+// Waiting jobs are retrieved in a single round trip. Each job is decoded into
+// a new value from dest, eg. func() interface{} { return &Job{} }, and the
+// values are returned alongside their Work.
+//
+// Every returned Work must be completed or resubmitted as with Get. Jobs
+// whose cancellation has been requested are discarded. Within a batch, a job
+// that cannot be decoded is resubmitted and logged rather than failing the
+// others.
+func (c *JobQueue) GetBatch(n int, dest func() interface{}) ([]*Work, []interface{}, error) {
+	if err := c.checkOptions(); err != nil {
+		return nil, nil, err
+	}
+	works, values, err := c.getBatch(n, dest)
+	if len(works) > 0 || err != nil {
+		return works, values, err
+	}
+	// Nothing is waiting: block for one job, then take any others that
+	// arrived with it.
+	v := dest()
+	work, err := c.Get(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	works, values, err = c.getBatch(n-1, dest)
+	if err != nil {
+		c.log().Error("Failed to get further jobs for batch", "queue", c.Queue, "error", err)
+	}
+	return append([]*Work{work}, works...), append([]interface{}{v}, values...), nil
+}
+
+// getBatch retrieves up to n waiting jobs without blocking.
+func (c *JobQueue) getBatch(n int, dest func() interface{}) ([]*Work, []interface{}, error) {
+	if n < 1 {
+		return nil, nil, nil
+	}
+	if !c.background.acquire() {
+		return nil, nil, ErrQueueClosed
+	}
+	defer c.background.release()
+	n, _, err := c.takeJobTokens(n)
+	if err != nil || n == 0 {
+		return nil, nil, err
+	}
+	r := getConn(c.pool, "JobQueue.GetBatch")
+	reply, err := c.popJobs(r, n)
+	r.Close()
+	if err != nil {
+		c.refundJobTokens(n)
+		return nil, nil, err
+	}
+	c.refundJobTokens(n - (len(reply)-2)/8)
+	works := []*Work{}
+	values := []interface{}{}
+	// Every popped job is now in progress, so the rest of the batch is
+	// accepted even if one could not be read, rather than left for the
+	// reaper. The error is returned only if there is nothing else to return.
+	var failed error
+	for i := 2; i+8 <= len(reply); i += 8 {
+		work, cancelled, err := c.popped(reply[i : i+8])
+		if work == nil {
+			if errors.Is(err, ErrPayloadMissing) {
+				c.log().Warn("Discarded job without a payload", "queue", c.Queue, "error", err)
+			} else {
+				c.log().Error("Failed to get job in batch", "queue", c.Queue, "error", err)
+				failed = err
+			}
+			continue
+		}
+		v := dest()
+		if work, err = c.accept(work, cancelled, err, v); err != nil {
+			c.log().Error("Failed to get job in batch", "queue", c.Queue, "error", err)
+		}
+		if work != nil {
+			works = append(works, work)
+			values = append(values, v)
+		}
+	}
+	if len(works) == 0 && failed != nil {
+		return nil, nil, failed
+	}
+	return works, values, nil
+}
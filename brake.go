@@ -0,0 +1,161 @@
+package grt
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Delay before each retrieval when the requeue brake first engages.
+	brakeBaseDelay = 100 * time.Millisecond
+	// Outcomes needed in the window before the failure ratio is considered.
+	brakeMinOutcomes = 10
+)
+
+// RequeueBrake configures the brake applied by WithRequeueBrake. A zero
+// threshold is not checked.
+type RequeueBrake struct {
+	// Automatic resubmissions per second, averaged over Window, above which
+	// the brake engages.
+	MaxRate float64
+	// Fraction of handled jobs resubmitted over Window above which the
+	// brake engages, eg. 0.8.
+	MaxFailureRatio float64
+	// Defaults to 30 seconds.
+	Window time.Duration
+	// Longest delay before each retrieval while braking. Defaults to 30
+	// seconds.
+	MaxDelay time.Duration
+}
+
+// WithRequeueBrake slows Run down during a requeue storm, eg. when a
+// dependency outage makes every handler fail at once and its jobs cycle
+// through the queue as fast as Redis allows. When the rate or proportion of
+// jobs Run resubmits because their handler failed exceeds brake's
+// thresholds, each of the queue's Run workers waits before retrieving its
+// next job, for 100ms at first and doubling after each delay while the storm
+// continues, up to MaxDelay. Once it passes, the delay is halved likewise
+// until the brake is released. Engaging and releasing the brake are logged,
+// and its state is reported by RunStats.
+//
+// Only resubmissions by Run count: Work.Resubmit called elsewhere is
+// unaffected.
+func WithRequeueBrake(brake RequeueBrake) Option {
+	return func(c *JobQueue) {
+		if brake.Window <= 0 {
+			brake.Window = 30 * time.Second
+		}
+		if brake.MaxDelay <= 0 {
+			brake.MaxDelay = 30 * time.Second
+		}
+		c.brake = &requeueBrake{config: brake, now: time.Now}
+	}
+}
+
+// requeueBrake tracks the outcomes of Run's handlers, and delays retrievals
+// while too many fail.
+type requeueBrake struct {
+	config RequeueBrake
+	now    func() time.Time
+
+	lock sync.Mutex
+	// Outcomes within the window, oldest first.
+	outcomes []brakeOutcome
+	failures int
+	braked   bool
+	delay    time.Duration
+	// When the delay last changed.
+	adjusted time.Time
+}
+
+type brakeOutcome struct {
+	at     time.Time
+	failed bool
+}
+
+// record notes whether a handled job was resubmitted because its handler
+// failed.
+func (b *requeueBrake) record(failed bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.outcomes = append(b.outcomes, brakeOutcome{at: b.now(), failed: failed})
+	if failed {
+		b.failures++
+	}
+	b.prune()
+}
+
+// prune forgets outcomes older than the window.
+func (b *requeueBrake) prune() {
+	since := b.now().Add(-b.config.Window)
+	i := 0
+	for ; i < len(b.outcomes) && b.outcomes[i].at.Before(since); i++ {
+		if b.outcomes[i].failed {
+			b.failures--
+		}
+	}
+	b.outcomes = b.outcomes[i:]
+}
+
+// rates returns the resubmissions per second and the fraction of outcomes
+// that were failures over the window.
+func (b *requeueBrake) rates() (rate, ratio float64) {
+	rate = float64(b.failures) / b.config.Window.Seconds()
+	if len(b.outcomes) > 0 {
+		ratio = float64(b.failures) / float64(len(b.outcomes))
+	}
+	return rate, ratio
+}
+
+// storming returns true if the failures over the window exceed a threshold.
+func (b *requeueBrake) storming() bool {
+	rate, ratio := b.rates()
+	return (b.config.MaxRate > 0 && rate > b.config.MaxRate) ||
+		(b.config.MaxFailureRatio > 0 && len(b.outcomes) >= brakeMinOutcomes && ratio > b.config.MaxFailureRatio)
+}
+
+// pause returns how long a worker should wait before retrieving its next
+// job, engaging, tightening, easing or releasing the brake as the failures
+// over the window dictate. The delay changes at most once per delay, however
+// many workers there are.
+func (b *requeueBrake) pause(c *JobQueue) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.prune()
+	rate, ratio := b.rates()
+	now := b.now()
+	storming := b.storming()
+	switch {
+	case storming && !b.braked:
+		b.braked = true
+		b.delay = brakeBaseDelay
+		b.adjusted = now
+		c.log().Warn("Braking requeue storm", "queue", c.Queue, "resubmissions_per_second", rate, "failure_ratio", ratio)
+	case !b.braked || now.Sub(b.adjusted) < b.delay:
+	case storming:
+		b.delay *= 2
+		b.adjusted = now
+	default:
+		b.delay /= 2
+		b.adjusted = now
+		if b.delay < brakeBaseDelay {
+			b.braked = false
+			b.delay = 0
+			c.log().Info("Released requeue brake", "queue", c.Queue, "resubmissions_per_second", rate, "failure_ratio", ratio)
+		}
+	}
+	if b.delay > b.config.MaxDelay {
+		b.delay = b.config.MaxDelay
+	}
+	return b.delay
+}
+
+// state fills in the brake's fields of stats.
+func (b *requeueBrake) state(stats *RunStats) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.prune()
+	stats.Braked = b.braked
+	stats.BrakeDelay = b.delay
+	stats.ResubmissionRate, stats.FailureRatio = b.rates()
+}
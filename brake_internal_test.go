@@ -0,0 +1,111 @@
+package grt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// simulateWorker runs a worker against q's brake for d of fake time: each
+// retrieval waits for the brake's delay, or 10ms if there is none, then its
+// handler fails or succeeds. Returns the number of retrievals.
+func simulateWorker(q *JobQueue, now *time.Time, d time.Duration, fail bool) int {
+	fetches := 0
+	for end := now.Add(d); now.Before(end); fetches++ {
+		delay := q.brake.pause(q)
+		if delay == 0 {
+			delay = 10 * time.Millisecond
+		}
+		*now = now.Add(delay)
+		q.brake.record(fail)
+	}
+	return fetches
+}
+
+func TestRequeueBrake(t *testing.T) {
+	tests := []struct {
+		name  string
+		brake RequeueBrake
+	}{
+		{"FailureRatio", RequeueBrake{MaxFailureRatio: 0.8, MaxDelay: 2 * time.Second}},
+		{"Rate", RequeueBrake{MaxRate: 0.5, MaxDelay: 2 * time.Second}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, pool := newTestPool(t)
+			q := NewJobQueue(pool, "brake", WithRequeueBrake(test.brake))
+			now := time.Unix(1000, 0)
+			q.brake.now = func() time.Time { return now }
+
+			// Every job fails, eg. because a dependency is down.
+			simulateWorker(q, &now, 10*time.Second, true)
+			stats := q.RunStats()
+			if !stats.Braked || stats.BrakeDelay != 2*time.Second || stats.FailureRatio != 1 {
+				t.Fatalf("%+v", stats)
+			}
+			// Once the delay has reached its cap, the fetch rate collapses.
+			if braked := simulateWorker(q, &now, 10*time.Second, true); braked > 5 {
+				t.Fatal(braked)
+			}
+			// The handler recovers, and the brake is released gradually.
+			simulateWorker(q, &now, 40*time.Second, false)
+			if stats := q.RunStats(); stats.Braked || stats.BrakeDelay != 0 {
+				t.Fatalf("%+v", stats)
+			}
+			if recovered := simulateWorker(q, &now, time.Second, false); recovered != 100 {
+				t.Fatal(recovered)
+			}
+		})
+	}
+}
+
+func TestRequeueBrakeIgnoresManualResubmits(t *testing.T) {
+	_, pool := newTestPool(t)
+	q := NewJobQueue(pool, "brake", WithRequeueBrake(RequeueBrake{MaxFailureRatio: 0.5}))
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		w, err := q.Get(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.ResubmitWithError(errors.New("failed")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := q.RunStats(); stats.Braked || stats.ResubmissionRate != 0 {
+		t.Fatalf("%+v", stats)
+	}
+}
+
+func TestRequeueBrakeInRun(t *testing.T) {
+	_, pool := newTestPool(t)
+	q := NewJobQueue(pool, "brake", WithRequeueBrake(RequeueBrake{MaxFailureRatio: 0.5}))
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Run(ctx, 2, func(ctx context.Context, w *Work, decode func(interface{}) error) error {
+			return errors.New("dependency down")
+		})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !q.RunStats().Braked {
+		if time.Now().After(deadline) {
+			t.Fatalf("%+v", q.RunStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := q.RunStats(); stats.BrakeDelay < brakeBaseDelay || stats.FailureRatio != 1 {
+		t.Fatalf("%+v", stats)
+	}
+}
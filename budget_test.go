@@ -0,0 +1,165 @@
+package grt_test
+
+import (
+	"errors"
+	"github.com/alecthomas/grt"
+	"github.com/alecthomas/grt/grttest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// budgets are the most Redis commands each public operation may issue,
+// including those run by scripts. Raising one is a deliberate decision.
+var budgets = map[string]int{
+	"JobQueue.Submit":        11,
+	"JobQueue.SubmitAll":     29, // Four jobs.
+	"JobQueue.Get":           15,
+	"JobQueue.GetBatch":      23, // Two jobs, one of them cancelled.
+	"JobQueue.Len":           1,
+	"JobQueue.IsEmpty":       1,
+	"JobQueue.IsQueued":      1,
+	"JobQueue.Stats":         18,
+	"JobQueue.Peek":          2,
+	"JobQueue.DeadLen":       1,
+	"JobQueue.DeadJobs":      1,
+	"JobQueue.Requeue":       9,
+	"JobQueue.PurgeDead":     6,
+	"JobQueue.DelayedLen":    1,
+	"JobQueue.RequestCancel": 1,
+	"JobQueue.Cancel":        12,
+	"JobQueue.Pause":         1,
+	"JobQueue.Resume":        1,
+	"Work.Complete":          16,
+	"Work.Resubmit":          12,
+	"Work.ResubmitWithError": 9,
+	"Work.Extend":            5,
+	"Work.Cancelled":         1,
+	"Work.Transfer":          21,
+	"Lock.TryLock":           4,
+	"Lock.Lock":              3,
+	"Lock.Unlock":            5,
+	"RWLock.RLock":           7,
+	"RWLock.RUnlock":         4,
+	"RWLock.Lock":            9,
+	"RWLock.Unlock":          4,
+	"Semaphore.TryAcquire":   7,
+	"Semaphore.Release":      3,
+	"RateLimiter.Take":       6,
+	"Counter.Add":            5,
+	"Counter.Value":          1,
+}
+
+func TestCommandBudgets(t *testing.T) {
+	var lock sync.Mutex
+	exercised := map[string]bool{}
+	remove := grt.ObserveCommands(func(op string, n int) {
+		lock.Lock()
+		defer lock.Unlock()
+		exercised[op] = true
+	})
+	t.Cleanup(func() {
+		remove()
+		lock.Lock()
+		defer lock.Unlock()
+		for op := range budgets {
+			if !exercised[op] {
+				t.Errorf("%s was not exercised", op)
+			}
+		}
+	})
+	for op, n := range budgets {
+		grttest.AssertMaxCommands(t, op, n)
+	}
+	_, pool := newPool(t)
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := grt.NewJobQueue(pool, "budget", grt.WithVisibilityTimeout(time.Minute))
+	check(q.Submit("a"))
+	_, err := q.SubmitAll([]interface{}{"b", "c", "d", "e"})
+	check(err)
+	check(q.SubmitAfter("later", time.Hour))
+	_, err = q.Len()
+	check(err)
+	_, err = q.IsEmpty()
+	check(err)
+	_, err = q.IsQueued("a")
+	check(err)
+	_, err = q.Stats()
+	check(err)
+	_, err = q.Peek(10)
+	check(err)
+	_, err = q.DelayedLen()
+	check(err)
+	check(q.RequestCancel("e"))
+	_, err = q.Cancel("d")
+	check(err)
+	check(q.Pause())
+	check(q.Resume())
+
+	var job string
+	w, err := q.Get(&job)
+	check(err)
+	check(w.Extend(time.Minute))
+	_, err = w.Cancelled()
+	check(err)
+	check(w.Complete())
+	w, err = q.Get(&job)
+	check(err)
+	check(w.Resubmit())
+	w, err = q.Get(&job)
+	check(err)
+	check(w.ResubmitWithError(errors.New("failed")))
+	works, _, err := q.GetBatch(2, func() interface{} { return new(string) })
+	check(err)
+	target := grt.NewJobQueue(pool, "budget-target")
+	check(works[0].Transfer(target, "moved"))
+
+	dead := grt.NewJobQueue(pool, "budget-dead")
+	dead.MaxAttempts = 1
+	check(dead.Submit("poison"))
+	w, err = dead.Get(&job)
+	check(err)
+	check(w.Resubmit())
+	_, err = dead.DeadLen()
+	check(err)
+	entries, _, err := dead.DeadJobs("", 10)
+	check(err)
+	check(dead.Requeue(entries[0].Key))
+	w, err = dead.Get(&job)
+	check(err)
+	check(w.Resubmit())
+	_, err = dead.PurgeDead()
+	check(err)
+
+	mutex := grt.NewLock(pool, "budget-lock")
+	_, err = mutex.TryLock()
+	check(err)
+	check(mutex.Unlock())
+	check(mutex.Lock())
+	check(mutex.Unlock())
+
+	rw := grt.NewRWLock(pool, "budget-rwlock")
+	check(rw.RLock())
+	check(rw.RUnlock())
+	check(rw.Lock())
+	check(rw.Unlock())
+
+	semaphore := grt.NewSemaphore(pool, "budget-semaphore", 2)
+	release, err := semaphore.TryAcquire()
+	check(err)
+	check(release())
+
+	_, err = grt.NewRateLimiter(pool, "budget-ratelimit", 10, 10).Allow()
+	check(err)
+	counter := grt.NewCounter(pool, "budget-counter")
+	_, err = counter.Add(1)
+	check(err)
+	_, err = counter.Value()
+	check(err)
+}
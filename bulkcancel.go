@@ -0,0 +1,325 @@
+package grt
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"time"
+)
+
+// CancelOptions configure CancelWhere.
+type CancelOptions struct {
+	// Also request cancellation of matching in-progress jobs, as with
+	// RequestCancel. Their workers are expected to observe the request.
+	IncludeInProgress bool
+	// Also cancel matching jobs submitted with SubmitAt or SubmitAfter that
+	// are not yet due.
+	IncludeDelayed bool
+	// Only consider jobs submitted by this producer service, if set.
+	Producer string
+	// Stop after cancelling this many jobs, if non-zero.
+	MaxCancel int
+	// Report what would be cancelled without cancelling anything.
+	DryRun bool
+	// Number of jobs scanned per round trip. Defaults to 500.
+	PageSize int
+	// Pause between pages, to limit the load placed on Redis.
+	PageInterval time.Duration
+}
+
+// CancelReport summarises the result of CancelWhere.
+type CancelReport struct {
+	Scanned int
+	// Waiting jobs removed from the queue.
+	Waiting int
+	// Delayed jobs removed from the queue.
+	Delayed int
+	// In-progress jobs for which cancellation was requested.
+	InProgress int
+	// Up to 10 of the cancelled keys.
+	Sample [][]byte
+	// True if MaxCancel was reached before the scan completed.
+	Truncated bool
+}
+
+const cancelSampleSize = 10
+
+// Cancel removes a waiting or delayed job from the queue, returning false if
+// it was not waiting. Jobs in progress are unaffected; use RequestCancel to
+// ask their workers to abort.
+func (c *JobQueue) Cancel(job interface{}) (bool, error) {
+	key, _, err := c.marshal(job)
+	if err != nil {
+		return false, err
+	}
+	r := getConn(c.pool, "JobQueue.Cancel")
+	defer r.Close()
+	reply, err := cancelJobScript.do(r, c.Queue+":payload", c.Queue+":enqueued", c.Queue+":producer", c.dedupeKey(),
+		c.Queue+":attempts", c.Queue+":delayed", c.priorityList(PriorityHigh), c.Queue, c.priorityList(PriorityLow),
+		cancelKey(c.Queue, key), chunksKey(c.Queue, key), historyKey(c.Queue, key), expiryKey(c.Queue), key)
+	if err != nil {
+		return false, err
+	}
+	record, err := redis.Bytes(reply[0], nil)
+	if err == redis.ErrNil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if ref := payloadRef(record); ref != "" && c.payloadStore != nil {
+		return true, c.payloadStore.Delete(ref)
+	}
+	return true, nil
+}
+
+// CancelWhere cancels every waiting job for which pred returns true, scanning
+// the queue a page at a time. pred is passed each job's key and encoded
+// payload. Matching jobs are removed atomically in one round trip per page.
+//
+// Jobs submitted during the scan may or may not be considered.
+func (c *JobQueue) CancelWhere(ctx context.Context, pred func(key, payload []byte) bool, opts CancelOptions) (CancelReport, error) {
+	if opts.PageSize <= 0 {
+		opts.PageSize = 500
+	}
+	op := startOperation("JobQueue.CancelWhere")
+	defer op.end()
+	report := CancelReport{}
+	lists := c.waitingLists()
+	if opts.IncludeDelayed {
+		lists = append(lists, c.Queue+":delayed")
+	}
+	for _, list := range lists {
+		if err := c.cancelList(ctx, op, list, pred, opts, &report); err != nil || report.Truncated {
+			return report, err
+		}
+	}
+	if !opts.IncludeInProgress {
+		return report, nil
+	}
+	err := c.cancelList(ctx, op, c.Queue+":processing", pred, opts, &report)
+	return report, err
+}
+
+// cancelList scans list, a waiting list, the delayed set or the processing
+// list, for jobs to cancel. Waiting and delayed jobs are removed and
+// in-progress jobs have cancellation requested.
+func (c *JobQueue) cancelList(ctx context.Context, op *operation, list string, pred func(key, payload []byte) bool, opts CancelOptions, report *CancelReport) error {
+	inProgress := list == c.Queue+":processing"
+	delayed := list == c.Queue+":delayed"
+	start := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		keys, records, producers, err := c.cancelPage(op, list, start, opts.PageSize)
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+		report.Scanned += len(keys)
+		matches := []interface{}{}
+		refs := map[string]string{}
+		for i, key := range keys {
+			if records[i] == nil {
+				continue
+			}
+			if opts.Producer != "" {
+				if producer := decodeProducer(producers[i]); producer == nil || producer.Service != opts.Producer {
+					continue
+				}
+			}
+			payload, err := c.cancelPayload(key, records[i])
+			if err != nil {
+				return err
+			}
+			if !pred(key, payload) {
+				continue
+			}
+			if opts.MaxCancel > 0 && report.Waiting+report.Delayed+report.InProgress+len(matches) >= opts.MaxCancel {
+				report.Truncated = true
+				break
+			}
+			matches = append(matches, key)
+			if ref := payloadRef(records[i].([]byte)); ref != "" {
+				refs[string(key)] = ref
+			}
+		}
+		cancelled, err := c.cancelKeys(op, list, matches, inProgress, delayed, opts.DryRun)
+		if err != nil {
+			return err
+		}
+		for _, key := range cancelled {
+			if len(report.Sample) < cancelSampleSize {
+				report.Sample = append(report.Sample, key)
+			}
+			if ref, ok := refs[string(key)]; ok && !inProgress && !opts.DryRun && c.payloadStore != nil {
+				c.payloadStore.Delete(ref)
+			}
+		}
+		switch {
+		case inProgress:
+			report.InProgress += len(cancelled)
+		case delayed:
+			report.Delayed += len(cancelled)
+		default:
+			report.Waiting += len(cancelled)
+		}
+		if report.Truncated {
+			return nil
+		}
+		// Removed jobs no longer occupy the page.
+		start += len(keys)
+		if !inProgress && !opts.DryRun {
+			start -= len(cancelled)
+		}
+		if opts.PageInterval > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(opts.PageInterval):
+			}
+		}
+	}
+}
+
+// cancelPage fetches a page of keys from list, or the delayed set, with their
+// payload records and producers. Records are nil for keys that have since
+// been removed.
+func (c *JobQueue) cancelPage(op *operation, list string, start, size int) (keys [][]byte, records, producers []interface{}, err error) {
+	r := op.conn(c.pool)
+	defer r.Close()
+	command := "LRANGE"
+	if list == c.Queue+":delayed" {
+		command = "ZRANGE"
+	}
+	keys, err = redis.ByteSlices(r.Do(command, list, start, start+size-1))
+	if err != nil || len(keys) == 0 {
+		return nil, nil, nil, err
+	}
+	args := redis.Args{}.AddFlat(keys)
+	r.Send("HMGET", append(redis.Args{c.Queue + ":payload"}, args...)...)
+	r.Send("HMGET", append(redis.Args{c.Queue + ":producer"}, args...)...)
+	replies, err := redis.Values(r.Do(""))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if records, err = redis.Values(replies[0], nil); err != nil {
+		return nil, nil, nil, err
+	}
+	if producers, err = redis.Values(replies[1], nil); err != nil {
+		return nil, nil, nil, err
+	}
+	return keys, records, producers, nil
+}
+
+// cancelPayload returns the encoded payload for a payload hash entry,
+// fetching it if it is not stored inline.
+func (c *JobQueue) cancelPayload(key []byte, record interface{}) ([]byte, error) {
+	data, err := redis.Bytes(record, nil)
+	if err != nil {
+		return nil, err
+	}
+	if payload := inlinePayload(data); payload != nil {
+		return payload, nil
+	}
+	work := &Work{pool: c.pool, Queue: c.Queue, key: key, queue: c, record: data}
+	rc, err := work.PayloadReader()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// cancelKeys removes waiting jobs from list or delayed jobs from the delayed
+// set, or requests cancellation of in-progress jobs, returning the keys
+// affected.
+func (c *JobQueue) cancelKeys(op *operation, list string, keys []interface{}, inProgress, delayed, dryRun bool) ([][]byte, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	if dryRun {
+		affected := [][]byte{}
+		for _, key := range keys {
+			affected = append(affected, key.([]byte))
+		}
+		return affected, nil
+	}
+	r := op.conn(c.pool)
+	defer r.Close()
+	if inProgress {
+		affected := [][]byte{}
+		for _, key := range keys {
+			r.Send("SET", cancelKey(c.Queue, key.([]byte)), 1, "PX", c.CancelTTL.Nanoseconds()/1000000)
+			affected = append(affected, key.([]byte))
+		}
+		_, err := r.Do("")
+		return affected, err
+	}
+	args := []interface{}{list, c.Queue + ":payload", c.Queue + ":enqueued", c.Queue + ":producer", c.dedupeKey(), c.Queue + ":attempts", c.Queue, delayed}
+	reply, err := cancelScript.do(r, append(args, keys...)...)
+	if err != nil {
+		return nil, err
+	}
+	return redis.ByteSlices(reply[0], nil)
+}
+
+// KEYS: waiting list or delayed set, payload hash, enqueued-at hash, producer
+// hash, dedupe hash, attempts hash. ARGV: queue, "1" if KEYS[1] is the
+// delayed set, keys to remove.
+//
+// Jobs that are no longer waiting are skipped. Returns the keys removed.
+var cancelScript = newLuaScript("cancel", 1, 6, `
+local removed = {}
+for i = 3, #ARGV - 1 do
+  local key = ARGV[i]
+  local found
+  if ARGV[2] == "1" then
+    found = redis.call("ZREM", KEYS[1], key)
+  else
+    found = redis.call("LREM", KEYS[1], 1, key)
+  end
+  if found == 1 then
+    redis.call("HDEL", KEYS[2], key)
+    redis.call("HDEL", KEYS[3], key)
+    redis.call("HDEL", KEYS[4], key)
+    redis.call("HDEL", KEYS[6], key)
+    if KEYS[5] ~= KEYS[2] then
+      redis.call("HDEL", KEYS[5], key)
+    end
+    redis.call("DEL", ARGV[1] .. ":cancel:" .. key, ARGV[1] .. ":chunks:" .. key, ARGV[1] .. ":history:" .. key,
+      ARGV[1] .. ":next:" .. key)
+    redis.call("ZREM", ARGV[1] .. ":expiry", key)
+    table.insert(removed, key)
+  end
+end
+return {0, removed}
+`)
+
+// KEYS: payload hash, enqueued-at hash, producer hash, dedupe hash, attempts
+// hash, delayed set, waiting lists (high, normal, low), the job's cancel,
+// chunks and history keys, expiry sorted set. ARGV: key.
+//
+// Returns the removed job's payload record, or nil if it was not waiting.
+var cancelJobScript = newLuaScript("cancel_job", 1, 13, `
+local key = ARGV[1]
+local removed = redis.call("ZREM", KEYS[6], key) == 1
+for i = 7, 9 do
+  if not removed and redis.call("LREM", KEYS[i], 1, key) == 1 then
+    removed = true
+  end
+end
+if not removed then
+  return {0, false}
+end
+local record = redis.call("HGET", KEYS[1], key)
+redis.call("HDEL", KEYS[1], key)
+redis.call("HDEL", KEYS[2], key)
+redis.call("HDEL", KEYS[3], key)
+redis.call("HDEL", KEYS[5], key)
+if KEYS[4] ~= KEYS[1] then
+  redis.call("HDEL", KEYS[4], key)
+end
+redis.call("DEL", KEYS[10], KEYS[11], KEYS[12])
+redis.call("ZREM", KEYS[13], key)
+return {0, record}
+`)
@@ -0,0 +1,141 @@
+package grt_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alecthomas/grt"
+	"testing"
+	"time"
+)
+
+type order struct {
+	ID    int
+	Bogus bool
+}
+
+func bogus(key, payload []byte) bool {
+	var o order
+	return json.Unmarshal(payload, &o) == nil && o.Bogus
+}
+
+// submitOrders submits n orders, every fourth of them bogus.
+func submitOrders(t *testing.T, q *grt.JobQueue, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := q.Submit(order{ID: i, Bogus: i%4 == 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCancelWhere(t *testing.T) {
+	_, pool := newPool(t)
+	ctx := context.Background()
+	q := grt.NewJobQueue(pool, "orders")
+	submitOrders(t, q, 600)
+	// Orders 0, which is bogus, and 1 are in progress.
+	var first, second order
+	w, err := q.Get(&first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := q.Get(&second)
+	if err != nil || first.ID != 0 || second.ID != 1 {
+		t.Fatal(first, second, err)
+	}
+
+	report, err := q.CancelWhere(ctx, bogus, grt.CancelOptions{DryRun: true, PageSize: 64})
+	if err != nil || report.Scanned != 598 || report.Waiting != 149 || len(report.Sample) != 10 || report.Truncated {
+		t.Fatalf("%+v %v", report, err)
+	}
+	if n, err := q.Len(); n != 600 || err != nil {
+		t.Fatal(n, err)
+	}
+
+	report, err = q.CancelWhere(ctx, bogus, grt.CancelOptions{MaxCancel: 50, PageSize: 64})
+	if err != nil || report.Waiting != 50 || !report.Truncated {
+		t.Fatalf("%+v %v", report, err)
+	}
+	if n, err := q.Len(); n != 550 || err != nil {
+		t.Fatal(n, err)
+	}
+
+	report, err = q.CancelWhere(ctx, bogus, grt.CancelOptions{PageSize: 64, IncludeInProgress: true})
+	if err != nil || report.Waiting != 99 || report.InProgress != 1 || report.Truncated {
+		t.Fatalf("%+v %v", report, err)
+	}
+	for _, key := range report.Sample {
+		var o order
+		if err := json.Unmarshal(key, &o); err != nil || !o.Bogus {
+			t.Fatal(string(key), err)
+		}
+	}
+	// In-progress jobs are asked to stop rather than removed.
+	if cancelled, err := w.Cancelled(); !cancelled || err != nil {
+		t.Fatal(cancelled, err)
+	}
+	if cancelled, err := other.Cancelled(); cancelled || err != nil {
+		t.Fatal(cancelled, err)
+	}
+	if n, err := q.Len(); n != 451 || err != nil {
+		t.Fatal(n, err)
+	}
+	for _, w := range []*grt.Work{w, other} {
+		if err := w.Complete(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := q.Len(); n != 449 || err != nil {
+		t.Fatal(n, err)
+	}
+	// Cancelled jobs may be submitted again.
+	if err := q.Submit(order{ID: 4, Bogus: true}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCancelWhereDelayed(t *testing.T) {
+	_, pool := newPool(t)
+	ctx := context.Background()
+	q := grt.NewJobQueue(pool, "orders")
+	submitOrders(t, q, 8)
+	for i := 8; i < 16; i++ {
+		if err := q.SubmitAfter(order{ID: i, Bogus: i%4 == 0}, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := q.CancelWhere(ctx, bogus, grt.CancelOptions{})
+	if err != nil || report.Waiting != 2 || report.Delayed != 0 {
+		t.Fatalf("%+v %v", report, err)
+	}
+	report, err = q.CancelWhere(ctx, bogus, grt.CancelOptions{IncludeDelayed: true, DryRun: true})
+	if err != nil || report.Waiting != 0 || report.Delayed != 2 {
+		t.Fatalf("%+v %v", report, err)
+	}
+	report, err = q.CancelWhere(ctx, bogus, grt.CancelOptions{IncludeDelayed: true, PageSize: 3})
+	if err != nil || report.Delayed != 2 {
+		t.Fatalf("%+v %v", report, err)
+	}
+	if n, err := q.DelayedLen(); n != 6 || err != nil {
+		t.Fatal(n, err)
+	}
+	if d := describe(t, q, order{ID: 12, Bogus: true}); d.State != grt.JobNotFound {
+		t.Fatalf("%+v", d)
+	}
+}
+
+func TestCancelWhereContext(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "orders")
+	submitOrders(t, q, 20)
+	ctx, cancel := context.WithCancel(context.Background())
+	pages := 0
+	_, err := q.CancelWhere(ctx, func(key, payload []byte) bool {
+		pages++
+		cancel()
+		return false
+	}, grt.CancelOptions{PageSize: 5, PageInterval: time.Hour})
+	if err != context.Canceled || pages != 5 {
+		t.Fatal(pages, err)
+	}
+}
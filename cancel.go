@@ -0,0 +1,73 @@
+package grt
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrCancelRequested is the cause of a Work.Context cancelled because
+	// cancellation of its job was requested with RequestCancel, and is passed
+	// to OnDeadLetter for a job dead-lettered on retrieval because of one
+	// (see WithCancelledDeadLetter).
+	ErrCancelRequested = errors.New("cancel requested")
+)
+
+// How often Work.Context checks for a cancellation request on a queue
+// without a visibility timeout.
+const cancelPollInterval = time.Second
+
+// WithCancelledDeadLetter moves waiting jobs whose cancellation was
+// requested with RequestCancel to the dead letters with the reason
+// "cancelled" when they are retrieved, passing ErrCancelRequested to
+// OnDeadLetter, rather than discarding them.
+func WithCancelledDeadLetter() Option {
+	return func(c *JobQueue) { c.deadLetterCancelled = true }
+}
+
+// dropCancelled discards a retrieved job whose cancellation was requested,
+// or moves it to the dead letters if the queue was created
+// WithCancelledDeadLetter.
+func (c *JobQueue) dropCancelled(w *Work) error {
+	if c.deadLetterCancelled {
+		w.checkFinalize()
+		return w.markFinalized(WorkResubmitted, w.deadLetter("cancelled", ErrCancelRequested))
+	}
+	w.discarded = true
+	if err := w.Complete(); err != nil {
+		return err
+	}
+	c.log().Info("Discarded cancelled job", "queue", c.Queue, "key", string(w.key))
+	return nil
+}
+
+// Context returns a context derived from parent that is cancelled, with the
+// cause ErrCancelRequested, once cancellation of the job is requested with
+// JobQueue.RequestCancel, and keeps the job alive as KeepAlive does until
+// stop is called. Run passes such a context to handlers.
+//
+// The request is checked every third of the queue's visibility timeout, as
+// the job's deadline is extended, or every second without one. The handler
+// then decides whether to Complete the job, abandoning it, or Fail it. stop
+// must be called once the handler is done with the job.
+func (w *Work) Context(parent context.Context) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	if w.replay != nil {
+		if w.replay.cancelled {
+			cancel(ErrCancelRequested)
+		}
+		return ctx, func() { cancel(nil) }
+	}
+	heartbeat, stopHeartbeat := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		w.keepAlive(heartbeat, cancel)
+	}()
+	return ctx, func() {
+		stopHeartbeat()
+		<-stopped
+		cancel(nil)
+	}
+}
@@ -0,0 +1,224 @@
+package grt_test
+
+import (
+	"context"
+	"errors"
+	"github.com/alecthomas/grt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// run runs q with handler until the test ends.
+func run(t *testing.T, q *grt.JobQueue, concurrency int, handler func(ctx context.Context, w *grt.Work, decode func(interface{}) error) error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Run(ctx, concurrency, handler)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestCancelInFlightJob(t *testing.T) {
+	_, pool := newPool(t)
+	// Heartbeats every 100ms.
+	q := grt.NewJobQueue(pool, "cancel", grt.WithVisibilityTimeout(300*time.Millisecond))
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	run(t, q, 1, func(ctx context.Context, w *grt.Work, decode func(interface{}) error) error {
+		close(started)
+		<-ctx.Done()
+		cancelled <- context.Cause(ctx)
+		return w.Complete()
+	})
+	<-started
+	requested := time.Now()
+	if err := q.RequestCancel("a"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, grt.ErrCancelRequested) {
+			t.Fatal(err)
+		}
+		// One heartbeat, with some leeway for scheduling.
+		if elapsed := time.Since(requested); elapsed > 150*time.Millisecond {
+			t.Fatalf("cancelled after %s", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler's context was not cancelled")
+	}
+}
+
+func TestCancelWaitingJob(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "cancel")
+	for _, job := range []string{"a", "b"} {
+		if err := q.Submit(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.RequestCancel("a"); err != nil {
+		t.Fatal(err)
+	}
+	handled := make(chan string, 2)
+	run(t, q, 1, func(ctx context.Context, w *grt.Work, decode func(interface{}) error) error {
+		var job string
+		if err := decode(&job); err != nil {
+			return err
+		}
+		handled <- job
+		return nil
+	})
+	if job := <-handled; job != "b" {
+		t.Fatalf("cancelled job %q reached the handler", job)
+	}
+	select {
+	case job := <-handled:
+		t.Fatalf("unexpected job %q", job)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n, err := q.Len(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+}
+
+func TestCancelledDeadLetter(t *testing.T) {
+	_, pool := newPool(t)
+	var reason error
+	q := grt.NewJobQueue(pool, "cancel", grt.WithCancelledDeadLetter())
+	q.OnDeadLetter = func(w *grt.Work, err error) { reason = err }
+	for _, job := range []string{"a", "b"} {
+		if err := q.Submit(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.RequestCancel("a"); err != nil {
+		t.Fatal(err)
+	}
+	var job string
+	w, err := q.TryGet(&job)
+	if err != nil || job != "b" {
+		t.Fatal(job, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if reason != grt.ErrCancelRequested {
+		t.Fatal(reason)
+	}
+	dead, _, err := q.DeadJobs("", 10)
+	if err != nil || len(dead) != 1 || string(dead[0].Key) != `"a"` {
+		t.Fatal(dead, err)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "cancel")
+	for _, job := range []string{"a", "b"} {
+		if err := q.Submit(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.SubmitAfter("delayed", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range []string{"a", "delayed"} {
+		if cancelled, err := q.Cancel(job); !cancelled || err != nil {
+			t.Fatal(job, cancelled, err)
+		}
+	}
+	if cancelled, err := q.Cancel("a"); cancelled || err != nil {
+		t.Fatal(cancelled, err)
+	}
+	if keys, err := s.HKeys("cancel:payload"); err != nil || len(keys) != 1 || keys[0] != `"b"` {
+		t.Fatal(keys, err)
+	}
+	if keys, err := s.List("cancel"); err != nil || len(keys) != 1 {
+		t.Fatal(keys, err)
+	}
+	// A cancelled job can be submitted again.
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCancelMissingJob(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "cancel")
+	if cancelled, err := q.Cancel("missing"); cancelled || err != nil {
+		t.Fatal(cancelled, err)
+	}
+}
+
+func TestCancelCooperatively(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "cancel")
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In-progress jobs are not withdrawn.
+	if cancelled, err := q.Cancel("a"); cancelled || err != nil {
+		t.Fatal(cancelled, err)
+	}
+	if cancelled, err := w.Cancelled(); cancelled || err != nil {
+		t.Fatal(cancelled, err)
+	}
+	if err := q.RequestCancel("a"); err != nil {
+		t.Fatal(err)
+	}
+	if cancelled, err := w.Cancelled(); !cancelled || err != nil {
+		t.Fatal(cancelled, err)
+	}
+	// The handler aborts early and completes the job.
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := q.Len(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+}
+
+func TestCancelRacingSubmit(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "cancel")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := q.Submit("a"); err != nil && err != grt.ErrAlreadyQueued {
+					t.Error(err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := q.Cancel("a"); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// The payload and the list entry are removed and added together.
+	keys, _ := s.List("cancel")
+	payloads, _ := s.HKeys("cancel:payload")
+	if len(keys) != len(payloads) || len(keys) > 1 {
+		t.Fatal(keys, payloads)
+	}
+}
@@ -0,0 +1,111 @@
+package grt_test
+
+import (
+	"encoding/json"
+	"github.com/alecthomas/grt"
+	"testing"
+)
+
+type reportJob struct {
+	Name    string
+	Filters map[string]interface{}
+	Options json.RawMessage
+}
+
+type invoiceJob struct {
+	ID   string
+	Note string
+}
+
+func (j invoiceJob) JobQueueKey() []byte { return []byte("invoice:" + j.ID) }
+
+func TestCanonicalKeys(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "canonical")
+	first := reportJob{
+		Name:    "sales",
+		Filters: map[string]interface{}{"region": "eu", "range": map[string]int{"to": 2, "from": 1}},
+		Options: json.RawMessage(`{"format":"csv","columns":{"b":2,"a":1.50}}`),
+	}
+	if err := q.Submit(first); err != nil {
+		t.Fatal(err)
+	}
+	// The same job, with its fields encoded in a different order.
+	second := reportJob{
+		Name:    "sales",
+		Filters: map[string]interface{}{"range": map[string]int{"from": 1, "to": 2}, "region": "eu"},
+		Options: json.RawMessage(`{"columns":{"a":1.50,"b":2},"format":"csv"}`),
+	}
+	if err := q.Submit(second); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	if queued, err := q.IsQueued(second); !queued || err != nil {
+		t.Fatal(queued, err)
+	}
+	if err := q.Submit(map[string]interface{}{"b": 1, "a": []int{2, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Submit(map[string]interface{}{"a": []int{2, 1}, "b": 1}); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	// Array order is significant.
+	if err := q.Submit(map[string]interface{}{"a": []int{1, 2}, "b": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := q.Len(); n != 3 || err != nil {
+		t.Fatal(n, err)
+	}
+	// The payload is stored as encoded, and the key is canonical.
+	var job reportJob
+	w, err := q.TryGet(&job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(job.Options) != string(first.Options) {
+		t.Fatal(string(job.Options))
+	}
+	want := `{"Filters":{"range":{"from":1,"to":2},"region":"eu"},"Name":"sales","Options":{"columns":{"a":1.50,"b":2},"format":"csv"}}`
+	if string(w.Key()) != want {
+		t.Fatal(string(w.Key()))
+	}
+	encoded, err := json.Marshal(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload := s.HGet("canonical:payload", want); payload != string(encoded) {
+		t.Fatal(payload)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJobQueueKeyer(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "keyer")
+	if err := q.Submit(invoiceJob{"1", "first"}); err != nil {
+		t.Fatal(err)
+	}
+	// Jobs are keyed by ID alone.
+	if err := q.Submit(invoiceJob{"1", "second"}); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	if queued, err := q.IsQueued(invoiceJob{ID: "1"}); !queued || err != nil {
+		t.Fatal(queued, err)
+	}
+	if err := q.Submit(invoiceJob{"2", "first"}); err != nil {
+		t.Fatal(err)
+	}
+	// The key is the keyer's, and the payload the whole job.
+	if payload := s.HGet("keyer:payload", "invoice:1"); payload != `{"ID":"1","Note":"first"}` {
+		t.Fatal(payload)
+	}
+	var job invoiceJob
+	w, err := q.TryGet(&job)
+	if err != nil || job.Note != "first" || string(w.Key()) != "invoice:1" {
+		t.Fatal(job, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,153 @@
+package grt
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrJobNotFound is returned when a job is neither queued nor in progress.
+	ErrJobNotFound = errors.New("job not found")
+)
+
+// JobCapture is a self-contained, JSON-serializable snapshot of a job, for
+// replaying it elsewhere with NewReplayWork (or grttest.Replay).
+type JobCapture struct {
+	Queue string `json:"queue"`
+	Key   []byte `json:"key"`
+	// Encoded payload, as stored and without migrations applied. Externally
+	// stored and chunked payloads are fetched in full.
+	Payload        []byte    `json:"payload"`
+	PayloadVersion int       `json:"payload_version"`
+	Codec          string    `json:"codec"`
+	EnqueuedAt     time.Time `json:"enqueued_at,omitempty"`
+	Cancelled      bool      `json:"cancelled"`
+	Producer       *Producer `json:"producer,omitempty"`
+	// Most recent resubmissions with ResubmitWithError, oldest first.
+	History    []ResubmitRecord `json:"history"`
+	CapturedAt time.Time        `json:"captured_at"`
+}
+
+// Capture a queued or in-progress job by key. Returns ErrJobNotFound if there
+// is no such job.
+func (c *JobQueue) Capture(key []byte) (*JobCapture, error) {
+	r := getConn(c.pool, "JobQueue.Capture")
+	r.Send("HGET", c.Queue+":payload", key)
+	r.Send("HGET", c.Queue+":enqueued", key)
+	r.Send("EXISTS", cancelKey(c.Queue, key))
+	r.Send("LRANGE", historyKey(c.Queue, key), 0, -1)
+	r.Send("HGET", c.Queue+":producer", key)
+	replies, err := redis.Values(r.Do(""))
+	// Released before reading the payload, which may need a connection of its
+	// own.
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	record, err := redis.Bytes(replies[0], nil)
+	if err == redis.ErrNil {
+		return nil, ErrJobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	version, codec, _ := splitRecord(record)
+	if codec == "" {
+		codec = codecName(c.codec)
+	}
+	work := &Work{pool: c.pool, Queue: c.Queue, key: key, queue: c, record: record}
+	rc, err := work.PayloadReader()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	payload, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	capture := &JobCapture{
+		Queue:          c.Queue,
+		Key:            key,
+		Payload:        payload,
+		PayloadVersion: version,
+		Codec:          codec,
+		CapturedAt:     c.clock.now(),
+	}
+	if enqueued, err := redis.Int64(replies[1], nil); err == nil {
+		capture.EnqueuedAt = time.Unix(0, enqueued*int64(time.Millisecond))
+	}
+	capture.Cancelled, _ = redis.Bool(replies[2], nil)
+	capture.Producer = decodeProducer(replies[4])
+	if capture.History, err = decodeHistory(replies[3]); err != nil {
+		return nil, err
+	}
+	return capture, nil
+}
+
+// WorkOutcome is how Work was finalized.
+type WorkOutcome int
+
+const (
+	// WorkPending Work has been neither completed nor resubmitted.
+	WorkPending WorkOutcome = iota
+	WorkCompleted
+	WorkResubmitted
+	WorkTransferred
+)
+
+func (w WorkOutcome) String() string {
+	switch w {
+	case WorkCompleted:
+		return "completed"
+	case WorkResubmitted:
+		return "resubmitted"
+	case WorkTransferred:
+		return "transferred"
+	default:
+		return "pending"
+	}
+}
+
+// replayState records what was done to replayed Work.
+type replayState struct {
+	lock      sync.Mutex
+	cancelled bool
+	outcome   WorkOutcome
+	// Called with the outcome once recorded, if not nil, returning any error
+	// applying it.
+	finalized func(outcome WorkOutcome) error
+}
+
+// NewReplayWork fabricates in-memory Work for a captured job. Complete,
+// Resubmit and Transfer are recorded and reported by outcome rather than sent
+// to Redis, and Cancelled reports whether cancellation had been requested
+// when the job was captured. Payloads captured with a custom Codec cannot be
+// decoded.
+func NewReplayWork(capture *JobCapture) (w *Work, outcome func() WorkOutcome) {
+	queue := &JobQueue{Queue: capture.Queue, payloadVersion: capture.PayloadVersion, codec: codecByName(capture.Codec)}
+	replay := &replayState{cancelled: capture.Cancelled}
+	w = &Work{
+		Queue:  capture.Queue,
+		key:    capture.Key,
+		queue:  queue,
+		record: queue.versionRecord(capture.Payload),
+		replay: replay,
+	}
+	return w, func() WorkOutcome {
+		replay.lock.Lock()
+		defer replay.lock.Unlock()
+		return replay.outcome
+	}
+}
+
+func (r *replayState) finalize(outcome WorkOutcome) error {
+	r.lock.Lock()
+	r.outcome = outcome
+	r.lock.Unlock()
+	if r.finalized != nil {
+		return r.finalized(outcome)
+	}
+	return nil
+}
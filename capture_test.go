@@ -0,0 +1,106 @@
+package grt_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/alecthomas/grt"
+	"github.com/alecthomas/grt/grttest"
+	"testing"
+)
+
+type captured struct {
+	User  string `json:"user"`
+	Count int    `json:"count"`
+}
+
+func TestCapture(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "capture")
+	if _, err := q.Capture([]byte(`"missing"`)); err != grt.ErrJobNotFound {
+		t.Fatal(err)
+	}
+	job := captured{User: "bob", Count: 3}
+	if err := q.Submit(job); err != nil {
+		t.Fatal(err)
+	}
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := w.Key()
+	if err := w.ResubmitWithError(errors.New("upstream timeout")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.RequestCancel(job); err != nil {
+		t.Fatal(err)
+	}
+	capture, err := q.Capture(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capture.Queue != "capture" || string(capture.Key) != string(key) || capture.Codec != "json" ||
+		!capture.Cancelled || capture.EnqueuedAt.IsZero() || capture.CapturedAt.IsZero() {
+		t.Fatalf("%+v", capture)
+	}
+	if len(capture.History) != 1 || capture.History[0].Error != "upstream timeout" {
+		t.Fatalf("%+v", capture.History)
+	}
+
+	// The capture is self-contained once serialized.
+	data, err := json.Marshal(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored grt.JobCapture
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatal(err)
+	}
+	if string(restored.Key) != string(key) || len(restored.History) != 1 || !restored.Cancelled {
+		t.Fatalf("%+v", restored)
+	}
+
+	failure := errors.New("handler failed")
+	tests := []struct {
+		name    string
+		finish  func(w *grt.Work) error
+		outcome grt.WorkOutcome
+		err     error
+	}{
+		{"Complete", (*grt.Work).Complete, grt.WorkCompleted, nil},
+		{"Resubmit", (*grt.Work).Resubmit, grt.WorkResubmitted, nil},
+		{"ResubmitWithError", func(w *grt.Work) error { return w.ResubmitWithError(failure) }, grt.WorkResubmitted, nil},
+		{"Error", func(w *grt.Work) error { return failure }, grt.WorkPending, failure},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outcome, err := grttest.Replay(&restored, func(ctx context.Context, payload []byte, w *grt.Work) error {
+				if cancelled, err := w.Cancelled(); err != nil || !cancelled {
+					t.Fatal(cancelled, err)
+				}
+				rc, err := w.PayloadReader()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer rc.Close()
+				var decoded captured
+				if err := json.NewDecoder(rc).Decode(&decoded); err != nil || decoded != job {
+					t.Fatal(decoded, err)
+				}
+				return test.finish(w)
+			})
+			if outcome != test.outcome || err != test.err {
+				t.Fatal(outcome, err)
+			}
+		})
+	}
+
+	// Replaying sent nothing to Redis.
+	if n, err := q.Len(); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	after, err := q.Capture(key)
+	if err != nil || len(after.History) != 1 {
+		t.Fatalf("%+v %v", after, err)
+	}
+}
@@ -0,0 +1,59 @@
+package grt
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a measured clock offset is reused before being resampled.
+	clockOffsetRefresh = time.Minute
+	// Offsets larger than this are logged as a warning.
+	clockSkewWarning = time.Second
+)
+
+// clock measures the offset between the local clock and the Redis server's.
+//
+// Timestamps stored in Redis should be taken from the server's TIME, inside
+// Lua scripts where possible, and only translated to local time for display.
+type clock struct {
+	now     func() time.Time
+	lock    sync.Mutex
+	offset  time.Duration
+	sampled time.Time
+}
+
+// ClockOffset returns how far the Redis server's clock is ahead of the local
+// clock, compensating for round-trip time. The measurement is cached for a
+// minute. A warning is logged if the offset exceeds one second.
+func (c *JobQueue) ClockOffset() (time.Duration, error) {
+	return c.clock.Offset(c.pool, c.log())
+}
+
+// Offset returns the cached offset, resampling it if stale and logging a
+// warning to logger if it is large.
+func (c *clock) Offset(pool *redis.Pool, logger *slog.Logger) (time.Duration, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.sampled.IsZero() && c.now().Sub(c.sampled) < clockOffsetRefresh {
+		return c.offset, nil
+	}
+	r := getConn(pool, "JobQueue.ClockOffset")
+	defer r.Close()
+	before := c.now()
+	reply, err := redis.Int64s(r.Do("TIME"))
+	if err != nil {
+		return 0, err
+	}
+	after := c.now()
+	server := time.Unix(reply[0], reply[1]*1000)
+	local := before.Add(after.Sub(before) / 2)
+	c.offset = server.Sub(local)
+	c.sampled = after
+	if c.offset > clockSkewWarning || c.offset < -clockSkewWarning {
+		logger.Warn("Redis server clock is ahead of the local clock", "offset", c.offset)
+	}
+	return c.offset, nil
+}
@@ -0,0 +1,96 @@
+package grt
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// skewedQueue returns a queue whose local clock runs skew ahead of the Redis
+// server's, logging to the returned buffer.
+func skewedQueue(t *testing.T, skew time.Duration, options ...Option) (*JobQueue, *bytes.Buffer, func(time.Duration)) {
+	s, pool := newTestPool(t)
+	server := time.Now()
+	s.SetTime(server)
+	logs := &bytes.Buffer{}
+	q := NewJobQueue(pool, "skewed", append(options, WithLogger(slog.New(slog.NewTextHandler(logs, nil))))...)
+	q.clock.now = func() time.Time { return time.Now().Add(skew) }
+	advance := func(d time.Duration) {
+		server = server.Add(d)
+		s.SetTime(server)
+	}
+	return q, logs, advance
+}
+
+func TestClockOffset(t *testing.T) {
+	q, logs, _ := skewedQueue(t, -30*time.Second)
+	offset, err := q.ClockOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset < 29*time.Second || offset > 31*time.Second {
+		t.Fatalf("offset %s, want about 30s", offset)
+	}
+	if !strings.Contains(logs.String(), "Redis server clock is ahead of the local clock") {
+		t.Fatalf("no skew warning in %q", logs)
+	}
+	// The measurement is cached.
+	q.clock.now = time.Now
+	if cached, err := q.ClockOffset(); cached != offset || err != nil {
+		t.Fatal(cached, err)
+	}
+}
+
+func TestSkewedPromotion(t *testing.T) {
+	for _, skew := range []time.Duration{-30 * time.Second, 30 * time.Second} {
+		t.Run(skew.String(), func(t *testing.T) {
+			q, _, advance := skewedQueue(t, skew)
+			if err := q.SubmitAfter("later", 5*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if w, err := q.TryGet(nil); w != nil || err != nil {
+				t.Fatal("promoted early", w, err)
+			}
+			advance(4 * time.Second)
+			if w, err := q.TryGet(nil); w != nil || err != nil {
+				t.Fatal("promoted early", w, err)
+			}
+			advance(2 * time.Second)
+			w, err := q.TryGet(nil)
+			if w == nil || err != nil {
+				t.Fatal("not promoted once due", err)
+			}
+			if err := w.Complete(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSkewedReap(t *testing.T) {
+	for _, skew := range []time.Duration{-30 * time.Second, 30 * time.Second} {
+		t.Run(skew.String(), func(t *testing.T) {
+			q, _, advance := skewedQueue(t, skew, WithVisibilityTimeout(10*time.Second))
+			if err := q.Submit("a"); err != nil {
+				t.Fatal(err)
+			}
+			w, err := q.TryGet(nil)
+			if w == nil || err != nil {
+				t.Fatal(err)
+			}
+			if n, err := q.ReapExpired(); n != 0 || err != nil {
+				t.Fatal("reaped early", n, err)
+			}
+			advance(9 * time.Second)
+			if n, err := q.ReapExpired(); n != 0 || err != nil {
+				t.Fatal("reaped early", n, err)
+			}
+			advance(2 * time.Second)
+			if n, err := q.ReapExpired(); n != 1 || err != nil {
+				t.Fatal("not reaped once expired", n, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package grt
+
+import (
+	"context"
+	"errors"
+)
+
+// WithClusterKeys wraps the queue's name in a Redis Cluster hash tag, so that
+// all of its keys ("{jobs}", "{jobs}:processing", "{jobs}:payload", ...) hash
+// to the same slot and its transactions and scripts can run in a cluster.
+// The queue's Queue field, and Work.Queue, are then the tagged name.
+//
+// Every instance of the queue must agree. An existing queue's keys can be
+// moved to the tagged names with MigrateKeys.
+//
+// Operations spanning queues, namely Transfer, RenameQueue and dedupe
+// namespaces, remain unsupported in a cluster.
+func WithClusterKeys() Option {
+	return func(c *JobQueue) { c.clusterKeys = true }
+}
+
+// MigrateKeys renames the keys of a queue created without WithClusterKeys to
+// the tagged names used with it, as RenameQueue does. Call it on a queue
+// created WithClusterKeys, with its instances stopped, against the single
+// Redis server the queue was created on, before moving to a cluster.
+func (c *JobQueue) MigrateKeys(ctx context.Context) error {
+	if !c.clusterKeys {
+		return errors.New("MigrateKeys requires a queue created WithClusterKeys")
+	}
+	return RenameQueue(ctx, c.pool, c.Queue[1:len(c.Queue)-1], c.Queue)
+}
+
+// clusterQueueName wraps queue in a hash tag.
+func clusterQueueName(queue string) string {
+	return "{" + queue + "}"
+}
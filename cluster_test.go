@@ -0,0 +1,94 @@
+package grt_test
+
+import (
+	"context"
+	"github.com/alecthomas/grt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClusterKeys(t *testing.T) {
+	layouts := []struct {
+		name    string
+		options []grt.Option
+		queue   string
+	}{
+		{"Plain", nil, "cluster"},
+		{"Tagged", []grt.Option{grt.WithClusterKeys()}, "{cluster}"},
+	}
+	for _, layout := range layouts {
+		t.Run(layout.name, func(t *testing.T) {
+			s, pool := newPool(t)
+			q := grt.NewJobQueue(pool, "cluster", layout.options...)
+			q.DedupWindow = time.Minute
+			if q.Queue != layout.queue {
+				t.Fatal(q.Queue)
+			}
+			submitJobs(t, q, "job", 2)
+			if err := q.SubmitAfter("delayed", time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := q.SubmitAll([]interface{}{"batch0", "batch1"}); n != 2 || err != nil {
+				t.Fatal(n, err)
+			}
+			var job string
+			w, err := q.Get(&job)
+			if err != nil || job != "job0" || w.Queue != layout.queue {
+				t.Fatal(w, job, err)
+			}
+			if err := w.Complete(); err != nil {
+				t.Fatal(err)
+			}
+			if err := q.Submit("job0"); err != grt.ErrRecentlyCompleted {
+				t.Fatal(err)
+			}
+			for _, job := range []string{"job1", "delayed"} {
+				if ok, err := q.Cancel(job); !ok || err != nil {
+					t.Fatal(job, ok, err)
+				}
+			}
+			if _, err := q.Get(&job); err != nil || job != "batch0" {
+				t.Fatal(job, err)
+			}
+			if err := q.Cleanup(); err != nil {
+				t.Fatal(err)
+			}
+			if keys := q.Describe().Keys; keys.Payload != layout.queue+":payload" {
+				t.Fatalf("%+v", keys)
+			}
+			// Every key shares the queue's name, and so its hash tag.
+			for _, key := range s.Keys() {
+				if key != layout.queue && !strings.HasPrefix(key, layout.queue+":") {
+					t.Errorf("key %q is outside %q", key, layout.queue)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	s, pool := newPool(t)
+	old := grt.NewJobQueue(pool, "cluster")
+	if err := old.Submit("job"); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.MigrateKeys(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+	q := grt.NewJobQueue(pool, "cluster", grt.WithClusterKeys())
+	if err := q.MigrateKeys(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists("cluster:payload") || !s.Exists("{cluster}:payload") {
+		t.Fatal(s.Keys())
+	}
+	var job string
+	w, err := q.Get(&job)
+	if err != nil || job != "job" {
+		t.Fatal(job, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
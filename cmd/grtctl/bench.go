@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/alecthomas/grt"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"time"
+)
+
+// benchPrefetches are the prefetch sizes bench compares. Zero disables
+// prefetching.
+var benchPrefetches = []int{0, 10, 100}
+
+// bench submits n jobs to a new scratch queue then retrieves and completes
+// them one at a time, once for each prefetch size, printing the throughput of
+// each. The scratch queue's name is random, so that no worker consumes its
+// jobs, and its keys are deleted afterwards.
+func bench(ctx context.Context, pool *redis.Pool, ns grt.Namespace, n int) (err error) {
+	queue, err := scratchQueueName()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if deleteErr := deleteQueue(ctx, pool, ns.Key(queue)); err == nil {
+			err = deleteErr
+		}
+	}()
+	jobs := make([]interface{}, n)
+	for i := range jobs {
+		jobs[i] = i
+	}
+	for _, prefetch := range benchPrefetches {
+		options := []grt.Option{}
+		if prefetch > 0 {
+			options = append(options, grt.WithPrefetch(prefetch))
+		}
+		q := ns.NewJobQueue(pool, queue, options...)
+		elapsed, err := benchQueue(q, jobs)
+		q.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("prefetch %d\t%d jobs in %s\t%.0f jobs/s\n", prefetch, n, elapsed.Round(time.Millisecond), float64(n)/elapsed.Seconds())
+	}
+	return nil
+}
+
+// scratchQueueName returns a random queue name for bench.
+func scratchQueueName() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "grtctl:bench:" + hex.EncodeToString(b), nil
+}
+
+// globEscaper escapes the special characters of SCAN's MATCH patterns.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// deleteQueue deletes the keys of a queue, namely the queue's own key and
+// every key below it.
+func deleteQueue(ctx context.Context, pool *redis.Pool, queue string) error {
+	r := grt.GetConn(pool, "grtctl.deleteQueue")
+	defer r.Close()
+	if _, err := r.Do("DEL", queue); err != nil {
+		return err
+	}
+	cursor := "0"
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		reply, err := redis.Values(r.Do("SCAN", cursor, "MATCH", globEscaper.Replace(queue)+":*", "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		keys, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if _, err := r.Do("DEL", redis.Args{}.AddFlat(keys)...); err != nil {
+				return err
+			}
+		}
+		if cursor, err = redis.String(reply[0], nil); err != nil || cursor == "0" {
+			return err
+		}
+	}
+}
+
+// benchQueue submits jobs to q, then times retrieving and completing them.
+func benchQueue(q *grt.JobQueue, jobs []interface{}) (time.Duration, error) {
+	if _, err := q.SubmitAll(jobs); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	for range jobs {
+		var job int
+		work, err := q.Get(&job)
+		if err != nil {
+			return 0, err
+		}
+		if err := work.Complete(); err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(start), nil
+}
@@ -0,0 +1,235 @@
+// Command grtctl inspects and administers grt queues and locks.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/alecthomas/grt"
+	"github.com/garyburd/redigo/redis"
+	"os"
+	"strconv"
+)
+
+const usage = `usage: grtctl [flags] <command> [args]
+
+Commands:
+  queues                 List queues.
+  stats <queue>          Show a queue's statistics.
+  describe <queue>       Show a queue's configuration and keys.
+  peek <queue> [n]       Show the next n waiting jobs (default 10).
+  dead <queue> [n]       Show up to n dead letters (default 100).
+  requeue <queue> <key>  Move a dead letter back onto its queue.
+  purge <queue>          Remove every waiting job from a queue.
+  purge-dead <queue>     Delete every dead letter of a queue.
+  pause <queue>          Stop jobs being retrieved from a queue.
+  resume <queue>         Resume a paused queue.
+  lock <key>             Show the holder of a lock.
+  unlock <key>           Release a lock whoever holds it.
+  bench [n]              Time retrieving n jobs (default 10000) from a new
+                         scratch queue, with and without prefetching, then
+                         delete it.
+  selftest [feature...]  Check Redis is suitable for grt, or for the given
+                         features: jobqueue, lock, admin, sidekiq.
+
+Flags:
+`
+
+func main() {
+	url := flag.String("url", "redis://localhost:6379", "Redis URL.")
+	prefix := flag.String("prefix", "", "Namespace of queues and locks, eg. app1:prod.")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	pool := &redis.Pool{
+		MaxIdle: 2,
+		Dial:    func() (redis.Conn, error) { return redis.DialURL(*url) },
+	}
+	defer pool.Close()
+	if err := run(context.Background(), pool, grt.Namespace(*prefix), flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "grtctl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, pool *redis.Pool, ns grt.Namespace, command string, args []string) error {
+	switch command {
+	case "queues":
+		queues, err := ns.ListQueues(ctx, pool)
+		if err != nil {
+			return err
+		}
+		for _, queue := range queues {
+			fmt.Println(queue)
+		}
+		return nil
+	case "lock", "unlock":
+		if len(args) != 1 {
+			return fmt.Errorf("%s takes a lock key", command)
+		}
+		if command == "unlock" {
+			held, err := grt.ForceUnlock(pool, ns.Key(args[0]))
+			if err == nil && !held {
+				fmt.Println("not locked")
+			}
+			return err
+		}
+		return showLock(pool, ns.Key(args[0]))
+	case "selftest":
+		return selfTest(ctx, pool, args)
+	case "bench":
+		n, err := countArg(args, 10000)
+		if err != nil {
+			return err
+		}
+		return bench(ctx, pool, ns, n)
+	}
+	if len(args) < 1 {
+		return fmt.Errorf("%s takes a queue name", command)
+	}
+	options, err := queueOptions(pool, ns, args[0])
+	if err != nil {
+		return err
+	}
+	queue := ns.NewJobQueue(pool, args[0], options...)
+	defer queue.Close()
+	switch command {
+	case "stats":
+		stats, err := queue.Stats()
+		if err != nil {
+			return err
+		}
+		return printJSON(stats)
+	case "describe":
+		return printJSON(queue.Describe())
+	case "peek":
+		n, err := countArg(args[1:], 10)
+		if err != nil {
+			return err
+		}
+		jobs, err := queue.Peek(n)
+		if err != nil {
+			return err
+		}
+		printJobs(jobs)
+		return nil
+	case "dead":
+		n, err := countArg(args[1:], 100)
+		if err != nil {
+			return err
+		}
+		jobs, _, err := queue.DeadJobs("", n)
+		if err != nil {
+			return err
+		}
+		printJobs(jobs)
+		return nil
+	case "requeue":
+		if len(args) != 2 {
+			return errors.New("requeue takes a queue name and a job key")
+		}
+		return queue.Requeue([]byte(args[1]))
+	case "purge":
+		report, err := queue.CancelWhere(ctx, func(key, payload []byte) bool { return true }, grt.CancelOptions{})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("removed %d jobs\n", report.Waiting)
+		return nil
+	case "purge-dead":
+		n, err := queue.PurgeDead()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("deleted %d dead letters\n", n)
+		return nil
+	case "pause":
+		return queue.Pause()
+	case "resume":
+		return queue.Resume()
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+// countArg parses the optional count that args start with.
+func countArg(args []string, fallback int) (int, error) {
+	if len(args) < 1 {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid count %q", args[0])
+	}
+	return n, nil
+}
+
+// features are the names of the features selftest can check.
+var features = map[string]grt.Feature{
+	"jobqueue": grt.FeatureJobQueue,
+	"lock":     grt.FeatureLock,
+	"admin":    grt.FeatureAdmin,
+	"sidekiq":  grt.FeatureSidekiqBridge,
+}
+
+// selfTest runs grt.SelfTest for the named features, failing if any check
+// fails.
+func selfTest(ctx context.Context, pool *redis.Pool, names []string) error {
+	checked := []grt.Feature{}
+	for _, name := range names {
+		feature, ok := features[name]
+		if !ok {
+			return fmt.Errorf("unknown feature %q", name)
+		}
+		checked = append(checked, feature)
+	}
+	report, err := grt.SelfTest(ctx, pool, checked...)
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
+	if report.Status() == grt.CheckFail {
+		return errors.New("self-test failed")
+	}
+	return nil
+}
+
+func printJobs(jobs []grt.JobEntry) {
+	for _, job := range jobs {
+		if job.Payload == nil {
+			fmt.Printf("%s\t(stored externally)\n", job.Key)
+		} else {
+			fmt.Printf("%s\t%s\n", job.Key, job.Payload)
+		}
+	}
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+func showLock(pool *redis.Pool, key string) error {
+	state, err := grt.InspectLock(pool, key)
+	if err != nil {
+		return err
+	}
+	if !state.Held {
+		fmt.Println("not locked")
+		return nil
+	}
+	fmt.Printf("token %s, expires in %s\n", state.Token, state.TTL)
+	return nil
+}
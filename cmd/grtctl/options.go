@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"github.com/alecthomas/grt"
+	"github.com/alecthomas/grt/msgpack"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+)
+
+// queueOptions returns the options recorded in a queue's stored options
+// fingerprint, so that commands use the queue's keys and codec and pass its
+// fingerprint check. A queue created WithClusterKeys is found by its untagged
+// name. A queue that has never been used gets the default options.
+func queueOptions(pool *redis.Pool, ns grt.Namespace, queue string) ([]grt.Option, error) {
+	r := grt.GetConn(pool, "grtctl.queueOptions")
+	defer r.Close()
+	stored, err := redis.StringMap(r.Do("HGETALL", ns.Key(queue)+":options"))
+	if err != nil {
+		return nil, err
+	}
+	options := []grt.Option{}
+	if len(stored) == 0 && !strings.HasPrefix(queue, "{") {
+		tagged, err := redis.StringMap(r.Do("HGETALL", ns.Key("{"+queue+"}")+":options"))
+		if err != nil {
+			return nil, err
+		}
+		if len(tagged) > 0 {
+			stored = tagged
+			options = append(options, grt.WithClusterKeys())
+		}
+	}
+	switch codec := stored["codec"]; codec {
+	case "", "json":
+	case "gob":
+		options = append(options, grt.WithCodec(grt.GobCodec{}))
+	case "msgpack":
+		options = append(options, grt.WithCodec(msgpack.Codec{}))
+	default:
+		return nil, fmt.Errorf("queue %s uses codec %s, which grtctl does not support", queue, codec)
+	}
+	if stored["priorities"] == "on" {
+		options = append(options, grt.WithPriorities())
+	}
+	if stored["keys"] == "hashed" {
+		options = append(options, grt.WithHashedKeys())
+	}
+	if scope := stored["dedupe_scope"]; strings.HasPrefix(scope, "namespace:") {
+		options = append(options, grt.WithDedupeScope(grt.DedupeNamespace(strings.TrimPrefix(scope, "namespace:"))))
+	}
+	return options, nil
+}
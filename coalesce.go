@@ -0,0 +1,47 @@
+package grt
+
+import (
+	"time"
+)
+
+// WithSubmitCoalescing collapses concurrent Submits of the same job within
+// this process into a single Redis operation. One caller performs the
+// submission and the others receive ErrAlreadyQueued, as they would have
+// from Redis. Submits of the same job within window after a successful or
+// duplicate submission also return ErrAlreadyQueued without a round trip.
+//
+// Redis remains authoritative: a job completed within window may be reported
+// as queued, so keep window to a few milliseconds.
+func WithSubmitCoalescing(window time.Duration) Option {
+	return func(c *JobQueue) {
+		c.submitFlights = &readCache{ttl: window, entries: map[string]*readCacheEntry{}}
+	}
+}
+
+// coalesceSubmit performs submit, sharing its result with concurrent and
+// recent submissions of the same key if coalescing is enabled.
+func (c *JobQueue) coalesceSubmit(key []byte, submit func() error) error {
+	if c.submitFlights == nil {
+		return submit()
+	}
+	leader := false
+	result, err := c.submitFlights.do(string(key), func() (interface{}, error) {
+		leader = true
+		err := submit()
+		if err != nil && err != ErrAlreadyQueued {
+			// Errors are not cached.
+			return nil, err
+		}
+		return err, nil
+	})
+	if err != nil {
+		return err
+	}
+	if !leader {
+		return ErrAlreadyQueued
+	}
+	if result != nil {
+		return result.(error)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package grt_test
+
+import (
+	"github.com/alecthomas/grt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSubmitCoalescing(t *testing.T) {
+	_, pool := newPool(t)
+	var submits int32
+	defer grt.ObserveCommands(func(op string, n int) {
+		if op == "JobQueue.Submit" {
+			atomic.AddInt32(&submits, 1)
+		}
+	})()
+	q := grt.NewJobQueue(pool, "coalesce", grt.WithSubmitCoalescing(time.Second))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	var queued, duplicates int32
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			switch err := q.Submit("burst"); err {
+			case nil:
+				atomic.AddInt32(&queued, 1)
+			case grt.ErrAlreadyQueued:
+				atomic.AddInt32(&duplicates, 1)
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if submits != 1 || queued != 1 || duplicates != 199 {
+		t.Fatalf("%d Redis submits, %d queued, %d duplicates", submits, queued, duplicates)
+	}
+	if n, err := q.Len(); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+}
+
+func TestSubmitCoalescingWindow(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "coalesce", grt.WithSubmitCoalescing(50*time.Millisecond))
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	// Within the window the earlier submission is reused, even though the
+	// job has since completed.
+	if err := q.Submit("a"); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	// Afterwards Redis is asked again.
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubmitCoalescingDisabled(t *testing.T) {
+	_, pool := newPool(t)
+	var submits int32
+	defer grt.ObserveCommands(func(op string, n int) {
+		if op == "JobQueue.Submit" {
+			atomic.AddInt32(&submits, 1)
+		}
+	})()
+	q := grt.NewJobQueue(pool, "coalesce")
+	for i := 0; i < 3; i++ {
+		q.Submit("a")
+	}
+	if submits != 3 {
+		t.Fatal(submits)
+	}
+}
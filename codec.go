@@ -0,0 +1,153 @@
+package grt
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Codec encodes jobs for storage in Redis.
+type Codec interface {
+	// Name identifies the codec in the payloads it encodes, so that they are
+	// decoded with it by queues configured with a different codec. It must
+	// not contain a colon and should never change.
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	// DecodeFrom decodes a payload read from r, which is streamed from a
+	// chunked or offloaded payload, into v. Codecs that cannot decode
+	// incrementally can read r in full and call Unmarshal.
+	DecodeFrom(r io.Reader, v interface{}) error
+}
+
+// JSONCodec encodes jobs with encoding/json. It is the default.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string                               { return "json" }
+func (JSONCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (JSONCodec) DecodeFrom(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+// GobCodec encodes jobs with encoding/gob, preserving types that JSON does
+// not, such as int64 and []byte. Each job is encoded on its own, so payloads
+// are self-describing but carry their type information.
+//
+// Gob encodes maps in no particular order, so jobs containing maps should
+// implement JobQueueKeyer to be deduplicated reliably.
+type GobCodec struct{}
+
+func (GobCodec) Name() string { return "gob" }
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (GobCodec) DecodeFrom(r io.Reader, v interface{}) error {
+	return gob.NewDecoder(r).Decode(v)
+}
+
+// WithCodec encodes jobs with codec rather than JSON. Every instance of the
+// queue must agree. Payloads are marked with the name of any codec other than
+// JSON, and are decoded with the codec that encoded them if it is JSON or
+// gob, so that workers keep reading payloads submitted before the codec
+// changed (see ForceAdoptOptions). Unmarked payloads are decoded with the
+// queue's codec.
+//
+// With JSON, a job's key is its canonical encoding (or its hash, with
+// WithHashedKeys); with any other codec it is the hex SHA-256 of its encoding,
+// unless it implements JobQueueKeyer.
+func WithCodec(codec Codec) Option {
+	return func(c *JobQueue) { c.codec = codec }
+}
+
+// codecName identifies codec in the queue's options fingerprint and in the
+// payloads it encodes.
+func codecName(codec Codec) string {
+	return codec.Name()
+}
+
+// codecByName returns the built-in codec with the given name. Unknown codecs
+// fail to encode or decode.
+func codecByName(name string) Codec {
+	switch name {
+	case "json", "":
+		return JSONCodec{}
+	case "gob":
+		return GobCodec{}
+	default:
+		return unknownCodec(name)
+	}
+}
+
+type unknownCodec string
+
+func (u unknownCodec) Name() string { return string(u) }
+
+func (u unknownCodec) Marshal(v interface{}) ([]byte, error) {
+	return nil, fmt.Errorf("unknown codec %s", string(u))
+}
+
+func (u unknownCodec) Unmarshal(data []byte, v interface{}) error {
+	return fmt.Errorf("unknown codec %s", string(u))
+}
+
+func (u unknownCodec) DecodeFrom(r io.Reader, v interface{}) error {
+	return fmt.Errorf("unknown codec %s", string(u))
+}
+
+// marshal encodes job, returning its queue key and payload.
+func (c *JobQueue) marshal(job interface{}) (key []byte, payload []byte, err error) {
+	if payload, err = c.codec.Marshal(job); err != nil {
+		return nil, nil, err
+	}
+	if keyer, ok := job.(JobQueueKeyer); ok {
+		return keyer.JobQueueKey(), payload, nil
+	}
+	if codecName(c.codec) == "json" {
+		key, err = canonicalJSON(payload)
+		if err != nil || !c.hashedKeys {
+			return key, payload, err
+		}
+		return hashedKey(key), payload, nil
+	}
+	return hashedKey(payload), payload, nil
+}
+
+// payloadCodec returns the codec that encoded a payload marked with the
+// codec name, which is empty for unmarked payloads.
+func (c *JobQueue) payloadCodec(name string) (Codec, error) {
+	if name == "" || name == codecName(c.codec) {
+		return c.codec, nil
+	}
+	codec := codecByName(name)
+	if _, ok := codec.(unknownCodec); ok {
+		return nil, fmt.Errorf("payload is encoded with codec %s but the queue uses %s", name, codecName(c.codec))
+	}
+	return codec, nil
+}
+
+// canonicalJSON re-encodes data with object keys sorted at every level, so
+// that jobs whose custom MarshalJSON methods (or json.RawMessage fields) emit
+// keys in varying order still encode to the same key. Numbers are preserved
+// exactly.
+func canonicalJSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
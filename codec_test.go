@@ -0,0 +1,76 @@
+package grt_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/alecthomas/grt"
+	"testing"
+	"time"
+)
+
+type archiveJob struct {
+	ID   int64
+	At   time.Time
+	Data []byte
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	tests := []struct {
+		name  string
+		codec grt.Codec
+	}{
+		{"json", grt.JSONCodec{}},
+		{"gob", grt.GobCodec{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, pool := newPool(t)
+			q := grt.NewJobQueue(pool, "codec", grt.WithCodec(test.codec))
+			// An int64 beyond float64's precision.
+			job := archiveJob{ID: 1<<62 + 1, At: at, Data: []byte{0, 1, 2}}
+			if err := q.Submit(job); err != nil {
+				t.Fatal(err)
+			}
+			if err := q.Submit(job); err != grt.ErrAlreadyQueued {
+				t.Fatal(err)
+			}
+			if queued, err := q.IsQueued(job); !queued || err != nil {
+				t.Fatal(queued, err)
+			}
+			var got archiveJob
+			w, err := q.TryGet(&got)
+			if err != nil || got.ID != job.ID || !got.At.Equal(at) || !bytes.Equal(got.Data, job.Data) {
+				t.Fatal(got, err)
+			}
+			if d := q.Describe(); d.Codec != test.name {
+				t.Fatal(d.Codec)
+			}
+			if err := w.Complete(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestGobCodecKeys(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "codec", grt.WithCodec(grt.GobCodec{}))
+	if err := q.Submit(archiveJob{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Submit(archiveJob{ID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// Binary payloads are keyed by their SHA-256 hash.
+	keys, err := s.HKeys("codec:payload")
+	if err != nil || len(keys) != 2 {
+		t.Fatal(keys, err)
+	}
+	for _, key := range keys {
+		if sum, err := hex.DecodeString(key); err != nil || len(sum) != sha256.Size {
+			t.Fatal(key, err)
+		}
+	}
+}
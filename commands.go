@@ -0,0 +1,192 @@
+package grt
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"sync"
+	"sync/atomic"
+)
+
+// CommandObserver is called after each invocation of an operation completes
+// with the operation name (eg. "JobQueue.Submit") and the number of Redis
+// commands it issued across every connection it used, including MULTI/EXEC,
+// commands queued inside transactions, and those run by scripts. Operations
+// one performs along the way, eg. a Get discarding a cancelled job with
+// Work.Complete, are reported separately under their own names.
+type CommandObserver func(op string, commands int)
+
+var commandObservers struct {
+	sync.RWMutex
+	active int32
+	next   int
+	fns    map[int]CommandObserver
+}
+
+// ObserveCommands registers an observer of per-operation Redis command
+// counts. Observers are process-wide. The returned function removes the
+// observer.
+func ObserveCommands(observer CommandObserver) (remove func()) {
+	commandObservers.Lock()
+	defer commandObservers.Unlock()
+	if commandObservers.fns == nil {
+		commandObservers.fns = map[int]CommandObserver{}
+	}
+	id := commandObservers.next
+	commandObservers.next++
+	commandObservers.fns[id] = observer
+	atomic.AddInt32(&commandObservers.active, 1)
+	return func() {
+		commandObservers.Lock()
+		defer commandObservers.Unlock()
+		if _, ok := commandObservers.fns[id]; ok {
+			delete(commandObservers.fns, id)
+			atomic.AddInt32(&commandObservers.active, -1)
+		}
+	}
+}
+
+// notifyCommands reports an operation's command count to the observers. They
+// are called without the lock held, so that one may remove itself.
+func notifyCommands(op string, commands int) {
+	commandObservers.RLock()
+	observers := make([]CommandObserver, 0, len(commandObservers.fns))
+	for _, observer := range commandObservers.fns {
+		observers = append(observers, observer)
+	}
+	commandObservers.RUnlock()
+	for _, observer := range observers {
+		observer(op, commands)
+	}
+}
+
+// operation counts the commands issued by one invocation of an operation,
+// across every connection it uses, and reports them when it ends. A nil
+// operation counts nothing.
+type operation struct {
+	name     string
+	commands int64
+}
+
+// startOperation begins an invocation of the named operation, or returns nil
+// if no command observers are registered.
+func startOperation(name string) *operation {
+	if atomic.LoadInt32(&commandObservers.active) == 0 {
+		return nil
+	}
+	return &operation{name: name}
+}
+
+// end reports the operation's command count to the observers.
+func (o *operation) end() {
+	if o != nil {
+		notifyCommands(o.name, int(atomic.LoadInt64(&o.commands)))
+	}
+}
+
+func (o *operation) add(commands int) {
+	if o != nil {
+		atomic.AddInt64(&o.commands, int64(commands))
+	}
+}
+
+// conn retrieves a connection from the pool whose commands count towards the
+// operation, retrying round trips according to the pool's RetryPolicy, if
+// any.
+func (o *operation) conn(pool *redis.Pool) redis.Conn {
+	conn := pool.Get()
+	if policy := retryPolicy(pool); policy != nil {
+		conn = &retryingConn{Conn: conn, pool: pool, policy: policy}
+	}
+	if o == nil {
+		return conn
+	}
+	return &countingConn{Conn: conn, operation: o}
+}
+
+// getConn retrieves a connection from the pool for an operation that uses no
+// other, which ends when the connection is closed. See operation.conn.
+func getConn(pool *redis.Pool, op string) redis.Conn {
+	o := startOperation(op)
+	conn := o.conn(pool)
+	if counter, ok := conn.(*countingConn); ok {
+		counter.ends = true
+	}
+	return conn
+}
+
+// GetConn retrieves a connection from the pool for commands issued outside
+// grt's own types, eg. by tools, so that they are counted towards op by
+// ObserveCommands and retried according to the pool's RetryPolicy. The
+// operation ends when the connection is closed.
+func GetConn(pool *redis.Pool, op string) redis.Conn {
+	return getConn(pool, op)
+}
+
+// countingConn counts the commands issued through it towards an operation.
+type countingConn struct {
+	redis.Conn
+	operation *operation
+	// Whether closing the connection ends the operation.
+	ends bool
+	// Commands sent since the last Do, and which of them are scripts that
+	// append their command count to their reply.
+	sent    []string
+	scripts []int
+}
+
+func (c *countingConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	// An empty command name only flushes pending commands and reads replies.
+	if commandName != "" {
+		c.operation.add(1)
+	}
+	sent, scripts := c.sent, c.scripts
+	c.sent, c.scripts = nil, nil
+	reply, err := c.Conn.Do(commandName, args...)
+	if len(scripts) == 0 || err != nil {
+		return reply, err
+	}
+	// The replies of commands sent with the script are returned by EXEC
+	// for a transaction, or all together by Do("") for a pipeline.
+	first := 0
+	switch commandName {
+	case "EXEC":
+		for i, name := range sent {
+			if name == "MULTI" {
+				first = i + 1
+			}
+		}
+	case "":
+	default:
+		return reply, err
+	}
+	replies, _ := reply.([]interface{})
+	for _, i := range scripts {
+		if i < first || i-first >= len(replies) {
+			continue
+		}
+		if values, ok := replies[i-first].([]interface{}); ok && len(values) > 0 {
+			commands, _ := redis.Int(values[len(values)-1], nil)
+			c.operation.add(commands)
+		}
+	}
+	return reply, err
+}
+
+func (c *countingConn) Send(commandName string, args ...interface{}) error {
+	c.operation.add(1)
+	c.sent = append(c.sent, commandName)
+	return c.Conn.Send(commandName, args...)
+}
+
+// sendScript sends script, noting that its reply ends with its command
+// count.
+func (c *countingConn) sendScript(script *redis.Script, keysAndArgs ...interface{}) error {
+	c.scripts = append(c.scripts, len(c.sent))
+	return script.Send(c, keysAndArgs...)
+}
+
+func (c *countingConn) Close() error {
+	if c.ends {
+		c.operation.end()
+	}
+	return c.Conn.Close()
+}
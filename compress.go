@@ -0,0 +1,145 @@
+package grt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	// ErrPayloadTooLarge is returned when submitting a job whose encoded
+	// payload exceeds the queue's WithMaxPayloadSize.
+	ErrPayloadTooLarge = errors.New("payload too large")
+)
+
+// compressedRecordPrefix marks a payload hash entry as a compressed payload.
+// It is followed by the compressor's name, a colon, and the compressed
+// payload.
+const compressedRecordPrefix = "\x00grt:compressed:"
+
+// Compressor compresses job payloads for storage in Redis.
+type Compressor interface {
+	// Name identifies the compressor in the payloads it compresses, so must
+	// not change. It may not contain a colon.
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// GzipCompressor compresses payloads with compress/gzip. Payloads it
+// compresses can be read by any queue, whatever its compressor.
+type GzipCompressor struct {
+	// Compression level, eg. gzip.BestSpeed. Defaults to
+	// gzip.DefaultCompression.
+	Level int
+}
+
+func (GzipCompressor) Name() string { return "gzip" }
+
+func (g GzipCompressor) Compress(data []byte) ([]byte, error) {
+	level := g.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	buf := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// WithCompression compresses payloads larger than threshold bytes with
+// compressor, eg. GzipCompressor{} or zstd.Compressor{}. Compressed payloads
+// are marked as such, so queues read uncompressed and compressed payloads
+// alike, but only those created with the same compressor (or any, for gzip)
+// can read them: enable compression on consumers before producers.
+//
+// Payloads offloaded to a PayloadStore or submitted with SubmitStream are not
+// compressed.
+func WithCompression(compressor Compressor, threshold int) Option {
+	return func(c *JobQueue) {
+		c.compressor = compressor
+		c.compressionThreshold = threshold
+	}
+}
+
+// WithMaxPayloadSize makes Submit and its variants return ErrPayloadTooLarge
+// for jobs whose encoded payload, before any compression, exceeds size bytes.
+func WithMaxPayloadSize(size int) Option {
+	return func(c *JobQueue) { c.maxPayloadSize = size }
+}
+
+// payloadRecord returns the payload hash entry to write for payload, after
+// checking its size: payload itself, or compressed, or a reference to it in
+// the PayloadStore, in which case ref is that reference.
+func (c *JobQueue) payloadRecord(key, payload []byte) (record []byte, ref string, err error) {
+	if c.maxPayloadSize > 0 && len(payload) > c.maxPayloadSize {
+		return nil, "", fmt.Errorf("%w: payload of %s:%s is %d bytes, the limit is %d", ErrPayloadTooLarge, c.Queue, key, len(payload), c.maxPayloadSize)
+	}
+	if record, ref, err = c.offload(key, payload); err != nil || ref != "" {
+		return record, ref, err
+	}
+	if c.compressor == nil || len(payload) <= c.compressionThreshold {
+		return payload, "", nil
+	}
+	compressed, err := c.compressor.Compress(payload)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not compress payload: %w", err)
+	}
+	record = append([]byte(compressedRecordPrefix+c.compressor.Name()+":"), compressed...)
+	// Incompressible payloads are stored as they are.
+	if len(record) >= len(payload) {
+		return payload, "", nil
+	}
+	return record, "", nil
+}
+
+// isCompressed returns true if a payload hash entry is a compressed payload.
+func isCompressed(record []byte) bool {
+	_, record = splitVersion(record)
+	return bytes.HasPrefix(record, []byte(compressedRecordPrefix))
+}
+
+// decompress returns the payload in a compressed payload hash entry, with
+// the version marker already removed.
+func (c *JobQueue) decompress(record []byte) ([]byte, error) {
+	rest := string(record[len(compressedRecordPrefix):])
+	colon := strings.IndexByte(rest, ':')
+	if colon < 0 {
+		return nil, errors.New("invalid compressed payload")
+	}
+	name, data := rest[:colon], record[len(compressedRecordPrefix)+colon+1:]
+	var compressor Compressor
+	switch {
+	case c.compressor != nil && c.compressor.Name() == name:
+		compressor = c.compressor
+	case name == "gzip":
+		compressor = GzipCompressor{}
+	default:
+		return nil, fmt.Errorf("payload is compressed with %s but the queue is not configured WithCompression for it", name)
+	}
+	payload, err := compressor.Decompress(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress payload: %w", err)
+	}
+	return payload, nil
+}
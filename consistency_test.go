@@ -0,0 +1,75 @@
+package grt_test
+
+import (
+	"github.com/alecthomas/grt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+	"testing"
+)
+
+// splitConn routes plain read commands to a replica, as a proxy splitting
+// reads and writes does, and everything else, including transactions and
+// pipelines, to the primary. The replica never catches up.
+type splitConn struct {
+	redis.Conn
+	replica redis.Conn
+}
+
+var replicaReads = map[string]bool{"HEXISTS": true, "HLEN": true, "HGET": true, "LLEN": true, "EXISTS": true}
+
+func (s *splitConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if replicaReads[cmd] {
+		return s.replica.Do(cmd, args...)
+	}
+	return s.Conn.Do(cmd, args...)
+}
+
+func (s *splitConn) Close() error {
+	s.replica.Close()
+	return s.Conn.Close()
+}
+
+func newSplitPool(t *testing.T) *redis.Pool {
+	primary, replica := miniredis.RunT(t), miniredis.RunT(t)
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) {
+		p, err := redis.Dial("tcp", primary.Addr())
+		if err != nil {
+			return nil, err
+		}
+		r, err := redis.Dial("tcp", replica.Addr())
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		return &splitConn{Conn: p, replica: r}, nil
+	}}
+	t.Cleanup(func() { pool.Close() })
+	return pool
+}
+
+func TestReadYourWritesNeedsConsistentReads(t *testing.T) {
+	q := grt.NewJobQueue(newSplitPool(t), "split")
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	if queued, err := q.IsQueued("a"); queued || err != nil {
+		t.Fatal("the replica should not have seen the submit", queued, err)
+	}
+}
+
+func TestConsistentReads(t *testing.T) {
+	q := grt.NewJobQueue(newSplitPool(t), "split", grt.WithConsistentReads())
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	if queued, err := q.IsQueued("a"); !queued || err != nil {
+		t.Fatal(queued, err)
+	}
+	if n, err := q.Len(); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	// A duplicate Submit reports the existing job without a second read.
+	if err := q.Submit("a"); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+}
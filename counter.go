@@ -0,0 +1,165 @@
+package grt
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// Minutes for which a Counter retains per-minute counts by default.
+const defaultCounterRetention = 60
+
+// Counter is a Redis-based counter shared by every client using its key, eg.
+// to count events across a fleet. As well as its running total, it counts by
+// minute of the Redis server's clock, so that recent activity can be measured
+// with Window. Queues keep their throughput in one.
+//
+// The total and per-minute counts are kept in a single hash at Key.
+type Counter struct {
+	pool *redis.Pool
+	Key  string
+	// Minutes for which per-minute counts are retained. Older counts are
+	// pruned as the counter is incremented, so longer windows undercount.
+	Retention int
+}
+
+// NewCounter creates a Redis counter, retaining per-minute counts for an
+// hour.
+func NewCounter(pool *redis.Pool, key string) *Counter {
+	return &Counter{pool: pool, Key: key, Retention: defaultCounterRetention}
+}
+
+// Incr adds one to the counter, returning its new total.
+func (c *Counter) Incr() (int64, error) {
+	return c.Add(1)
+}
+
+// Add adds n to the counter, returning its new total.
+func (c *Counter) Add(n int64) (int64, error) {
+	r := getConn(c.pool, "Counter.Add")
+	defer r.Close()
+	reply, err := counterAddScript.do(r, c.Key, n, c.Retention)
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int64(reply[0], nil)
+}
+
+// send queues adding n to the counter, eg. within MULTI.
+func (c *Counter) send(r redis.Conn, n int64) error {
+	return counterAddScript.send(r, c.Key, n, c.Retention)
+}
+
+// Value returns the counter's total.
+func (c *Counter) Value() (int64, error) {
+	r := getConn(c.pool, "Counter.Value")
+	defer r.Close()
+	total, err := redis.Int64(r.Do("HGET", c.Key, "total"))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return total, err
+}
+
+// Window returns the count over the last minutes whole minutes, excluding
+// the current one, which is still accumulating.
+func (c *Counter) Window(minutes int) (int64, error) {
+	r := getConn(c.pool, "Counter.Window")
+	defer r.Close()
+	reply, err := counterWindowScript.do(r, c.Key, minutes)
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int64(reply[0], nil)
+}
+
+// KEYS: counter hash. ARGV: amount, retention in minutes. Returns the new
+// total.
+//
+// Minute counts older than the retention are pruned once there are more
+// fields than it allows, so that minutes without increments are not left
+// behind.
+var counterAddScript = newLuaScript("counter_add", 1, 1, `
+redis.replicate_commands()
+local now = redis.call("TIME")
+local minute = math.floor(tonumber(now[1]) / 60)
+local retention = tonumber(ARGV[2])
+redis.call("HINCRBY", KEYS[1], minute, ARGV[1])
+local total = redis.call("HINCRBY", KEYS[1], "total", ARGV[1])
+if redis.call("HLEN", KEYS[1]) > retention + 1 then
+  for _, field in ipairs(redis.call("HKEYS", KEYS[1])) do
+    local m = tonumber(field)
+    if m and m <= minute - retention then
+      redis.call("HDEL", KEYS[1], field)
+    end
+  end
+end
+return {0, total}
+`)
+
+// KEYS: counter hash. ARGV: number of minutes. Returns the count over that
+// many whole minutes before the current one.
+var counterWindowScript = newLuaScript("counter_window", 1, 1, `
+redis.replicate_commands()
+local now = redis.call("TIME")
+local minute = math.floor(tonumber(now[1]) / 60)
+local fields = {}
+for m = minute - tonumber(ARGV[1]), minute - 1 do
+  table.insert(fields, m)
+end
+local total = 0
+if #fields > 0 then
+  for _, count in ipairs(redis.call("HMGET", KEYS[1], unpack(fields))) do
+    total = total + (tonumber(count) or 0)
+  end
+end
+return {0, total}
+`)
+
+// Gauge is a Redis-based value shared by every client using its key, that
+// can be set or adjusted atomically, eg. the number of connected clients
+// across a fleet.
+type Gauge struct {
+	pool *redis.Pool
+	Key  string
+}
+
+// NewGauge creates a Redis gauge. Its value is zero until set.
+func NewGauge(pool *redis.Pool, key string) *Gauge {
+	return &Gauge{pool: pool, Key: key}
+}
+
+// Set the gauge's value.
+func (g *Gauge) Set(value int64) error {
+	r := getConn(g.pool, "Gauge.Set")
+	defer r.Close()
+	_, err := r.Do("SET", g.Key, value)
+	return err
+}
+
+// Incr adds one to the gauge, returning its new value.
+func (g *Gauge) Incr() (int64, error) {
+	return g.Add(1)
+}
+
+// Decr subtracts one from the gauge, returning its new value.
+func (g *Gauge) Decr() (int64, error) {
+	return g.Add(-1)
+}
+
+// Add adds delta, which may be negative, to the gauge, returning its new
+// value.
+func (g *Gauge) Add(delta int64) (int64, error) {
+	r := getConn(g.pool, "Gauge.Add")
+	defer r.Close()
+	return redis.Int64(r.Do("INCRBY", g.Key, delta))
+}
+
+// Value returns the gauge's value.
+func (g *Gauge) Value() (int64, error) {
+	r := getConn(g.pool, "Gauge.Value")
+	defer r.Close()
+	value, err := redis.Int64(r.Do("GET", g.Key))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return value, err
+}
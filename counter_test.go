@@ -0,0 +1,87 @@
+package grt_test
+
+import (
+	"github.com/alecthomas/grt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCounter(t *testing.T) {
+	s, pool := newPool(t)
+	now := time.Unix(1700000000, 0)
+	s.SetTime(now)
+	c := grt.NewCounter(pool, "counter")
+	if n, err := c.Incr(); err != nil || n != 1 {
+		t.Fatalf("expected 1, got %d: %v", n, err)
+	}
+	// Another client using the same key shares the count.
+	if n, err := grt.NewCounter(pool, "counter").Add(4); err != nil || n != 5 {
+		t.Fatalf("expected 5, got %d: %v", n, err)
+	}
+	if v, err := c.Value(); err != nil || v != 5 {
+		t.Fatalf("expected 5, got %d: %v", v, err)
+	}
+	// The current minute is still accumulating.
+	if w, err := c.Window(5); err != nil || w != 0 {
+		t.Fatalf("expected an empty window, got %d: %v", w, err)
+	}
+	s.SetTime(now.Add(time.Minute))
+	c.Add(2)
+	if w, _ := c.Window(1); w != 5 {
+		t.Fatalf("expected 5 in the last minute, got %d", w)
+	}
+	s.SetTime(now.Add(3 * time.Minute))
+	if w, _ := c.Window(2); w != 2 {
+		t.Fatalf("expected 2 in the last two minutes, got %d", w)
+	}
+	if w, _ := c.Window(3); w != 7 {
+		t.Fatalf("expected 7 in the last three minutes, got %d", w)
+	}
+	if w, _ := c.Window(0); w != 0 {
+		t.Fatalf("expected an empty window of no minutes, got %d", w)
+	}
+}
+
+func TestCounterRetention(t *testing.T) {
+	s, pool := newPool(t)
+	now := time.Unix(1700000000, 0)
+	c := grt.NewCounter(pool, "counter")
+	c.Retention = 3
+	for i := 0; i < 8; i++ {
+		s.SetTime(now.Add(time.Duration(i) * time.Minute))
+		c.Incr()
+	}
+	if v, _ := c.Value(); v != 8 {
+		t.Fatalf("expected the total to outlive the retention, got %d", v)
+	}
+	if w, _ := c.Window(10); w != 2 {
+		t.Fatalf("expected pruned minutes to be excluded, got %d", w)
+	}
+	if s.HGet("counter", strconv.FormatInt(now.Unix()/60, 10)) != "" {
+		t.Fatal("expected the first minute to be pruned")
+	}
+}
+
+func TestGauge(t *testing.T) {
+	_, pool := newPool(t)
+	g := grt.NewGauge(pool, "gauge")
+	if v, err := g.Value(); err != nil || v != 0 {
+		t.Fatalf("expected an unset gauge to be 0, got %d: %v", v, err)
+	}
+	if err := g.Set(10); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := g.Incr(); v != 11 {
+		t.Fatalf("expected 11, got %d", v)
+	}
+	if v, _ := g.Decr(); v != 10 {
+		t.Fatalf("expected 10, got %d", v)
+	}
+	if v, _ := grt.NewGauge(pool, "gauge").Add(-13); v != -3 {
+		t.Fatalf("expected -3, got %d", v)
+	}
+	if v, err := g.Value(); err != nil || v != -3 {
+		t.Fatalf("expected -3, got %d: %v", v, err)
+	}
+}
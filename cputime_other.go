@@ -0,0 +1,12 @@
+//go:build !unix
+
+package grt
+
+import (
+	"time"
+)
+
+// processCPUTime is unavailable on this platform.
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,190 @@
+package grt
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+)
+
+// MaxAttemptsError is passed to OnDeadLetter for a job moved to the dead
+// letters after using all of the queue's MaxAttempts, wrapping the error it
+// was last resubmitted with, if any.
+type MaxAttemptsError struct {
+	Key      []byte
+	Attempts int
+	Err      error
+}
+
+func (m *MaxAttemptsError) Error() string {
+	if m.Err == nil {
+		return fmt.Sprintf("job %s failed after %d attempts", m.Key, m.Attempts)
+	}
+	return fmt.Sprintf("job %s failed after %d attempts: %s", m.Key, m.Attempts, m.Err)
+}
+
+func (m *MaxAttemptsError) Unwrap() error {
+	return m.Err
+}
+
+// Attempts returns the number of times the job has been retrieved, including
+// this one.
+func (w *Work) Attempts() int {
+	return w.attempts
+}
+
+// exhausted returns true if the job has used up the queue's MaxAttempts.
+func (w *Work) exhausted() bool {
+	return w.queue.MaxAttempts > 0 && w.attempts >= w.queue.MaxAttempts
+}
+
+// exhaustedError is the error passed to OnDeadLetter for a job that has used
+// up the queue's MaxAttempts, last resubmitted with cause.
+func (w *Work) exhaustedError(cause error) error {
+	return &MaxAttemptsError{Key: w.key, Attempts: w.attempts, Err: cause}
+}
+
+// deadLetter moves the job to the queue's dead letters instead of
+// resubmitting it, recording message in its history if it is not empty, and
+// passes reason to the queue's OnDeadLetter.
+func (w *Work) deadLetter(message string, reason error) error {
+	r := getConn(w.pool, "Work.Resubmit")
+	defer r.Close()
+	_, err := deadLetterScript.do(r, w.Queue+":processing", w.Queue+":payload", deadKey(w.Queue),
+		w.Queue+":enqueued", w.Queue+":attempts", w.Queue+":deadlines", w.queue.dedupeKey(),
+		historyKey(w.Queue, w.key), cancelKey(w.Queue, w.key), w.Queue+":stats", expiryKey(w.Queue),
+		w.key, workerID, message, resubmitHistoryLen)
+	if err != nil {
+		return err
+	}
+	w.queue.log().Warn("Moved job to dead letters", "queue", w.Queue, "key", string(w.key), "attempts", w.attempts)
+	if w.queue.OnDeadLetter != nil {
+		w.queue.OnDeadLetter(w, reason)
+	}
+	return nil
+}
+
+// DeadLen returns the number of dead letters: jobs that were resubmitted
+// after MaxAttempts attempts.
+func (c *JobQueue) DeadLen() (int, error) {
+	r := getConn(c.pool, "JobQueue.DeadLen")
+	defer r.Close()
+	return redis.Int(r.Do("HLEN", deadKey(c.Queue)))
+}
+
+// DeadJobs lists the queue's dead letters. See "Listing methods" for cursor
+// semantics.
+func (c *JobQueue) DeadJobs(cursor string, limit int) (jobs []JobEntry, next string, err error) {
+	return c.scanJobs("JobQueue.DeadJobs", "dead", deadKey(c.Queue), cursor, limit)
+}
+
+// Requeue moves a dead letter back onto the queue with its attempts reset.
+// Returns ErrJobNotFound if there is no such dead letter, or ErrAlreadyQueued
+// if the job has since been resubmitted.
+func (c *JobQueue) Requeue(key []byte) error {
+	r := getConn(c.pool, "JobQueue.Requeue")
+	defer r.Close()
+	_, err := requeueScript.do(r, deadKey(c.Queue), c.Queue+":payload", c.Queue, c.Queue+":enqueued", c.dedupeKey(),
+		key, c.Queue)
+	return err
+}
+
+// PurgeDead deletes all dead letters, along with their histories, producers
+// and any stored payloads, returning the number deleted.
+func (c *JobQueue) PurgeDead() (int, error) {
+	r := getConn(c.pool, "JobQueue.PurgeDead")
+	defer r.Close()
+	reply, err := purgeDeadScript.do(r, deadKey(c.Queue), c.Queue+":producer", c.Queue)
+	if err != nil {
+		return 0, err
+	}
+	records, err := redis.ByteSlices(reply[0], nil)
+	if err != nil {
+		return 0, err
+	}
+	if c.payloadStore != nil {
+		for _, record := range records {
+			if ref := payloadRef(record); ref != "" {
+				if err := c.payloadStore.Delete(ref); err != nil {
+					return len(records), err
+				}
+			}
+		}
+	}
+	return len(records), nil
+}
+
+func deadKey(queue string) string {
+	return queue + ":dead"
+}
+
+// KEYS: processing list, payload hash, dead letter hash, enqueued-at hash,
+// attempts hash, deadlines sorted set, dedupe hash, history list, cancel key,
+// stats hash, expiry sorted set. ARGV: key, worker, error or "", history
+// length.
+//
+// The job's history, producer and any payload chunks are retained.
+var deadLetterScript = newLuaScript("dead_letter", 1, 11, `
+redis.replicate_commands()
+local record = redis.call("HGET", KEYS[2], ARGV[1])
+redis.call("LREM", KEYS[1], 0, ARGV[1])
+redis.call("ZREM", KEYS[6], ARGV[1])
+redis.call("ZREM", KEYS[11], ARGV[1])
+redis.call("HDEL", KEYS[4], ARGV[1])
+redis.call("HDEL", KEYS[5], ARGV[1])
+redis.call("DEL", KEYS[9])
+if KEYS[7] ~= KEYS[2] then
+  redis.call("HDEL", KEYS[7], ARGV[1])
+end
+if record then
+  redis.call("HDEL", KEYS[2], ARGV[1])
+  redis.call("HSET", KEYS[3], ARGV[1], record)
+end
+if ARGV[3] ~= "" then
+  local now = redis.call("TIME")
+  local at = now[1] * 1000 + math.floor(now[2] / 1000)
+  redis.call("RPUSH", KEYS[8], cjson.encode({at = at, worker = ARGV[2], error = ARGV[3]}))
+  redis.call("LTRIM", KEYS[8], -tonumber(ARGV[4]), -1)
+end
+redis.call("HINCRBY", KEYS[10], "dead_lettered", 1)
+return {0}
+`)
+
+// KEYS: dead letter hash, payload hash, waiting list, enqueued-at hash,
+// dedupe hash. ARGV: key, queue.
+var requeueScript = newLuaScript("requeue", 1, 5, `
+redis.replicate_commands()
+local record = redis.call("HGET", KEYS[1], ARGV[1])
+if not record then
+  return {6} -- statusNotFound
+end
+if redis.call("HEXISTS", KEYS[2], ARGV[1]) == 1 then
+  return {1} -- statusDuplicate
+end
+if KEYS[5] ~= KEYS[2] and redis.call("HEXISTS", KEYS[5], ARGV[1]) == 1 then
+  return {1} -- statusDuplicate
+end
+redis.call("HDEL", KEYS[1], ARGV[1])
+redis.call("HSET", KEYS[2], ARGV[1], record)
+if KEYS[5] ~= KEYS[2] then
+  redis.call("HSET", KEYS[5], ARGV[1], ARGV[2])
+end
+redis.call("LPUSH", KEYS[3], ARGV[1])
+local now = redis.call("TIME")
+redis.call("HSET", KEYS[4], ARGV[1], now[1] * 1000 + math.floor(now[2] / 1000))
+return {0}
+`)
+
+// KEYS: dead letter hash, producer hash. ARGV: queue.
+//
+// Returns the deleted payload records.
+var purgeDeadScript = newLuaScript("purge_dead", 1, 2, `
+local records = {}
+local dead = redis.call("HGETALL", KEYS[1])
+for i = 1, #dead, 2 do
+  local key = dead[i]
+  redis.call("HDEL", KEYS[2], key)
+  redis.call("DEL", ARGV[1] .. ":chunks:" .. key, ARGV[1] .. ":history:" .. key, ARGV[1] .. ":next:" .. key)
+  table.insert(records, dead[i + 1])
+end
+redis.call("DEL", KEYS[1])
+return {0, records}
+`)
@@ -0,0 +1,137 @@
+package grt_test
+
+import (
+	"errors"
+	"github.com/alecthomas/grt"
+	"testing"
+)
+
+// deadLetters returns the queue's dead letters.
+func deadLetters(t *testing.T, q *grt.JobQueue) []grt.JobEntry {
+	t.Helper()
+	entries, _, err := q.DeadJobs("", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestDeadLetterUndecodable(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "dead")
+	q.MaxAttempts = 2
+	var reasons []error
+	q.OnDeadLetter = func(w *grt.Work, err error) { reasons = append(reasons, err) }
+	if err := q.Submit("not a number"); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for i := 0; i < 2; i++ {
+		if w, err := q.TryGet(&n); w != nil || err == nil {
+			t.Fatal(w, err)
+		}
+	}
+	// The job no longer cycles through the queue.
+	if w, err := q.TryGet(&n); w != nil || err != nil {
+		t.Fatal(w, err)
+	}
+	if dead, err := q.DeadLen(); dead != 1 || err != nil {
+		t.Fatal(dead, err)
+	}
+	var exhausted *grt.MaxAttemptsError
+	if len(reasons) != 1 || !errors.As(reasons[0], &exhausted) || exhausted.Attempts != 2 {
+		t.Fatal(reasons)
+	}
+	entries := deadLetters(t, q)
+	if len(entries) != 1 || string(entries[0].Payload) != `"not a number"` {
+		t.Fatal(entries)
+	}
+	if d, err := q.DescribeKey(entries[0].Key); err != nil || d.State != grt.JobDead {
+		t.Fatalf("%+v %v", d, err)
+	}
+	if s.Exists("dead:attempts") {
+		t.Fatal("attempts left behind")
+	}
+}
+
+func TestDeadLetterResubmitted(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "dead")
+	q.MaxAttempts = 3
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 1; attempt <= 3; attempt++ {
+		w, err := q.Get(nil)
+		if err != nil || w.Attempts() != attempt {
+			t.Fatal(w.Attempts(), err)
+		}
+		if err := w.ResubmitWithError(errors.New("failed")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := q.Len(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+	if dead, err := q.DeadLen(); dead != 1 || err != nil {
+		t.Fatal(dead, err)
+	}
+}
+
+func TestDeadLetterRequeue(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "dead")
+	q.MaxAttempts = 1
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Resubmit(); err != nil {
+		t.Fatal(err)
+	}
+	key := w.Key()
+	if err := q.Requeue(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Requeue(key); !errors.Is(err, grt.ErrJobNotFound) {
+		t.Fatal(err)
+	}
+	// The requeued job gets another full set of attempts.
+	var job string
+	w, err = q.Get(&job)
+	if err != nil || job != "a" || w.Attempts() != 1 {
+		t.Fatal(job, w.Attempts(), err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if dead, err := q.DeadLen(); dead != 0 || err != nil {
+		t.Fatal(dead, err)
+	}
+	if s.Exists("dead:attempts") {
+		t.Fatal("attempts left behind")
+	}
+}
+
+func TestDeadLetterUnlimited(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "dead")
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		w, err := q.Get(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Resubmit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dead, err := q.DeadLen(); dead != 0 || err != nil {
+		t.Fatal(dead, err)
+	}
+}
@@ -0,0 +1,108 @@
+package grt
+
+import (
+	"context"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+)
+
+// DedupeScope is the set of queues within which a job key may only be queued
+// once.
+type DedupeScope struct {
+	namespace string
+}
+
+// DedupePerQueue deduplicates jobs within a single queue. This is the default.
+var DedupePerQueue = DedupeScope{}
+
+// DedupeNamespace deduplicates jobs across every queue in the named namespace:
+// a key queued or in progress on any of them cannot be submitted to another
+// until it completes.
+func DedupeNamespace(name string) DedupeScope {
+	return DedupeScope{namespace: name}
+}
+
+func (d DedupeScope) String() string {
+	if d.namespace == "" {
+		return "queue"
+	}
+	return "namespace:" + d.namespace
+}
+
+// WithDedupeScope sets the scope within which duplicate jobs are rejected.
+//
+// The scope is part of the queue's options fingerprint, so every instance of
+// a queue must agree on it. To move an existing queue from per-queue to
+// namespace scope, stop its instances, then from an instance with the new
+// scope call ForceAdoptOptions followed by ClaimDedupeNamespace.
+func WithDedupeScope(scope DedupeScope) Option {
+	return func(c *JobQueue) { c.dedupeNamespace = scope.namespace }
+}
+
+// DedupeConflictError is returned by ClaimDedupeNamespace, listing keys that
+// are already claimed in the namespace by other queues.
+type DedupeConflictError struct {
+	Namespace string
+	// Map of key to the queue that claimed it.
+	Conflicts map[string]string
+}
+
+func (d *DedupeConflictError) Error() string {
+	conflicts := []string{}
+	for key, queue := range d.Conflicts {
+		conflicts = append(conflicts, fmt.Sprintf("%s (claimed by %s)", key, queue))
+	}
+	return fmt.Sprintf("jobs already queued elsewhere in dedupe namespace %s: %s", d.Namespace, strings.Join(conflicts, ", "))
+}
+
+// dedupeKey returns the hash consulted by Submit for duplicates.
+//
+// The namespace hash maps each key to the queue that claimed it. Its name is
+// hash-tagged so every namespace lives in a single cluster slot.
+func (c *JobQueue) dedupeKey() string {
+	if c.dedupeNamespace == "" {
+		return c.Queue + ":payload"
+	}
+	return Namespace(c.prefix).Key("grt:dedupe:{" + c.dedupeNamespace + "}")
+}
+
+// ClaimDedupeNamespace claims every job already queued or in progress on this
+// queue in its dedupe namespace. It is used when moving a queue to namespace
+// scope, and returns a *DedupeConflictError listing any keys that are queued
+// on other queues in the namespace; these must be resolved by hand.
+func (c *JobQueue) ClaimDedupeNamespace(ctx context.Context) error {
+	if c.dedupeNamespace == "" {
+		return fmt.Errorf("queue %s does not use a dedupe namespace", c.Queue)
+	}
+	conflicts := map[string]string{}
+	err := ForEachPage(ctx, c.Jobs, 100, func(page []JobEntry) error {
+		r := getConn(c.pool, "JobQueue.ClaimDedupeNamespace")
+		defer r.Close()
+		for _, job := range page {
+			r.Send("HSETNX", c.dedupeKey(), job.Key, c.Queue)
+			r.Send("HGET", c.dedupeKey(), job.Key)
+		}
+		replies, err := redis.Values(r.Do(""))
+		if err != nil {
+			return err
+		}
+		for i, job := range page {
+			owner, err := redis.String(replies[i*2+1], nil)
+			if err != nil {
+				return err
+			}
+			if owner != c.Queue {
+				conflicts[string(job.Key)] = owner
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return &DedupeConflictError{Namespace: c.dedupeNamespace, Conflicts: conflicts}
+	}
+	return nil
+}
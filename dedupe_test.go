@@ -0,0 +1,124 @@
+package grt_test
+
+import (
+	"context"
+	"errors"
+	"github.com/alecthomas/grt"
+	"testing"
+)
+
+func regionalQueues(t *testing.T) (eu, us *grt.JobQueue) {
+	_, pool := newPool(t)
+	scope := grt.WithDedupeScope(grt.DedupeNamespace("sync"))
+	return grt.NewJobQueue(pool, "sync-eu", scope), grt.NewJobQueue(pool, "sync-us", scope)
+}
+
+func TestDedupeNamespace(t *testing.T) {
+	eu, us := regionalQueues(t)
+	if err := eu.Submit("record"); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Submit("record"); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	if n, err := us.Len(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+	var job string
+	w, err := eu.Get(&job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The claim is held while the job is in progress and across resubmits.
+	if err := us.Submit("record"); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	if err := w.Resubmit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Submit("record"); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	if w, err = eu.Get(&job); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	// Completion on EU frees the key for US.
+	if err := us.Submit("record"); err != nil {
+		t.Fatal(err)
+	}
+	if err := eu.Submit("record"); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+}
+
+func TestDedupePerQueue(t *testing.T) {
+	_, pool := newPool(t)
+	eu := grt.NewJobQueue(pool, "sync-eu", grt.WithDedupeScope(grt.DedupePerQueue))
+	us := grt.NewJobQueue(pool, "sync-us")
+	for _, q := range []*grt.JobQueue{eu, us} {
+		if err := q.Submit("record"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDedupeNamespaceMigration(t *testing.T) {
+	_, pool := newPool(t)
+	scope := grt.WithDedupeScope(grt.DedupeNamespace("sync"))
+	us := grt.NewJobQueue(pool, "sync-us", scope)
+	if err := us.Submit("shared"); err != nil {
+		t.Fatal(err)
+	}
+	old := grt.NewJobQueue(pool, "sync-eu")
+	for _, job := range []string{"shared", "own"} {
+		if err := old.Submit(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := old.ClaimDedupeNamespace(context.Background()); err == nil {
+		t.Fatal("expected an error for a queue without a namespace")
+	}
+
+	eu := grt.NewJobQueue(pool, "sync-eu", scope)
+	var mismatch *grt.OptionsMismatchError
+	if err := eu.Submit("new"); !errors.As(err, &mismatch) {
+		t.Fatal(err)
+	}
+	if err := eu.ForceAdoptOptions(); err != nil {
+		t.Fatal(err)
+	}
+	var conflict *grt.DedupeConflictError
+	err := eu.ClaimDedupeNamespace(context.Background())
+	if !errors.As(err, &conflict) || conflict.Namespace != "sync" || len(conflict.Conflicts) != 1 || conflict.Conflicts[`"shared"`] != "sync-us" {
+		t.Fatal(err)
+	}
+	// Keys without conflicts were claimed regardless.
+	if err := us.Submit("own"); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	// Claiming again is idempotent.
+	if err := eu.ClaimDedupeNamespace(context.Background()); !errors.As(err, &conflict) || len(conflict.Conflicts) != 1 {
+		t.Fatal(err)
+	}
+}
+
+func TestDedupeNamespaceReleasedByDeadLetter(t *testing.T) {
+	eu, us := regionalQueues(t)
+	eu.MaxAttempts = 1
+	if err := eu.Submit("record"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := eu.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Resubmit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Submit("record"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,47 @@
+package grt
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// Maximum number of due jobs moved onto the queue per Get.
+const promoteBatchSize = 100
+
+// SubmitAt submits a job that will not be retrieved before at.
+//
+// Delayed jobs are stored like any other, so they are deduplicated against
+// queued and in-progress jobs and counted by Len and IsQueued, but wait in
+// <queue>:delayed until due. Get moves due jobs onto the queue. Due times are
+// relative to the Redis server's clock, so clock skew between producer and
+// server does not affect them.
+//
+// Submissions are not delayed if at has passed. The unavailable fallback is
+// not used for delayed jobs, and they are queued at normal priority when due.
+func (c *JobQueue) SubmitAt(job interface{}, at time.Time) error {
+	return c.submit(context.Background(), job, time.Until(at), PriorityNormal, c.jobTTL)
+}
+
+// SubmitAfter submits a job that will not be retrieved until d has elapsed.
+// See SubmitAt.
+func (c *JobQueue) SubmitAfter(job interface{}, d time.Duration) error {
+	return c.submit(context.Background(), job, d, PriorityNormal, c.jobTTL)
+}
+
+// DelayedLen returns the number of delayed jobs that are not yet due.
+func (c *JobQueue) DelayedLen() (int, error) {
+	r := getConn(c.pool, "JobQueue.DelayedLen")
+	defer r.Close()
+	return redis.Int(r.Do("ZCARD", c.Queue+":delayed"))
+}
+
+// dueWait rounds d up to the server's blocking timeout resolution, so that a
+// wait for a delayed job to fall due neither returns early nor spins.
+func (c *JobQueue) dueWait(d time.Duration) time.Duration {
+	resolution := time.Second
+	if fractionalTimeouts(c.pool) {
+		resolution = time.Millisecond
+	}
+	return (d + resolution - 1).Truncate(resolution)
+}
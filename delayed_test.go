@@ -0,0 +1,138 @@
+package grt_test
+
+import (
+	"fmt"
+	"github.com/alecthomas/grt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubmitDelayed(t *testing.T) {
+	s, pool := newPool(t)
+	now := time.Now()
+	s.SetTime(now)
+	q := grt.NewJobQueue(pool, "delayed")
+	if err := q.SubmitAfter("later", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// Delayed and immediate submissions of a job are deduplicated both ways.
+	if err := q.Submit("later"); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	if err := q.Submit("now"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SubmitAfter("now", time.Hour); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	if err := q.SubmitAt("past", now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if queued, err := q.IsQueued("later"); !queued || err != nil {
+		t.Fatal(queued, err)
+	}
+	if n, err := q.Len(); n != 3 || err != nil {
+		t.Fatal(n, err)
+	}
+	if n, err := q.DelayedLen(); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	d, err := q.DescribeJob("later")
+	if err != nil || d.State != grt.JobDelayed || d.DueAt == nil {
+		t.Fatalf("%+v %v", d, err)
+	}
+	var job string
+	for _, want := range []string{"now", "past"} {
+		w, err := q.TryGet(&job)
+		if err != nil || w == nil || job != want {
+			t.Fatal(w, job, err)
+		}
+		if err := w.Complete(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w, err := q.TryGet(&job); w != nil || err != nil {
+		t.Fatal("retrieved early", w, err)
+	}
+	// Due times follow the Redis server's clock.
+	s.SetTime(now.Add(time.Hour))
+	w, err := q.TryGet(&job)
+	if err != nil || w == nil || job != "later" {
+		t.Fatal(w, job, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := q.DelayedLen(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+}
+
+func TestDelayedWakesGet(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "delayed")
+	if err := q.SubmitAfter("soon", 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	var job string
+	w, err := q.Get(&job)
+	// miniredis only blocks for whole seconds.
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+	if err != nil || job != "soon" {
+		t.Fatal(job, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDelayedPromotedOnce(t *testing.T) {
+	s, pool := newPool(t)
+	now := time.Now()
+	s.SetTime(now)
+	q := grt.NewJobQueue(pool, "delayed")
+	for i := 0; i < 50; i++ {
+		if err := q.SubmitAfter(fmt.Sprintf("job%d", i), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.SetTime(now.Add(time.Minute))
+	var lock sync.Mutex
+	retrieved := map[string]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var job string
+				w, err := q.TryGet(&job)
+				if err != nil {
+					t.Error(err)
+					return
+				} else if w == nil {
+					return
+				}
+				lock.Lock()
+				retrieved[job]++
+				lock.Unlock()
+				if err := w.Complete(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(retrieved) != 50 {
+		t.Fatal(len(retrieved))
+	}
+	for job, n := range retrieved {
+		if n != 1 {
+			t.Errorf("%s retrieved %d times", job, n)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package grt
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// schemaVersion identifies the layout of the Redis structures used by
+// JobQueue. It is bumped whenever the layout changes incompatibly.
+const schemaVersion = 1
+
+// QueueDescription is a JSON-marshallable snapshot of a JobQueue's effective
+// configuration, for diagnostics.
+type QueueDescription struct {
+	Queue           string        `json:"queue"`
+	SchemaVersion   int           `json:"schema_version"`
+	Codec           string        `json:"codec"`
+	PayloadVersion  int           `json:"payload_version"`
+	CancelTTL       time.Duration `json:"cancel_ttl"`
+	ResultTTL       time.Duration `json:"result_ttl"`
+	DedupWindow     time.Duration `json:"dedup_window,omitempty"`
+	StreamChunkSize int           `json:"stream_chunk_size"`
+	ConsistentReads bool          `json:"consistent_reads"`
+	ReadCacheTTL    time.Duration `json:"read_cache_ttl,omitempty"`
+	SLOMaxLatency   time.Duration `json:"slo_max_latency,omitempty"`
+	SLOMaxDepth     int           `json:"slo_max_depth,omitempty"`
+	// Window over which duplicate Submits are coalesced, if enabled.
+	SubmitCoalescing time.Duration `json:"submit_coalescing,omitempty"`
+	DedupeScope      string        `json:"dedupe_scope"`
+	// Deadline given to retrieved jobs, and how often they are reaped.
+	VisibilityTimeout time.Duration `json:"visibility_timeout,omitempty"`
+	ReapInterval      time.Duration `json:"reap_interval,omitempty"`
+	Priorities        bool          `json:"priorities"`
+	HashedKeys        bool          `json:"hashed_keys"`
+	// Default TTL of submitted jobs, and whether expired jobs are
+	// dead-lettered rather than discarded.
+	JobTTL            time.Duration `json:"job_ttl,omitempty"`
+	ExpiredDeadLetter bool          `json:"expired_dead_letter,omitempty"`
+	// Whether cancelled jobs are dead-lettered rather than discarded.
+	CancelledDeadLetter bool `json:"cancelled_dead_letter,omitempty"`
+	// Whether lifecycle events are published for Watch.
+	Events bool `json:"events,omitempty"`
+	// Number of jobs Get prefetches, if any.
+	Prefetch int `json:"prefetch,omitempty"`
+	// Rate and burst set with WithRateLimit, if any.
+	RateLimit      float64 `json:"rate_limit,omitempty"`
+	RateLimitBurst int     `json:"rate_limit_burst,omitempty"`
+	// Type of the PayloadStore payloads are offloaded to, if any.
+	PayloadStore          string    `json:"payload_store,omitempty"`
+	PayloadStoreThreshold int       `json:"payload_store_threshold,omitempty"`
+	Keys                  QueueKeys `json:"keys"`
+}
+
+// QueueKeys are the Redis keys used by a JobQueue. Per-job keys are described
+// as patterns.
+type QueueKeys struct {
+	Waiting string `json:"waiting"`
+	// Waiting lists for high and low priority jobs.
+	High       string `json:"high"`
+	Low        string `json:"low"`
+	Processing string `json:"processing"`
+	Payload    string `json:"payload"`
+	Enqueued   string `json:"enqueued"`
+	Producer   string `json:"producer"`
+	Cancel     string `json:"cancel"`
+	Chunks     string `json:"chunks"`
+	History    string `json:"history"`
+	// Outcomes reported with Work.Succeed or Work.Fail, for SubmitAndWait.
+	Results string `json:"results"`
+	// Tombstones of jobs completed within DedupWindow.
+	Done string `json:"done"`
+	// Visibility deadlines of in-progress jobs.
+	Deadlines string `json:"deadlines"`
+	Attempts  string `json:"attempts"`
+	// Due times of delayed jobs.
+	Delayed string `json:"delayed"`
+	// Expiry times of jobs with a TTL.
+	Expiry string `json:"expiry"`
+	// Jobs moved aside after MaxAttempts.
+	Dead string `json:"dead"`
+	// Count of Gets, used to interleave low priority jobs.
+	Pops string `json:"pops"`
+	// Totals reported by Stats.
+	Stats string `json:"stats"`
+	// Set while the queue is paused.
+	Paused string `json:"paused"`
+	// Completions by minute, for Stats.
+	Throughput string `json:"throughput"`
+	// Token bucket for WithRateLimit.
+	RateLimit string `json:"rate_limit"`
+	// Forwarding marker left by RenameQueue.
+	Renamed string `json:"renamed"`
+	Options string `json:"options"`
+	// Hash consulted for duplicates: the payload hash, or the dedupe
+	// namespace's hash.
+	Dedupe string `json:"dedupe"`
+}
+
+// Describe the queue's effective configuration.
+func (c *JobQueue) Describe() QueueDescription {
+	description := QueueDescription{
+		Queue:               c.Queue,
+		SchemaVersion:       schemaVersion,
+		Codec:               codecName(c.codec),
+		PayloadVersion:      c.payloadVersion,
+		CancelTTL:           c.CancelTTL,
+		ResultTTL:           c.ResultTTL,
+		DedupWindow:         c.DedupWindow,
+		StreamChunkSize:     c.StreamChunkSize,
+		ConsistentReads:     c.consistentReads,
+		DedupeScope:         DedupeScope{c.dedupeNamespace}.String(),
+		VisibilityTimeout:   c.visibilityTimeout,
+		ReapInterval:        c.reapInterval,
+		Priorities:          c.priorities,
+		HashedKeys:          c.hashedKeys,
+		JobTTL:              c.jobTTL,
+		ExpiredDeadLetter:   c.deadLetterExpired,
+		CancelledDeadLetter: c.deadLetterCancelled,
+		Events:              c.events,
+		Prefetch:            c.prefetch,
+		Keys: QueueKeys{
+			Waiting:    c.Queue,
+			High:       c.priorityList(PriorityHigh),
+			Low:        c.priorityList(PriorityLow),
+			Processing: c.Queue + ":processing",
+			Payload:    c.Queue + ":payload",
+			Enqueued:   c.Queue + ":enqueued",
+			Producer:   c.Queue + ":producer",
+			Cancel:     cancelKey(c.Queue, []byte("*")),
+			Chunks:     chunksKey(c.Queue, []byte("*")),
+			History:    historyKey(c.Queue, []byte("*")),
+			Results:    resultKey(c.Queue, []byte("*")),
+			Done:       doneKey(c.Queue, []byte("*")),
+			Deadlines:  c.Queue + ":deadlines",
+			Attempts:   c.Queue + ":attempts",
+			Delayed:    c.Queue + ":delayed",
+			Expiry:     expiryKey(c.Queue),
+			Dead:       deadKey(c.Queue),
+			Pops:       c.Queue + ":pops",
+			Stats:      c.Queue + ":stats",
+			Paused:     pausedKey(c.Queue),
+			Throughput: throughputKey(c.Queue),
+			RateLimit:  rateLimitKey(c.Queue),
+			Renamed:    renamedKey(c.Queue),
+			Options:    c.Queue + ":options",
+			Dedupe:     c.dedupeKey(),
+		},
+	}
+	if c.readCache != nil {
+		description.ReadCacheTTL = c.readCache.ttl
+	}
+	if c.rateLimiter != nil {
+		description.RateLimit = c.rateLimiter.Rate
+		description.RateLimitBurst = c.rateLimiter.Burst
+	}
+	if c.slo != nil {
+		description.SLOMaxLatency = c.slo.maxLatency
+		description.SLOMaxDepth = c.slo.maxDepth
+	}
+	if c.submitFlights != nil {
+		description.SubmitCoalescing = c.submitFlights.ttl
+	}
+	if c.payloadStore != nil {
+		description.PayloadStore = fmt.Sprintf("%T", c.payloadStore)
+		description.PayloadStoreThreshold = c.payloadThreshold
+	}
+	return description
+}
+
+// LockDescription is a JSON-marshallable snapshot of a Lock's effective
+// configuration, for diagnostics.
+type LockDescription struct {
+	Key                string        `json:"key"`
+	Expiry             time.Duration `json:"expiry"`
+	Backoff            string        `json:"backoff"`
+	TTLWarningFraction float64       `json:"ttl_warning_fraction"`
+}
+
+// Describe the lock's effective configuration.
+func (l *Lock) Describe() LockDescription {
+	return LockDescription{
+		Key:                l.Key,
+		Expiry:             l.Expiry,
+		Backoff:            fmt.Sprint(l.backoff()),
+		TTLWarningFraction: l.TTLWarningFraction,
+	}
+}
+
+// JobState is the lifecycle state of a job.
+type JobState string
+
+const (
+	JobNotFound JobState = "not_found"
+	// JobQueued is reported when a job exists but Redis does not support
+	// LPOS, so whether it is waiting or in progress is unknown.
+	JobQueued     JobState = "queued"
+	JobWaiting    JobState = "waiting"
+	JobInProgress JobState = "in_progress"
+	// JobDelayed is reported for a job submitted with SubmitAt or
+	// SubmitAfter that is not yet due.
+	JobDelayed JobState = "delayed"
+	// JobDead is reported for a job moved to the queue's dead letters.
+	JobDead JobState = "dead"
+)
+
+// JobDescription is a JSON-marshallable snapshot of a single job, for support
+// tooling. Fields for features that do not apply are omitted.
+type JobDescription struct {
+	Queue string   `json:"queue"`
+	Key   string   `json:"key"`
+	State JobState `json:"state"`
+	// Number of jobs that will be retrieved before this one. Best-effort: it
+	// is omitted unless the job is waiting, the queue has no priorities and
+	// Redis supports LPOS, and may be stale by the time it is read.
+	Position *int `json:"position,omitempty"`
+	// Priority of a waiting job.
+	Priority   string     `json:"priority,omitempty"`
+	EnqueuedAt *time.Time `json:"enqueued_at,omitempty"`
+	// When a delayed job is due.
+	DueAt *time.Time `json:"due_at,omitempty"`
+	// Visibility deadline of an in-progress job, if it has one.
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Number of times the job has been retrieved since it was last queued.
+	Attempts int `json:"attempts"`
+	// Whether cancellation has been requested with RequestCancel.
+	CancelRequested bool                `json:"cancel_requested"`
+	Producer        *Producer           `json:"producer,omitempty"`
+	Payload         *PayloadDescription `json:"payload,omitempty"`
+	// Most recent resubmissions with ResubmitWithError, oldest first.
+	History []ResubmitRecord `json:"history,omitempty"`
+}
+
+// PayloadDescription describes how a job's payload is stored.
+type PayloadDescription struct {
+	Version int `json:"version"`
+	// Name of the codec the payload is marked with, or empty if it is
+	// encoded with the queue's codec.
+	Codec string `json:"codec,omitempty"`
+	// "inline", "compressed", "external" (in a PayloadStore) or "chunked"
+	// (by SubmitStream).
+	Storage string `json:"storage"`
+	// PayloadStore reference, if stored externally.
+	Ref string `json:"ref,omitempty"`
+}
+
+// DescribeJob describes the current state of a job, in a single round trip.
+// A job that is not queued, in progress or dead is described as JobNotFound.
+func (c *JobQueue) DescribeJob(job interface{}) (*JobDescription, error) {
+	key, _, err := c.marshal(job)
+	if err != nil {
+		return nil, err
+	}
+	return c.DescribeKey(key)
+}
+
+// DescribeKey is like DescribeJob but takes a raw queue key.
+func (c *JobQueue) DescribeKey(key []byte) (*JobDescription, error) {
+	r := getConn(c.pool, "JobQueue.DescribeKey")
+	defer r.Close()
+	r.Send("HGET", c.Queue+":payload", key)
+	r.Send("HGET", c.Queue+":enqueued", key)
+	r.Send("EXISTS", cancelKey(c.Queue, key))
+	r.Send("LLEN", c.Queue)
+	r.Send("LPOS", c.Queue, key)
+	r.Send("LPOS", c.Queue+":processing", key)
+	r.Send("LRANGE", historyKey(c.Queue, key), 0, -1)
+	r.Send("HGET", c.Queue+":producer", key)
+	r.Send("ZSCORE", c.Queue+":deadlines", key)
+	r.Send("HGET", c.Queue+":attempts", key)
+	r.Send("HGET", deadKey(c.Queue), key)
+	r.Send("ZSCORE", c.Queue+":delayed", key)
+	r.Send("LPOS", c.priorityList(PriorityHigh), key)
+	r.Send("LPOS", c.priorityList(PriorityLow), key)
+	replies, err := redis.Values(r.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	description := &JobDescription{Queue: c.Queue, Key: string(key), State: JobNotFound}
+	record, err := redis.Bytes(replies[0], nil)
+	dead := false
+	if err == redis.ErrNil {
+		if record, err = redis.Bytes(replies[10], nil); err == redis.ErrNil {
+			return description, nil
+		}
+		dead = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	version, codec, record := splitRecord(record)
+	description.Payload = &PayloadDescription{Version: version, Codec: codec, Storage: "inline"}
+	if ref := payloadRef(record); ref != "" {
+		description.Payload.Storage = "external"
+		description.Payload.Ref = ref
+	} else if bytes.HasPrefix(record, []byte(chunksRecordPrefix)) {
+		description.Payload.Storage = "chunked"
+	} else if isCompressed(record) {
+		description.Payload.Storage = "compressed"
+	}
+	if enqueued, err := redis.Int64(replies[1], nil); err == nil {
+		at := time.Unix(0, enqueued*int64(time.Millisecond))
+		description.EnqueuedAt = &at
+	}
+	if deadline, err := redis.Int64(replies[8], nil); err == nil {
+		at := time.Unix(0, deadline*int64(time.Millisecond))
+		description.Deadline = &at
+	}
+	description.Attempts, _ = redis.Int(replies[9], nil)
+	description.CancelRequested, _ = redis.Bool(replies[2], nil)
+	description.Producer = decodeProducer(replies[7])
+	if description.History, err = decodeHistory(replies[6]); err != nil {
+		return nil, err
+	}
+	if dead {
+		description.State = JobDead
+		return description, nil
+	}
+	if due, err := redis.Int64(replies[11], nil); err == nil {
+		at := time.Unix(0, due*int64(time.Millisecond))
+		description.State = JobDelayed
+		description.DueAt = &at
+		return description, nil
+	}
+	// LPOS replies with an error on Redis < 6.0.6, leaving the state unknown.
+	description.State = JobQueued
+	if index, err := redis.Int(replies[4], nil); err == nil {
+		description.State = JobWaiting
+		description.Priority = PriorityNormal.String()
+		if length, err := redis.Int(replies[3], nil); err == nil && !c.priorities {
+			position := length - 1 - index
+			description.Position = &position
+		}
+	} else if _, err := redis.Int(replies[12], nil); err == nil {
+		description.State = JobWaiting
+		description.Priority = PriorityHigh.String()
+	} else if _, err := redis.Int(replies[13], nil); err == nil {
+		description.State = JobWaiting
+		description.Priority = PriorityLow.String()
+	} else if _, err := redis.Int(replies[5], nil); err == nil {
+		description.State = JobInProgress
+	}
+	return description, nil
+}
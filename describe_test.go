@@ -0,0 +1,88 @@
+package grt_test
+
+import (
+	"encoding/json"
+	"github.com/alecthomas/grt"
+	"github.com/alecthomas/grt/backoff"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// credentialedStore is a PayloadStore configured with a secret.
+type credentialedStore struct {
+	*grt.MemoryPayloadStore
+	AccessKey string
+}
+
+func TestDescribeQueue(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "jobs",
+		grt.WithPrefix("app"),
+		grt.WithCodec(grt.GobCodec{}),
+		grt.WithPriorities(),
+		grt.WithConsistentReads(),
+		grt.WithVisibilityTimeout(time.Minute),
+		grt.WithPrefetch(10),
+		grt.WithRateLimit(5, 10),
+		grt.WithReadCache(time.Second),
+		grt.WithPayloadStore(&credentialedStore{grt.NewMemoryPayloadStore(), "hunter2"}, 1024),
+	)
+	description := q.Describe()
+	if description.Keys.Waiting != "app:jobs" || description.Keys.Payload != "app:jobs:payload" ||
+		description.Keys.Cancel != "app:jobs:cancel:*" || description.Keys.Dedupe != "app:jobs:payload" {
+		t.Fatalf("%+v", description.Keys)
+	}
+	description.Keys = grt.QueueKeys{}
+	want := grt.QueueDescription{
+		Queue:                 "app:jobs",
+		SchemaVersion:         description.SchemaVersion,
+		Codec:                 "gob",
+		CancelTTL:             24 * time.Hour,
+		ResultTTL:             5 * time.Minute,
+		StreamChunkSize:       1 << 20,
+		ConsistentReads:       true,
+		ReadCacheTTL:          time.Second,
+		DedupeScope:           "queue",
+		VisibilityTimeout:     time.Minute,
+		Priorities:            true,
+		Prefetch:              10,
+		RateLimit:             5,
+		RateLimitBurst:        10,
+		PayloadStore:          "*grt_test.credentialedStore",
+		PayloadStoreThreshold: 1024,
+	}
+	if !reflect.DeepEqual(description, want) {
+		t.Fatalf("got %+v\nwant %+v", description, want)
+	}
+	if description.SchemaVersion < 1 {
+		t.Fatalf("%+v", description)
+	}
+}
+
+func TestDescribeRedactsSecrets(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "jobs", grt.WithPayloadStore(&credentialedStore{grt.NewMemoryPayloadStore(), "hunter2"}, 1024))
+	data, err := json.Marshal(q.Describe())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hunter2") {
+		t.Fatalf("secret leaked: %s", data)
+	}
+}
+
+func TestDescribeLock(t *testing.T) {
+	_, pool := newPool(t)
+	lock := grt.NewLock(pool, "migrate")
+	lock.Expiry = 10 * time.Second
+	lock.Backoff = backoff.Constant(time.Second)
+	want := grt.LockDescription{Key: "migrate", Expiry: 10 * time.Second, Backoff: "constant(1s)", TTLWarningFraction: lock.TTLWarningFraction}
+	if description := lock.Describe(); description != want {
+		t.Fatalf("%+v", description)
+	}
+	if _, err := json.Marshal(lock.Describe()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,156 @@
+package grt_test
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/alecthomas/grt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func describe(t *testing.T, q *grt.JobQueue, job interface{}) *grt.JobDescription {
+	t.Helper()
+	description, err := q.DescribeJob(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return description
+}
+
+func TestDescribeJobLifecycle(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "describe", grt.WithVisibilityTimeout(time.Minute))
+	q.MaxAttempts = 2
+	if d := describe(t, q, "a"); d.State != grt.JobNotFound || d.Key != `"a"` || d.Payload != nil {
+		t.Fatalf("%+v", d)
+	}
+
+	for _, job := range []string{"a", "b"} {
+		if err := q.Submit(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := describe(t, q, "b")
+	if d.State != grt.JobWaiting || d.Position == nil || *d.Position != 1 || d.Priority != "normal" ||
+		d.EnqueuedAt == nil || d.Deadline != nil || d.Attempts != 0 || d.Payload == nil || d.Payload.Storage != "inline" {
+		t.Fatalf("%+v", d)
+	}
+
+	if err := q.RequestCancel("b"); err != nil {
+		t.Fatal(err)
+	}
+	if d := describe(t, q, "b"); !d.CancelRequested {
+		t.Fatalf("%+v", d)
+	}
+
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = describe(t, q, "a")
+	if d.State != grt.JobInProgress || d.Position != nil || d.Deadline == nil || d.Attempts != 1 {
+		t.Fatalf("%+v", d)
+	}
+	if err := w.ResubmitWithError(errors.New("flaky")); err != nil {
+		t.Fatal(err)
+	}
+	d = describe(t, q, "a")
+	if d.State != grt.JobWaiting || d.Deadline != nil || d.CancelRequested || len(d.History) != 1 || d.History[0].Error != "flaky" {
+		t.Fatalf("%+v", d)
+	}
+
+	// Exhausting its attempts moves the job to the dead letters.
+	if w, err = q.Get(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ResubmitWithError(errors.New("broken")); err != nil {
+		t.Fatal(err)
+	}
+	d = describe(t, q, "a")
+	if d.State != grt.JobDead || d.Payload == nil || len(d.History) == 0 || d.History[len(d.History)-1].Error != "broken" {
+		t.Fatalf("%+v", d)
+	}
+
+	if err := q.SubmitAfter("later", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	d = describe(t, q, "later")
+	if d.State != grt.JobDelayed || d.DueAt == nil || time.Until(*d.DueAt) < 59*time.Minute {
+		t.Fatalf("%+v", d)
+	}
+
+	if err := q.Submit("done"); err != nil {
+		t.Fatal(err)
+	}
+	w, err = q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if d := describe(t, q, "done"); d.State != grt.JobNotFound {
+		t.Fatalf("%+v", d)
+	}
+}
+
+func TestDescribeJobPriority(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "describe", grt.WithPriorities())
+	if err := q.SubmitWithPriority("urgent", grt.PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Submit("routine"); err != nil {
+		t.Fatal(err)
+	}
+	// Positions are not reported across several priority lists.
+	if d := describe(t, q, "urgent"); d.State != grt.JobWaiting || d.Priority != "high" || d.Position != nil {
+		t.Fatalf("%+v", d)
+	}
+	if d := describe(t, q, "routine"); d.State != grt.JobWaiting || d.Priority != "normal" || d.Position != nil {
+		t.Fatalf("%+v", d)
+	}
+}
+
+func TestDescribeJobPayloadStore(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "describe", grt.WithPayloadStore(grt.NewMemoryPayloadStore(), 16))
+	if err := q.Submit("a payload well over the threshold"); err != nil {
+		t.Fatal(err)
+	}
+	d := describe(t, q, "a payload well over the threshold")
+	if d.Payload == nil || d.Payload.Storage != "external" || d.Payload.Ref == "" {
+		t.Fatalf("%+v", d.Payload)
+	}
+}
+
+func TestDescribeJobJSON(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "describe")
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(describe(t, q, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	// Sections for features that do not apply are omitted.
+	want := []string{"attempts", "cancel_requested", "enqueued_at", "key", "payload", "position", "priority", "producer", "queue", "state"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatal(keys)
+	}
+	if fields["state"] != "waiting" || fields["key"] != `"a"` {
+		t.Fatal(string(data))
+	}
+}
@@ -0,0 +1,140 @@
+package grt_test
+
+import (
+	"fmt"
+	"github.com/alecthomas/grt"
+	"github.com/garyburd/redigo/redis"
+	"reflect"
+	"testing"
+)
+
+func TestIsEmpty(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "empty")
+	if empty, err := q.IsEmpty(); !empty || err != nil {
+		t.Fatal(empty, err)
+	}
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	if empty, err := q.IsEmpty(); empty || err != nil {
+		t.Fatal(empty, err)
+	}
+	// Jobs in progress are not waiting.
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty, err := q.IsEmpty(); !empty || err != nil {
+		t.Fatal(empty, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsEmptyPriorities(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "empty", grt.WithPrefix("app"), grt.WithPriorities())
+	if err := q.SubmitWithPriority("a", grt.PriorityLow); err != nil {
+		t.Fatal(err)
+	}
+	if empty, err := q.IsEmpty(); empty || err != nil {
+		t.Fatal(empty, err)
+	}
+}
+
+func TestAnyNonEmpty(t *testing.T) {
+	_, pool := newPool(t)
+	plain := grt.NewJobQueue(pool, "plain")
+	idle := grt.NewJobQueue(pool, "idle")
+	prefixed := grt.NewJobQueue(pool, "prefixed", grt.WithPrefix("app"))
+	high := grt.NewJobQueue(pool, "high", grt.WithPriorities())
+	low := grt.NewJobQueue(pool, "low", grt.WithPriorities())
+	if err := plain.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := prefixed.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := high.SubmitWithPriority("a", grt.PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	if err := low.SubmitWithPriority("a", grt.PriorityLow); err != nil {
+		t.Fatal(err)
+	}
+	queues := []string{plain.Queue, idle.Queue, prefixed.Queue, high.Queue, low.Queue, "missing"}
+	nonEmpty, err := grt.AnyNonEmpty(pool, queues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"plain", "app:prefixed", "high", "low"}; !reflect.DeepEqual(nonEmpty, want) {
+		t.Fatal(nonEmpty)
+	}
+	if nonEmpty, err := grt.AnyNonEmpty(pool, nil); len(nonEmpty) != 0 || err != nil {
+		t.Fatal(nonEmpty, err)
+	}
+}
+
+// benchmarkQueues returns 200 queues and their names, every tenth queue with
+// a job waiting.
+func benchmarkQueues(b *testing.B) (*redis.Pool, []string, []*grt.JobQueue) {
+	_, pool := newPool(b)
+	names := []string{}
+	queues := []*grt.JobQueue{}
+	for i := 0; i < 200; i++ {
+		q := grt.NewJobQueue(pool, fmt.Sprintf("bench%d", i))
+		if i%10 == 0 {
+			if err := q.Submit("a"); err != nil {
+				b.Fatal(err)
+			}
+		}
+		names = append(names, q.Queue)
+		queues = append(queues, q)
+	}
+	return pool, names, queues
+}
+
+func BenchmarkNonEmptyByLen(b *testing.B) {
+	_, names, queues := benchmarkQueues(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nonEmpty := []string{}
+		for j, q := range queues {
+			n, err := q.Len()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if n > 0 {
+				nonEmpty = append(nonEmpty, names[j])
+			}
+		}
+	}
+}
+
+func BenchmarkNonEmptyByIsEmpty(b *testing.B) {
+	_, names, queues := benchmarkQueues(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nonEmpty := []string{}
+		for j, q := range queues {
+			empty, err := q.IsEmpty()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if !empty {
+				nonEmpty = append(nonEmpty, names[j])
+			}
+		}
+	}
+}
+
+func BenchmarkAnyNonEmpty(b *testing.B) {
+	pool, names, _ := benchmarkQueues(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := grt.AnyNonEmpty(pool, names); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package grt
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// How long Watch waits before resubscribing after its subscription fails.
+const watchRetryInterval = time.Second
+
+// Number of events Watch buffers for a slow receiver.
+const watchBufferSize = 100
+
+// EventType is the kind of lifecycle change an Event reports.
+type EventType string
+
+const (
+	// Events are published when the corresponding Hooks are called: see
+	// OnSubmit, OnStart, OnComplete and OnFail.
+	EventSubmitted EventType = "submitted"
+	EventStarted   EventType = "started"
+	EventCompleted EventType = "completed"
+	EventFailed    EventType = "failed"
+	// EventTransferred is published on the source queue when Work.Transfer
+	// hands a job off to another queue.
+	EventTransferred EventType = "transferred"
+)
+
+// Event is a change in a job's lifecycle, published by queues created
+// WithEvents and received with Watch.
+type Event struct {
+	Type  EventType
+	Queue string
+	Key   []byte
+	At    time.Time
+	// The process that caused the event, as recorded in job histories.
+	Worker string
+	// The error an EventFailed job failed with.
+	Error string
+}
+
+// eventMessage is an Event as published, with its key as a string.
+type eventMessage struct {
+	Type   EventType `json:"type"`
+	Queue  string    `json:"queue"`
+	Key    string    `json:"key"`
+	At     time.Time `json:"at"`
+	Worker string    `json:"worker"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// WithEvents publishes an Event to the queue's events channel,
+// <queue>:events, as each job is submitted, started, completed, failed or transferred, for
+// Watch. Each event costs a PUBLISH, issued synchronously after the operation
+// it reports. Only instances created WithEvents publish, so producers and
+// consumers both need it for every event to be seen.
+func WithEvents() Option {
+	return func(c *JobQueue) { c.events = true }
+}
+
+// eventsChannel is published to by queues created WithEvents.
+func eventsChannel(queue string) string {
+	return queue + ":events"
+}
+
+// publishEvent publishes an event for the job with key, if the queue was
+// created WithEvents. Failures are logged, not returned, as the operation
+// reported has already succeeded.
+func (c *JobQueue) publishEvent(eventType EventType, key []byte, cause error) {
+	// A MemoryJobQueue's configuration has no pool.
+	if !c.events || c.pool == nil {
+		return
+	}
+	message := eventMessage{Type: eventType, Queue: c.Queue, Key: string(key), At: c.clock.now(), Worker: workerID}
+	if cause != nil {
+		message.Error = cause.Error()
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		c.log().Warn("Failed to encode event", "queue", c.Queue, "key", string(key), "error", err)
+		return
+	}
+	r := getConn(c.pool, "JobQueue.publishEvent")
+	defer r.Close()
+	if _, err := r.Do("PUBLISH", eventsChannel(c.Queue), data); err != nil {
+		c.log().Warn("Failed to publish event", "queue", c.Queue, "key", string(key), "type", string(eventType), "error", err)
+	}
+}
+
+// Watch receives the queue's events, published by instances created
+// WithEvents, until ctx is done, when the channel is closed. Events are
+// delivered with Redis Pub/Sub, so are not persisted: those published while
+// nothing is watching, or while Watch resubscribes after losing its
+// connection, are missed. Events are buffered, but a receiver that falls
+// behind holds up delivery and may eventually be disconnected by Redis.
+//
+// Watch needs a connection of its own, so on a pool created with
+// NewSingleConnPool the channel is closed immediately.
+func (c *JobQueue) Watch(ctx context.Context) <-chan Event {
+	events := make(chan Event, watchBufferSize)
+	if isSingleConn(c.pool) {
+		c.log().Error("Cannot watch events on a single connection pool", "queue", c.Queue)
+		close(events)
+		return events
+	}
+	go func() {
+		defer close(events)
+		for ctx.Err() == nil {
+			if err := c.watch(ctx, events); err != nil {
+				c.log().Warn("Lost event subscription, resubscribing", "queue", c.Queue, "error", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(watchRetryInterval):
+				}
+			}
+		}
+	}()
+	return events
+}
+
+// watch subscribes to the queue's events, sending them to events until ctx
+// is done or the subscription fails.
+func (c *JobQueue) watch(ctx context.Context, events chan<- Event) error {
+	conn := redis.PubSubConn{Conn: getConn(c.pool, "JobQueue.Watch")}
+	defer conn.Close()
+	if err := conn.Subscribe(eventsChannel(c.Queue)); err != nil {
+		return err
+	}
+	received := make(chan error, 1)
+	go func() { received <- c.receiveEvents(ctx, conn, events) }()
+	select {
+	case err := <-received:
+		return err
+	case <-ctx.Done():
+		conn.Unsubscribe()
+		<-received
+		return nil
+	}
+}
+
+func (c *JobQueue) receiveEvents(ctx context.Context, conn redis.PubSubConn, events chan<- Event) error {
+	for {
+		switch v := conn.Receive().(type) {
+		case redis.Message:
+			message := eventMessage{}
+			if err := json.Unmarshal(v.Data, &message); err != nil {
+				c.log().Warn("Ignored invalid event", "queue", c.Queue, "error", err)
+				continue
+			}
+			event := Event{Type: message.Type, Queue: message.Queue, Key: []byte(message.Key), At: message.At,
+				Worker: message.Worker, Error: message.Error}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return nil
+			}
+		case redis.Subscription:
+			if v.Count == 0 {
+				return nil
+			}
+		case error:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return v
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package grt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WithUnavailableFallback calls fn with the job instead of failing Submit when
+// Redis is unreachable, eg. to execute low-risk jobs inline. Only
+// connection errors trigger the fallback; duplicates and other errors are
+// returned as usual.
+//
+// A circuit breaker opens after consecutive connection failures (see
+// WithFallbackBreaker), sending Submits straight to fn without a doomed
+// round trip. While open, Redis is probed in the background every cool-down
+// period and the breaker closes once a probe succeeds.
+func WithUnavailableFallback(fn func(ctx context.Context, job interface{}) error) Option {
+	return func(c *JobQueue) { c.breaker().fn = fn }
+}
+
+// WithFallbackBreaker configures the circuit breaker used by
+// WithUnavailableFallback. It opens after failures consecutive connection
+// errors and probes Redis every coolDown while open. The default is 3 failures
+// and 5 seconds.
+func WithFallbackBreaker(failures int, coolDown time.Duration) Option {
+	return func(c *JobQueue) {
+		b := c.breaker()
+		b.threshold = failures
+		b.coolDown = coolDown
+	}
+}
+
+// FallbackStats returns whether the unavailable fallback's circuit breaker is
+// open, and how many Submits have been sent to the fallback.
+func (c *JobQueue) FallbackStats() (open bool, fallbacks uint64) {
+	if c.fallback == nil {
+		return false, 0
+	}
+	c.fallback.lock.Lock()
+	defer c.fallback.lock.Unlock()
+	return c.fallback.open, atomic.LoadUint64(&c.fallback.fallbacks)
+}
+
+type fallback struct {
+	fn        func(ctx context.Context, job interface{}) error
+	threshold int
+	coolDown  time.Duration
+	fallbacks uint64
+	lock      sync.Mutex
+	failures  int
+	open      bool
+}
+
+func (c *JobQueue) breaker() *fallback {
+	if c.fallback == nil {
+		c.fallback = &fallback{threshold: 3, coolDown: 5 * time.Second}
+	}
+	return c.fallback
+}
+
+// submitWithFallback submits job, sending it to the fallback if Redis is
+// unreachable.
+func (c *JobQueue) submitWithFallback(ctx context.Context, job interface{}) error {
+	f := c.fallback
+	f.lock.Lock()
+	open := f.open
+	f.lock.Unlock()
+	if open {
+		return f.call(ctx, job)
+	}
+	err := c.submit(ctx, job, 0, PriorityNormal, c.jobTTL)
+	if !isConnectionError(err) {
+		f.lock.Lock()
+		f.failures = 0
+		f.lock.Unlock()
+		return err
+	}
+	f.lock.Lock()
+	f.failures++
+	if !f.open && f.failures >= f.threshold {
+		f.open = true
+		c.log().Warn("Redis unreachable, sending submissions to fallback", "queue", c.Queue, "attempts", f.failures, "error", err)
+		c.schedule(f.coolDown, c.probe)
+	}
+	f.lock.Unlock()
+	return f.call(ctx, job)
+}
+
+func (f *fallback) call(ctx context.Context, job interface{}) error {
+	atomic.AddUint64(&f.fallbacks, 1)
+	return f.fn(ctx, job)
+}
+
+// probe pings Redis, closing the breaker and returning false if it responds.
+// It is scheduled every cool-down period while the breaker is open.
+func (c *JobQueue) probe() bool {
+	f := c.fallback
+	r := getConn(c.pool, "JobQueue.probe")
+	_, err := r.Do("PING")
+	r.Close()
+	if err != nil {
+		return true
+	}
+	f.lock.Lock()
+	f.open = false
+	f.failures = 0
+	f.lock.Unlock()
+	c.log().Info("Redis reachable again, resuming submissions", "queue", c.Queue)
+	return false
+}
+
+// isConnectionError returns true if err indicates Redis could not be reached,
+// as opposed to Redis rejecting the command.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,127 @@
+package grt_test
+
+import (
+	"context"
+	"github.com/alecthomas/grt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// inline records jobs executed by an unavailable fallback.
+type inline struct {
+	lock sync.Mutex
+	jobs []interface{}
+}
+
+func (i *inline) run(ctx context.Context, job interface{}) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.jobs = append(i.jobs, job)
+	return nil
+}
+
+func (i *inline) ran() int {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return len(i.jobs)
+}
+
+// restartablePool returns an in-process Redis with a pool that keeps dialling
+// its address while it is closed.
+func restartablePool(t *testing.T) (*miniredis.Miniredis, *redis.Pool) {
+	s := miniredis.RunT(t)
+	addr := s.Addr()
+	pool := &redis.Pool{
+		MaxIdle: 10,
+		Dial:    func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
+	}
+	t.Cleanup(func() { pool.Close() })
+	return s, pool
+}
+
+func TestUnavailableFallback(t *testing.T) {
+	s, pool := restartablePool(t)
+	var submits int32
+	defer grt.ObserveCommands(func(op string, n int) {
+		if op == "JobQueue.Submit" {
+			atomic.AddInt32(&submits, 1)
+		}
+	})()
+	fallback := &inline{}
+	q := grt.NewJobQueue(pool, "fallback", grt.WithUnavailableFallback(fallback.run), grt.WithFallbackBreaker(2, 50*time.Millisecond))
+	defer q.Close()
+
+	// Only connection errors fall back.
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Submit("a"); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	if open, n := q.FallbackStats(); open || n != 0 || fallback.ran() != 0 {
+		t.Fatal(open, n, fallback.ran())
+	}
+
+	s.Close()
+	for i := 0; i < 2; i++ {
+		if err := q.Submit("b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if open, n := q.FallbackStats(); !open || n != 2 || fallback.ran() != 2 {
+		t.Fatal(open, n, fallback.ran())
+	}
+	// Once open, Submit goes straight to the fallback without trying Redis.
+	tried := atomic.LoadInt32(&submits)
+	if err := q.Submit("c"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&submits); n != tried || fallback.ran() != 3 {
+		t.Fatal(n, tried, fallback.ran())
+	}
+
+	if err := s.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for open, _ := q.FallbackStats(); open; open, _ = q.FallbackStats() {
+		if time.Now().After(deadline) {
+			t.Fatal("breaker did not close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := q.Submit("d"); err != nil {
+		t.Fatal(err)
+	}
+	if fallback.ran() != 3 {
+		t.Fatal(fallback.ran())
+	}
+	if ok, err := q.IsQueued("d"); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+}
+
+func TestUnavailableFallbackBelowThreshold(t *testing.T) {
+	s, pool := restartablePool(t)
+	fallback := &inline{}
+	q := grt.NewJobQueue(pool, "fallback", grt.WithUnavailableFallback(fallback.run), grt.WithFallbackBreaker(3, time.Hour))
+	defer q.Close()
+	s.Close()
+	// Each failure still falls back, but the breaker stays closed until the
+	// threshold is reached.
+	for i := 0; i < 2; i++ {
+		if err := q.Submit("a"); err != nil {
+			t.Fatal(err)
+		}
+		if open, _ := q.FallbackStats(); open {
+			t.Fatal("opened after", i+1)
+		}
+	}
+	if fallback.ran() != 2 {
+		t.Fatal(fallback.ran())
+	}
+}
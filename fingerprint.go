@@ -0,0 +1,149 @@
+package grt
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// OptionMismatch is a setting whose value differs between this JobQueue and
+// the fingerprint stored for the queue.
+type OptionMismatch struct {
+	Setting string
+	Stored  string
+	Local   string
+}
+
+// OptionsMismatchError is returned by the first operation on a JobQueue whose
+// options are incompatible with those of another instance already using the
+// same queue.
+type OptionsMismatchError struct {
+	Queue      string
+	Mismatches []OptionMismatch
+}
+
+func (o *OptionsMismatchError) Error() string {
+	settings := []string{}
+	for _, mismatch := range o.Mismatches {
+		settings = append(settings, fmt.Sprintf("%s is %q but queue uses %q", mismatch.Setting, mismatch.Local, mismatch.Stored))
+	}
+	return fmt.Sprintf("queue %s options are incompatible: %s (use ForceAdoptOptions to migrate intentionally)", o.Queue, strings.Join(settings, ", "))
+}
+
+// optionsCheck records whether a queue's fingerprint has been verified. It is
+// shared between copies of a JobQueue.
+type optionsCheck struct {
+	lock     sync.Mutex
+	verified bool
+}
+
+// fingerprint returns the settings that must match between every instance of
+// a queue for them to interoperate.
+func (c *JobQueue) fingerprint() map[string]string {
+	store := "off"
+	if c.payloadStore != nil {
+		store = "on"
+	}
+	priorities := "off"
+	if c.priorities {
+		priorities = "on"
+	}
+	keys := "payload"
+	if c.hashedKeys {
+		keys = "hashed"
+	}
+	return map[string]string{
+		"schema_version": strconv.Itoa(schemaVersion),
+		"codec":          codecName(c.codec),
+		"payload_store":  store,
+		"dedupe_scope":   DedupeScope{c.dedupeNamespace}.String(),
+		"priorities":     priorities,
+		"keys":           keys,
+	}
+}
+
+// checkOptions verifies the queue's fingerprint against the one stored in
+// Redis, storing it if there is none. Only the first successful check
+// contacts Redis.
+func (c *JobQueue) checkOptions() error {
+	if c.isClosed() {
+		return ErrQueueClosed
+	}
+	c.options.lock.Lock()
+	defer c.options.lock.Unlock()
+	if c.options.verified {
+		return nil
+	}
+	r := getConn(c.pool, "JobQueue.checkOptions")
+	defer r.Close()
+	local := c.fingerprint()
+	args := []interface{}{c.Queue + ":options", renamedKey(c.Queue)}
+	for setting, value := range local {
+		args = append(args, setting, value)
+	}
+	reply, err := checkOptionsScript.do(r, args...)
+	if errors.Is(err, ErrQueueRenamed) {
+		return queueRenamedError(r, c.Queue)
+	} else if err != nil {
+		return err
+	}
+	stored, err := redis.StringMap(reply[0], nil)
+	if err != nil {
+		return err
+	}
+	mismatches := []OptionMismatch{}
+	for setting, value := range local {
+		if stored[setting] != value {
+			mismatches = append(mismatches, OptionMismatch{Setting: setting, Stored: stored[setting], Local: value})
+		}
+	}
+	if len(mismatches) > 0 {
+		sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].Setting < mismatches[j].Setting })
+		return &OptionsMismatchError{Queue: c.Queue, Mismatches: mismatches}
+	}
+	c.options.verified = true
+	return nil
+}
+
+// KEYS: options hash, forwarding marker. ARGV: setting, value pairs.
+//
+// Settings not yet in the hash are added, so settings introduced by newer
+// versions are adopted by the first instance that knows about them.
+var checkOptionsScript = newLuaScript("check_options", 1, 2, `
+if redis.call("EXISTS", KEYS[2]) == 1 then
+  return {2} -- statusRenamed
+end
+for i = 1, #ARGV - 1, 2 do
+  redis.call("HSETNX", KEYS[1], ARGV[i], ARGV[i + 1])
+end
+return {0, redis.call("HGETALL", KEYS[1])}
+`)
+
+// ForceAdoptOptions overwrites the queue's stored options fingerprint with
+// this JobQueue's, so that instances with the previous options fail fast.
+//
+// This is an escape hatch for intentional migrations, and should only be used
+// once every instance with the previous options has been stopped and the
+// queue drained.
+func (c *JobQueue) ForceAdoptOptions() error {
+	c.options.lock.Lock()
+	defer c.options.lock.Unlock()
+	r := getConn(c.pool, "JobQueue.ForceAdoptOptions")
+	defer r.Close()
+	args := []interface{}{c.Queue + ":options"}
+	for setting, value := range c.fingerprint() {
+		args = append(args, setting, value)
+	}
+	r.Send("MULTI")
+	r.Send("DEL", c.Queue+":options")
+	r.Send("HSET", args...)
+	if _, err := r.Do("EXEC"); err != nil {
+		return err
+	}
+	c.options.verified = true
+	return nil
+}
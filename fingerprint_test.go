@@ -0,0 +1,91 @@
+package grt_test
+
+import (
+	"errors"
+	"github.com/alecthomas/grt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOptionsMismatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []grt.Option
+		mismatch []grt.OptionMismatch
+	}{
+		{"HashedKeys", []grt.Option{grt.WithHashedKeys()}, []grt.OptionMismatch{{Setting: "keys", Stored: "payload", Local: "hashed"}}},
+		{"Codec", []grt.Option{grt.WithCodec(grt.GobCodec{})}, []grt.OptionMismatch{{Setting: "codec", Stored: "json", Local: "gob"}}},
+		{"Several", []grt.Option{grt.WithPriorities(), grt.WithPayloadStore(grt.NewMemoryPayloadStore(), 10)}, []grt.OptionMismatch{
+			{Setting: "payload_store", Stored: "off", Local: "on"},
+			{Setting: "priorities", Stored: "off", Local: "on"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, pool := newPool(t)
+			if err := grt.NewJobQueue(pool, "fingerprint").Submit("a"); err != nil {
+				t.Fatal(err)
+			}
+			q := grt.NewJobQueue(pool, "fingerprint", test.options...)
+			err := q.Submit("b")
+			var mismatch *grt.OptionsMismatchError
+			if !errors.As(err, &mismatch) {
+				t.Fatal(err)
+			}
+			if mismatch.Queue != "fingerprint" || !reflect.DeepEqual(mismatch.Mismatches, test.mismatch) {
+				t.Fatalf("%+v", mismatch)
+			}
+			if !strings.Contains(err.Error(), test.mismatch[0].Setting) || !strings.Contains(err.Error(), "ForceAdoptOptions") {
+				t.Fatal(err)
+			}
+			// Every operation fails fast, not only the first.
+			if _, err := q.TryGet(nil); !errors.As(err, &mismatch) {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestOptionsMatch(t *testing.T) {
+	_, pool := newPool(t)
+	options := []grt.Option{grt.WithPriorities(), grt.WithCodec(grt.GobCodec{})}
+	producer := grt.NewJobQueue(pool, "fingerprint", options...)
+	// Settings that do not affect the stored layout may differ.
+	consumer := grt.NewJobQueue(pool, "fingerprint", append(options, grt.WithConsistentReads())...)
+	if err := producer.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	var job string
+	w, err := consumer.Get(&job)
+	if err != nil || job != "a" {
+		t.Fatal(job, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForceAdoptOptions(t *testing.T) {
+	s, pool := newPool(t)
+	old := grt.NewJobQueue(pool, "fingerprint")
+	if err := old.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	migrated := grt.NewJobQueue(pool, "fingerprint", grt.WithHashedKeys())
+	if err := migrated.ForceAdoptOptions(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := s.HGet("fingerprint:options", "keys"); keys != "hashed" {
+		t.Fatal(keys)
+	}
+	if err := migrated.Submit("b"); err != nil {
+		t.Fatal(err)
+	}
+	// Instances with the previous options, other than those that already
+	// verified them, now fail fast.
+	var mismatch *grt.OptionsMismatchError
+	if err := grt.NewJobQueue(pool, "fingerprint").Submit("c"); !errors.As(err, &mismatch) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,419 @@
+// Package goredis runs grt over a go-redis client, so that its Cluster,
+// Sentinel and TLS support can be used:
+//
+//	client := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: addrs})
+//	jobs := grt.NewJobQueue(goredis.NewPool(client), "jobs")
+//
+// Every grt type that takes a pool accepts one created by NewPool. Commands
+// are issued through the client, which manages connections itself; the pool
+// only adapts its interface, so size the client's pool instead (eg. with
+// MinIdleConns rather than JobQueue.Warmup). Queues on a Redis Cluster must be
+// created WithClusterKeys.
+package goredis
+
+import (
+	"context"
+	"errors"
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewPool wraps client in a pool for use with grt. The client is not closed
+// by the pool.
+func NewPool(client redis.UniversalClient) *redigo.Pool {
+	return &redigo.Pool{
+		// Connections hold no resources between uses, other than
+		// subscriptions which must not outlive them.
+		MaxIdle: 0,
+		Dial:    func() (redigo.Conn, error) { return &conn{client: client}, nil },
+	}
+}
+
+// conn implements redigo.Conn over a go-redis client.
+//
+// Sent commands are issued as a pipeline when flushed, and their replies held
+// until received. Commands between MULTI and EXEC are queued locally and
+// issued as a go-redis transaction at EXEC. Subscriptions use a go-redis
+// PubSub, whose messages are received once any other replies have been.
+type conn struct {
+	client redis.UniversalClient
+	lock   sync.Mutex
+	// Commands sent but not yet flushed.
+	pending [][]interface{}
+	// Replies flushed but not yet received.
+	replies []interface{}
+	// Commands queued since MULTI.
+	tx     [][]interface{}
+	inTx   bool
+	pubsub *redis.PubSub
+	// Set when the connection fails.
+	err error
+}
+
+func (c *conn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pending, c.replies, c.tx, c.inTx = nil, nil, nil, false
+	if c.pubsub != nil {
+		pubsub := c.pubsub
+		c.pubsub = nil
+		return pubsub.Close()
+	}
+	return nil
+}
+
+func (c *conn) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+func (c *conn) Send(commandName string, args ...interface{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.pending = append(c.pending, command(commandName, args))
+	return nil
+}
+
+func (c *conn) Flush() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.flush()
+}
+
+// Do sends a command, if commandName is not empty, flushes and returns the
+// replies to every command not yet received, as redigo does: all of them if
+// commandName is empty, or else the last, with the first error among them.
+func (c *conn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	if commandName != "" {
+		c.pending = append(c.pending, command(commandName, args))
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+	replies := c.replies
+	c.replies = nil
+	if commandName == "" {
+		if len(replies) == 0 {
+			return nil, nil
+		}
+		return replies, nil
+	}
+	if len(replies) == 0 {
+		return nil, nil
+	}
+	var err error
+	for _, reply := range replies {
+		if e, ok := reply.(redigo.Error); ok && err == nil {
+			err = e
+		}
+	}
+	return replies[len(replies)-1], err
+}
+
+// Receive returns the next reply, or once there are none, waits for the next
+// message on the connection's subscriptions.
+func (c *conn) Receive() (interface{}, error) {
+	c.lock.Lock()
+	if len(c.replies) > 0 {
+		reply := c.replies[0]
+		c.replies = c.replies[1:]
+		c.lock.Unlock()
+		if err, ok := reply.(redigo.Error); ok {
+			return nil, err
+		}
+		return reply, nil
+	}
+	pubsub, err := c.pubsub, c.err
+	c.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if pubsub == nil {
+		return nil, errors.New("goredis: no replies to receive")
+	}
+	msg, err := pubsub.Receive(context.Background())
+	if err != nil {
+		var rerr redis.Error
+		if errors.As(err, &rerr) {
+			return nil, redigo.Error(err.Error())
+		}
+		return nil, err
+	}
+	switch msg := msg.(type) {
+	case *redis.Subscription:
+		return []interface{}{[]byte(msg.Kind), []byte(msg.Channel), int64(msg.Count)}, nil
+	case *redis.Message:
+		if msg.Pattern != "" {
+			return []interface{}{[]byte("pmessage"), []byte(msg.Pattern), []byte(msg.Channel), []byte(msg.Payload)}, nil
+		}
+		return []interface{}{[]byte("message"), []byte(msg.Channel), []byte(msg.Payload)}, nil
+	case *redis.Pong:
+		return []interface{}{[]byte("pong"), []byte(msg.Payload)}, nil
+	}
+	return nil, errors.New("goredis: unknown pubsub notification")
+}
+
+// flush issues the pending commands, queueing their replies. Runs of
+// ordinary commands are pipelined.
+func (c *conn) flush() error {
+	pending := c.pending
+	c.pending = nil
+	batch := [][]interface{}{}
+	for _, cmd := range pending {
+		name := cmd[0].(string)
+		if c.inTx {
+			switch name {
+			case "EXEC":
+				if err := c.run(batch); err != nil {
+					return err
+				}
+				batch = batch[:0]
+				if err := c.exec(); err != nil {
+					return err
+				}
+			case "DISCARD":
+				c.tx, c.inTx = nil, false
+				c.replies = append(c.replies, []byte("OK"))
+			default:
+				c.tx = append(c.tx, cmd)
+				c.replies = append(c.replies, []byte("QUEUED"))
+			}
+			continue
+		}
+		switch name {
+		case "MULTI":
+			if err := c.run(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+			c.inTx = true
+			c.replies = append(c.replies, []byte("OK"))
+		case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+			if err := c.run(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+			if err := c.subscribe(name, cmd[1:]); err != nil {
+				return c.fatal(err)
+			}
+		case "BRPOPLPUSH":
+			if err := c.run(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+			if err := c.blockingPop(cmd); err != nil {
+				return err
+			}
+		default:
+			batch = append(batch, cmd)
+		}
+	}
+	return c.run(batch)
+}
+
+// run issues cmds as a pipeline.
+func (c *conn) run(cmds [][]interface{}) error {
+	ctx := context.Background()
+	if len(cmds) == 1 {
+		return c.reply(c.client.Do(ctx, cmds[0]...))
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	pipe := c.client.Pipeline()
+	results := make([]*redis.Cmd, len(cmds))
+	for i, cmd := range cmds {
+		results[i] = pipe.Do(ctx, cmd...)
+	}
+	// Errors are reported by each command.
+	_, _ = pipe.Exec(ctx)
+	for _, result := range results {
+		if err := c.reply(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exec issues the commands queued since MULTI as a transaction, queueing
+// their replies as a single reply.
+func (c *conn) exec() error {
+	ctx := context.Background()
+	tx := c.tx
+	c.tx, c.inTx = nil, false
+	pipe := c.client.TxPipeline()
+	results := make([]*redis.Cmd, len(tx))
+	for i, cmd := range tx {
+		results[i] = pipe.Do(ctx, cmd...)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil && !isReplyError(err) {
+		return c.fatal(err)
+	}
+	replies := make([]interface{}, len(results))
+	for i, result := range results {
+		reply, err := convertResult(result.Result())
+		if err != nil {
+			return c.fatal(err)
+		}
+		replies[i] = reply
+	}
+	c.replies = append(c.replies, replies)
+	return nil
+}
+
+// blockingPop issues BRPOPLPUSH with a read timeout covering its wait, which
+// only go-redis's typed command sets.
+func (c *conn) blockingPop(cmd []interface{}) error {
+	if len(cmd) != 4 {
+		return c.reply(c.client.Do(context.Background(), cmd...))
+	}
+	seconds, err := strconv.ParseFloat(argString(cmd[3]), 64)
+	if err != nil {
+		return c.reply(c.client.Do(context.Background(), cmd...))
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	reply, err := c.client.BRPopLPush(context.Background(), argString(cmd[1]), argString(cmd[2]), timeout).Result()
+	converted, err := convertResult(reply, err)
+	if err != nil {
+		return c.fatal(err)
+	}
+	c.replies = append(c.replies, converted)
+	return nil
+}
+
+func (c *conn) subscribe(name string, channels []interface{}) error {
+	ctx := context.Background()
+	names := make([]string, len(channels))
+	for i, channel := range channels {
+		names[i] = argString(channel)
+	}
+	if c.pubsub == nil {
+		if name == "UNSUBSCRIBE" || name == "PUNSUBSCRIBE" {
+			return nil
+		}
+		c.pubsub = c.client.Subscribe(ctx)
+	}
+	switch name {
+	case "SUBSCRIBE":
+		return c.pubsub.Subscribe(ctx, names...)
+	case "PSUBSCRIBE":
+		return c.pubsub.PSubscribe(ctx, names...)
+	case "UNSUBSCRIBE":
+		return c.pubsub.Unsubscribe(ctx, names...)
+	default:
+		return c.pubsub.PUnsubscribe(ctx, names...)
+	}
+}
+
+// reply queues the reply to cmd, or fails the connection if it could not be
+// issued.
+func (c *conn) reply(cmd *redis.Cmd) error {
+	reply, err := convertResult(cmd.Result())
+	if err != nil {
+		return c.fatal(err)
+	}
+	c.replies = append(c.replies, reply)
+	return nil
+}
+
+func (c *conn) fatal(err error) error {
+	if c.err == nil {
+		c.err = err
+	}
+	return err
+}
+
+// command is a command's name, upper-cased, followed by its arguments.
+func command(name string, args []interface{}) []interface{} {
+	cmd := make([]interface{}, 0, len(args)+1)
+	cmd = append(cmd, strings.ToUpper(name))
+	for _, arg := range args {
+		if arg, ok := arg.(redigo.Argument); ok {
+			cmd = append(cmd, arg.RedisArg())
+			continue
+		}
+		cmd = append(cmd, arg)
+	}
+	return cmd
+}
+
+func argString(arg interface{}) string {
+	switch arg := arg.(type) {
+	case string:
+		return arg
+	case []byte:
+		return string(arg)
+	case int:
+		return strconv.Itoa(arg)
+	case int64:
+		return strconv.FormatInt(arg, 10)
+	case float64:
+		return strconv.FormatFloat(arg, 'f', -1, 64)
+	}
+	return ""
+}
+
+func isReplyError(err error) bool {
+	var rerr redis.Error
+	return errors.As(err, &rerr)
+}
+
+// convertResult converts a go-redis result to the reply redigo would return:
+// error replies are returned as redigo.Error values, and other errors as
+// errors.
+func convertResult(reply interface{}, err error) (interface{}, error) {
+	switch {
+	case err == redis.Nil:
+		return nil, nil
+	case isReplyError(err):
+		return redigo.Error(err.Error()), nil
+	case err != nil:
+		return nil, err
+	}
+	return convert(reply), nil
+}
+
+// convert converts a go-redis reply value to the types redigo uses for RESP2:
+// strings as []byte, and maps, sets, doubles and booleans from RESP3 as
+// arrays, bulk strings and integers.
+func convert(reply interface{}) interface{} {
+	switch reply := reply.(type) {
+	case string:
+		return []byte(reply)
+	case []interface{}:
+		values := make([]interface{}, len(reply))
+		for i, value := range reply {
+			values[i] = convert(value)
+		}
+		return values
+	case map[interface{}]interface{}:
+		values := make([]interface{}, 0, len(reply)*2)
+		for key, value := range reply {
+			values = append(values, convert(key), convert(value))
+		}
+		return values
+	case float64:
+		return []byte(strconv.FormatFloat(reply, 'f', -1, 64))
+	case bool:
+		if reply {
+			return int64(1)
+		}
+		return int64(0)
+	case error:
+		return redigo.Error(reply.Error())
+	}
+	return reply
+}
@@ -0,0 +1,141 @@
+package grt_test
+
+import (
+	"context"
+	"github.com/alecthomas/grt"
+	"github.com/alecthomas/grt/goredis"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+	goredisclient "github.com/redis/go-redis/v9"
+	"testing"
+	"time"
+)
+
+// newGoRedisPool is newPool, issuing commands through a go-redis client.
+func newGoRedisPool(t testing.TB) (*miniredis.Miniredis, *redis.Pool) {
+	s := miniredis.RunT(t)
+	client := goredisclient.NewClient(&goredisclient.Options{Addr: s.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return s, goredis.NewPool(client)
+}
+
+func TestGoRedisQueue(t *testing.T) {
+	s, pool := newGoRedisPool(t)
+	q := grt.NewJobQueue(pool, "goredis")
+	// SubmitAll pipelines its commands.
+	if n, err := q.SubmitAll([]interface{}{"a", "b", "c"}); n != 3 || err != nil {
+		t.Fatal(n, err)
+	}
+	if err := q.Submit("a"); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	var job string
+	w, err := q.Get(&job)
+	if err != nil || job != "a" {
+		t.Fatal(job, err)
+	}
+	if processing, err := s.List("goredis:processing"); err != nil || len(processing) != 1 {
+		t.Fatal(processing, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	w, err = q.TryGet(&job)
+	if err != nil || w == nil || job != "b" {
+		t.Fatal(w, job, err)
+	}
+	if err := w.Resubmit(); err != nil {
+		t.Fatal(err)
+	}
+	// A worker that dies holding a job.
+	if _, err := q.Get(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := q.Len(); n != 2 || err != nil {
+		t.Fatal(n, err)
+	}
+	stats, err := q.Stats()
+	if err != nil || stats.Waiting != 2 {
+		t.Fatalf("%+v %v", stats, err)
+	}
+}
+
+func TestGoRedisScriptsReloaded(t *testing.T) {
+	_, pool := newGoRedisPool(t)
+	q := grt.NewJobQueue(pool, "goredis")
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	r := pool.Get()
+	_, err := r.Do("SCRIPT", "FLUSH")
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Scripts missing from the server are loaded again after NOSCRIPT.
+	w, err := q.TryGet(nil)
+	if err != nil || w == nil {
+		t.Fatal(w, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoRedisBlockingGet(t *testing.T) {
+	_, pool := newGoRedisPool(t)
+	q := grt.NewJobQueue(pool, "goredis")
+	start := time.Now()
+	if w, err := q.GetWait(nil, time.Second); w != nil || err != nil {
+		t.Fatal(w, err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 2*time.Second {
+		t.Fatal(elapsed)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if err := q.Submit("a"); err != nil {
+			t.Error(err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var job string
+	w, err := q.GetContext(ctx, &job)
+	if err != nil || job != "a" {
+		t.Fatal(job, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoRedisLockNotified(t *testing.T) {
+	_, pool := newGoRedisPool(t)
+	holder := grt.NewLock(pool, "goredis")
+	if err := holder.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if err := holder.Unlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	// Released through a subscription, rather than after the backoff.
+	waiter := grt.NewLock(pool, "goredis")
+	waiter.Expiry = 10 * time.Second
+	start := time.Now()
+	if err := waiter.LockWait(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal(elapsed)
+	}
+	if err := waiter.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
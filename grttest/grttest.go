@@ -0,0 +1,42 @@
+// Package grttest provides helpers for testing code that uses grt.
+package grttest
+
+import (
+	"github.com/alecthomas/grt"
+	"sync"
+	"testing"
+)
+
+// AssertMaxCommands fails the test if any invocation of op (eg.
+// "JobQueue.Submit") issues more than n Redis commands before the test
+// finishes.
+//
+// Command counts are observed process-wide, so tests using this should not
+// run in parallel with other tests exercising the same operation.
+func AssertMaxCommands(t testing.TB, op string, n int) {
+	t.Helper()
+	var (
+		lock  sync.Mutex
+		worst int
+		calls int
+	)
+	remove := grt.ObserveCommands(func(observed string, commands int) {
+		if observed != op {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		if commands > worst {
+			worst = commands
+		}
+	})
+	t.Cleanup(func() {
+		remove()
+		lock.Lock()
+		defer lock.Unlock()
+		if worst > n {
+			t.Errorf("%s issued %d Redis commands, budget is %d (over %d calls)", op, worst, n, calls)
+		}
+	})
+}
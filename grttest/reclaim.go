@@ -0,0 +1,30 @@
+package grttest
+
+import (
+	"github.com/alecthomas/grt"
+	"testing"
+	"time"
+)
+
+// AssertReclaimedWithin fails the test unless the job with key is returned to
+// the waiting list of q within d, typically after Work.AbandonForTest and
+// JobQueue.Cleanup.
+func AssertReclaimedWithin(t testing.TB, q *grt.JobQueue, key []byte, d time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(d)
+	for {
+		description, err := q.DescribeKey(key)
+		if err != nil {
+			t.Errorf("could not describe %s: %s", key, err)
+			return
+		}
+		if description.State == grt.JobWaiting {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("%s was not reclaimed within %s, state is %s", key, d, description.State)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,18 @@
+package grttest
+
+import (
+	"context"
+	"github.com/alecthomas/grt"
+)
+
+// Replay invokes handler with a captured job, as fabricated by
+// grt.NewReplayWork, and returns how the handler finalized the Work along
+// with the handler's error.
+//
+// Nothing is sent to Redis, so a capture from production can be replayed
+// locally under a debugger.
+func Replay(capture *grt.JobCapture, handler func(ctx context.Context, payload []byte, w *grt.Work) error) (grt.WorkOutcome, error) {
+	w, outcome := grt.NewReplayWork(capture)
+	err := handler(context.Background(), capture.Payload, w)
+	return outcome(), err
+}
@@ -0,0 +1,142 @@
+package grt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+)
+
+// WithHashedKeys keys JSON-encoded jobs by the hex SHA-256 of their canonical
+// encoding, rather than by the encoding itself, so that large jobs are not
+// stored twice over in every structure holding their key. Jobs implementing
+// JobQueueKeyer keep their own keys, and other codecs always hash. Every
+// instance of the queue must agree.
+//
+// Jobs queued before switching keep their old keys, and are processed as
+// normal, but are not deduplicated against new submissions until rewritten
+// with MigrateHashedKeys.
+func WithHashedKeys() Option {
+	return func(c *JobQueue) { c.hashedKeys = true }
+}
+
+// MigrateHashedKeys rewrites the keys of jobs queued, in progress, delayed or
+// dead under their canonical JSON encoding to the hashed form used by queues
+// created WithHashedKeys, returning the number of jobs rewritten. Stop the
+// queue's other instances before calling it.
+//
+// Jobs implementing JobQueueKeyer are left alone, unless their keys happen
+// to be canonical JSON themselves. Jobs whose hashed key is already present
+// are skipped.
+//
+// The rewrite runs as a single script, so it blocks Redis for a time
+// proportional to the number of jobs in the queue.
+func (c *JobQueue) MigrateHashedKeys(ctx context.Context) (int, error) {
+	if !c.hashedKeys {
+		return 0, errors.New("MigrateHashedKeys requires a queue created WithHashedKeys")
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if codecName(c.codec) != "json" {
+		return 0, nil
+	}
+	r := getConn(c.pool, "JobQueue.MigrateHashedKeys")
+	defer r.Close()
+	r.Send("HKEYS", c.Queue+":payload")
+	r.Send("HKEYS", deadKey(c.Queue))
+	r.Flush()
+	args := []interface{}{c.Queue, c.priorityList(PriorityHigh), c.priorityList(PriorityLow), c.Queue + ":processing",
+		c.Queue + ":payload", c.Queue + ":enqueued", c.Queue + ":producer", c.Queue + ":attempts", deadKey(c.Queue),
+		c.Queue + ":deadlines", c.Queue + ":delayed", c.dedupeKey(), c.Queue + ":options", expiryKey(c.Queue), c.Queue}
+	for i := 0; i < 2; i++ {
+		keys, err := redis.ByteSlices(r.Receive())
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			if canonical, err := canonicalJSON(key); err == nil && bytes.Equal(canonical, key) {
+				args = append(args, key, hashedKey(key))
+			}
+		}
+	}
+	reply, err := migrateHashedKeysScript.do(r, args...)
+	if err != nil {
+		return 0, err
+	}
+	migrated, err := redis.Int(reply[0], nil)
+	if migrated > 0 {
+		c.log().Info("Migrated job keys", "queue", c.Queue, "migrated", migrated)
+	}
+	return migrated, err
+}
+
+// hashedKey returns the key of a job with the canonical JSON encoding data.
+func hashedKey(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+// KEYS: waiting lists (normal, high, low), processing list, payload hash,
+// enqueued-at hash, producer hash, attempts hash, dead letter hash, deadlines
+// sorted set, delayed sorted set, dedupe hash, options hash, expiry sorted
+// set. ARGV: queue, then old and new key pairs.
+//
+// Per-job keys are derived from the queue name inside the script. Returns the
+// number of jobs rewritten.
+var migrateHashedKeysScript = newLuaScript("migrate_hashed_keys", 1, 14, `
+local keys = {}
+local migrated = 0
+for i = 2, #ARGV - 2, 2 do
+  local old, new = ARGV[i], ARGV[i + 1]
+  if redis.call("HEXISTS", KEYS[5], new) == 0 and redis.call("HEXISTS", KEYS[9], new) == 0 then
+    keys[old] = new
+    migrated = migrated + 1
+  end
+end
+for i = 1, 4 do
+  local items = redis.call("LRANGE", KEYS[i], 0, -1)
+  local changed = false
+  for j, item in ipairs(items) do
+    if keys[item] then
+      items[j] = keys[item]
+      changed = true
+    end
+  end
+  if changed then
+    redis.call("DEL", KEYS[i])
+    for j = 1, #items, 1000 do
+      redis.call("RPUSH", KEYS[i], unpack(items, j, math.min(j + 999, #items)))
+    end
+  end
+end
+local hashes = {5, 6, 7, 8, 9}
+if KEYS[12] ~= KEYS[5] then
+  table.insert(hashes, 12)
+end
+for old, new in pairs(keys) do
+  for _, i in ipairs(hashes) do
+    local value = redis.call("HGET", KEYS[i], old)
+    if value then
+      redis.call("HDEL", KEYS[i], old)
+      redis.call("HSET", KEYS[i], new, value)
+    end
+  end
+  for _, i in ipairs({10, 11, 14}) do
+    local score = redis.call("ZSCORE", KEYS[i], old)
+    if score then
+      redis.call("ZREM", KEYS[i], old)
+      redis.call("ZADD", KEYS[i], score, new)
+    end
+  end
+  for _, kind in ipairs({":cancel:", ":chunks:", ":history:", ":done:", ":results:", ":next:"}) do
+    if redis.call("EXISTS", ARGV[1] .. kind .. old) == 1 then
+      redis.call("RENAME", ARGV[1] .. kind .. old, ARGV[1] .. kind .. new)
+    end
+  end
+end
+redis.call("HSET", KEYS[13], "keys", "hashed")
+return {0, migrated}
+`)
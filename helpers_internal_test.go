@@ -0,0 +1,18 @@
+package grt
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+	"testing"
+)
+
+// newTestPool is newPool for tests of unexported behaviour.
+func newTestPool(t testing.TB) (*miniredis.Miniredis, *redis.Pool) {
+	s := miniredis.RunT(t)
+	pool := &redis.Pool{
+		MaxIdle: 10,
+		Dial:    func() (redis.Conn, error) { return redis.Dial("tcp", s.Addr()) },
+	}
+	t.Cleanup(func() { pool.Close() })
+	return s, pool
+}
@@ -0,0 +1,19 @@
+package grt_test
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+	"testing"
+)
+
+// newPool starts an in-process Redis and returns it with a pool connected to
+// it.
+func newPool(t testing.TB) (*miniredis.Miniredis, *redis.Pool) {
+	s := miniredis.RunT(t)
+	pool := &redis.Pool{
+		MaxIdle: 10,
+		Dial:    func() (redis.Conn, error) { return redis.Dial("tcp", s.Addr()) },
+	}
+	t.Cleanup(func() { pool.Close() })
+	return s, pool
+}
@@ -0,0 +1,111 @@
+package grt
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Number of resubmissions retained in a job's history.
+	resubmitHistoryLen = 10
+	// Maximum length of an error message in a job's history.
+	resubmitErrorLimit = 1024
+)
+
+// workerID identifies this process in job histories.
+var workerID = func() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}()
+
+// ResubmitRecord is an entry in a job's resubmission history.
+type ResubmitRecord struct {
+	At     time.Time `json:"at"`
+	Worker string    `json:"worker"`
+	Error  string    `json:"error"`
+}
+
+// ResubmitWithError resubmits the job like Resubmit, additionally recording
+// err in the job's resubmission history. The history retains the most recent
+// resubmissions, with long error messages truncated, and is available from
+// DescribeJob and Capture. Concurrency safe.
+func (w *Work) ResubmitWithError(err error) error {
+	w.checkFinalize()
+	return w.failed(err, w.markFinalized(WorkResubmitted, w.resubmitWithError(err)))
+}
+
+func (w *Work) resubmitWithError(cause error) error {
+	if w.replay != nil {
+		return w.replay.finalize(WorkResubmitted)
+	}
+	message := cause.Error()
+	if len(message) > resubmitErrorLimit {
+		message = strings.ToValidUTF8(message[:resubmitErrorLimit], "")
+	}
+	if w.exhausted() {
+		return w.deadLetter(message, w.exhaustedError(cause))
+	}
+	if delay := w.retryDelay(); delay > 0 {
+		return w.retry(delay, message, w.verifyChecksum())
+	}
+	r := getConn(w.pool, "Work.ResubmitWithError")
+	defer r.Close()
+	_, err := resubmitScript.do(r, w.Queue+":processing", w.queue.priorityList(w.priority), historyKey(w.Queue, w.key), w.Queue+":payload",
+		w.Queue+":deadlines", w.Queue+":stats", w.key, workerID, message, resubmitHistoryLen, w.verifyChecksum())
+	return err
+}
+
+// KEYS: processing list, waiting list, history list, payload hash, deadlines
+// sorted set, stats hash. ARGV: key, worker, error, history length, payload
+// checksum to verify or "".
+var resubmitScript = newLuaScript("resubmit", 1, 6, `
+redis.replicate_commands()
+if ARGV[5] ~= "" then
+  local record = redis.call("HGET", KEYS[4], ARGV[1])
+  if not record or redis.sha1hex(record) ~= ARGV[5] then
+    return {4} -- statusPayloadChanged
+  end
+end
+redis.call("LREM", KEYS[1], 0, ARGV[1])
+redis.call("ZREM", KEYS[5], ARGV[1])
+redis.call("LPUSH", KEYS[2], ARGV[1])
+redis.call("HINCRBY", KEYS[6], "failed", 1)
+local now = redis.call("TIME")
+local at = now[1] * 1000 + math.floor(now[2] / 1000)
+redis.call("RPUSH", KEYS[3], cjson.encode({at = at, worker = ARGV[2], error = ARGV[3]}))
+redis.call("LTRIM", KEYS[3], -tonumber(ARGV[4]), -1)
+return {0}
+`)
+
+// decodeHistory decodes the entries of a history list, oldest first.
+func decodeHistory(reply interface{}) ([]ResubmitRecord, error) {
+	entries, err := redis.ByteSlices(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	history := []ResubmitRecord{}
+	for _, entry := range entries {
+		var record struct {
+			At     int64  `json:"at"`
+			Worker string `json:"worker"`
+			Error  string `json:"error"`
+		}
+		if err := json.Unmarshal(entry, &record); err != nil {
+			return nil, fmt.Errorf("invalid history entry %q: %w", entry, err)
+		}
+		history = append(history, ResubmitRecord{
+			At:     time.Unix(0, record.At*int64(time.Millisecond)),
+			Worker: record.Worker,
+			Error:  record.Error,
+		})
+	}
+	return history, nil
+}
+
+func historyKey(queue string, key []byte) string {
+	return queue + ":history:" + string(key)
+}
@@ -0,0 +1,145 @@
+package grt_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alecthomas/grt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fail retrieves the next job from q and resubmits it with err.
+func fail(t *testing.T, q *grt.JobQueue, err error) {
+	t.Helper()
+	w, getErr := q.Get(nil)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if err := w.ResubmitWithError(err); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func historyErrors(t *testing.T, q *grt.JobQueue, job interface{}) []string {
+	t.Helper()
+	errs := []string{}
+	for _, record := range describe(t, q, job).History {
+		if record.At.IsZero() || record.Worker == "" {
+			t.Fatalf("%+v", record)
+		}
+		errs = append(errs, record.Error)
+	}
+	return errs
+}
+
+func TestResubmitHistory(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "history")
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		fail(t, q, fmt.Errorf("attempt %d", i))
+	}
+	if errs := historyErrors(t, q, "a"); strings.Join(errs, ",") != "attempt 0,attempt 1,attempt 2" {
+		t.Fatal(errs)
+	}
+	// Plain Resubmit does not add to the history.
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Resubmit(); err != nil {
+		t.Fatal(err)
+	}
+	if errs := historyErrors(t, q, "a"); len(errs) != 3 {
+		t.Fatal(errs)
+	}
+	// Completing the job discards its history.
+	if w, err = q.Get(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	if errs := historyErrors(t, q, "a"); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+}
+
+func TestResubmitHistoryBounded(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "history")
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	fail(t, q, errors.New(strings.Repeat("é", 1000)))
+	for i := 0; i < 12; i++ {
+		fail(t, q, fmt.Errorf("attempt %d", i))
+	}
+	errs := historyErrors(t, q, "a")
+	if len(errs) != 10 || errs[0] != "attempt 2" || errs[9] != "attempt 11" {
+		t.Fatal(errs)
+	}
+
+	// Long errors are truncated without splitting a character.
+	if err := q.Submit("b"); err != nil {
+		t.Fatal(err)
+	}
+	if cancelled, err := q.Cancel("a"); !cancelled || err != nil {
+		t.Fatal(cancelled, err)
+	}
+	fail(t, q, errors.New("x"+strings.Repeat("é", 1000)))
+	errs = historyErrors(t, q, "b")
+	if len(errs) != 1 || len(errs[0]) != 1023 || !strings.HasPrefix(errs[0], "xé") {
+		t.Fatal(len(errs[0]))
+	}
+}
+
+func TestResubmitHistoryDeadLetter(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "history")
+	q.MaxAttempts = 3
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		fail(t, q, fmt.Errorf("attempt %d", i))
+	}
+	d := describe(t, q, "a")
+	if d.State != grt.JobDead || len(d.History) != 3 || d.History[2].Error != "attempt 2" {
+		t.Fatalf("%+v", d)
+	}
+}
+
+func TestRunRecordsHistory(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "history")
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	attempts := make(chan struct{}, 3)
+	run(t, q, 1, func(ctx context.Context, w *grt.Work, decode func(interface{}) error) error {
+		attempts <- struct{}{}
+		if len(attempts) == cap(attempts) {
+			<-ctx.Done()
+			return w.Resubmit()
+		}
+		return errors.New("handler failed")
+	})
+	deadline := time.Now().Add(time.Second)
+	for len(attempts) < cap(attempts) {
+		if time.Now().After(deadline) {
+			t.Fatal("handler was not retried")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if errs := historyErrors(t, q, "a"); strings.Join(errs, ",") != "handler failed,handler failed" {
+		t.Fatal(errs)
+	}
+}
@@ -0,0 +1,98 @@
+package grt
+
+// Middleware wraps a Handler, eg. to add logging, metrics, tracing or
+// payload validation around every job run by Run.
+type Middleware func(next Handler) Handler
+
+// WithMiddleware wraps the handler passed to Run in middleware. The first
+// middleware is outermost, so sees each job first and its result last.
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(c *JobQueue) { c.middleware = append(c.middleware, middleware...) }
+}
+
+// Hooks are called as jobs pass through a queue, for observing them without
+// wrapping every call site. Any hook may be nil. Hooks are called
+// synchronously, so should be quick.
+type Hooks struct {
+	// Called when Submit, SubmitWithPriority, SubmitAt or SubmitAfter queues
+	// a job, but not for duplicates.
+	OnSubmit func(queue string, key []byte)
+	// Called when a job is retrieved by Get (or any of its variants) or Run.
+	OnStart func(work *Work)
+	// Called when a job is completed with Complete or Succeed.
+	OnComplete func(work *Work)
+	// Called when a job is resubmitted with ResubmitWithError, which Run does
+	// for handlers that fail, or completed with Fail.
+	OnFail func(work *Work, err error)
+}
+
+// WithHooks calls hooks as jobs pass through the queue. It may be given more
+// than once, and hooks are called in the order given.
+func WithHooks(hooks Hooks) Option {
+	return func(c *JobQueue) { c.hooks = append(c.hooks, hooks) }
+}
+
+// wrapHandler wraps handler in the queue's middleware, and outside that its
+// tracing span.
+func (c *JobQueue) wrapHandler(handler Handler) Handler {
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		handler = c.middleware[i](handler)
+	}
+	if c.tracer != nil {
+		handler = c.traceHandler(handler)
+	}
+	return handler
+}
+
+func (c *JobQueue) submitted(key []byte) {
+	for _, hooks := range c.hooks {
+		if hooks.OnSubmit != nil {
+			hooks.OnSubmit(c.Queue, key)
+		}
+	}
+	c.publishEvent(EventSubmitted, key, nil)
+}
+
+func (w *Work) started() {
+	for _, hooks := range w.queue.hooks {
+		if hooks.OnStart != nil {
+			hooks.OnStart(w)
+		}
+	}
+	w.queue.publishEvent(EventStarted, w.key, nil)
+}
+
+// completed calls OnComplete hooks if err, the result of completing the job,
+// is nil, and returns err.
+func (w *Work) completed(err error) error {
+	if err != nil {
+		return err
+	}
+	for _, hooks := range w.queue.hooks {
+		if hooks.OnComplete != nil {
+			hooks.OnComplete(w)
+		}
+	}
+	w.queue.publishEvent(EventCompleted, w.key, nil)
+	return nil
+}
+
+// failed calls OnFail hooks with cause if err, the result of failing the job,
+// is nil, and returns err.
+func (w *Work) failed(cause error, err error) error {
+	if err != nil {
+		return err
+	}
+	for _, hooks := range w.queue.hooks {
+		if hooks.OnFail != nil {
+			hooks.OnFail(w, cause)
+		}
+	}
+	w.queue.publishEvent(EventFailed, w.key, cause)
+	return nil
+}
+
+// Key returns the job's queue key.
+func (w *Work) Key() []byte {
+	return w.key
+}
@@ -0,0 +1,62 @@
+package grt
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+)
+
+var (
+	// ErrPayloadChanged is returned by Resubmit and ResubmitWithError on a
+	// queue created WithPayloadIntegrity when the job's payload in Redis no
+	// longer matches the payload it was retrieved with.
+	ErrPayloadChanged = errors.New("job payload changed while in progress")
+)
+
+// WithPayloadIntegrity makes Resubmit and ResubmitWithError verify that the
+// job's payload in Redis is still the one the Work was retrieved with,
+// returning ErrPayloadChanged without resubmitting if another actor replaced
+// or removed it. The handler can then reload its state, and resubmit with
+// ResubmitFresh or complete the job.
+func WithPayloadIntegrity() Option {
+	return func(c *JobQueue) { c.payloadIntegrity = true }
+}
+
+// PayloadChecksum returns a checksum of the job's payload as retrieved. It
+// identifies the payload for callers that persist processing state outside
+// Redis, and is what WithPayloadIntegrity verifies.
+func (w *Work) PayloadChecksum() string {
+	sum := sha1.Sum(w.record)
+	return hex.EncodeToString(sum[:])
+}
+
+// ResubmitFresh resubmits the job like Resubmit, without verifying its
+// payload, so that it is next processed with whatever payload is now in Redis.
+// Concurrency safe.
+func (w *Work) ResubmitFresh() error {
+	w.checkFinalize()
+	return w.markFinalized(WorkResubmitted, w.resubmit())
+}
+
+// verifyChecksum returns the checksum Resubmit should verify, or "" if
+// integrity checks are disabled.
+func (w *Work) verifyChecksum() string {
+	if !w.queue.payloadIntegrity {
+		return ""
+	}
+	return w.PayloadChecksum()
+}
+
+// KEYS: processing list, waiting list, payload hash, deadlines sorted set,
+// stats hash. ARGV: key, checksum.
+var verifiedResubmitScript = newLuaScript("verified_resubmit", 1, 5, `
+local record = redis.call("HGET", KEYS[3], ARGV[1])
+if not record or redis.sha1hex(record) ~= ARGV[2] then
+  return {4} -- statusPayloadChanged
+end
+redis.call("LREM", KEYS[1], 0, ARGV[1])
+redis.call("ZREM", KEYS[4], ARGV[1])
+redis.call("LPUSH", KEYS[2], ARGV[1])
+redis.call("HINCRBY", KEYS[5], "resubmitted", 1)
+return {0}
+`)
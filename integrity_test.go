@@ -0,0 +1,97 @@
+package grt_test
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"github.com/alecthomas/grt"
+	"testing"
+)
+
+type account struct {
+	ID      string
+	Balance int
+}
+
+func TestPayloadIntegrity(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "integrity", grt.WithPayloadIntegrity())
+	if err := q.Submit(account{"a", 1}); err != nil {
+		t.Fatal(err)
+	}
+	var job account
+	w, err := q.Get(&job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := string(w.Key())
+	sum := sha1.Sum([]byte(s.HGet("integrity:payload", key)))
+	if w.PayloadChecksum() != hex.EncodeToString(sum[:]) {
+		t.Fatal(w.PayloadChecksum())
+	}
+	// Mutating the decoded job does not affect the checksum.
+	job.Balance = 100
+	if err := w.Resubmit(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = q.Get(&job)
+	if err != nil || job.Balance != 1 {
+		t.Fatal(job, err)
+	}
+	// Another actor updates the job while it is in flight.
+	s.HSet("integrity:payload", key, `{"Balance":2,"ID":"a"}`)
+	if err := w.Resubmit(); !errors.Is(err, grt.ErrPayloadChanged) {
+		t.Fatal(err)
+	}
+	if err := w.ResubmitWithError(errors.New("stale")); !errors.Is(err, grt.ErrPayloadChanged) {
+		t.Fatal(err)
+	}
+	// Nothing was resubmitted.
+	if waiting, _, err := q.Waiting("", 10); err != nil || len(waiting) != 0 {
+		t.Fatal(waiting, err)
+	}
+	// The handler chooses to pick up the update.
+	if err := w.ResubmitFresh(); err != nil {
+		t.Fatal(err)
+	}
+	w, err = q.Get(&job)
+	if err != nil || job.Balance != 2 {
+		t.Fatal(job, err)
+	}
+	if err := w.ResubmitWithError(errors.New("retry")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPayloadIntegrityRemoved(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "integrity", grt.WithPayloadIntegrity())
+	if err := q.Submit(account{"a", 1}); err != nil {
+		t.Fatal(err)
+	}
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.HDel("integrity:payload", string(w.Key()))
+	if err := w.Resubmit(); !errors.Is(err, grt.ErrPayloadChanged) {
+		t.Fatal(err)
+	}
+}
+
+func TestPayloadIntegrityDisabled(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "integrity")
+	if err := q.Submit(account{"a", 1}); err != nil {
+		t.Fatal(err)
+	}
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.HSet("integrity:payload", string(w.Key()), `{"Balance":2,"ID":"a"}`)
+	if err := w.Resubmit(); err != nil {
+		t.Fatal(err)
+	}
+}
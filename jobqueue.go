@@ -1,19 +1,50 @@
 package grt
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
+	"github.com/alecthomas/grt/backoff"
 	"github.com/garyburd/redigo/redis"
-	"log"
+	"log/slog"
+	"sync"
+	"time"
 )
 
 var (
 	// ErrAlreadyQueued is returned by Submit() when a duplicate job is submitted.
 	ErrAlreadyQueued = errors.New("job already queued")
+	// ErrRecentlyCompleted is returned by Submit() when an identical job
+	// completed within the queue's DedupWindow. The job is not queued.
+	ErrRecentlyCompleted = errors.New("job recently completed")
+	// ErrPayloadMissing is returned by Get when it retrieves a job whose
+	// payload has been deleted, eg. by a concurrent Complete. The job is
+	// discarded.
+	ErrPayloadMissing = errors.New("job payload missing")
+	// ErrQueueClosed is returned by the Submit and Get variants, Run and
+	// Cleanup once the queue has been closed with Close.
+	ErrQueueClosed = errors.New("queue closed")
 )
 
-// JobQueueKeyer can be implemented by a type to specify a custom job queue key.
+// PayloadDecodeError is returned by Get, and by the decode function passed to
+// a Run handler, when a job's payload cannot be decoded, wrapping the cause.
+type PayloadDecodeError struct {
+	Queue string
+	Key   []byte
+	Err   error
+}
+
+func (p *PayloadDecodeError) Error() string {
+	return fmt.Sprintf("could not decode job %s:%s: %s", p.Queue, p.Key, p.Err)
+}
+
+func (p *PayloadDecodeError) Unwrap() error {
+	return p.Err
+}
+
+// JobQueueKeyer can be implemented by a type to specify a custom job queue key,
+// eg. an ID field, in place of its encoded payload. Jobs with the same key are
+// duplicates.
 type JobQueueKeyer interface {
 	JobQueueKey() []byte
 }
@@ -22,106 +53,866 @@ type JobQueueKeyer interface {
 type JobQueue struct {
 	pool  *redis.Pool
 	Queue string
+	// How long a cancellation request made with RequestCancel is retained.
+	CancelTTL time.Duration
+	// How long a result reported with Work.Succeed or Work.Fail is retained
+	// for SubmitAndWait.
+	ResultTTL time.Duration
+	// If set, completing a job suppresses identical jobs for this long
+	// afterwards: submitting one returns ErrRecentlyCompleted. Resubmitted
+	// jobs are not suppressed.
+	DedupWindow time.Duration
+	// Size of the chunks payloads submitted with SubmitStream are split into.
+	StreamChunkSize int
+	// Number of times a job may be retrieved before resubmitting it moves it
+	// to the queue's dead letters instead. Unlimited if zero.
+	MaxAttempts int
+	// If set, a resubmitted job is delayed by RetryBackoff.Next(attempts-1)
+	// before it can be retrieved again, rather than requeued immediately.
+	// Delayed retries are queued at normal priority when due.
+	RetryBackoff backoff.Backoff
+	// If set, called after a job is moved to the dead letters, with a
+	// *MaxAttemptsError wrapping the error it was last resubmitted with, or
+	// ErrJobExpired for a job dead-lettered WithExpiredDeadLetter.
+	OnDeadLetter func(work *Work, err error)
+	// How often GetWait polls when it cannot block for the remaining timeout.
+	SpinInterval         time.Duration
+	consistentReads      bool
+	codec                Codec
+	payloadStore         PayloadStore
+	payloadThreshold     int
+	compressor           Compressor
+	compressionThreshold int
+	maxPayloadSize       int
+	jobTTL               time.Duration
+	deadLetterExpired    bool
+	deadLetterCancelled  bool
+	events               bool
+	prefix               string
+	prefetch             int
+	prefetched           *prefetchBuffer
+	// Current payload version and migrations from older versions.
+	payloadVersion     int
+	migrations         map[int]Migration
+	migrationWriteBack bool
+	dedupeNamespace    string
+	payloadIntegrity   bool
+	priorities         bool
+	clusterKeys        bool
+	hashedKeys         bool
+	streams            bool
+	rateLimiter        *RateLimiter
+	middleware         []Middleware
+	hooks              []Hooks
+	visibilityTimeout  time.Duration
+	reapInterval       time.Duration
+	readCache          *readCache
+	submitFlights      *readCache
+	clock              *clock
+	strict             bool
+	slo                *slo
+	runtime            *Runtime
+	logger             *slog.Logger
+	background         *background
+	options            *optionsCheck
+	fallback           *fallback
+	runs               *runs
+	autoConcurrency    *autoConcurrency
+	brake              *requeueBrake
+	warmup             *warmup
+	producer           Producer
+	tracer             Tracer
+}
+
+// background tracks the tasks a queue has scheduled on its Runtime, and the
+// Gets in flight and Work held by this process, which Close waits for.
+type background struct {
+	lock    sync.Mutex
+	closed  bool
+	cancels []func()
+	busy    int
+	// Closed once busy falls to zero, if Close is waiting for it.
+	drained chan struct{}
+}
+
+// acquire counts a Get in flight, returning false if the queue is closed.
+func (b *background) acquire() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return false
+	}
+	b.busy++
+	return true
+}
+
+// hold counts Work retrieved by a Get in flight, until it is finalized.
+func (b *background) hold() {
+	b.lock.Lock()
+	b.busy++
+	b.lock.Unlock()
+}
+
+// release ends a Get in flight or releases held Work.
+func (b *background) release() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.busy--
+	if b.busy == 0 && b.drained != nil {
+		close(b.drained)
+		b.drained = nil
+	}
+}
+
+// wait blocks until no Get is in flight and no Work is held, or ctx is done.
+func (b *background) wait(ctx context.Context) error {
+	b.lock.Lock()
+	if b.busy == 0 {
+		b.lock.Unlock()
+		return nil
+	}
+	if b.drained == nil {
+		b.drained = make(chan struct{})
+	}
+	drained := b.drained
+	b.lock.Unlock()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Option configures a JobQueue.
+type Option func(*JobQueue)
+
+// WithConsistentReads routes the reads used for deduplication (IsQueued, Len
+// and the duplicate check in SubmitStream) through a MULTI/EXEC transaction.
+//
+// By default reads are issued as plain commands, so a proxy that splits reads
+// and writes (eg. Envoy with a replica read policy) may serve them from a
+// replica that has not yet seen a preceding Submit. Transactions are always
+// routed to the primary, which restores read-your-writes at the cost of two
+// extra commands per read.
+func WithConsistentReads() Option {
+	return func(c *JobQueue) { c.consistentReads = true }
 }
 
 // NewJobQueue creates a new Redis-based job queue. Jobs can be any
-// JSON-encodable structure. Note that this currently relies on stable
-// ordering of encoded objects.
-func NewJobQueue(pool *redis.Pool, queue string) *JobQueue {
-	return &JobQueue{pool: pool, Queue: queue}
+// JSON-encodable structure.
+//
+// A job's queue key, used for deduplication, is its JSON encoding with object
+// keys sorted, or its hash WithHashedKeys, unless it implements JobQueueKeyer.
+func NewJobQueue(pool *redis.Pool, queue string, options ...Option) *JobQueue {
+	c := &JobQueue{
+		pool:            pool,
+		Queue:           queue,
+		CancelTTL:       time.Hour * 24,
+		ResultTTL:       time.Minute * 5,
+		StreamChunkSize: 1 << 20,
+		SpinInterval:    DefaultSpinInterval,
+		codec:           JSONCodec{},
+		clock:           &clock{now: time.Now},
+		strict:          strictEnabled(),
+		background:      &background{},
+		options:         &optionsCheck{},
+		runs:            &runs{},
+		producer:        defaultProducer(),
+	}
+	for _, option := range options {
+		option(c)
+	}
+	if c.clusterKeys {
+		c.Queue = clusterQueueName(queue)
+	}
+	c.Queue = Namespace(c.prefix).Key(c.Queue)
+	if c.rateLimiter != nil {
+		c.rateLimiter.Key = rateLimitKey(c.Queue)
+	}
+	if c.runtime == nil {
+		c.runtime = defaultRuntime(pool)
+	}
+	if c.strict {
+		registerStrictQueue(c)
+	}
+	c.startSLOSampler()
+	c.startReaper()
+	return c
+}
+
+// Close shuts the queue down in this process, for a clean exit: it stops the
+// queue's background work, if any, and waits for any in progress to finish,
+// then waits for Gets already waiting to return and for every Work they
+// retrieved to be finalized. Submits and Gets started afterwards return
+// ErrQueueClosed, as do Gets waiting for a job within a second, and Run
+// returns once its handlers have.
+//
+// Close must not be called by a handler or while holding Work that it will
+// wait for. See CloseContext to bound the wait.
+func (c *JobQueue) Close() error {
+	return c.CloseContext(context.Background())
+}
+
+// CloseContext is like Close, but returns ctx.Err() if Work is still held
+// when ctx is done, eg. at the end of a termination grace period. The queue
+// is closed regardless, and jobs still in progress are left to Cleanup or the
+// reaper.
+func (c *JobQueue) CloseContext(ctx context.Context) error {
+	c.background.lock.Lock()
+	cancels := c.background.cancels
+	c.background.closed = true
+	c.background.cancels = nil
+	c.background.lock.Unlock()
+	for _, cancel := range cancels {
+		cancel()
+	}
+	if err := c.returnPrefetched(); err != nil {
+		c.log().Error("Failed to return prefetched jobs to the queue", "queue", c.Queue, "error", err)
+	}
+	return c.background.wait(ctx)
+}
+
+func (c *JobQueue) isClosed() bool {
+	c.background.lock.Lock()
+	defer c.background.lock.Unlock()
+	return c.background.closed
+}
+
+// schedule runs fn on the queue's Runtime every interval until it returns
+// false or the queue is closed.
+func (c *JobQueue) schedule(interval time.Duration, fn func() bool) {
+	c.background.lock.Lock()
+	defer c.background.lock.Unlock()
+	if c.background.closed {
+		return
+	}
+	c.background.cancels = append(c.background.cancels, c.runtime.schedule(interval, fn))
 }
 
 // Cleanup should be called when a job runner starts up, to return any aborted
 // in-progress jobs to the queue.
 func (c *JobQueue) Cleanup() error {
-	r := c.pool.Get()
+	if err := c.checkOptions(); err != nil {
+		return err
+	}
+	r := getConn(c.pool, "JobQueue.Cleanup")
 	defer r.Close()
-	log.Printf("Cleaning up in-progress jobs in %s", c.Queue)
 	// Move in-progress items back to queue
+	moved := 0
 	for {
-		v, err := r.Do("RPOPLPUSH", c.Queue+":processing", c.Queue)
-		if err != nil {
-			r.Close()
-			return err
-		}
-		if v == nil {
+		key, err := redis.String(r.Do("RPOPLPUSH", c.Queue+":processing", c.Queue))
+		if err == redis.ErrNil {
 			break
+		} else if err != nil {
+			return err
 		}
-		log.Printf("Moved %s from processing to waiting", v)
+		c.log().Debug("Moved job from processing to waiting", "queue", c.Queue, "key", key)
+		moved++
+	}
+	if _, err := r.Do("DEL", c.Queue+":deadlines"); err != nil {
+		return err
 	}
+	c.log().Info("Cleaned up in-progress jobs", "queue", c.Queue, "moved", moved)
 	return nil
 }
 
 // Len returns the length of the queue.
 func (c *JobQueue) Len() (int, error) {
-	r := c.pool.Get()
+	v, err := c.cached("len", func() (interface{}, error) {
+		r := getConn(c.pool, "JobQueue.Len")
+		defer r.Close()
+		l, err := redis.Int(c.read(r, "HLEN", c.Queue+":payload"))
+		if err == redis.ErrNil {
+			return 0, nil
+		}
+		return l, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return v.(int), nil
+}
+
+// IsEmpty returns true if no jobs are waiting. Unlike Len it ignores jobs in
+// progress, and is cheap enough to call in a tight loop.
+func (c *JobQueue) IsEmpty() (bool, error) {
+	r := getConn(c.pool, "JobQueue.IsEmpty")
 	defer r.Close()
-	l, err := redis.Int(r.Do("HLEN", c.Queue+":payload"))
-	if err == redis.ErrNil {
-		return 0, nil
+	lists := c.waitingLists()
+	args := make([]interface{}, len(lists))
+	for i, list := range lists {
+		args[i] = list
+	}
+	exists, err := redis.Bool(c.read(r, "EXISTS", args...))
+	return !exists, err
+}
+
+// AnyNonEmpty returns those of queues that have jobs waiting, checking them
+// all in a single round trip. Queues are named as by JobQueue.Queue, so
+// including any WithPrefix prefix, and jobs waiting at any priority count.
+func AnyNonEmpty(pool *redis.Pool, queues []string) ([]string, error) {
+	if len(queues) == 0 {
+		return []string{}, nil
+	}
+	r := getConn(pool, "AnyNonEmpty")
+	defer r.Close()
+	for _, queue := range queues {
+		// Without WithPriorities the priority lists never exist.
+		r.Send("EXISTS", queue+":high", queue, queue+":low")
+	}
+	replies, err := redis.Ints(r.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	nonEmpty := []string{}
+	for i, exists := range replies {
+		if exists > 0 {
+			nonEmpty = append(nonEmpty, queues[i])
+		}
 	}
-	return l, err
+	return nonEmpty, nil
 }
 
 // IsQueued checks whether a job is currently queued for processing, or in-progress.
 func (c *JobQueue) IsQueued(job interface{}) (bool, error) {
-	r := c.pool.Get()
-	defer r.Close()
-	key, _, err := jobQueueMarshal(job)
+	key, _, err := c.marshal(job)
 	if err != nil {
 		return false, err
 	}
-	v, err := redis.Int(r.Do("HEXISTS", c.Queue+":payload", key))
+	v, err := c.cached("queued:"+string(key), func() (interface{}, error) {
+		r := getConn(c.pool, "JobQueue.IsQueued")
+		defer r.Close()
+		return c.isQueued(r, key)
+	})
 	if err != nil {
 		return false, err
 	}
-	return v != 0, nil
+	return v.(bool), nil
+}
+
+func (c *JobQueue) isQueued(r redis.Conn, key []byte) (bool, error) {
+	return redis.Bool(c.read(r, "HEXISTS", c.Queue+":payload", key))
+}
+
+// read issues a read-only command, inside a transaction if consistent reads
+// are enabled.
+func (c *JobQueue) read(r redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	if !c.consistentReads {
+		return r.Do(cmd, args...)
+	}
+	r.Send("MULTI")
+	r.Send(cmd, args...)
+	replies, err := redis.Values(r.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
 }
 
 // Submit a job for processing.
+//
+// A nil return or ErrAlreadyQueued both mean the job is queued once Submit
+// returns, so there is no need to confirm with IsQueued. ErrRecentlyCompleted
+// means an identical job completed within DedupWindow, and this one was not
+// queued.
 func (c *JobQueue) Submit(job interface{}) error {
-	r := c.pool.Get()
-	defer r.Close()
-	key, payload, err := jobQueueMarshal(job)
-	if queued, err := c.IsQueued(job); err != nil || queued {
-		return ErrAlreadyQueued
+	return c.SubmitContext(context.Background(), job)
+}
+
+// SubmitContext is Submit on behalf of ctx: any headers of ctx (see
+// ContextWithHeaders) are recorded with the job, as is, on a queue created
+// WithTracer, its trace context, and ctx is passed to any unavailable
+// fallback.
+func (c *JobQueue) SubmitContext(ctx context.Context, job interface{}) error {
+	if c.fallback != nil && c.fallback.fn != nil {
+		return c.submitWithFallback(ctx, job)
 	}
+	return c.submit(ctx, job, 0, PriorityNormal, c.jobTTL)
+}
 
-	r.Send("MULTI")
-	r.Send("LPUSH", c.Queue, key)
-	r.Send("HSET", c.Queue+":payload", key, payload)
-	_, err = r.Do("EXEC")
-	return err
+// submit submits job from ctx at priority p, delayed by delay if it is
+// positive, and expiring ttl after it is due if ttl is positive.
+func (c *JobQueue) submit(ctx context.Context, job interface{}, delay time.Duration, p Priority, ttl time.Duration) error {
+	return c.submitJob(ctx, job, delay, p, ttl, false)
 }
 
-// Get some work.
-func (c *JobQueue) Get(v interface{}) (*Work, error) {
-	r := c.pool.Get()
-	defer r.Close()
-	key, err := redis.Bytes(r.Do("BRPOPLPUSH", c.Queue, c.Queue+":processing", 0))
+// submitJob is submit, also discarding any result left by an earlier run of
+// the job if clearResult is true and the job is enqueued.
+func (c *JobQueue) submitJob(ctx context.Context, job interface{}, delay time.Duration, p Priority, ttl time.Duration, clearResult bool) (err error) {
+	if c.strict && isZeroJob(job) {
+		return fmt.Errorf("grt: strict mode: refusing to submit %T: %w", job, ErrZeroJob)
+	}
+	key, payload, err := c.marshal(job)
 	if err != nil {
+		return err
+	}
+	if err := c.checkOptions(); err != nil {
+		return err
+	}
+	var trace map[string]string
+	if c.tracer != nil {
+		var end func(error)
+		trace, end = c.tracer.StartSubmit(ctx, c.Queue, key)
+		defer func() { end(err) }()
+	}
+	return c.coalesceSubmit(key, func() error {
+		r := getConn(c.pool, "JobQueue.Submit")
+		defer r.Close()
+		payload, ref, err := c.payloadRecord(key, payload)
+		if err != nil {
+			return err
+		}
+		script, keys := submitScript, []interface{}{c.priorityList(p), c.Queue + ":payload", c.Queue + ":enqueued", c.dedupeKey(), renamedKey(c.Queue),
+			c.Queue + ":producer", c.Queue + ":delayed", doneKey(c.Queue, key), expiryKey(c.Queue)}
+		if clearResult {
+			script, keys = submitClearingResultScript, append(keys, resultKey(c.Queue, key))
+		}
+		_, err = script.do(r, append(keys, key, c.versionRecord(payload), c.Queue, c.producerRecord(trace, contextHeaders(ctx)),
+			delay.Milliseconds(), ttl.Milliseconds())...)
+		if err != nil && ref != "" {
+			c.payloadStore.Delete(ref)
+		}
+		if errors.Is(err, ErrQueueRenamed) {
+			return queueRenamedError(r, c.Queue)
+		}
+		if err == nil {
+			c.submitted(key)
+		}
+		return err
+	})
+}
+
+// KEYS: waiting list for the job's priority, payload hash, enqueued-at hash,
+// dedupe hash (the payload hash unless namespaced), forwarding marker,
+// producer hash, delayed sorted set, completion tombstone, expiry sorted set.
+// ARGV: key, payload, queue, producer, delay and TTL in milliseconds.
+//
+// A job queued without delay is announced on the queue's submitted channel.
+var submitScript = newLuaScript("submit", 1, 9, submitLua)
+
+const submitLua = `
+redis.replicate_commands()
+if redis.call("EXISTS", KEYS[5]) == 1 then
+  return {2} -- statusRenamed
+end
+if redis.call("EXISTS", KEYS[8]) == 1 then
+  return {8} -- statusRecentlyCompleted
+end
+if redis.call("HSETNX", KEYS[2], ARGV[1], ARGV[2]) == 0 then
+  return {1} -- statusDuplicate
+end
+if KEYS[4] ~= KEYS[2] and redis.call("HSETNX", KEYS[4], ARGV[1], ARGV[3]) == 0 then
+  redis.call("HDEL", KEYS[2], ARGV[1])
+  return {1} -- statusDuplicate
+end
+local now = redis.call("TIME")
+local ms = now[1] * 1000 + math.floor(now[2] / 1000)
+if tonumber(ARGV[5]) > 0 then
+  redis.call("ZADD", KEYS[7], ms + tonumber(ARGV[5]), ARGV[1])
+else
+  redis.call("LPUSH", KEYS[1], ARGV[1])
+  redis.call("PUBLISH", ARGV[3] .. ":submitted", "")
+end
+if tonumber(ARGV[6]) > 0 then
+  redis.call("ZADD", KEYS[9], ms + math.max(tonumber(ARGV[5]), 0) + tonumber(ARGV[6]), ARGV[1])
+else
+  redis.call("ZREM", KEYS[9], ARGV[1])
+end
+redis.call("HSET", KEYS[3], ARGV[1], ms)
+redis.call("HSET", KEYS[6], ARGV[1], ARGV[4])
+return {0}
+`
+
+// Get some work, blocking until a job is available.
+//
+// If v is nil the payload is not decoded, and can instead be streamed with
+// Work.PayloadReader().
+//
+// Jobs that have been cancelled with RequestCancel while waiting, or whose
+// TTL has passed (see SubmitWithTTL), are discarded rather than returned.
+//
+// Get blocks for at most closePollInterval at a time, so that it returns
+// ErrQueueClosed soon after Close. On a pool created with NewSingleConnPool it
+// polls rather than blocking so that it does not monopolise the connection.
+func (c *JobQueue) Get(v interface{}) (*Work, error) {
+	if err := c.checkOptions(); err != nil {
+		return nil, err
+	}
+	op := startOperation("JobQueue.Get")
+	defer op.end()
+	wait := closePollInterval
+	if isSingleConn(c.pool) {
+		wait = 0
+	}
+	for {
+		work, err := c.get(op, v, wait)
+		if work != nil || err != nil {
+			return work, err
+		}
+		if wait == 0 {
+			time.Sleep(singleConnPollInterval)
+		}
+	}
+}
+
+// TryGet is like Get, but returns a nil Work immediately if no job is
+// waiting.
+func (c *JobQueue) TryGet(v interface{}) (*Work, error) {
+	if err := c.checkOptions(); err != nil {
 		return nil, err
 	}
-	d, err := redis.Bytes(r.Do("HGET", c.Queue+":payload", key))
-	if err == nil {
-		err = jobQueueUnmarshal(d, v)
+	op := startOperation("JobQueue.Get")
+	defer op.end()
+	return c.get(op, v, 0)
+}
+
+// get retrieves a job for op, waiting for up to wait for one, or returns a nil
+// Work. Returns ErrQueueClosed if the queue has been closed.
+func (c *JobQueue) get(op *operation, v interface{}, wait time.Duration) (*Work, error) {
+	if !c.background.acquire() {
+		return nil, ErrQueueClosed
+	}
+	defer c.background.release()
+	for {
+		work, cancelled, err := c.popOne(op, wait)
+		if work == nil {
+			return nil, err
+		}
+		work, err = c.accept(work, cancelled, err, v)
+		if work == nil && err == nil {
+			continue
+		}
+		return work, err
+	}
+}
+
+// popOne moves the next job to the processing list as pop does, or takes it
+// from the prefetch buffer. work is nil if no job arrived in time, the queue
+// is paused or the rate limit was reached, in which case it waits for up to
+// wait before returning.
+func (c *JobQueue) popOne(op *operation, wait time.Duration) (work *Work, cancelled bool, err error) {
+	if c.prefetched != nil {
+		if work, cancelled, err = c.nextPrefetched(op); work != nil || err != nil {
+			return work, cancelled, err
+		}
+	}
+	if _, retry, err := c.takeJobTokens(1); err != nil {
+		return nil, false, err
+	} else if retry > 0 {
+		// Rate limited.
+		if wait > 0 {
+			time.Sleep(minDuration(retry, wait))
+		}
+		return nil, false, nil
+	}
+	work, cancelled, err = c.pop(op, wait)
+	if work == nil {
+		c.refundJobTokens(1)
+	}
+	if err == errPaused {
+		if wait > 0 {
+			time.Sleep(pausedWait(wait))
+		}
+		return nil, false, nil
+	}
+	return work, cancelled, err
+}
+
+// accept finishes retrieving a popped job, decoding it into v. A job whose
+// cancellation has been requested is discarded and nil returned, as is one
+// whose TTL has passed, unless either is dead-lettered. If err is not nil, or
+// decoding fails, the job is resubmitted and the error returned.
+func (c *JobQueue) accept(work *Work, cancelled bool, err error, v interface{}) (*Work, error) {
+	if err == nil && cancelled {
+		return nil, c.dropCancelled(work)
+	}
+	if err == nil && work.expired {
+		return nil, c.dropExpired(work)
+	}
+	if err == nil && v != nil {
+		err = work.decode(v)
+	}
+	if dropped, derr := work.dropUndecodable(err); dropped {
+		if derr != nil {
+			return nil, errors.Join(err, fmt.Errorf("could not dead-letter %s: %w", work, derr))
+		}
+		return nil, err
 	}
-	work := &Work{pool: c.pool, Queue: c.Queue, key: key}
 	if err != nil {
-		if rerr := work.Resubmit(); rerr != nil {
-			panic("could not resubmit job: " + rerr.Error())
+		if rerr := work.ResubmitFresh(); rerr != nil {
+			return nil, errors.Join(err, fmt.Errorf("could not resubmit %s: %w", work, rerr))
 		}
 		return nil, err
 	}
+	if work.strict {
+		trackWork(work)
+	}
+	work.held = true
+	c.background.hold()
+	work.started()
 	return work, nil
 }
 
+// pop moves the next job to the processing list, returning it with whether
+// cancellation has been requested, after moving any due delayed jobs onto
+// the queue. It blocks for up to wait, or not at all if it is zero, but no
+// later than the next delayed job is due. work is nil if no job arrived in
+// time. If err is not nil but work is, the job must be resubmitted.
+//
+// A job found without a payload is removed and reported as ErrPayloadMissing.
+// If the queue is paused, errPaused is returned without waiting.
+func (c *JobQueue) pop(op *operation, wait time.Duration) (work *Work, cancelled bool, err error) {
+	r := op.conn(c.pool)
+	defer r.Close()
+	reply, err := c.popJobs(r, 1)
+	if err != nil {
+		return nil, false, err
+	}
+	if paused, _ := redis.Bool(reply[1], nil); paused {
+		return nil, false, errPaused
+	}
+	if len(reply) > 2 {
+		return c.popped(reply[2:])
+	}
+	if wait == 0 {
+		return nil, false, nil
+	}
+	if due, err := redis.Int64(reply[0], nil); err == nil && due >= 0 {
+		// Wake when the next delayed job is due.
+		if due := c.dueWait(time.Duration(due) * time.Millisecond); due < wait {
+			wait = due
+		}
+	}
+	list, priority := c.Queue, PriorityNormal
+	if c.priorities {
+		// Block on the high priority list only, returning periodically to
+		// check the others.
+		list, priority = c.priorityList(PriorityHigh), PriorityHigh
+		if wait > priorityPollInterval {
+			wait = priorityPollInterval
+		}
+	}
+	key, err := redis.Bytes(r.Do("BRPOPLPUSH", list, c.Queue+":processing", blockingTimeout(wait)))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	reply, err = fetchScript.do(r, c.Queue+":processing", c.Queue+":payload", c.Queue+":attempts",
+		c.Queue+":enqueued", c.Queue+":deadlines", pausedKey(c.Queue), list, key, c.Queue, c.visibilityTimeout.Milliseconds())
+	if err != nil {
+		return &Work{pool: c.pool, Queue: c.Queue, key: key, queue: c, priority: priority, strict: c.strict}, false, err
+	}
+	if paused, _ := redis.Bool(reply[0], nil); paused {
+		return nil, false, errPaused
+	}
+	return c.fetched(key, priority, reply[1:])
+}
+
+// popJobs moves up to n waiting jobs to the processing list with popScript,
+// after moving any due delayed jobs onto the queue. No jobs are moved if the
+// queue is paused.
+func (c *JobQueue) popJobs(r redis.Conn, n int) ([]interface{}, error) {
+	priorities := "0"
+	if c.priorities {
+		priorities = "1"
+	}
+	return popScript.do(r, c.Queue+":delayed", c.Queue, c.Queue+":processing",
+		c.priorityList(PriorityHigh), c.priorityList(PriorityLow), c.Queue+":pops",
+		c.Queue+":payload", c.Queue+":attempts", c.Queue+":enqueued", c.Queue+":deadlines", pausedKey(c.Queue),
+		promoteBatchSize, priorities, priorityStarvationInterval, c.Queue, c.visibilityTimeout.Milliseconds(), n)
+}
+
+// popped creates Work for a job in the reply of popScript: its key and
+// priority, then the job as fetched.
+func (c *JobQueue) popped(reply []interface{}) (work *Work, cancelled bool, err error) {
+	key, err := redis.Bytes(reply[0], nil)
+	if err != nil {
+		return nil, false, err
+	}
+	p, _ := redis.Int(reply[1], nil)
+	return c.fetched(key, Priority(p), reply[2:])
+}
+
+// fetched creates Work for a job moved to the processing list, from the reply
+// of fetchJobLua: its payload record (false if missing), whether cancellation
+// has been requested, its attempts, its enqueue time, whether it is part of a
+// workflow and whether its TTL has passed.
+func (c *JobQueue) fetched(key []byte, priority Priority, reply []interface{}) (work *Work, cancelled bool, err error) {
+	if reply[0] == nil {
+		return nil, false, fmt.Errorf("%w: %s:%s", ErrPayloadMissing, c.Queue, key)
+	}
+	work = &Work{pool: c.pool, Queue: c.Queue, key: key, queue: c, priority: priority, strict: c.strict}
+	if work.record, err = redis.Bytes(reply[0], nil); err != nil {
+		return work, false, err
+	}
+	cancelled, _ = redis.Bool(reply[1], nil)
+	work.attempts, _ = redis.Int(reply[2], nil)
+	if enqueued, err := redis.Int64(reply[3], nil); err == nil {
+		work.enqueuedAt = time.Unix(0, enqueued*int64(time.Millisecond))
+	}
+	work.chained, _ = redis.Bool(reply[4], nil)
+	work.expired, _ = redis.Bool(reply[5], nil)
+	return work, cancelled, nil
+}
+
+// fetchJobLua defines fetch(), which reads a job just moved to the processing
+// list, counts the attempt and sets its visibility deadline if timeout is
+// positive. A job without a payload is removed from the processing list.
+// Returns the payload record or false, whether cancellation has been
+// requested, the attempt count, the enqueue time or false, whether the job
+// has a workflow continuation and whether its TTL has passed.
+const fetchJobLua = `
+local function fetch(key, processing, payload, attempts, enqueued, deadlines, queue, timeout)
+  local record = redis.call("HGET", payload, key)
+  if not record then
+    redis.call("LREM", processing, 0, key)
+    redis.call("HDEL", attempts, key)
+    redis.call("ZREM", deadlines, key)
+    return {false, 0, 0, false, 0, 0}
+  end
+  local cancelled = redis.call("EXISTS", queue .. ":cancel:" .. key)
+  local attempt = redis.call("HINCRBY", attempts, key, 1)
+  local at = redis.call("HGET", enqueued, key)
+  local chained = redis.call("EXISTS", queue .. ":next:" .. key)
+  local now = redis.call("TIME")
+  local ms = now[1] * 1000 + math.floor(now[2] / 1000)
+  local expires = redis.call("ZSCORE", queue .. ":expiry", key)
+  local expired = 0
+  if expires and tonumber(expires) <= ms then
+    expired = 1
+  end
+  if tonumber(timeout) > 0 then
+    redis.call("ZADD", deadlines, ms + tonumber(timeout), key)
+  end
+  return {record, cancelled, attempt, at, chained, expired}
+end
+`
+
+// KEYS: delayed sorted set, waiting list, processing list, high and low
+// priority waiting lists, pop counter, payload hash, attempts hash,
+// enqueued-at hash, deadlines sorted set, paused flag. ARGV: maximum number of
+// jobs to promote, "1" if priorities are enabled, starvation interval, queue,
+// visibility timeout in milliseconds, maximum number of jobs to pop.
+//
+// Returns the milliseconds until the next delayed job is due or -1, whether
+// the queue is paused, then for each popped job its key, its priority and the
+// job as fetched.
+var popScript = newLuaScript("pop", 1, 11, `
+redis.replicate_commands()
+`+fetchJobLua+`
+local now = redis.call("TIME")
+local ms = now[1] * 1000 + math.floor(now[2] / 1000)
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ms, "LIMIT", 0, tonumber(ARGV[1]))
+for _, key in ipairs(due) do
+  redis.call("ZREM", KEYS[1], key)
+  redis.call("LPUSH", KEYS[2], key)
+end
+local lists, priorities = {KEYS[2]}, {0}
+if ARGV[2] == "1" then
+  lists, priorities = {KEYS[4], KEYS[2], KEYS[5]}, {1, 0, -1}
+  if redis.call("INCR", KEYS[6]) % tonumber(ARGV[3]) == 0 then
+    lists, priorities = {KEYS[5], KEYS[2], KEYS[4]}, {-1, 0, 1}
+  end
+end
+local next = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+if #next == 0 then
+  next = -1
+else
+  next = math.max(tonumber(next[2]) - ms, 1)
+end
+if redis.call("EXISTS", KEYS[11]) == 1 then
+  return {0, next, 1}
+end
+local reply = {0, next, 0}
+for n = 1, tonumber(ARGV[6]) do
+  local key, priority = false, 0
+  for i, list in ipairs(lists) do
+    key = redis.call("RPOPLPUSH", list, KEYS[3])
+    if key then
+      priority = priorities[i]
+      break
+    end
+  end
+  if not key then
+    break
+  end
+  local job = fetch(key, KEYS[3], KEYS[7], KEYS[8], KEYS[9], KEYS[10], ARGV[4], ARGV[5])
+  for _, value in ipairs({key, priority, job[1], job[2], job[3], job[4], job[5], job[6]}) do
+    table.insert(reply, value)
+  end
+end
+return reply
+`)
+
+// KEYS: processing list, payload hash, attempts hash, enqueued-at hash,
+// deadlines sorted set, paused flag, waiting list the job was popped from.
+// ARGV: key, queue, visibility timeout in milliseconds.
+//
+// If the queue has been paused the job is returned to the end of the waiting
+// list it came from. Returns whether the queue is paused, then the job as
+// fetched.
+var fetchScript = newLuaScript("fetch", 1, 7, `
+redis.replicate_commands()
+`+fetchJobLua+`
+if redis.call("EXISTS", KEYS[6]) == 1 then
+  redis.call("LREM", KEYS[1], 1, ARGV[1])
+  redis.call("RPUSH", KEYS[7], ARGV[1])
+  return {0, 1}
+end
+local job = fetch(ARGV[1], KEYS[1], KEYS[2], KEYS[3], KEYS[4], KEYS[5], ARGV[2], ARGV[3])
+return {0, 0, job[1], job[2], job[3], job[4], job[5], job[6]}
+`)
+
+// RequestCancel asks for a job to be cancelled. If the job is waiting it will
+// be discarded when next retrieved by Get, or dead-lettered on a queue created
+// WithCancelledDeadLetter. If it is in progress, the worker processing it can
+// observe the request with Work.Cancelled() or Work.Context and abort.
+//
+// The request is retained for CancelTTL.
+func (c *JobQueue) RequestCancel(job interface{}) error {
+	r := getConn(c.pool, "JobQueue.RequestCancel")
+	defer r.Close()
+	key, _, err := c.marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = r.Do("SET", cancelKey(c.Queue, key), 1, "PX", c.CancelTTL.Nanoseconds()/1000000)
+	return err
+}
+
 // Work represents an in-progress job. Complete() or Resubmit() *must* be called
-// after processing or a recoverable error occurs, respectively.
+// after processing or a recoverable error occurs, respectively, unless the job
+// is handed off to another queue with Transfer().
 type Work struct {
 	pool  *redis.Pool
 	Queue string
 	key   []byte
+	queue *JobQueue
+	// The payload hash entry: the payload itself, or a reference to it.
+	record   []byte
+	attempts int
+	// Zero if the job was submitted before enqueue times were recorded.
+	enqueuedAt time.Time
+	priority   Priority
+	strict     bool
+	// Set if the job has a workflow continuation, advanced when it is
+	// completed.
+	chained bool
+	// Set if the Work counts towards those Close waits for.
+	held bool
+	// Set if the job's TTL had passed when it was retrieved.
+	expired bool
+	// Set if the job is discarded because its cancellation was requested or
+	// its TTL passed, abandoning its continuation.
+	discarded bool
+	lock      sync.Mutex
+	finalized bool
+	// Set for Work fabricated by NewReplayWork.
+	replay *replayState
+	// Called with the outcome once the Work is finalized, if not nil.
+	onFinalize func(outcome WorkOutcome)
 }
 
 func (w *Work) String() string {
@@ -130,45 +921,138 @@ func (w *Work) String() string {
 
 // Complete a job and remove it from the in-progress queue. Concurrency safe.
 func (w *Work) Complete() error {
-	r := w.pool.Get()
+	w.checkFinalize()
+	return w.completed(w.markFinalized(WorkCompleted, w.complete(nil, nil)))
+}
+
+// complete the job, storing and announcing result if it is not nil, and in
+// the same transaction submitting next if it is not nil and advancing the
+// job's workflow continuation, if any.
+func (w *Work) complete(result []byte, next *encodedStep) error {
+	if w.replay != nil {
+		return w.replay.finalize(WorkCompleted)
+	}
+	r := getConn(w.pool, "Work.Complete")
 	defer r.Close()
 	r.Send("MULTI")
 	r.Send("LREM", w.Queue+":processing", 0, w.key)
 	r.Send("HDEL", w.Queue+":payload", w.key)
-	_, err := r.Do("EXEC")
-	return err
+	r.Send("HDEL", w.Queue+":enqueued", w.key)
+	r.Send("HDEL", w.Queue+":producer", w.key)
+	r.Send("ZREM", w.Queue+":deadlines", w.key)
+	r.Send("ZREM", expiryKey(w.Queue), w.key)
+	r.Send("HDEL", w.Queue+":attempts", w.key)
+	r.Send("DEL", cancelKey(w.Queue, w.key), chunksKey(w.Queue, w.key), historyKey(w.Queue, w.key))
+	if w.queue.dedupeNamespace != "" {
+		r.Send("HDEL", w.queue.dedupeKey(), w.key)
+	}
+	r.Send("HINCRBY", w.Queue+":stats", "completed", 1)
+	w.queue.throughput().send(r, 1)
+	if w.queue.DedupWindow > 0 {
+		r.Send("SET", doneKey(w.Queue, w.key), 1, "PX", w.queue.DedupWindow.Nanoseconds()/1000000)
+	}
+	if result != nil {
+		r.Send("SET", resultKey(w.Queue, w.key), result, "PX", w.queue.ResultTTL.Nanoseconds()/1000000)
+		r.Send("PUBLISH", resultKey(w.Queue, w.key), "")
+	}
+	if w.chained {
+		// A failed, cancelled or expired job abandons the rest of its
+		// workflow.
+		advance := !w.discarded && (result == nil || result[0] != resultFailed)
+		continueScript.send(r, continuationKey(w.Queue, w.key), advance)
+	}
+	if next != nil {
+		stepScript.send(r, next.args()...)
+	}
+	replies, err := redis.Values(r.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	// Only scripts can fail within the transaction.
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return err
+		}
+	}
+	if ref := payloadRef(w.record); ref != "" && w.queue.payloadStore != nil {
+		return w.queue.payloadStore.Delete(ref)
+	}
+	return nil
+}
+
+// Cancelled returns true if cancellation of the job has been requested with
+// JobQueue.RequestCancel. Cooperative handlers should check this periodically
+// and abort early, typically by calling Complete(), or instead watch the Done
+// channel of the context returned by Context. Concurrency safe.
+func (w *Work) Cancelled() (bool, error) {
+	if w.replay != nil {
+		return w.replay.cancelled, nil
+	}
+	r := getConn(w.pool, "Work.Cancelled")
+	defer r.Close()
+	return redis.Bool(r.Do("EXISTS", cancelKey(w.Queue, w.key)))
 }
 
 // Resubmit a job and return it to the job queue. Concurrency safe.
+//
+// If the job has been retrieved MaxAttempts times it is moved to the queue's
+// dead letters instead. With a RetryBackoff, it is delayed before its next
+// attempt.
+//
+// On a queue created WithPayloadIntegrity, ErrPayloadChanged is returned and
+// the job is left in progress if its payload has changed since it was
+// retrieved.
 func (w *Work) Resubmit() error {
-	r := w.pool.Get()
+	w.checkFinalize()
+	if checksum := w.verifyChecksum(); checksum != "" {
+		return w.markFinalized(WorkResubmitted, w.verifiedResubmit(checksum))
+	}
+	return w.markFinalized(WorkResubmitted, w.resubmit())
+}
+
+func (w *Work) resubmit() error {
+	if w.replay != nil {
+		return w.replay.finalize(WorkResubmitted)
+	}
+	if w.exhausted() {
+		return w.deadLetter("", w.exhaustedError(nil))
+	}
+	if delay := w.retryDelay(); delay > 0 {
+		return w.retry(delay, "", "")
+	}
+	r := getConn(w.pool, "Work.Resubmit")
 	defer r.Close()
 	r.Send("MULTI")
 	r.Send("LREM", w.Queue+":processing", 0, w.key)
-	r.Send("LPUSH", w.Queue, w.key)
+	r.Send("ZREM", w.Queue+":deadlines", w.key)
+	r.Send("LPUSH", w.queue.priorityList(w.priority), w.key)
+	r.Send("HINCRBY", w.Queue+":stats", "resubmitted", 1)
 	_, err := r.Do("EXEC")
 	return err
 }
 
-func jobQueueRawMarshal(v interface{}) (payload []byte, err error) {
-	payload, err = json.Marshal(v)
-	if err != nil {
-		return nil, err
+func (w *Work) verifiedResubmit(checksum string) error {
+	if w.replay != nil {
+		return w.replay.finalize(WorkResubmitted)
 	}
-	return
-}
-
-func jobQueueMarshal(job interface{}) (key []byte, payload []byte, err error) {
-	if payload, err = jobQueueRawMarshal(job); err != nil {
-		return
+	if w.exhausted() {
+		return w.deadLetter("", w.exhaustedError(nil))
 	}
-	key = payload
-	if keyer, ok := job.(JobQueueKeyer); ok {
-		payload = keyer.JobQueueKey()
+	if delay := w.retryDelay(); delay > 0 {
+		return w.retry(delay, "", checksum)
 	}
-	return
+	r := getConn(w.pool, "Work.Resubmit")
+	defer r.Close()
+	_, err := verifiedResubmitScript.do(r, w.Queue+":processing", w.queue.priorityList(w.priority), w.Queue+":payload", w.Queue+":deadlines",
+		w.Queue+":stats", w.key, checksum)
+	return err
+}
+
+// doneKey is the tombstone left by a job completed with a DedupWindow.
+func doneKey(queue string, key []byte) string {
+	return queue + ":done:" + string(key)
 }
 
-func jobQueueUnmarshal(payload []byte, v interface{}) error {
-	return json.Unmarshal(payload, v)
+func cancelKey(queue string, key []byte) string {
+	return queue + ":cancel:" + string(key)
 }
@@ -0,0 +1,122 @@
+package grt
+
+import (
+	"context"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// LeaderElector campaigns for leadership of a key among all clients using
+// it, by holding a Lock, so that exactly one of them at a time does some
+// work. Leadership lasts until it is lost or the elector stops, after which
+// the elector campaigns again.
+type LeaderElector struct {
+	// Held while leader. Its Expiry bounds how long a crashed leader can
+	// delay the next election. It must not be locked or unlocked directly.
+	Lock *Lock
+	// Identifies this elector to Leader.
+	Identity string
+	// Called in its own goroutine on election, with a context cancelled when
+	// leadership ends. The elector waits for it to return before resigning.
+	OnElected func(ctx context.Context)
+	// Called after leadership ends and OnElected has returned.
+	OnResigned func()
+	// Receives lost leadership and campaign errors. Defaults to
+	// slog.Default().
+	Logger *slog.Logger
+	leader int32
+}
+
+// NewLeaderElector creates a new elector for key, identified by identity, or
+// by a random value if identity is empty.
+func NewLeaderElector(pool *redis.Pool, key string, identity string) *LeaderElector {
+	if identity == "" {
+		identity = randomKey("")
+	}
+	return &LeaderElector{Lock: NewLock(pool, key), Identity: identity}
+}
+
+// Run campaigns for leadership until ctx is done, calling OnElected and
+// OnResigned as leadership is won and lost. It returns once any leadership
+// held when ctx is done has been resigned.
+func (e *LeaderElector) Run(ctx context.Context) error {
+	e.Lock.tokenPrefix = e.Identity + leaderSeparator
+	for {
+		if err := e.Lock.LockContext(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			lockLogger(e.Logger).Error("Leader election failed", "key", e.Lock.Key, "error", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(e.Lock.Expiry):
+			}
+			continue
+		}
+		e.lead(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// lead runs OnElected until leadership is lost or ctx is done, then resigns.
+func (e *LeaderElector) lead(ctx context.Context) {
+	atomic.StoreInt32(&e.leader, 1)
+	leading, cancel := context.WithCancel(ctx)
+	elected := make(chan struct{})
+	go func() {
+		defer close(elected)
+		if e.OnElected != nil {
+			e.OnElected(leading)
+		}
+	}()
+	lost := false
+	select {
+	case err := <-e.Lock.Done():
+		lockLogger(e.Logger).Warn("Leadership lost", "key", e.Lock.Key, "identity", e.Identity, "error", err)
+		lost = true
+	case <-ctx.Done():
+	}
+	atomic.StoreInt32(&e.leader, 0)
+	cancel()
+	<-elected
+	// Unlock reports a loss already logged again, eg. ErrLockLost if the
+	// lock expired or was taken over while OnElected returned.
+	if err := e.Lock.Unlock(); err != nil && !(lost && errors.Is(err, ErrLockLost)) {
+		lockLogger(e.Logger).Warn("Failed to resign leadership", "key", e.Lock.Key, "identity", e.Identity, "error", err)
+	}
+	if e.OnResigned != nil {
+		e.OnResigned()
+	}
+}
+
+// IsLeader returns true while this elector holds leadership.
+func (e *LeaderElector) IsLeader() bool {
+	return atomic.LoadInt32(&e.leader) == 1
+}
+
+// Leader returns the Identity of the current leader of the elector's key, or
+// "" if there is none.
+func (e *LeaderElector) Leader() (string, error) {
+	r := getConn(e.Lock.pool, "LeaderElector.Leader")
+	defer r.Close()
+	token, err := redis.String(r.Do("GET", e.Lock.Key))
+	if err == redis.ErrNil {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if i := strings.LastIndex(token, leaderSeparator); i >= 0 {
+		return token[:i], nil
+	}
+	return "", nil
+}
+
+// Separates the leader's identity from the random part of its lock token.
+const leaderSeparator = "/"
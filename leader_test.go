@@ -0,0 +1,114 @@
+package grt_test
+
+import (
+	"context"
+	"github.com/alecthomas/grt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeaderHandover(t *testing.T) {
+	_, pool := newPool(t)
+	events := make(chan string, 10)
+	electors := map[string]*grt.LeaderElector{}
+	for _, identity := range []string{"a", "b"} {
+		identity := identity
+		e := grt.NewLeaderElector(pool, "leader", identity)
+		e.Lock.Expiry = 200 * time.Millisecond
+		e.OnElected = func(ctx context.Context) {
+			events <- identity + " elected"
+			<-ctx.Done()
+		}
+		e.OnResigned = func() { events <- identity + " resigned" }
+		electors[identity] = e
+	}
+	ctxA, cancelA := context.WithCancel(context.Background())
+	doneA := make(chan error, 1)
+	go func() { doneA <- electors["a"].Run(ctxA) }()
+	if event := <-events; event != "a elected" {
+		t.Fatal(event)
+	}
+	ctxB, cancelB := context.WithCancel(context.Background())
+	doneB := make(chan error, 1)
+	go func() { doneB <- electors["b"].Run(ctxB) }()
+	time.Sleep(50 * time.Millisecond)
+	if !electors["a"].IsLeader() || electors["b"].IsLeader() {
+		t.Fatal("leadership was not exclusive")
+	}
+	if leader, err := electors["b"].Leader(); leader != "a" || err != nil {
+		t.Fatal(leader, err)
+	}
+	// Stopping the leader resigns, and the other takes over on release.
+	start := time.Now()
+	cancelA()
+	if err := <-doneA; err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"a resigned", "b elected"} {
+		if event := <-events; event != want {
+			t.Fatalf("%s, want %s", event, want)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Fatalf("handed over after %s", elapsed)
+	}
+	if leader, err := electors["a"].Leader(); leader != "b" || err != nil {
+		t.Fatal(leader, err)
+	}
+	cancelB()
+	if err := <-doneB; err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event != "b resigned" {
+		t.Fatal(event)
+	}
+	if leader, err := electors["a"].Leader(); leader != "" || err != nil {
+		t.Fatal(leader, err)
+	}
+}
+
+func TestLeaderLost(t *testing.T) {
+	s, pool := newPool(t)
+	logs := &syncBuffer{}
+	e := grt.NewLeaderElector(pool, "leader", "a")
+	e.Logger = slog.New(slog.NewTextHandler(logs, nil))
+	e.Lock.Expiry = 200 * time.Millisecond
+	e.Lock.RetryAttempts = 0
+	elected := make(chan struct{}, 10)
+	resigned := make(chan struct{}, 10)
+	e.OnElected = func(ctx context.Context) {
+		elected <- struct{}{}
+		<-ctx.Done()
+	}
+	e.OnResigned = func() { resigned <- struct{}{} }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- e.Run(ctx) }()
+	<-elected
+	// Another client takes the lock over.
+	s.Set("leader", "b/token")
+	select {
+	case <-resigned:
+	case <-time.After(time.Second):
+		t.Fatal("leadership was not lost")
+	}
+	if e.IsLeader() {
+		t.Fatal("still leader")
+	}
+	if text := logs.String(); !strings.Contains(text, `msg="Leadership lost" key=leader identity=a`) || strings.Contains(text, "Failed to resign") {
+		t.Fatal(text)
+	}
+	// The elector campaigns again once the lock is free.
+	s.Del("leader")
+	select {
+	case <-elected:
+	case <-time.After(time.Second):
+		t.Fatal("not elected again")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,129 @@
+package grt
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// LimiterAlgorithm is how a Limiter counts events.
+type LimiterAlgorithm int
+
+const (
+	// TokenBucket allows bursts of up to Limit events, refilled evenly over
+	// Window. It stores two numbers per key.
+	TokenBucket LimiterAlgorithm = iota
+	// SlidingWindow allows at most Limit events in any Window, exactly. It
+	// stores every event in the window, so suits small limits.
+	SlidingWindow
+)
+
+func (a LimiterAlgorithm) String() string {
+	switch a {
+	case TokenBucket:
+		return "token_bucket"
+	case SlidingWindow:
+		return "sliding_window"
+	default:
+		return fmt.Sprintf("LimiterAlgorithm(%d)", int(a))
+	}
+}
+
+// Limiter is a Redis-based rate limiter for many independent keys, eg. one
+// per API client, shared by all clients using the same Prefix.
+//
+// For a single limit, RateLimiter has a simpler interface.
+type Limiter struct {
+	pool *redis.Pool
+	// Prepended, with a colon, to each key to form its Redis key.
+	Prefix string
+	// Maximum number of events per Window.
+	Limit  int
+	Window time.Duration
+	// Defaults to TokenBucket.
+	Algorithm LimiterAlgorithm
+}
+
+// NewLimiter creates a new Redis rate limiter allowing limit events per
+// window for each key.
+func NewLimiter(pool *redis.Pool, prefix string, limit int, window time.Duration) *Limiter {
+	return &Limiter{pool: pool, Prefix: prefix, Limit: limit, Window: window}
+}
+
+// Allow records an event for key, returning false without recording it if
+// key's limit has been reached.
+func (l *Limiter) Allow(key string) (bool, error) {
+	return l.AllowN(key, 1)
+}
+
+// AllowN records n events for key if all of them are within key's limit,
+// returning false without recording any otherwise.
+func (l *Limiter) AllowN(key string, n int) (bool, error) {
+	if n > l.Limit {
+		return false, nil
+	}
+	granted, _, err := l.take(key, n, takeAll)
+	return granted == n, err
+}
+
+// Reserve records an event for key whether or not its limit has been
+// reached, returning how long the caller must wait before acting on it to
+// stay within the limit. A reservation cannot be cancelled.
+func (l *Limiter) Reserve(key string) (time.Duration, error) {
+	_, delay, err := l.take(key, 1, takeReserve)
+	return delay, err
+}
+
+func (l *Limiter) take(key string, n int, mode int) (granted int, delay time.Duration, err error) {
+	r := getConn(l.pool, "Limiter.Take")
+	defer r.Close()
+	var reply []interface{}
+	switch l.Algorithm {
+	case TokenBucket:
+		rate := float64(l.Limit) / l.Window.Seconds()
+		reply, err = rateTakeScript.do(r, l.key(key), formatRate(rate), l.Limit, n, mode)
+	case SlidingWindow:
+		reply, err = slidingWindowScript.do(r, l.key(key), l.Limit, l.Window.Milliseconds(), n,
+			mode == takeReserve, randomKey(""))
+	default:
+		return 0, 0, fmt.Errorf("unknown limiter algorithm %s", l.Algorithm)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(reply[0].(int64)), time.Duration(reply[1].(int64)) * time.Millisecond, nil
+}
+
+func (l *Limiter) key(key string) string {
+	return l.Prefix + ":" + key
+}
+
+// KEYS: sorted set of events scored by time. ARGV: limit, window in
+// milliseconds, events wanted, whether to reserve, unique event ID. Events
+// older than the window are discarded. Returns the number of events
+// recorded, and the milliseconds until they are within the limit: if not
+// reserving, none are recorded unless they all fit now.
+var slidingWindowScript = newLuaScript("sliding_window", 1, 1, `
+redis.replicate_commands()
+local now = redis.call("TIME")
+local ms = now[1] * 1000 + math.floor(now[2] / 1000)
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local wanted = tonumber(ARGV[3])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ms - window)
+local count = redis.call("ZCARD", KEYS[1])
+local at = ms
+if count + wanted > limit then
+  -- The events must wait until enough of those recorded leave the window.
+  local oldest = redis.call("ZRANGE", KEYS[1], count + wanted - limit - 1, count + wanted - limit - 1, "WITHSCORES")
+  at = math.max(ms, tonumber(oldest[2]) + window)
+  if ARGV[4] ~= "1" then
+    return {0, 0, at - ms}
+  end
+end
+for i = 1, wanted do
+  redis.call("ZADD", KEYS[1], at, ARGV[5] .. ":" .. i)
+end
+redis.call("PEXPIRE", KEYS[1], at - ms + window)
+return {0, wanted, at - ms}
+`)
@@ -0,0 +1,85 @@
+package grt_test
+
+import (
+	"github.com/alecthomas/grt"
+	"testing"
+	"time"
+)
+
+// allow checks whether a Limiter allows n events for key.
+func allow(t *testing.T, l *grt.Limiter, key string, n int, want bool) {
+	t.Helper()
+	allowed, err := l.AllowN(key, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed != want {
+		t.Fatalf("%d events for %s allowed: %v, want %v", n, key, allowed, want)
+	}
+}
+
+func TestLimiterTokenBucket(t *testing.T) {
+	s, pool := newPool(t)
+	now := time.Now().Truncate(time.Second)
+	s.SetTime(now)
+	l := grt.NewLimiter(pool, "limiter", 5, time.Second)
+	// A full bucket allows a burst of up to Limit events.
+	allow(t, l, "a", 6, false)
+	allow(t, l, "a", 5, true)
+	allow(t, l, "a", 1, false)
+	// Keys are limited independently.
+	allow(t, l, "b", 5, true)
+	// Tokens are refilled evenly over the window.
+	now = now.Add(200 * time.Millisecond)
+	s.SetTime(now)
+	allow(t, l, "a", 1, true)
+	allow(t, l, "a", 1, false)
+	now = now.Add(400 * time.Millisecond)
+	s.SetTime(now)
+	allow(t, l, "a", 3, false)
+	allow(t, l, "a", 2, true)
+	// Refilling stops at a full bucket, however long it is left.
+	now = now.Add(time.Hour)
+	s.SetTime(now)
+	allow(t, l, "a", 5, true)
+	allow(t, l, "a", 1, false)
+	// Reservations queue up behind each other.
+	for i := 1; i <= 3; i++ {
+		delay, err := l.Reserve("a")
+		if want := time.Duration(i) * 200 * time.Millisecond; delay != want || err != nil {
+			t.Fatalf("reservation %d: %s, want %s: %v", i, delay, want, err)
+		}
+	}
+}
+
+func TestLimiterSlidingWindow(t *testing.T) {
+	s, pool := newPool(t)
+	now := time.Now().Truncate(time.Second)
+	s.SetTime(now)
+	l := grt.NewLimiter(pool, "limiter", 3, time.Second)
+	l.Algorithm = grt.SlidingWindow
+	allow(t, l, "a", 4, false)
+	allow(t, l, "a", 2, true)
+	now = now.Add(500 * time.Millisecond)
+	s.SetTime(now)
+	allow(t, l, "a", 2, false)
+	allow(t, l, "a", 1, true)
+	allow(t, l, "b", 3, true)
+	// Events leave the window exactly a window after they were recorded.
+	now = now.Add(499 * time.Millisecond)
+	s.SetTime(now)
+	allow(t, l, "a", 1, false)
+	now = now.Add(time.Millisecond)
+	s.SetTime(now)
+	allow(t, l, "a", 2, true)
+	allow(t, l, "a", 1, false)
+	// The third event, recorded 500ms ago, leaves the window next.
+	delay, err := l.Reserve("a")
+	if delay != 500*time.Millisecond || err != nil {
+		t.Fatal(delay, err)
+	}
+	// The reservation counts against the window it was made for.
+	now = now.Add(500 * time.Millisecond)
+	s.SetTime(now)
+	allow(t, l, "a", 1, false)
+}
@@ -0,0 +1,220 @@
+package grt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+)
+
+var (
+	// ErrInvalidCursor is returned by listing methods when given a cursor
+	// they did not produce.
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// Listing methods take an opaque cursor ("" to start) and an approximate
+// page size, and return a page of items and the cursor for the next page,
+// which is "" when iteration is complete.
+//
+// Iteration is stable under concurrent modification: an item present for the
+// whole iteration is returned at least once, though it may be returned more
+// than once. Items added or removed during iteration may or may not be
+// returned.
+
+// JobEntry is a job as stored in Redis.
+type JobEntry struct {
+	Key []byte
+	// Encoded payload, or nil if the payload is stored externally, in
+	// chunks or compressed.
+	Payload []byte
+}
+
+// Jobs lists all jobs that are queued or in progress. See "Listing methods"
+// for cursor semantics.
+func (c *JobQueue) Jobs(cursor string, limit int) (jobs []JobEntry, next string, err error) {
+	return c.scanJobs("JobQueue.Jobs", "jobs", c.Queue+":payload", cursor, limit)
+}
+
+// scanJobs lists the jobs in a hash of keys to payload records.
+func (c *JobQueue) scanJobs(op, listing, hash string, cursor string, limit int) (jobs []JobEntry, next string, err error) {
+	position, err := decodeCursor(listing, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	r := getConn(c.pool, op)
+	defer r.Close()
+	reply, err := redis.Values(r.Do("HSCAN", hash, position, "COUNT", limit))
+	if err != nil {
+		return nil, "", err
+	}
+	position, err = redis.String(reply[0], nil)
+	if err != nil {
+		return nil, "", err
+	}
+	fields, err := redis.ByteSlices(reply[1], nil)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		jobs = append(jobs, JobEntry{Key: fields[i], Payload: inlinePayload(fields[i+1])})
+	}
+	if position == "0" {
+		return jobs, "", nil
+	}
+	return jobs, encodeCursor(listing, position), nil
+}
+
+// Waiting lists the jobs waiting to be retrieved, newest first within each
+// priority, highest priority first. See "Listing methods" for cursor
+// semantics.
+func (c *JobQueue) Waiting(cursor string, limit int) (jobs []JobEntry, next string, err error) {
+	return c.listJobs("JobQueue.Waiting", "waiting", c.waitingLists(), cursor, limit)
+}
+
+// InProgress lists the jobs that have been retrieved and not yet finalized,
+// most recently retrieved first. See "Listing methods" for cursor semantics.
+func (c *JobQueue) InProgress(cursor string, limit int) (jobs []JobEntry, next string, err error) {
+	return c.listJobs("JobQueue.InProgress", "in_progress", []string{c.Queue + ":processing"}, cursor, limit)
+}
+
+// listJobs lists the jobs in each of lists in turn, from the head. Jobs are
+// removed from the tail, so removals do not cause others to be skipped.
+func (c *JobQueue) listJobs(op, listing string, lists []string, cursor string, limit int) (jobs []JobEntry, next string, err error) {
+	position, err := decodeCursor(listing, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	list, offset := 0, 0
+	if position != "0" {
+		if _, err := fmt.Sscanf(position, "%d:%d", &list, &offset); err != nil || list >= len(lists) {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	r := getConn(c.pool, op)
+	defer r.Close()
+	keys, err := redis.ByteSlices(r.Do("LRANGE", lists[list], offset, offset+limit-1))
+	if err != nil {
+		return nil, "", err
+	}
+	if jobs, err = c.jobEntries(r, keys); err != nil {
+		return nil, "", err
+	}
+	if len(keys) < limit {
+		list, offset = list+1, 0
+	} else {
+		offset += len(keys)
+	}
+	if list == len(lists) {
+		return jobs, "", nil
+	}
+	return jobs, encodeCursor(listing, fmt.Sprintf("%d:%d", list, offset)), nil
+}
+
+// Peek returns up to n waiting jobs, in the order Get will retrieve them,
+// without removing them.
+func (c *JobQueue) Peek(n int) ([]JobEntry, error) {
+	jobs := []JobEntry{}
+	if n < 1 {
+		return jobs, nil
+	}
+	r := getConn(c.pool, "JobQueue.Peek")
+	defer r.Close()
+	for _, list := range c.waitingLists() {
+		if len(jobs) >= n {
+			break
+		}
+		// Jobs are retrieved from the tail.
+		keys, err := redis.ByteSlices(r.Do("LRANGE", list, -(n - len(jobs)), -1))
+		if err != nil {
+			return nil, err
+		}
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+		entries, err := c.jobEntries(r, keys)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, entries...)
+	}
+	return jobs, nil
+}
+
+// jobEntries fetches the payloads of keys, omitting jobs that have since been
+// removed.
+func (c *JobQueue) jobEntries(r redis.Conn, keys [][]byte) ([]JobEntry, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	records, err := redis.ByteSlices(r.Do("HMGET", redis.Args{c.Queue + ":payload"}.AddFlat(keys)...))
+	if err != nil {
+		return nil, err
+	}
+	jobs := []JobEntry{}
+	for i, key := range keys {
+		if records[i] != nil {
+			jobs = append(jobs, JobEntry{Key: key, Payload: inlinePayload(records[i])})
+		}
+	}
+	return jobs, nil
+}
+
+// ForEachPage drives a listing method to completion, calling fn with each
+// page of items. It stops early if ctx is cancelled or fn returns an error.
+func ForEachPage[T any](ctx context.Context, list func(cursor string, limit int) ([]T, string, error), limit int, fn func(page []T) error) error {
+	cursor := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		page, next, err := list(cursor, limit)
+		if err != nil {
+			return err
+		}
+		if len(page) > 0 {
+			if err := fn(page); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// inlinePayload returns the payload in a payload hash entry, or nil if it is
+// stored elsewhere or compressed.
+func inlinePayload(record []byte) []byte {
+	_, record = splitVersion(record)
+	if payloadRef(record) != "" || bytes.HasPrefix(record, []byte(chunksRecordPrefix)) || isCompressed(record) {
+		return nil
+	}
+	return record
+}
+
+// encodeCursor encodes an underlying Redis position as an opaque cursor for
+// the named listing.
+func encodeCursor(listing, position string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(listing + ":" + position))
+}
+
+// decodeCursor decodes a cursor produced by encodeCursor for the named
+// listing. An empty cursor is the start of the listing.
+func decodeCursor(listing, cursor string) (string, error) {
+	if cursor == "" {
+		return "0", nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(data), listing+":") {
+		return "", ErrInvalidCursor
+	}
+	return string(data[len(listing)+1:]), nil
+}
@@ -0,0 +1,290 @@
+package grt_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alecthomas/grt"
+	"testing"
+)
+
+// iterate lists every page of list, calling mutate between pages, and
+// returns how often each key was listed.
+func iterate(t *testing.T, list func(cursor string, limit int) ([]grt.JobEntry, string, error), mutate func(page int)) map[string]int {
+	t.Helper()
+	seen := map[string]int{}
+	page := 0
+	err := grt.ForEachPage(context.Background(), list, 7, func(entries []grt.JobEntry) error {
+		for _, entry := range entries {
+			seen[string(entry.Key)]++
+		}
+		page++
+		mutate(page)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seen
+}
+
+func submitJobs(t *testing.T, q *grt.JobQueue, prefix string, n int) []string {
+	t.Helper()
+	keys := []string{}
+	for i := 0; i < n; i++ {
+		job := fmt.Sprintf("%s%d", prefix, i)
+		if err := q.Submit(job); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, `"`+job+`"`)
+	}
+	return keys
+}
+
+func TestListingUnderMutation(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "listing")
+	keys := submitJobs(t, q, "job", 50)
+	tests := []struct {
+		name string
+		list func(string, int) ([]grt.JobEntry, string, error)
+	}{
+		{"Waiting", q.Waiting},
+		{"Jobs", q.Jobs},
+	}
+	batch := 0
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Jobs are retrieved oldest first, so the ten retrieved during
+			// each iteration, and those before it, are not present
+			// throughout.
+			present := keys[10*(i+1):]
+			retrieved := 0
+			seen := iterate(t, test.list, func(int) {
+				batch++
+				submitJobs(t, q, fmt.Sprintf("new%d-", batch), 3)
+				if retrieved < 10 {
+					w, err := q.Get(nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if err := w.Complete(); err != nil {
+						t.Fatal(err)
+					}
+					retrieved++
+				}
+			})
+			for _, key := range present {
+				if seen[key] == 0 {
+					t.Errorf("%s was skipped", key)
+				}
+			}
+		})
+	}
+}
+
+func TestInProgressUnderMutation(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "listing")
+	keys := submitJobs(t, q, "job", 30)
+	held := []*grt.Work{}
+	for range keys {
+		w, err := q.Get(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, w)
+	}
+	// Completing the oldest retrieved jobs removes them from the tail.
+	seen := iterate(t, q.InProgress, func(page int) {
+		if err := held[0].Complete(); err != nil {
+			t.Fatal(err)
+		}
+		held = held[1:]
+		submitJobs(t, q, fmt.Sprintf("new%d-", page), 1)
+		w, err := q.Get(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, w)
+	})
+	for _, w := range held {
+		if err := w.Complete(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range keys[5:] {
+		if seen[key] == 0 {
+			t.Errorf("%s was skipped", key)
+		}
+	}
+}
+
+func TestDeadJobsListing(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "listing")
+	q.MaxAttempts = 1
+	keys := submitJobs(t, q, "job", 20)
+	for range keys {
+		w, err := q.Get(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Resubmit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := iterate(t, q.DeadJobs, func(int) {})
+	for _, key := range keys {
+		if seen[key] == 0 {
+			t.Errorf("%s was skipped", key)
+		}
+	}
+}
+
+func TestListingCursors(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "listing")
+	submitJobs(t, q, "job", 10)
+	page, next, err := q.Waiting("", 4)
+	if err != nil || len(page) != 4 || next == "" {
+		t.Fatal(page, next, err)
+	}
+	// Cursors belong to the listing that produced them.
+	if _, _, err := q.InProgress(next, 4); err != grt.ErrInvalidCursor {
+		t.Fatal(err)
+	}
+	if _, _, err := q.Waiting("garbage", 4); err != grt.ErrInvalidCursor {
+		t.Fatal(err)
+	}
+	page, next, err = q.Waiting("", 100)
+	if err != nil || len(page) != 10 || next != "" {
+		t.Fatal(len(page), next, err)
+	}
+}
+
+func TestForEachPageStops(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "listing")
+	submitJobs(t, q, "job", 10)
+	stop := errors.New("stop")
+	pages := 0
+	err := grt.ForEachPage(context.Background(), q.Waiting, 3, func(page []grt.JobEntry) error {
+		pages++
+		return stop
+	})
+	if err != stop || pages != 1 {
+		t.Fatal(pages, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pages = 0
+	err = grt.ForEachPage(ctx, q.Waiting, 3, func(page []grt.JobEntry) error {
+		pages++
+		cancel()
+		return nil
+	})
+	if err != context.Canceled || pages != 1 {
+		t.Fatal(pages, err)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "listing")
+	keys := submitJobs(t, q, "job", 5)
+	jobs, err := q.Peek(10)
+	if err != nil || len(jobs) != 5 {
+		t.Fatal(jobs, err)
+	}
+	// Jobs are listed in the order Get retrieves them.
+	for i, job := range jobs {
+		if string(job.Key) != keys[i] || string(job.Payload) != keys[i] {
+			t.Fatalf("entry %d is %s", i, job.Payload)
+		}
+	}
+	if jobs, err := q.Peek(2); err != nil || len(jobs) != 2 || string(jobs[1].Key) != keys[1] {
+		t.Fatal(jobs, err)
+	}
+	if n, err := q.Len(); n != 5 || err != nil {
+		t.Fatal(n, err)
+	}
+	// A job retrieved between reading the list and its payload is skipped.
+	s.HDel("listing:payload", keys[2])
+	if jobs, err := q.Peek(10); err != nil || len(jobs) != 4 || string(jobs[2].Key) != keys[3] {
+		t.Fatal(jobs, err)
+	}
+	var job string
+	w, err := q.Get(&job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Complete()
+	inProgress, next, err := q.InProgress("", 10)
+	if err != nil || next != "" || len(inProgress) != 1 || string(inProgress[0].Key) != keys[0] {
+		t.Fatal(inProgress, next, err)
+	}
+}
+
+func TestPeekPriorities(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "listing", grt.WithPriorities())
+	if err := q.Submit("normal"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SubmitWithPriority("high", grt.PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SubmitWithPriority("low", grt.PriorityLow); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := q.Peek(3)
+	if err != nil || len(jobs) != 3 {
+		t.Fatal(jobs, err)
+	}
+	for i, want := range []string{`"high"`, `"normal"`, `"low"`} {
+		if string(jobs[i].Key) != want {
+			t.Fatalf("entry %d is %s, want %s", i, jobs[i].Key, want)
+		}
+	}
+}
+
+func TestNamespaceListQueues(t *testing.T) {
+	_, pool := newPool(t)
+	for _, queue := range []*grt.JobQueue{
+		grt.NewJobQueue(pool, "root"),
+		grt.Namespace("prod").NewJobQueue(pool, "jobs"),
+		grt.Namespace("prod").NewJobQueue(pool, "mail"),
+		grt.Namespace("prod:eu").NewJobQueue(pool, "jobs"),
+		grt.Namespace("staging").NewJobQueue(pool, "jobs"),
+	} {
+		if err := queue.Submit("job"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		namespace grt.Namespace
+		want      []string
+	}{
+		{"", []string{"root"}},
+		{"prod", []string{"jobs", "mail"}},
+		{"prod:eu", []string{"jobs"}},
+		{"staging", []string{"jobs"}},
+	}
+	for _, test := range tests {
+		queues, err := test.namespace.ListQueues(context.Background(), pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(queues) != fmt.Sprint(test.want) {
+			t.Errorf("namespace %q: expected %v, got %v", test.namespace, test.want, queues)
+		}
+	}
+	// ListQueues lists every queue, nested or not.
+	all, err := grt.ListQueues(context.Background(), pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[prod:eu:jobs prod:jobs prod:mail root staging:jobs]"; fmt.Sprint(all) != want {
+		t.Fatalf("expected %s, got %v", want, all)
+	}
+}
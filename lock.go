@@ -1,98 +1,523 @@
 package grt
 
 import (
+	"context"
 	"errors"
+	"github.com/alecthomas/grt/backoff"
 	"github.com/garyburd/redigo/redis"
-	"sync"
+	"log/slog"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	// ErrLockTimeout is returned by LockWait() when the lock expires.
 	ErrLockTimeout = errors.New("lock timeout")
+	// ErrLockLost is returned by Unlock() if the lock expired and was
+	// acquired by another client before it was released.
+	ErrLockLost = errors.New("lock lost")
+	// ErrNotLocked is returned by Unlock() if the lock is not held.
+	ErrNotLocked = errors.New("not locked")
 )
 
-// Lock is a Redis-based lock.
+// Lock is a Redis-based lock. Like sync.Mutex, a Lock may be locked and
+// unlocked repeatedly and from multiple goroutines, each hold excluding other
+// goroutines as well as other clients.
 type Lock struct {
 	pool *redis.Pool
 	Key  string
 	// Set the expiry time.
-	Expiry  time.Duration
-	lock    sync.Mutex
-	errors  chan error
-	stop    chan bool
-	stopped chan bool
+	Expiry time.Duration
+	// Backoff between acquisition attempts in LockWait, which also retries as
+	// soon as the holder releases the lock. Defaults to waiting Expiry
+	// between attempts, by which time a crashed holder's lock has expired.
+	Backoff backoff.Backoff
+	// A warning is logged if the lock's remaining TTL when renewed drops
+	// below this fraction of Expiry, indicating that renewals are being
+	// delayed (eg. by GC pauses) close to the point of losing the lock.
+	TTLWarningFraction float64
+	// Number of times a failed renewal is retried, RetryDelay apart, before
+	// the lock is declared lost.
+	RetryAttempts int
+	RetryDelay    time.Duration
+	// Receives renewals at debug level, and lost holds and renewal warnings.
+	// Defaults to slog.Default().
+	Logger *slog.Logger
+	// Called when the lock is acquired, with how long acquiring it took, eg.
+	// for metrics.
+	OnAcquired func(wait time.Duration)
+	// Called when a hold is lost, with the error it was lost to.
+	OnLost func(err error)
+	// Held by the goroutine holding or acquiring the lock.
+	lock chan struct{}
+	// Prepended to the tokens of holds, eg. to identify the holder.
+	tokenPrefix string
+	// The current or most recent hold.
+	hold   *lockHold
+	strict bool
+	held   int32
+	// Fencing token of the current or most recent hold.
+	fence int64
+	// Minimum remaining TTL observed when renewing during the current or
+	// most recent hold, in nanoseconds.
+	minRemaining int64
+}
+
+// LockStats are statistics for the current or most recent hold of a Lock.
+type LockStats struct {
+	// Minimum remaining TTL of the lock observed immediately before a
+	// heartbeat renewed it.
+	MinRemainingTTL time.Duration
 }
 
 // NewLock creates a new Redis lock.
 func NewLock(pool *redis.Pool, key string) *Lock {
-	return &Lock{
-		pool:    pool,
-		Key:     key,
-		Expiry:  time.Second * 2,
-		errors:  make(chan error, 1),
-		stop:    make(chan bool, 1),
-		stopped: make(chan bool, 1),
+	l := &Lock{
+		pool:               pool,
+		Key:                key,
+		Expiry:             time.Second * 2,
+		TTLWarningFraction: 0.25,
+		RetryAttempts:      3,
+		RetryDelay:         time.Millisecond * 100,
+		lock:               make(chan struct{}, 1),
+		strict:             strictEnabled(),
 	}
+	if l.strict {
+		registerStrictLock(key)
+	}
+	return l
 }
 
 // Lock is a blocking lock. Returns nil if the lock is acquired, or any Redis error.
 func (l *Lock) Lock() error {
-	return l.LockWait(time.Hour * 100000)
+	return l.LockContext(context.Background())
 }
 
 // LockWait is a non-blocking lock. Returns nil if the lock is acquired,
 // ErrLockTimeout if the timeout is reached, or any Redis error.
 func (l *Lock) LockWait(wait time.Duration) error {
-	l.lock.Lock()
-	r := l.pool.Get()
-	defer r.Close()
-	expire := time.Now().Add(wait)
-	for {
-		v, err := r.Do("SET", l.Key, 1, "NX", "PX", l.Expiry.Nanoseconds()/1000000)
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	err := l.LockContext(ctx)
+	if err == context.DeadlineExceeded {
+		return ErrLockTimeout
+	}
+	return err
+}
+
+// LockContext acquires the lock, waiting until it is acquired or ctx is done.
+// Returns nil if the lock is acquired, ctx.Err() if ctx is done first, or any
+// Redis error.
+//
+// While the lock is held elsewhere, LockContext subscribes to notifications
+// of its release on a connection of its own, except on a single connection
+// pool.
+func (l *Lock) LockContext(ctx context.Context) error {
+	start := time.Now()
+	if err := takeSlot(ctx, l.lock); err != nil {
+		return err
+	}
+	op := startOperation("Lock.Lock")
+	defer op.end()
+	token := randomKey(l.tokenPrefix)
+	err := waitForLock(ctx, l.pool, l.Key, l.backoff(), func() (bool, error) {
+		return l.acquire(op, token)
+	})
+	if err != nil {
+		<-l.lock
+		return err
+	}
+	l.start(token)
+	l.acquired(time.Since(start))
+	return nil
+}
+
+// takeSlot takes the single slot of slot, which serializes the holds of a lock
+// within the process, waiting until it is free or ctx is done. A free slot is
+// taken even if ctx is already done, so that an expired or zero deadline still
+// makes one attempt at the lock.
+func takeSlot(ctx context.Context, slot chan struct{}) error {
+	select {
+	case slot <- struct{}{}:
+		return nil
+	default:
+	}
+	select {
+	case slot <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitForLockTimeout is waitForLock with a timeout, returning ErrLockTimeout
+// when it is reached.
+func waitForLockTimeout(wait time.Duration, pool *redis.Pool, key string, b backoff.Backoff, acquire func() (bool, error)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	err := waitForLock(ctx, pool, key, b, acquire)
+	if err == context.DeadlineExceeded {
+		return ErrLockTimeout
+	}
+	return err
+}
+
+// waitForLock calls acquire until it succeeds or ctx is done, backing off
+// between attempts and retrying early when the lock at key is released. A
+// final attempt is made when ctx is done.
+func waitForLock(ctx context.Context, pool *redis.Pool, key string, b backoff.Backoff, acquire func() (bool, error)) error {
+	return waitForLockAll(ctx, []*redis.Pool{pool}, key, b, acquire)
+}
+
+// waitForLockAll is waitForLock for a lock held across pools, retrying early
+// when the lock is released on any of them.
+func waitForLockAll(ctx context.Context, pools []*redis.Pool, key string, b backoff.Backoff, acquire func() (bool, error)) error {
+	var released *notifications
+	defer func() {
+		if released != nil {
+			released.close()
+		}
+	}()
+	subscribable := []*redis.Pool{}
+	for _, pool := range pools {
+		if !isSingleConn(pool) {
+			subscribable = append(subscribable, pool)
+		}
+	}
+	for attempt := 0; ; {
+		// The connection is not held while backing off.
+		acquired, err := acquire()
 		if err != nil {
-			l.lock.Unlock()
 			return err
 		}
-		if v != nil {
-			break
+		if acquired {
+			return nil
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Retry straight after subscribing, in case the lock was released
+		// in between.
+		if released == nil && len(subscribable) > 0 {
+			if released = subscribeNotificationsAll(subscribable, "Lock.LockWait", lockReleasedChannel(key)); released != nil {
+				continue
+			}
+		}
+		released.wait(ctx, b.Next(attempt))
+		attempt++
+	}
+}
 
-		time.Sleep(l.Expiry)
-		if time.Now().After(expire) {
-			l.lock.Unlock()
-			return ErrLockTimeout
+// TryLock attempts to acquire the lock once, without waiting, returning
+// whether it was acquired. It returns false if another goroutine holds or is
+// acquiring this Lock.
+func (l *Lock) TryLock() (bool, error) {
+	start := time.Now()
+	select {
+	case l.lock <- struct{}{}:
+	default:
+		return false, nil
+	}
+	op := startOperation("Lock.TryLock")
+	defer op.end()
+	token := randomKey(l.tokenPrefix)
+	acquired, err := l.acquire(op, token)
+	if err != nil || !acquired {
+		<-l.lock
+		return false, err
+	}
+	l.start(token)
+	l.acquired(time.Since(start))
+	return true, nil
+}
+
+func (l *Lock) acquired(wait time.Duration) {
+	if l.OnAcquired != nil {
+		l.OnAcquired(wait)
+	}
+}
+
+func (l *Lock) acquire(op *operation, token string) (bool, error) {
+	r := op.conn(l.pool)
+	defer r.Close()
+	reply, err := acquireScript.do(r, l.Key, fenceKey(l.Key), token, l.Expiry.Nanoseconds()/1000000)
+	if err != nil {
+		return false, err
+	}
+	fence := reply[0].(int64)
+	if fence == 0 {
+		return false, nil
+	}
+	atomic.StoreInt64(&l.fence, fence)
+	return true, nil
+}
+
+// start a hold of the lock, acquired with token.
+func (l *Lock) start(token string) {
+	l.hold = newLockHold(token)
+	atomic.StoreInt64(&l.minRemaining, l.Expiry.Nanoseconds())
+	atomic.StoreInt32(&l.held, 1)
+	go l.hold.heartbeat(lockLogger(l.Logger), l.Key, l.Expiry/4, func() error {
+		err := renewWithRetries(l.RetryAttempts, l.RetryDelay, func() error {
+			r := getConn(l.pool, "Lock.heartbeat")
+			defer r.Close()
+			reply, err := renewScript.do(r, l.Key, token, l.Expiry.Nanoseconds()/1000000)
+			if err != nil {
+				return err
+			}
+			if ttl, _ := redis.Int64(reply[0], nil); ttl >= 0 {
+				l.observeRemaining(time.Duration(ttl) * time.Millisecond)
+				lockLogger(l.Logger).Debug("Lock renewed", "key", l.Key, "remaining", time.Duration(ttl)*time.Millisecond)
+			}
+			return nil
+		})
+		if err != nil && l.OnLost != nil {
+			l.OnLost(err)
 		}
+		return err
+	})
+}
+
+// Done returns a channel that receives an error if the current hold of the
+// lock is lost, because it could not be renewed or was taken over by another
+// client, and is closed when the hold ends. A critical section should abort
+// when it receives. Unlock must still be called.
+func (l *Lock) Done() <-chan error {
+	if l.hold == nil {
+		return nil
 	}
+	return l.hold.done
+}
 
-	// Lock heartbeat.
-	go l.heartbeat()
-	return nil
+// Held checks with Redis that the lock is still held by this hold, returning
+// false if it is not or Redis cannot be reached.
+func (l *Lock) Held() bool {
+	if atomic.LoadInt32(&l.held) == 0 {
+		return false
+	}
+	r := getConn(l.pool, "Lock.Held")
+	defer r.Close()
+	token, err := redis.String(r.Do("GET", l.Key))
+	return err == nil && token == l.hold.token
+}
+
+func lockReleasedChannel(key string) string {
+	return key + ":released"
 }
 
-func (l *Lock) heartbeat() {
-	wait := time.Tick(l.Expiry / 4)
+// Token returns a value unique to the current hold of the lock, for use as a
+// fencing token when writing to other systems.
+func (l *Lock) Token() string {
+	if l.hold == nil {
+		return ""
+	}
+	return l.hold.token
+}
+
+// FencingToken returns a number that increases with each hold of the lock by
+// any client, for downstream systems that reject writes from holders older
+// than the latest they have seen. It is zero if the lock has not been held.
+//
+// The counter is kept in Key+":fence", which never expires.
+func (l *Lock) FencingToken() int64 {
+	return atomic.LoadInt64(&l.fence)
+}
+
+func fenceKey(key string) string {
+	return key + ":fence"
+}
+
+func (l *Lock) backoff() backoff.Backoff {
+	if l.Backoff != nil {
+		return l.Backoff
+	}
+	return backoff.Constant(l.Expiry)
+}
+
+// lockHold is a single hold of a lock, kept alive by a heartbeat until it is
+// released or lost.
+type lockHold struct {
+	// Unique to the hold.
+	token string
+	// Closed to stop the heartbeat, which then sends any error it stopped
+	// on, or nil, to stopped.
+	stop    chan struct{}
+	stopped chan error
+	// Receives the error the hold was lost to, and is closed when the hold
+	// ends.
+	done chan error
+}
+
+func newLockHold(token string) *lockHold {
+	return &lockHold{
+		token:   token,
+		stop:    make(chan struct{}),
+		stopped: make(chan error, 1),
+		done:    make(chan error, 1),
+	}
+}
+
+// heartbeat calls renew every interval until the hold is released, or renew
+// fails, in which case the hold is lost and logged to logger.
+func (h *lockHold) heartbeat(logger *slog.Logger, key string, interval time.Duration, renew func() error) {
+	defer close(h.done)
+	wait := time.NewTicker(interval)
+	defer wait.Stop()
 	for {
-		r := l.pool.Get()
-		_, err := r.Do("SET", l.Key, 1, "XX", "PX", l.Expiry.Nanoseconds()/1000000)
-		r.Close()
-		if err != nil {
-			l.errors <- err
+		if err := renew(); err != nil {
+			logger.Error("Lock lost", "key", key, "error", err)
+			h.done <- err
+			h.stopped <- err
 			return
 		}
 
 		select {
-		case <-l.stop:
-			l.stopped <- true
+		case <-h.stop:
+			h.stopped <- nil
 			return
-		case <-wait:
+		case <-wait.C:
 		}
 	}
 }
 
-// Unlock the lock.
-func (l *Lock) Unlock() {
-	defer l.lock.Unlock()
-	l.stop <- true
-	<-l.stopped
+// release stops the heartbeat, waiting for it to exit.
+func (h *lockHold) release() {
+	close(h.stop)
+	<-h.stopped
+}
+
+// renewWithRetries calls renew, retrying errors other than ErrLockLost up to
+// attempts times, delay apart.
+func renewWithRetries(attempts int, delay time.Duration, renew func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := renew()
+		if err == nil || errors.Is(err, ErrLockLost) || attempt >= attempts {
+			return err
+		}
+		time.Sleep(delay)
+	}
+}
+
+// KEYS: lock, fencing counter. ARGV: token, expiry in milliseconds. Returns
+// the hold's fencing token if the lock was acquired, or 0.
+var acquireScript = newLuaScript("acquire", 1, 2, `
+if not redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+  return {0, 0}
+end
+return {0, redis.call("INCR", KEYS[2])}
+`)
+
+// KEYS: lock. ARGV: token, expiry in milliseconds. Returns the lock's PTTL
+// before renewal.
+var renewScript = newLuaScript("renew", 1, 1, `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+  return {7} -- statusLockLost
+end
+local ttl = redis.call("PTTL", KEYS[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return {0, ttl}
+`)
+
+// KEYS: lock. ARGV: token, release notification channel.
+var releaseScript = newLuaScript("release", 1, 1, `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+  return {7} -- statusLockLost
+end
+redis.call("DEL", KEYS[1])
+redis.call("PUBLISH", ARGV[2], "")
+return {0}
+`)
+
+// observeRemaining records the remaining TTL seen by a renewal, warning if it
+// is dangerously low.
+func (l *Lock) observeRemaining(remaining time.Duration) {
+	for {
+		min := atomic.LoadInt64(&l.minRemaining)
+		if remaining.Nanoseconds() >= min || atomic.CompareAndSwapInt64(&l.minRemaining, min, remaining.Nanoseconds()) {
+			break
+		}
+	}
+	if threshold := time.Duration(float64(l.Expiry) * l.TTLWarningFraction); remaining < threshold {
+		lockLogger(l.Logger).Warn("Lock renewed with TTL below the warning threshold", "key", l.Key,
+			"remaining", remaining, "expiry", l.Expiry, "threshold", threshold)
+	}
+}
+
+// Stats returns statistics for the current or most recent hold of the lock.
+func (l *Lock) Stats() LockStats {
+	return LockStats{MinRemainingTTL: time.Duration(atomic.LoadInt64(&l.minRemaining))}
+}
+
+// ForceUnlock releases the lock at key whoever holds it, returning whether it
+// was held, and wakes any waiters. It is for clearing a lock held by a stuck
+// process: the holder is not told, and its next renewal fails with
+// ErrLockLost.
+func ForceUnlock(pool *redis.Pool, key string) (bool, error) {
+	r := getConn(pool, "ForceUnlock")
+	defer r.Close()
+	r.Send("MULTI")
+	r.Send("DEL", key)
+	r.Send("PUBLISH", lockReleasedChannel(key), "")
+	replies, err := redis.Ints(r.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+	return replies[0] == 1, nil
+}
+
+// LockState is a JSON-marshallable snapshot of a lock as seen in Redis.
+type LockState struct {
+	Key  string `json:"key"`
+	Held bool   `json:"held"`
+	// Token of the current hold, as returned by Lock.Token.
+	Token string `json:"token,omitempty"`
+	// Time until the hold expires unless renewed.
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+// InspectLock reports whether the lock at key is held, and by whom, without
+// acquiring it.
+func InspectLock(pool *redis.Pool, key string) (LockState, error) {
+	r := getConn(pool, "InspectLock")
+	defer r.Close()
+	r.Send("GET", key)
+	r.Send("PTTL", key)
+	replies, err := redis.Values(r.Do(""))
+	if err != nil {
+		return LockState{}, err
+	}
+	state := LockState{Key: key}
+	token, err := redis.String(replies[0], nil)
+	if err == redis.ErrNil {
+		return state, nil
+	} else if err != nil {
+		return LockState{}, err
+	}
+	ttl, err := redis.Int64(replies[1], nil)
+	if err != nil {
+		return LockState{}, err
+	}
+	state.Held, state.Token = true, token
+	if ttl > 0 {
+		state.TTL = time.Duration(ttl) * time.Millisecond
+	}
+	return state, nil
+}
+
+// Unlock stops renewing the lock and releases it, if it is still held.
+// Returns ErrLockLost if it had expired and been acquired by another client,
+// which is left holding it, or ErrNotLocked if it is not held.
+func (l *Lock) Unlock() error {
+	if !atomic.CompareAndSwapInt32(&l.held, 1, 0) {
+		if l.strict {
+			panic("grt: strict mode: unlock of unlocked lock " + l.Key)
+		}
+		return ErrNotLocked
+	}
+	defer func() { <-l.lock }()
+	l.hold.release()
+	r := getConn(l.pool, "Lock.Unlock")
+	defer r.Close()
+	_, err := releaseScript.do(r, l.Key, l.hold.token, lockReleasedChannel(l.Key))
+	return err
 }
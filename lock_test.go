@@ -0,0 +1,178 @@
+package grt_test
+
+import (
+	"github.com/alecthomas/grt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockDone(t *testing.T) {
+	_, pool := newPool(t)
+	l := grt.NewLock(pool, "lock")
+	if l.Done() != nil {
+		t.Fatal("done before locking")
+	}
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if !l.Held() {
+		t.Fatal("not held")
+	}
+	// Unlocking closes Done without an error.
+	done := l.Done()
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := <-done; ok || err != nil {
+		t.Fatal(err, ok)
+	}
+	if l.Held() {
+		t.Fatal("held after unlocking")
+	}
+}
+
+func TestLockLostToConnectionFailure(t *testing.T) {
+	s, pool := restartablePool(t)
+	l := grt.NewLock(pool, "lock")
+	l.Expiry = 400 * time.Millisecond
+	l.RetryDelay = 20 * time.Millisecond
+	var lost []error
+	l.OnLost = func(err error) { lost = append(lost, err) }
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	select {
+	case err := <-l.Done():
+		if err == nil {
+			t.Fatal("lost without an error")
+		}
+	case <-time.After(l.Expiry):
+		t.Fatal("not notified within an expiry")
+	}
+	if l.Held() || len(lost) != 1 {
+		t.Fatal(l.Held(), lost)
+	}
+}
+
+func TestLockRetriesTransientErrors(t *testing.T) {
+	s, pool := newPool(t)
+	l := grt.NewLock(pool, "lock")
+	l.Expiry = 400 * time.Millisecond
+	l.RetryDelay = 50 * time.Millisecond
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	s.SetError("LOADING Redis is loading the dataset in memory")
+	time.Sleep(150 * time.Millisecond)
+	s.SetError("")
+	select {
+	case err := <-l.Done():
+		t.Fatal("lost to a transient error", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	if !l.Held() {
+		t.Fatal("not held")
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockTakenOver(t *testing.T) {
+	s, pool := newPool(t)
+	l := grt.NewLock(pool, "lock")
+	l.Expiry = 400 * time.Millisecond
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	s.Set("lock", "another holder")
+	select {
+	case err := <-l.Done():
+		if err != grt.ErrLockLost {
+			t.Fatal(err)
+		}
+	case <-time.After(l.Expiry):
+		t.Fatal("not notified within an expiry")
+	}
+	if err := l.Unlock(); err != grt.ErrLockLost {
+		t.Fatal(err)
+	}
+	// The other holder's lock is left alone.
+	if value, err := s.Get("lock"); err != nil || value != "another holder" {
+		t.Fatal(value, err)
+	}
+}
+
+func TestLockReuse(t *testing.T) {
+	_, pool := newPool(t)
+	l := grt.NewLock(pool, "lock")
+	if err := l.Unlock(); err != grt.ErrNotLocked {
+		t.Fatal(err)
+	}
+	var inside int32
+	var lock sync.Mutex
+	tokens := map[string]bool{}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				if err := l.Lock(); err != nil {
+					t.Error(err)
+					return
+				}
+				if atomic.AddInt32(&inside, 1) != 1 {
+					t.Error("lock held twice")
+				}
+				lock.Lock()
+				tokens[l.Token()] = true
+				lock.Unlock()
+				atomic.AddInt32(&inside, -1)
+				if err := l.Unlock(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// Every hold has a token of its own.
+	if len(tokens) != 200 {
+		t.Fatal(len(tokens))
+	}
+	if err := l.Unlock(); err != grt.ErrNotLocked {
+		t.Fatal(err)
+	}
+}
+
+func TestLockTryLock(t *testing.T) {
+	_, pool := newPool(t)
+	l := grt.NewLock(pool, "lock")
+	if acquired, err := l.TryLock(); !acquired || err != nil {
+		t.Fatal(acquired, err)
+	}
+	if acquired, err := l.TryLock(); acquired || err != nil {
+		t.Fatal(acquired, err)
+	}
+	other := grt.NewLock(pool, "lock")
+	start := time.Now()
+	if acquired, err := other.TryLock(); acquired || err != nil {
+		t.Fatal(acquired, err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatal("waited", elapsed)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if acquired, err := other.TryLock(); !acquired || err != nil {
+		t.Fatal(acquired, err)
+	}
+	if err := other.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,94 @@
+package grt_test
+
+import (
+	"bytes"
+	"github.com/alecthomas/grt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use by a logger.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.buf.String()
+}
+
+func TestLockRemainingTTL(t *testing.T) {
+	s, pool := newPool(t)
+	logs := &syncBuffer{}
+	l := grt.NewLock(pool, "ttl")
+	l.Expiry = 400 * time.Millisecond
+	l.Logger = slog.New(slog.NewTextHandler(logs, nil))
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	// Renewals are due every 100ms, but the first one runs as if it had been
+	// delayed until the lock was 50ms from expiring.
+	s.FastForward(350 * time.Millisecond)
+	time.Sleep(250 * time.Millisecond)
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if min := l.Stats().MinRemainingTTL; min != 50*time.Millisecond {
+		t.Fatal(min)
+	}
+	if !strings.Contains(logs.String(), "Lock renewed with TTL below the warning threshold") {
+		t.Fatal(logs)
+	}
+
+	// Each hold is measured afresh.
+	logs = &syncBuffer{}
+	l.Logger = slog.New(slog.NewTextHandler(logs, nil))
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if min := l.Stats().MinRemainingTTL; min != l.Expiry {
+		t.Fatal(min)
+	}
+	if strings.Contains(logs.String(), "WARN") {
+		t.Fatal(logs)
+	}
+}
+
+func TestLockRemainingTTLWarningFraction(t *testing.T) {
+	s, pool := newPool(t)
+	logs := &syncBuffer{}
+	l := grt.NewLock(pool, "ttl")
+	l.Expiry = 400 * time.Millisecond
+	l.TTLWarningFraction = 0.1
+	l.Logger = slog.New(slog.NewTextHandler(logs, nil))
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	s.FastForward(300 * time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	// 100ms remaining is above 10% of Expiry.
+	if min := l.Stats().MinRemainingTTL; min != 100*time.Millisecond {
+		t.Fatal(min)
+	}
+	if strings.Contains(logs.String(), "WARN") {
+		t.Fatal(logs)
+	}
+}
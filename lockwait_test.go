@@ -0,0 +1,150 @@
+package grt_test
+
+import (
+	"github.com/alecthomas/grt"
+	"github.com/alecthomas/grt/backoff"
+	"github.com/garyburd/redigo/redis"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockWaitTimeout(t *testing.T) {
+	_, pool := newPool(t)
+	holder := grt.NewLock(pool, "lockwait")
+	if err := holder.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Unlock()
+	// The default backoff is an Expiry, far longer than the wait.
+	waiter := grt.NewLock(pool, "lockwait")
+	start := time.Now()
+	if err := waiter.LockWait(300 * time.Millisecond); err != grt.ErrLockTimeout {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 400*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+}
+
+func TestLockWaitZero(t *testing.T) {
+	_, pool := newPool(t)
+	l := grt.NewLock(pool, "lockwait")
+	// A free lock is attempted once, even though the wait is already over.
+	for i := 0; i < 50; i++ {
+		if err := l.LockWait(0); err != nil {
+			t.Fatalf("attempt %d: %s", i, err)
+		}
+		if err := l.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	holder := grt.NewLock(pool, "lockwait")
+	if err := holder.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Unlock()
+	if err := l.LockWait(0); err != grt.ErrLockTimeout {
+		t.Fatal(err)
+	}
+}
+
+func TestLockWaitNotified(t *testing.T) {
+	_, pool := newPool(t)
+	holder := grt.NewLock(pool, "lockwait")
+	if err := holder.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if err := holder.Unlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	waiter := grt.NewLock(pool, "lockwait")
+	start := time.Now()
+	if err := waiter.LockWait(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// Acquired on release rather than after the two second backoff.
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+	if err := waiter.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockWaitBackoff(t *testing.T) {
+	s, pool := newPool(t)
+	// A holder that crashed, so that no release is published.
+	s.Set("lockwait", "crashed")
+	s.SetTTL("lockwait", 100*time.Millisecond)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.FastForward(100 * time.Millisecond)
+	}()
+	waiter := grt.NewLock(pool, "lockwait")
+	waiter.Backoff = backoff.Constant(20 * time.Millisecond)
+	start := time.Now()
+	if err := waiter.LockWait(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+	if err := waiter.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkLockContention reports the mean time 20 goroutines sharing a lock
+// take to acquire it, each holding it for 5ms. Without release notifications,
+// as on a single connection pool, waiters poll every Expiry.
+func BenchmarkLockContention(b *testing.B) {
+	b.Run("Notified", func(b *testing.B) {
+		_, pool := newPool(b)
+		benchmarkLockContention(b, pool)
+	})
+	b.Run("Polling", func(b *testing.B) {
+		s, _ := newPool(b)
+		conn, err := redis.Dial("tcp", s.Addr())
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		benchmarkLockContention(b, grt.NewSingleConnPool(conn))
+	})
+}
+
+func benchmarkLockContention(b *testing.B, pool *redis.Pool) {
+	var lock sync.Mutex
+	var total time.Duration
+	acquired := 0
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for g := 0; g < 20; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				l := grt.NewLock(pool, "contended")
+				l.Expiry = 200 * time.Millisecond
+				start := time.Now()
+				if err := l.LockWait(time.Minute); err != nil {
+					b.Error(err)
+					return
+				}
+				lock.Lock()
+				total += time.Since(start)
+				acquired++
+				lock.Unlock()
+				time.Sleep(5 * time.Millisecond)
+				if err := l.Unlock(); err != nil {
+					b.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	b.ReportMetric(float64(total.Milliseconds())/float64(acquired), "ms/acquire")
+}
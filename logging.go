@@ -0,0 +1,27 @@
+package grt
+
+import (
+	"log/slog"
+)
+
+// WithLogger sends the queue's log messages to logger rather than
+// slog.Default(). Messages carry the queue name, and where relevant the job
+// key and error, as attributes.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *JobQueue) { c.logger = logger }
+}
+
+func (c *JobQueue) log() *slog.Logger {
+	if c.logger != nil {
+		return c.logger
+	}
+	return slog.Default()
+}
+
+// lockLogger returns logger, or slog.Default() if it is nil.
+func lockLogger(logger *slog.Logger) *slog.Logger {
+	if logger != nil {
+		return logger
+	}
+	return slog.Default()
+}
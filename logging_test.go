@@ -0,0 +1,55 @@
+package grt_test
+
+import (
+	"github.com/alecthomas/grt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueLogging(t *testing.T) {
+	_, pool := newPool(t)
+	logs := &syncBuffer{}
+	logger := slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	q := grt.NewJobQueue(pool, "logging", grt.WithLogger(logger))
+	submitJobs(t, q, "job", 2)
+	for i := 0; i < 2; i++ {
+		if _, err := q.Get(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	text := logs.String()
+	if n := strings.Count(text, `level=DEBUG msg="Moved job from processing to waiting" queue=logging key=`); n != 2 {
+		t.Fatalf("%d jobs logged as moved:\n%s", n, text)
+	}
+	if !strings.Contains(text, `level=INFO msg="Cleaned up in-progress jobs" queue=logging moved=2`) {
+		t.Fatal(text)
+	}
+}
+
+func TestLockLogging(t *testing.T) {
+	s, pool := newPool(t)
+	logs := &syncBuffer{}
+	l := grt.NewLock(pool, "logging")
+	l.Logger = slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	l.Expiry = 200 * time.Millisecond
+	l.RetryAttempts = 0
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	s.Set("logging", "other")
+	<-l.Done()
+	l.Unlock()
+	text := logs.String()
+	if !strings.Contains(text, `level=DEBUG msg="Lock renewed" key=logging`) {
+		t.Fatal(text)
+	}
+	if !strings.Contains(text, `level=ERROR msg="Lock lost" key=logging error=`) {
+		t.Fatal(text)
+	}
+}
@@ -0,0 +1,407 @@
+package grt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Queue is the part of JobQueue used by producers and consumers, so that code
+// using a queue can be tested against a MemoryJobQueue.
+type Queue interface {
+	Submit(job interface{}) error
+	SubmitContext(ctx context.Context, job interface{}) error
+	SubmitAt(job interface{}, at time.Time) error
+	SubmitAfter(job interface{}, d time.Duration) error
+	SubmitWithTTL(job interface{}, ttl time.Duration) error
+	Get(v interface{}) (*Work, error)
+	TryGet(v interface{}) (*Work, error)
+	GetWait(v interface{}, timeout time.Duration) (*Work, error)
+	GetContext(ctx context.Context, v interface{}) (*Work, error)
+	Len() (int, error)
+	IsQueued(job interface{}) (bool, error)
+	Run(ctx context.Context, concurrency int, handler Handler) error
+}
+
+// Locker is the interface of Lock and MultiLock, so that code using a lock can
+// be tested against a MemoryLock.
+type Locker interface {
+	Lock() error
+	LockWait(wait time.Duration) error
+	LockContext(ctx context.Context) error
+	TryLock() (bool, error)
+	Unlock() error
+}
+
+// How often a MemoryJobQueue waiting for a job checks for delayed jobs that
+// have fallen due.
+const memoryPollInterval = 10 * time.Millisecond
+
+// MemoryJobQueue is an in-process Queue for tests of code that uses grt,
+// without a Redis server. Jobs are keyed, deduplicated, decoded and passed
+// through middleware and hooks as a JobQueue created with the same options
+// would, and Work retrieved from it is finalized back into it. Create with
+// NewMemoryJobQueue.
+//
+// Options that depend on Redis, such as WithVisibilityTimeout, have no
+// effect. Transfer removes a job without submitting it to the target.
+type MemoryJobQueue struct {
+	Queue string
+	// Returns the current time, for delayed jobs. Defaults to time.Now, and
+	// may be replaced to control time in tests.
+	Now func() time.Time
+	// Work resubmitted after this many attempts is moved to the dead letters.
+	// Zero is unlimited.
+	MaxAttempts int
+	// Supplies codec, keying, middleware and hooks. Never connects to Redis.
+	config *JobQueue
+
+	lock sync.Mutex
+	// Closed and replaced whenever a job is queued.
+	queued  chan struct{}
+	waiting [][]byte
+	delayed map[string]memoryDelayedJob
+	// Incremented for each job submitted, to order delayed jobs that fall
+	// due together.
+	submissions uint64
+	payloads    map[string][]byte
+	enqueued    map[string]time.Time
+	expiry      map[string]time.Time
+	attempts    map[string]int
+	processing  map[string]bool
+	dead        map[string]bool
+}
+
+// memoryDelayedJob is a job submitted to a MemoryJobQueue that is not yet
+// due.
+type memoryDelayedJob struct {
+	key        []byte
+	due        time.Time
+	submission uint64
+}
+
+// NewMemoryJobQueue creates an in-process queue configured with options.
+func NewMemoryJobQueue(queue string, options ...Option) *MemoryJobQueue {
+	config := &JobQueue{Queue: queue, codec: JSONCodec{}, clock: &clock{now: time.Now}, background: &background{}, options: &optionsCheck{}}
+	for _, option := range options {
+		option(config)
+	}
+	return &MemoryJobQueue{
+		Queue:      queue,
+		Now:        time.Now,
+		config:     config,
+		queued:     make(chan struct{}),
+		delayed:    map[string]memoryDelayedJob{},
+		payloads:   map[string][]byte{},
+		enqueued:   map[string]time.Time{},
+		expiry:     map[string]time.Time{},
+		attempts:   map[string]int{},
+		processing: map[string]bool{},
+		dead:       map[string]bool{},
+	}
+}
+
+// Submit a job, returning ErrAlreadyQueued if an identical job is waiting,
+// delayed or in progress. An identical dead-lettered job is replaced.
+func (q *MemoryJobQueue) Submit(job interface{}) error {
+	return q.submit(job, 0, q.config.jobTTL)
+}
+
+// SubmitContext is Submit. Trace context is not recorded.
+func (q *MemoryJobQueue) SubmitContext(ctx context.Context, job interface{}) error {
+	return q.submit(job, 0, q.config.jobTTL)
+}
+
+// SubmitAt submits a job that will not be retrieved before at, by Now.
+func (q *MemoryJobQueue) SubmitAt(job interface{}, at time.Time) error {
+	return q.submit(job, at.Sub(q.Now()), q.config.jobTTL)
+}
+
+// SubmitAfter submits a job that will not be retrieved until d has elapsed,
+// by Now.
+func (q *MemoryJobQueue) SubmitAfter(job interface{}, d time.Duration) error {
+	return q.submit(job, d, q.config.jobTTL)
+}
+
+// SubmitWithTTL submits a job that is discarded, or dead-lettered on a queue
+// created WithExpiredDeadLetter, if it is not retrieved within ttl, by Now.
+func (q *MemoryJobQueue) SubmitWithTTL(job interface{}, ttl time.Duration) error {
+	return q.submit(job, 0, ttl)
+}
+
+func (q *MemoryJobQueue) submit(job interface{}, delay time.Duration, ttl time.Duration) error {
+	key, payload, err := q.config.marshal(job)
+	if err != nil {
+		return err
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.payloads[string(key)]; ok && !q.dead[string(key)] {
+		return ErrAlreadyQueued
+	}
+	delete(q.dead, string(key))
+	delete(q.attempts, string(key))
+	now := q.Now()
+	q.payloads[string(key)] = payload
+	q.enqueued[string(key)] = now
+	due := now
+	if delay > 0 {
+		due = now.Add(delay)
+		q.submissions++
+		q.delayed[string(key)] = memoryDelayedJob{key: key, due: due, submission: q.submissions}
+	} else {
+		q.push(key)
+	}
+	if ttl > 0 {
+		q.expiry[string(key)] = due.Add(ttl)
+	}
+	q.config.submitted(key)
+	return nil
+}
+
+// push queues key and wakes waiting consumers.
+func (q *MemoryJobQueue) push(key []byte) {
+	q.waiting = append(q.waiting, key)
+	close(q.queued)
+	q.queued = make(chan struct{})
+}
+
+// Get retrieves the next job, waiting until one is available.
+func (q *MemoryJobQueue) Get(v interface{}) (*Work, error) {
+	return q.GetContext(context.Background(), v)
+}
+
+// TryGet retrieves the next job, or returns a nil Work if none is waiting.
+func (q *MemoryJobQueue) TryGet(v interface{}) (*Work, error) {
+	q.lock.Lock()
+	work := q.pop()
+	q.lock.Unlock()
+	return acceptWork(work, v)
+}
+
+// GetWait retrieves the next job, waiting at most timeout for one.
+func (q *MemoryJobQueue) GetWait(v interface{}, timeout time.Duration) (*Work, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	work, err := q.GetContext(ctx, v)
+	if err == context.DeadlineExceeded {
+		return nil, nil
+	}
+	return work, err
+}
+
+// GetContext retrieves the next job, waiting until one is available or ctx
+// is done.
+func (q *MemoryJobQueue) GetContext(ctx context.Context, v interface{}) (*Work, error) {
+	for {
+		q.lock.Lock()
+		work, queued := q.pop(), q.queued
+		q.lock.Unlock()
+		if work != nil {
+			return acceptWork(work, v)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-queued:
+		case <-time.After(memoryPollInterval):
+		}
+	}
+}
+
+// pop moves the next job to in progress, after queueing any delayed jobs
+// that have fallen due and dropping any expired ones, or returns nil if none
+// is waiting.
+func (q *MemoryJobQueue) pop() *Work {
+	now := q.Now()
+	due := []memoryDelayedJob{}
+	for key, job := range q.delayed {
+		if !job.due.After(now) {
+			delete(q.delayed, key)
+			due = append(due, job)
+		}
+	}
+	// Jobs are queued in the order they fell due, and those falling due
+	// together in the order they were submitted.
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].due.Equal(due[j].due) {
+			return due[i].due.Before(due[j].due)
+		}
+		return due[i].submission < due[j].submission
+	})
+	for _, job := range due {
+		q.waiting = append(q.waiting, job.key)
+	}
+	var key []byte
+	for key == nil {
+		if len(q.waiting) == 0 {
+			return nil
+		}
+		key = q.waiting[0]
+		q.waiting = q.waiting[1:]
+		if expiry, ok := q.expiry[string(key)]; ok && !expiry.After(now) {
+			q.expire(key)
+			key = nil
+		}
+	}
+	q.processing[string(key)] = true
+	q.attempts[string(key)]++
+	return &Work{
+		Queue:      q.Queue,
+		key:        key,
+		queue:      q.config,
+		record:     q.payloads[string(key)],
+		attempts:   q.attempts[string(key)],
+		enqueuedAt: q.enqueued[string(key)],
+		replay:     &replayState{finalized: func(outcome WorkOutcome) error { q.finalize(key, outcome); return nil }},
+	}
+}
+
+// acceptWork decodes work into v, resubmitting it if it cannot be decoded,
+// for queues other than JobQueue.
+func acceptWork(work *Work, v interface{}) (*Work, error) {
+	if work == nil {
+		return nil, nil
+	}
+	if v != nil {
+		if err := work.decode(v); err != nil {
+			if rerr := work.Resubmit(); rerr != nil {
+				return nil, errors.Join(err, fmt.Errorf("could not resubmit %s: %w", work, rerr))
+			}
+			return nil, err
+		}
+	}
+	work.started()
+	return work, nil
+}
+
+// expire discards the waiting job with key, or moves it to the dead letters if
+// the queue was created WithExpiredDeadLetter.
+func (q *MemoryJobQueue) expire(key []byte) {
+	delete(q.expiry, string(key))
+	if q.config.deadLetterExpired {
+		q.dead[string(key)] = true
+		return
+	}
+	delete(q.payloads, string(key))
+	delete(q.enqueued, string(key))
+	delete(q.attempts, string(key))
+}
+
+// finalize applies outcome to the job with key.
+func (q *MemoryJobQueue) finalize(key []byte, outcome WorkOutcome) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.processing[string(key)] {
+		return
+	}
+	delete(q.processing, string(key))
+	if outcome == WorkResubmitted {
+		if q.MaxAttempts == 0 || q.attempts[string(key)] < q.MaxAttempts {
+			q.push(key)
+			return
+		}
+		q.dead[string(key)] = true
+		delete(q.expiry, string(key))
+		return
+	}
+	delete(q.expiry, string(key))
+	delete(q.payloads, string(key))
+	delete(q.enqueued, string(key))
+	delete(q.attempts, string(key))
+}
+
+// Len returns the number of jobs waiting, delayed or in progress, as
+// JobQueue.Len does. Dead-lettered jobs are not counted.
+func (q *MemoryJobQueue) Len() (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.payloads) - len(q.dead), nil
+}
+
+// IsQueued returns true if an identical job is waiting, delayed or in
+// progress.
+func (q *MemoryJobQueue) IsQueued(job interface{}) (bool, error) {
+	key, _, err := q.config.marshal(job)
+	if err != nil {
+		return false, err
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	_, ok := q.payloads[string(key)]
+	return ok && !q.dead[string(key)], nil
+}
+
+// DeadLen returns the number of jobs moved to the dead letters after
+// MaxAttempts attempts.
+func (q *MemoryJobQueue) DeadLen() (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.dead), nil
+}
+
+// Run processes jobs with concurrency workers until ctx is done, as
+// JobQueue.Run does.
+func (q *MemoryJobQueue) Run(ctx context.Context, concurrency int, handler Handler) error {
+	q.config.runWorkers(ctx, concurrency, handler, q.GetContext)
+	return nil
+}
+
+// MemoryLock is an in-process Locker for tests of code that uses grt, without
+// a Redis server. Like Lock, it may be locked and unlocked from multiple
+// goroutines. Create with NewMemoryLock.
+type MemoryLock struct {
+	lock chan struct{}
+}
+
+// NewMemoryLock creates an unlocked in-process lock.
+func NewMemoryLock() *MemoryLock {
+	return &MemoryLock{lock: make(chan struct{}, 1)}
+}
+
+// Lock acquires the lock, waiting until it is available.
+func (l *MemoryLock) Lock() error {
+	return l.LockContext(context.Background())
+}
+
+// LockWait acquires the lock, returning ErrLockTimeout if it is not
+// available within wait.
+func (l *MemoryLock) LockWait(wait time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	if err := l.LockContext(ctx); err == context.DeadlineExceeded {
+		return ErrLockTimeout
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// LockContext acquires the lock, returning ctx.Err() if ctx is done first.
+// A free lock is acquired even if ctx is already done.
+func (l *MemoryLock) LockContext(ctx context.Context) error {
+	return takeSlot(ctx, l.lock)
+}
+
+// TryLock acquires the lock if it is available, returning whether it was.
+func (l *MemoryLock) TryLock() (bool, error) {
+	select {
+	case l.lock <- struct{}{}:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// Unlock releases the lock, returning ErrNotLocked if it is not held.
+func (l *MemoryLock) Unlock() error {
+	select {
+	case <-l.lock:
+		return nil
+	default:
+		return ErrNotLocked
+	}
+}
@@ -0,0 +1,294 @@
+package grt_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alecthomas/grt"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	_ grt.Queue  = (*grt.JobQueue)(nil)
+	_ grt.Queue  = (*grt.MemoryJobQueue)(nil)
+	_ grt.Queue  = (*grt.StreamJobQueue)(nil)
+	_ grt.Locker = (*grt.Lock)(nil)
+	_ grt.Locker = (*grt.MultiLock)(nil)
+	_ grt.Locker = (*grt.MemoryLock)(nil)
+)
+
+// Code written against Queue behaves the same with either implementation.
+func TestQueueImplementations(t *testing.T) {
+	_, pool := newPool(t)
+	_, goRedisPool := newGoRedisPool(t)
+	queues := []struct {
+		name  string
+		queue grt.Queue
+	}{
+		{"Redis", grt.NewJobQueue(pool, "memory")},
+		{"GoRedis", grt.NewJobQueue(goRedisPool, "memory")},
+		{"Stream", grt.NewQueue(pool, "stream", grt.WithStreams())},
+		{"Memory", grt.NewMemoryJobQueue("memory")},
+	}
+	for _, test := range queues {
+		t.Run(test.name, func(t *testing.T) {
+			q := test.queue
+			for _, job := range []string{"a", "b"} {
+				if err := q.Submit(job); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := q.Submit("a"); err != grt.ErrAlreadyQueued {
+				t.Fatal(err)
+			}
+			var job string
+			w, err := q.Get(&job)
+			if err != nil || job != "a" {
+				t.Fatal(job, err)
+			}
+			// Jobs in progress and delayed are counted.
+			if err := q.SubmitAfter("later", time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := q.Len(); n != 3 || err != nil {
+				t.Fatal(n, err)
+			}
+			if err := w.Complete(); err != nil {
+				t.Fatal(err)
+			}
+			if queued, err := q.IsQueued("a"); queued || err != nil {
+				t.Fatal(queued, err)
+			}
+			w, err = q.TryGet(&job)
+			if err != nil || w == nil || job != "b" {
+				t.Fatal(w, job, err)
+			}
+			if err := w.Resubmit(); err != nil {
+				t.Fatal(err)
+			}
+			w, err = q.GetWait(&job, time.Second)
+			if err != nil || w == nil || job != "b" || w.Attempts() != 2 {
+				t.Fatal(w, job, err)
+			}
+			if err := w.Complete(); err != nil {
+				t.Fatal(err)
+			}
+			if w, err := q.GetWait(&job, 50*time.Millisecond); w != nil || err != nil {
+				t.Fatal(w, err)
+			}
+			if n, err := q.Len(); n != 1 || err != nil {
+				t.Fatal(n, err)
+			}
+		})
+	}
+}
+
+func TestMemoryJobQueue(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var submitted, completed int
+	q := grt.NewMemoryJobQueue("memory", grt.WithHooks(grt.Hooks{
+		OnSubmit:   func(string, []byte) { submitted++ },
+		OnComplete: func(*grt.Work) { completed++ },
+	}))
+	q.Now = func() time.Time { return now }
+	q.MaxAttempts = 2
+	if err := q.Submit("now"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SubmitAfter("later", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var job string
+	w, err := q.TryGet(&job)
+	if err != nil || w == nil || job != "now" {
+		t.Fatal(w, job, err)
+	}
+	// Time only passes when the test says so.
+	if w, err := q.TryGet(&job); w != nil || err != nil {
+		t.Fatal("delayed job retrieved early", w, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Minute)
+	for attempt := 1; attempt <= 2; attempt++ {
+		w, err := q.GetWait(&job, time.Second)
+		if err != nil || w == nil || job != "later" || w.Attempts() != attempt {
+			t.Fatal(w, job, err)
+		}
+		if err := w.Resubmit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := q.DeadLen(); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	if n, err := q.Len(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+	if submitted != 2 || completed != 1 {
+		t.Fatal(submitted, completed)
+	}
+}
+
+func TestMemoryJobQueueRun(t *testing.T) {
+	q := grt.NewMemoryJobQueue("memory")
+	for _, job := range []string{"a", "b", "c", "retry"} {
+		if err := q.Submit(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var lock sync.Mutex
+	handled := map[string]int{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Run(ctx, 2, func(ctx context.Context, w *grt.Work, decode func(interface{}) error) error {
+			var job string
+			if err := decode(&job); err != nil {
+				return err
+			}
+			lock.Lock()
+			handled[job]++
+			total := 0
+			for _, n := range handled {
+				total += n
+			}
+			lock.Unlock()
+			if total == 5 {
+				cancel()
+			}
+			if job == "retry" && w.Attempts() == 1 {
+				return errors.New("retry")
+			}
+			return nil
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not finish")
+	}
+	if handled["retry"] != 2 || handled["a"] != 1 || handled["b"] != 1 || handled["c"] != 1 {
+		t.Fatal(handled)
+	}
+	if n, err := q.Len(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+}
+
+// Code written against Locker behaves the same with any implementation.
+func TestLockerImplementations(t *testing.T) {
+	_, pool := newPool(t)
+	_, goRedisPool := newGoRedisPool(t)
+	_, multiPools := multiLockNodes(t, 3)
+	// Every MemoryLock is a lock of its own, so contenders share one.
+	memory := grt.NewMemoryLock()
+	locks := []struct {
+		name string
+		new  func() grt.Locker
+	}{
+		{"Redis", func() grt.Locker { return grt.NewLock(pool, "locker") }},
+		{"GoRedis", func() grt.Locker { return grt.NewLock(goRedisPool, "locker") }},
+		{"Multi", func() grt.Locker { return grt.NewMultiLock(multiPools, "locker") }},
+		{"Memory", func() grt.Locker { return memory }},
+	}
+	for _, test := range locks {
+		t.Run(test.name, func(t *testing.T) {
+			l, other := test.new(), test.new()
+			if err := l.Unlock(); err != grt.ErrNotLocked {
+				t.Fatal(err)
+			}
+			if err := l.LockWait(0); err != nil {
+				t.Fatal(err)
+			}
+			if ok, err := other.TryLock(); ok || err != nil {
+				t.Fatal(ok, err)
+			}
+			if err := other.LockWait(10 * time.Millisecond); err != grt.ErrLockTimeout {
+				t.Fatal(err)
+			}
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				if err := l.Unlock(); err != nil {
+					t.Error(err)
+				}
+			}()
+			if err := other.LockWait(5 * time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if err := other.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMemoryLock(t *testing.T) {
+	l := grt.NewMemoryLock()
+	if err := l.Unlock(); err != grt.ErrNotLocked {
+		t.Fatal(err)
+	}
+	// A free lock is acquired however short the wait.
+	for i := 0; i < 50; i++ {
+		if err := l.LockWait(0); err != nil {
+			t.Fatalf("attempt %d: %s", i, err)
+		}
+		if err := l.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := l.TryLock(); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if err := l.LockWait(10 * time.Millisecond); err != grt.ErrLockTimeout {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.LockContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	// Another goroutine may release it.
+	go l.Unlock()
+	if err := l.LockWait(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryJobQueueDelayedOrder(t *testing.T) {
+	now := time.Unix(1000, 0)
+	q := grt.NewMemoryJobQueue("memory")
+	q.Now = func() time.Time { return now }
+	want := []string{"early"}
+	for i := 0; i < 20; i++ {
+		job := fmt.Sprintf("job%d", i)
+		if err := q.SubmitAfter(job, 2*time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, job)
+	}
+	if err := q.SubmitAfter("early", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	for _, want := range want {
+		var job string
+		w, err := q.TryGet(&job)
+		if err != nil || w == nil || job != want {
+			t.Fatalf("got %s, want %s: %v", job, want, err)
+		}
+		if err := w.Complete(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
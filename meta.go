@@ -0,0 +1,54 @@
+package grt
+
+import (
+	"context"
+	"time"
+)
+
+type headersKey struct{}
+
+// ContextWithHeaders returns a copy of ctx carrying headers, such as a
+// request ID, that SubmitContext records with the job in its Producer. Headers
+// are limited as producer labels are. Headers already carried by ctx are
+// replaced.
+func ContextWithHeaders(ctx context.Context, headers map[string]string) context.Context {
+	return context.WithValue(ctx, headersKey{}, truncateLabels(headers))
+}
+
+// contextHeaders returns the headers carried by ctx, or nil.
+func contextHeaders(ctx context.Context) map[string]string {
+	headers, _ := ctx.Value(headersKey{}).(map[string]string)
+	if len(headers) == 0 {
+		return nil
+	}
+	return headers
+}
+
+// Meta is what is recorded about a job alongside its payload.
+type Meta struct {
+	// When the job was first submitted, or the zero time if not recorded.
+	EnqueuedAt time.Time
+	// Number of times the job has been retrieved, including this one.
+	Attempts int
+	// Who submitted the job, including its host and process as Instance and
+	// the headers of its submission, or nil if not recorded.
+	Producer *Producer
+}
+
+// Age returns how long ago the job was first submitted, or zero if that was
+// not recorded.
+func (m *Meta) Age() time.Duration {
+	if m.EnqueuedAt.IsZero() {
+		return 0
+	}
+	return time.Since(m.EnqueuedAt)
+}
+
+// Meta returns the job's metadata. Reading its producer costs a round trip.
+func (w *Work) Meta() (*Meta, error) {
+	producer, err := w.Producer()
+	if err != nil {
+		return nil, err
+	}
+	return &Meta{EnqueuedAt: w.enqueuedAt, Attempts: w.attempts, Producer: producer}, nil
+}
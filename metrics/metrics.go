@@ -0,0 +1,199 @@
+// Package metrics exports grt queue and lock metrics to Prometheus:
+//
+//	collector := metrics.New()
+//	prometheus.MustRegister(collector)
+//	jobs := grt.NewJobQueue(pool, "jobs", grt.WithMiddleware(collector.Middleware()))
+//	collector.Add(jobs)
+//	collector.InstrumentLock(lock)
+//	defer collector.ObserveCommands()()
+//
+// Queue depths and lifetime totals are read from each queue's statistics in
+// Redis when scraped, so they cover every instance. Handler latencies, lock
+// metrics and command counts are observed by this process only.
+package metrics
+
+import (
+	"context"
+	"github.com/alecthomas/grt"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+// Collector is a prometheus.Collector for grt queues and locks. Create with
+// New.
+type Collector struct {
+	lock   sync.Mutex
+	queues []*grt.JobQueue
+
+	waiting      *prometheus.Desc
+	processing   *prometheus.Desc
+	delayed      *prometheus.Desc
+	dead         *prometheus.Desc
+	oldestAge    *prometheus.Desc
+	throughput   *prometheus.Desc
+	paused       *prometheus.Desc
+	completed    *prometheus.Desc
+	resubmitted  *prometheus.Desc
+	failed       *prometheus.Desc
+	deadLettered *prometheus.Desc
+
+	duration  *prometheus.HistogramVec
+	lockWait  *prometheus.HistogramVec
+	locksLost *prometheus.CounterVec
+	commands  *prometheus.HistogramVec
+}
+
+// New creates a Collector reporting the statistics of queues.
+func New(queues ...*grt.JobQueue) *Collector {
+	queue := []string{"queue"}
+	return &Collector{
+		queues:       queues,
+		waiting:      prometheus.NewDesc("grt_queue_waiting", "Jobs waiting to be retrieved.", queue, nil),
+		processing:   prometheus.NewDesc("grt_queue_processing", "Jobs in progress.", queue, nil),
+		delayed:      prometheus.NewDesc("grt_queue_delayed", "Delayed jobs not yet due.", queue, nil),
+		dead:         prometheus.NewDesc("grt_queue_dead", "Jobs in the dead letter set.", queue, nil),
+		oldestAge:    prometheus.NewDesc("grt_queue_oldest_age_seconds", "Age of the oldest waiting job.", queue, nil),
+		throughput:   prometheus.NewDesc("grt_queue_throughput_per_minute", "Jobs completed per minute over the last five minutes.", queue, nil),
+		paused:       prometheus.NewDesc("grt_queue_paused", "Whether the queue is paused.", queue, nil),
+		completed:    prometheus.NewDesc("grt_jobs_completed_total", "Jobs completed.", queue, nil),
+		resubmitted:  prometheus.NewDesc("grt_jobs_resubmitted_total", "Jobs resubmitted without an error.", queue, nil),
+		failed:       prometheus.NewDesc("grt_jobs_failed_total", "Jobs resubmitted with an error, ie. retried after failing.", queue, nil),
+		deadLettered: prometheus.NewDesc("grt_jobs_dead_lettered_total", "Jobs moved to the dead letter set.", queue, nil),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grt_job_duration_seconds",
+			Help:    "Time taken by handlers run with Run, by outcome.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"queue", "outcome"}),
+		lockWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grt_lock_acquire_seconds",
+			Help:    "Time taken to acquire locks.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"lock"}),
+		locksLost: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grt_lock_lost_total",
+			Help: "Lock holds lost before they were released.",
+		}, []string{"lock"}),
+		commands: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grt_redis_commands",
+			Help:    "Redis commands issued per operation, counting commands run by scripts.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+		}, []string{"op"}),
+	}
+}
+
+// Add reports the statistics of queues as well.
+func (c *Collector) Add(queues ...*grt.JobQueue) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.queues = append(c.queues, queues...)
+}
+
+// Middleware returns middleware observing the duration and outcome of every
+// job handled, for queues created with grt.WithMiddleware.
+func (c *Collector) Middleware() grt.Middleware {
+	return func(next grt.Handler) grt.Handler {
+		return func(ctx context.Context, w *grt.Work, decode func(v interface{}) error) error {
+			start := time.Now()
+			outcome := "error"
+			defer func() {
+				c.duration.WithLabelValues(w.Queue, outcome).Observe(time.Since(start).Seconds())
+			}()
+			err := next(ctx, w, decode)
+			if err == nil {
+				outcome = "success"
+			}
+			return err
+		}
+	}
+}
+
+// InstrumentLock observes lock's acquisition latency and lost holds, labelled
+// by its key, calling any OnAcquired and OnLost hooks it already has.
+func (c *Collector) InstrumentLock(lock *grt.Lock) {
+	key := lock.Key
+	wait := c.lockWait.WithLabelValues(key)
+	lost := c.locksLost.WithLabelValues(key)
+	onAcquired, onLost := lock.OnAcquired, lock.OnLost
+	lock.OnAcquired = func(d time.Duration) {
+		wait.Observe(d.Seconds())
+		if onAcquired != nil {
+			onAcquired(d)
+		}
+	}
+	lock.OnLost = func(err error) {
+		lost.Inc()
+		if onLost != nil {
+			onLost(err)
+		}
+	}
+}
+
+// ObserveCommands observes the number of Redis commands issued by each grt
+// operation in this process, labelled by operation, eg. "JobQueue.Submit",
+// until the returned function is called. See grt.ObserveCommands.
+func (c *Collector) ObserveCommands() (remove func()) {
+	return grt.ObserveCommands(func(op string, commands int) {
+		c.commands.WithLabelValues(op).Observe(float64(commands))
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.queueDescs() {
+		ch <- desc
+	}
+	c.duration.Describe(ch)
+	c.lockWait.Describe(ch)
+	c.locksLost.Describe(ch)
+	c.commands.Describe(ch)
+}
+
+// Collect implements prometheus.Collector, reading each queue's statistics
+// from Redis. A queue whose statistics cannot be read is reported as an
+// invalid metric.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	queues := c.queues
+	c.lock.Unlock()
+	for _, queue := range queues {
+		stats, err := queue.Stats()
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(c.waiting, err)
+			continue
+		}
+		name := queue.Queue
+		gauge := func(desc *prometheus.Desc, v float64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, name)
+		}
+		counter := func(desc *prometheus.Desc, v int64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v), name)
+		}
+		gauge(c.waiting, float64(stats.Waiting))
+		gauge(c.processing, float64(stats.Processing))
+		gauge(c.delayed, float64(stats.Delayed))
+		gauge(c.dead, float64(stats.Dead))
+		gauge(c.oldestAge, stats.OldestAge.Seconds())
+		gauge(c.throughput, stats.Throughput)
+		paused := 0.0
+		if stats.Paused {
+			paused = 1
+		}
+		gauge(c.paused, paused)
+		counter(c.completed, stats.Completed)
+		counter(c.resubmitted, stats.Resubmitted)
+		counter(c.failed, stats.Failed)
+		counter(c.deadLettered, stats.DeadLettered)
+	}
+	c.duration.Collect(ch)
+	c.lockWait.Collect(ch)
+	c.locksLost.Collect(ch)
+	c.commands.Collect(ch)
+}
+
+func (c *Collector) queueDescs() []*prometheus.Desc {
+	return []*prometheus.Desc{
+		c.waiting, c.processing, c.delayed, c.dead, c.oldestAge, c.throughput, c.paused,
+		c.completed, c.resubmitted, c.failed, c.deadLettered,
+	}
+}
@@ -0,0 +1,206 @@
+package grt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// versionRecordPrefix marks a payload hash entry with the version of the
+// payload's schema. It is followed by the version, a slash and the name of
+// the payload's codec unless it is JSON, a colon, and the rest of the record.
+// Records without it are version 0, encoded with the queue's codec.
+const versionRecordPrefix = "\x00grt:v"
+
+// Migration transforms an encoded payload from one version to the next.
+type Migration func(old []byte) ([]byte, error)
+
+// WithMigrations enables payload versioning. migrations maps each version
+// to the Migration that upgrades payloads from it to the next version, so
+// the current version is one greater than the highest version migrated
+// from. Submit marks payloads with the current version and Get applies
+// migrations in sequence to older payloads before decoding them.
+//
+// Payloads submitted before versioning was enabled are version 0. A job
+// whose migration fails is moved to the dead letters with a *MigrationError
+// naming the version, as retrying it would fail again.
+func WithMigrations(migrations map[int]Migration) Option {
+	return func(c *JobQueue) {
+		c.migrations = migrations
+		c.payloadVersion = 0
+		for version := range migrations {
+			if version+1 > c.payloadVersion {
+				c.payloadVersion = version + 1
+			}
+		}
+	}
+}
+
+// MigrationError is wrapped by the *PayloadDecodeError for a payload whose
+// migration from Version failed.
+type MigrationError struct {
+	Version int
+	Err     error
+}
+
+func (m *MigrationError) Error() string {
+	return fmt.Sprintf("migration from payload version %d failed: %s", m.Version, m.Err)
+}
+
+func (m *MigrationError) Unwrap() error {
+	return m.Err
+}
+
+// WithMigrationWriteBack writes migrated payloads back to Redis, so each
+// payload is only migrated once even if it is retried.
+func WithMigrationWriteBack() Option {
+	return func(c *JobQueue) { c.migrationWriteBack = true }
+}
+
+// versionRecord prefixes a payload hash entry with the current version and
+// the queue's codec.
+func (c *JobQueue) versionRecord(record []byte) []byte {
+	return markRecord(c.payloadVersion, codecName(c.codec), record)
+}
+
+// markRecord prefixes a payload hash entry with version and codec, unless
+// they are version 0 and JSON.
+func markRecord(version int, codec string, record []byte) []byte {
+	if codec == "json" {
+		if version == 0 {
+			return record
+		}
+		codec = ""
+	} else {
+		codec = "/" + codec
+	}
+	return append([]byte(versionRecordPrefix+strconv.Itoa(version)+codec+":"), record...)
+}
+
+// splitVersion returns the version of a payload hash entry and the entry
+// with the version and codec marker removed.
+func splitVersion(record []byte) (int, []byte) {
+	version, _, record := splitRecord(record)
+	return version, record
+}
+
+// splitRecord returns the version of a payload hash entry, the name of the
+// codec it is marked with, if any, and the entry with the marker removed.
+func splitRecord(record []byte) (version int, codec string, rest []byte) {
+	if !bytes.HasPrefix(record, []byte(versionRecordPrefix)) {
+		return 0, "", record
+	}
+	rest = record[len(versionRecordPrefix):]
+	colon := bytes.IndexByte(rest, ':')
+	if colon < 0 {
+		return 0, "", record
+	}
+	marker := string(rest[:colon])
+	if slash := strings.IndexByte(marker, '/'); slash >= 0 {
+		marker, codec = marker[:slash], marker[slash+1:]
+	}
+	version, err := strconv.Atoi(marker)
+	if err != nil {
+		return 0, "", record
+	}
+	return version, codec, rest[colon+1:]
+}
+
+// decode the payload into v, migrating it first if necessary. Failures are
+// reported as a *PayloadDecodeError.
+func (w *Work) decode(v interface{}) error {
+	if err := w.decodePayload(v); err != nil {
+		return &PayloadDecodeError{Queue: w.Queue, Key: w.key, Err: err}
+	}
+	return nil
+}
+
+func (w *Work) decodePayload(v interface{}) error {
+	c := w.queue
+	version, name, record := splitRecord(w.record)
+	if version > c.payloadVersion {
+		return fmt.Errorf("payload version %d is newer than the supported version %d", version, c.payloadVersion)
+	}
+	codec, err := c.payloadCodec(name)
+	if err != nil {
+		return err
+	}
+	inline := payloadRef(record) == "" && !bytes.HasPrefix(record, []byte(chunksRecordPrefix)) && !isCompressed(record)
+	if !inline && version == c.payloadVersion {
+		rc, err := w.PayloadReader()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		return codec.DecodeFrom(rc, v)
+	}
+	payload := record
+	if !inline {
+		rc, err := w.PayloadReader()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		if payload, err = io.ReadAll(rc); err != nil {
+			return err
+		}
+	}
+	if version < c.payloadVersion {
+		for ; version < c.payloadVersion; version++ {
+			migration, ok := c.migrations[version]
+			if !ok {
+				return fmt.Errorf("no migration from payload version %d", version)
+			}
+			var err error
+			if payload, err = migration(payload); err != nil {
+				return &MigrationError{Version: version, Err: err}
+			}
+		}
+		if inline && c.migrationWriteBack {
+			record := markRecord(c.payloadVersion, codecName(codec), payload)
+			r := getConn(w.pool, "JobQueue.Get")
+			defer r.Close()
+			if _, err := migrateScript.do(r, c.Queue+":payload", w.key, record); err != nil {
+				return err
+			}
+			w.record = record
+		}
+	}
+	return codec.Unmarshal(payload, v)
+}
+
+// KEYS: payload hash. ARGV: key, record.
+var migrateScript = newLuaScript("migrate", 1, 1, `
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1 then
+  redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+end
+return {0}
+`)
+
+// undecodableReason returns the dead letter reason for a job that failed with
+// err because its payload can never be decoded, however often it is retried,
+// or "" if retrying might succeed.
+func undecodableReason(err error) string {
+	var migration *MigrationError
+	switch {
+	case errors.As(err, &migration):
+		return migration.Error()
+	case errors.Is(err, ErrPayloadNotFound):
+		return ErrPayloadNotFound.Error()
+	}
+	return ""
+}
+
+// dropUndecodable moves the job to the dead letters if it failed with err
+// because its payload can never be decoded, returning true if it did.
+func (w *Work) dropUndecodable(err error) (bool, error) {
+	reason := undecodableReason(err)
+	if reason == "" {
+		return false, nil
+	}
+	w.checkFinalize()
+	return true, w.markFinalized(WorkResubmitted, w.deadLetter(reason, err))
+}
@@ -0,0 +1,125 @@
+package grt_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/alecthomas/grt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// userV1 is a job whose user_id int field became user string in version 1.
+type userV1 struct {
+	User string `json:"user"`
+}
+
+func migrateUserID(old []byte) ([]byte, error) {
+	var v0 struct {
+		UserID int `json:"user_id"`
+	}
+	if err := json.Unmarshal(old, &v0); err != nil {
+		return nil, err
+	}
+	return json.Marshal(userV1{User: strconv.Itoa(v0.UserID)})
+}
+
+func TestMigrations(t *testing.T) {
+	s, pool := newPool(t)
+	// Queued by a producer that predates versioning.
+	const key, v0 = `{"user_id":5}`, `{"user_id":5}`
+	s.HSet("users:payload", key, v0)
+	if _, err := s.Lpush("users", key); err != nil {
+		t.Fatal(err)
+	}
+	q := grt.NewJobQueue(pool, "users", grt.WithMigrationWriteBack(), grt.WithMigrations(map[int]grt.Migration{0: migrateUserID}))
+	var job userV1
+	w, err := q.Get(&job)
+	if err != nil || job.User != "5" {
+		t.Fatal(job, err)
+	}
+	record := s.HGet("users:payload", key)
+	if !strings.HasPrefix(record, "\x00grt:v1:") || strings.TrimPrefix(record, "\x00grt:v1:") != `{"user":"5"}` {
+		t.Fatalf("migrated payload was not written back: %q", record)
+	}
+	if err := w.Resubmit(); err != nil {
+		t.Fatal(err)
+	}
+	// Retrieved again, the payload is already current.
+	q = grt.NewJobQueue(pool, "users", grt.WithMigrations(map[int]grt.Migration{
+		0: func([]byte) ([]byte, error) { return nil, errors.New("migrated twice") },
+	}))
+	job = userV1{}
+	w, err = q.Get(&job)
+	if err != nil || job.User != "5" {
+		t.Fatal(job, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+
+	// New jobs are submitted at the current version.
+	if err := q.Submit(userV1{User: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if record := s.HGet("users:payload", `{"user":"bob"}`); !strings.HasPrefix(record, "\x00grt:v1:") {
+		t.Fatalf("%q", record)
+	}
+}
+
+func TestMigrationFailure(t *testing.T) {
+	s, pool := newPool(t)
+	s.HSet("users:payload", `"a"`, `{"user_id":"not a number"}`)
+	if _, err := s.Lpush("users", `"a"`); err != nil {
+		t.Fatal(err)
+	}
+	q := grt.NewJobQueue(pool, "users", grt.WithMigrations(map[int]grt.Migration{0: migrateUserID}))
+	var reason error
+	q.OnDeadLetter = func(w *grt.Work, err error) { reason = err }
+	var job userV1
+	_, err := q.TryGet(&job)
+	var migrationErr *grt.MigrationError
+	if !errors.As(err, &migrationErr) || migrationErr.Version != 0 {
+		t.Fatal(err)
+	}
+	if !errors.As(reason, &migrationErr) {
+		t.Fatal(reason)
+	}
+	if w, err := q.TryGet(&job); w != nil || err != nil {
+		t.Fatal("the job was retried", w, err)
+	}
+	description, err := q.DescribeJob("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if description.State != grt.JobDead || len(description.History) != 1 ||
+		!strings.HasPrefix(description.History[0].Error, "migration from payload version 0 failed") {
+		t.Fatalf("%+v", description)
+	}
+}
+
+func TestMigrationFailureInRun(t *testing.T) {
+	s, pool := newPool(t)
+	s.HSet("users:payload", `"a"`, `{"user_id":"not a number"}`)
+	if _, err := s.Lpush("users", `"a"`); err != nil {
+		t.Fatal(err)
+	}
+	q := grt.NewJobQueue(pool, "users", grt.WithMigrations(map[int]grt.Migration{0: migrateUserID}))
+	dead := make(chan error, 1)
+	q.OnDeadLetter = func(w *grt.Work, err error) { dead <- err }
+	run(t, q, 1, func(ctx context.Context, w *grt.Work, decode func(interface{}) error) error {
+		var job userV1
+		return decode(&job)
+	})
+	select {
+	case err := <-dead:
+		var migrationErr *grt.MigrationError
+		if !errors.As(err, &migrationErr) {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the job was not dead-lettered")
+	}
+}
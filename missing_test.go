@@ -0,0 +1,59 @@
+package grt_test
+
+import (
+	"errors"
+	"github.com/alecthomas/grt"
+	"testing"
+	"time"
+)
+
+func TestPayloadMissing(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "missing", grt.WithVisibilityTimeout(time.Minute))
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	// The payload is deleted out from under the queued job.
+	s.HDel("missing:payload", `"a"`)
+	var job string
+	w, err := q.TryGet(&job)
+	if w != nil || !errors.Is(err, grt.ErrPayloadMissing) {
+		t.Fatal(w, err)
+	}
+	// The job is not left in progress.
+	if s.Exists("missing:processing") || s.Exists("missing:deadlines") {
+		t.Fatal(s.Keys())
+	}
+	if w, err := q.TryGet(&job); w != nil || err != nil {
+		t.Fatal(w, err)
+	}
+}
+
+func TestPayloadMissingBlocking(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "missing", grt.WithVisibilityTimeout(time.Minute))
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.HSet("missing:payload", `"b"`, `"b"`)
+		s.Lpush("missing", `"b"`)
+		s.Lpush("missing", `"gone"`)
+	}()
+	// The pop and fetch are atomic, so the retrieved job is recorded in full.
+	var job string
+	w, err := q.Get(&job)
+	if err != nil || job != "b" {
+		t.Fatal(job, err)
+	}
+	if d, err := q.DescribeJob("b"); err != nil || d.Deadline == nil || d.Attempts != 1 {
+		t.Fatalf("%+v %v", d, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if w, err := q.Get(&job); w != nil || !errors.Is(err, grt.ErrPayloadMissing) {
+		t.Fatal(w, err)
+	}
+	if s.Exists("missing:processing") {
+		t.Fatal(s.Keys())
+	}
+}
@@ -0,0 +1,253 @@
+package grt
+
+import (
+	"context"
+	"github.com/alecthomas/grt/backoff"
+	"github.com/garyburd/redigo/redis"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MultiLock is a lock held on a majority of independent Redis instances,
+// using the Redlock algorithm, so that it survives the loss of any minority
+// of them. It is used like a Lock.
+//
+// A hold is valid for Expiry less the time taken to acquire it and an
+// allowance for clock drift, and is renewed by a heartbeat on every
+// instance. If a majority cannot be renewed, the hold is lost.
+type MultiLock struct {
+	pools []*redis.Pool
+	Key   string
+	// Set the expiry time.
+	Expiry time.Duration
+	// Fraction of Expiry allowed for clock drift between instances.
+	DriftFactor float64
+	// Backoff between acquisition attempts, which are also retried as soon
+	// as the holder releases the lock. Defaults to random delays of up to
+	// Expiry, so that contenders splitting the instances between them do
+	// not retry in lockstep.
+	Backoff backoff.Backoff
+	// Number of times a failed renewal is retried, RetryDelay apart, before
+	// the lock is declared lost.
+	RetryAttempts int
+	RetryDelay    time.Duration
+	// Receives lost holds. Defaults to slog.Default().
+	Logger *slog.Logger
+	// Held by the goroutine holding or acquiring the lock.
+	lock chan struct{}
+	hold *lockHold
+	held int32
+	// When the current hold expires unless renewed, in Unix nanoseconds.
+	validUntil int64
+}
+
+// NewMultiLock creates a new lock held on a majority of pools, each of which
+// should connect to an independent Redis instance.
+func NewMultiLock(pools []*redis.Pool, key string) *MultiLock {
+	return &MultiLock{
+		pools:         pools,
+		Key:           key,
+		Expiry:        time.Second * 2,
+		DriftFactor:   0.01,
+		RetryAttempts: 3,
+		RetryDelay:    time.Millisecond * 100,
+		lock:          make(chan struct{}, 1),
+	}
+}
+
+// Lock is a blocking lock. Returns nil if the lock is acquired, or any Redis
+// error.
+func (l *MultiLock) Lock() error {
+	return l.LockContext(context.Background())
+}
+
+// LockWait is a non-blocking lock. Returns nil if the lock is acquired,
+// ErrLockTimeout if the timeout is reached, or any Redis error.
+func (l *MultiLock) LockWait(wait time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	err := l.LockContext(ctx)
+	if err == context.DeadlineExceeded {
+		return ErrLockTimeout
+	}
+	return err
+}
+
+// LockContext acquires the lock, waiting until it is acquired or ctx is done.
+// Returns nil if the lock is acquired, or ctx.Err() if ctx is done first.
+// Instances that cannot be reached count against a majority rather than
+// failing the attempt.
+func (l *MultiLock) LockContext(ctx context.Context) error {
+	if err := takeSlot(ctx, l.lock); err != nil {
+		return err
+	}
+	op := startOperation("MultiLock.Lock")
+	defer op.end()
+	token := randomKey("")
+	// Releases are announced on every instance, and watched for on all of
+	// them, so that a release is noticed while some are unreachable.
+	err := waitForLockAll(ctx, l.pools, l.Key, l.backoff(), func() (bool, error) {
+		return l.acquire(op, token), nil
+	})
+	if err != nil {
+		<-l.lock
+		return err
+	}
+	l.start(token)
+	return nil
+}
+
+// TryLock attempts to acquire the lock once, without waiting, returning
+// whether it was acquired.
+func (l *MultiLock) TryLock() (bool, error) {
+	select {
+	case l.lock <- struct{}{}:
+	default:
+		return false, nil
+	}
+	op := startOperation("MultiLock.TryLock")
+	defer op.end()
+	token := randomKey("")
+	if !l.acquire(op, token) {
+		<-l.lock
+		return false, nil
+	}
+	l.start(token)
+	return true, nil
+}
+
+// Unlock stops renewing the lock and releases it on every instance. Returns
+// ErrLockLost if it was no longer held on a majority, or ErrNotLocked if it
+// is not held.
+func (l *MultiLock) Unlock() error {
+	if !atomic.CompareAndSwapInt32(&l.held, 1, 0) {
+		return ErrNotLocked
+	}
+	defer func() { <-l.lock }()
+	l.hold.release()
+	op := startOperation("MultiLock.Unlock")
+	defer op.end()
+	if l.release(op, l.hold.token) < l.quorum() {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// Done returns a channel that receives an error if the current hold of the
+// lock is lost, and is closed when the hold ends. See Lock.Done.
+func (l *MultiLock) Done() <-chan error {
+	if l.hold == nil {
+		return nil
+	}
+	return l.hold.done
+}
+
+// Token returns a value unique to the current hold of the lock.
+func (l *MultiLock) Token() string {
+	if l.hold == nil {
+		return ""
+	}
+	return l.hold.token
+}
+
+// Validity returns how long the current hold is guaranteed to last if it is
+// not renewed, allowing for clock drift.
+func (l *MultiLock) Validity() time.Duration {
+	if atomic.LoadInt32(&l.held) == 0 {
+		return 0
+	}
+	return time.Until(time.Unix(0, atomic.LoadInt64(&l.validUntil)))
+}
+
+// acquire attempts to acquire the lock on every instance, returning whether
+// a majority were acquired within the lock's validity. If not, any that were
+// acquired are released.
+func (l *MultiLock) acquire(op *operation, token string) bool {
+	start := time.Now()
+	acquired := l.each(op, func(r redis.Conn) bool {
+		v, err := r.Do("SET", l.Key, token, "NX", "PX", l.Expiry.Milliseconds())
+		return err == nil && v != nil
+	})
+	validUntil := start.Add(l.Expiry - l.drift())
+	if acquired >= l.quorum() && time.Now().Before(validUntil) {
+		atomic.StoreInt64(&l.validUntil, validUntil.UnixNano())
+		return true
+	}
+	l.release(op, token)
+	return false
+}
+
+// start renews a newly acquired hold on every instance, losing it when a
+// majority cannot be renewed.
+func (l *MultiLock) start(token string) {
+	l.hold = newLockHold(token)
+	atomic.StoreInt32(&l.held, 1)
+	go l.hold.heartbeat(lockLogger(l.Logger), l.Key, l.Expiry/4, func() error {
+		return renewWithRetries(l.RetryAttempts, l.RetryDelay, func() error {
+			start := time.Now()
+			op := startOperation("MultiLock.heartbeat")
+			defer op.end()
+			renewed := l.each(op, func(r redis.Conn) bool {
+				_, err := renewScript.do(r, l.Key, token, l.Expiry.Milliseconds())
+				return err == nil
+			})
+			if renewed < l.quorum() {
+				return ErrLockLost
+			}
+			atomic.StoreInt64(&l.validUntil, start.Add(l.Expiry-l.drift()).UnixNano())
+			return nil
+		})
+	})
+}
+
+// release releases the lock on every instance where token holds it,
+// returning how many released it.
+func (l *MultiLock) release(op *operation, token string) int {
+	return l.each(op, func(r redis.Conn) bool {
+		_, err := releaseScript.do(r, l.Key, token, lockReleasedChannel(l.Key))
+		return err == nil
+	})
+}
+
+// each calls fn on a connection to every instance concurrently, for op,
+// returning how many calls returned true.
+func (l *MultiLock) each(op *operation, fn func(r redis.Conn) bool) int {
+	var (
+		wg    sync.WaitGroup
+		lock  sync.Mutex
+		count int
+	)
+	for _, pool := range l.pools {
+		wg.Add(1)
+		go func(pool *redis.Pool) {
+			defer wg.Done()
+			r := op.conn(pool)
+			defer r.Close()
+			if fn(r) {
+				lock.Lock()
+				count++
+				lock.Unlock()
+			}
+		}(pool)
+	}
+	wg.Wait()
+	return count
+}
+
+func (l *MultiLock) quorum() int {
+	return len(l.pools)/2 + 1
+}
+
+// drift is the allowance for clock drift between instances.
+func (l *MultiLock) drift() time.Duration {
+	return time.Duration(float64(l.Expiry)*l.DriftFactor) + 2*time.Millisecond
+}
+
+func (l *MultiLock) backoff() backoff.Backoff {
+	if l.Backoff != nil {
+		return l.Backoff
+	}
+	return backoff.Exponential{Base: l.Expiry, Max: l.Expiry, Factor: 1, Jitter: 1}
+}
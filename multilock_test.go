@@ -0,0 +1,134 @@
+package grt_test
+
+import (
+	"github.com/alecthomas/grt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+	"testing"
+	"time"
+)
+
+// multiLockNodes starts n independent Redis instances, returning them and a
+// pool for each.
+func multiLockNodes(t *testing.T, n int) ([]*miniredis.Miniredis, []*redis.Pool) {
+	servers := []*miniredis.Miniredis{}
+	pools := []*redis.Pool{}
+	for i := 0; i < n; i++ {
+		s, pool := restartablePool(t)
+		servers = append(servers, s)
+		pools = append(pools, pool)
+	}
+	return servers, pools
+}
+
+func TestMultiLock(t *testing.T) {
+	servers, pools := multiLockNodes(t, 3)
+	l := grt.NewMultiLock(pools, "multilock")
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range servers {
+		if v, err := s.Get("multilock"); err != nil || v != l.Token() {
+			t.Fatalf("node %d: %q %v", i, v, err)
+		}
+	}
+	if validity := l.Validity(); validity <= 0 || validity > l.Expiry-time.Duration(float64(l.Expiry)*l.DriftFactor) {
+		t.Fatal(validity)
+	}
+	other := grt.NewMultiLock(pools, "multilock")
+	if ok, err := other.TryLock(); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range servers {
+		if s.Exists("multilock") {
+			t.Fatalf("node %d still locked", i)
+		}
+	}
+	if err := l.Unlock(); err != grt.ErrNotLocked {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiLockMinorityDown(t *testing.T) {
+	servers, pools := multiLockNodes(t, 3)
+	servers[0].Close()
+	l := grt.NewMultiLock(pools, "multilock")
+	if err := l.LockWait(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiLockMajorityDown(t *testing.T) {
+	servers, pools := multiLockNodes(t, 3)
+	servers[0].Close()
+	servers[1].Close()
+	l := grt.NewMultiLock(pools, "multilock")
+	if ok, err := l.TryLock(); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	// The single instance acquired is released rather than left to expire.
+	if servers[2].Exists("multilock") {
+		t.Fatal("minority hold was not released")
+	}
+	if err := l.LockWait(0); err != grt.ErrLockTimeout {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiLockLost(t *testing.T) {
+	servers, pools := multiLockNodes(t, 3)
+	l := grt.NewMultiLock(pools, "multilock")
+	l.Expiry = 200 * time.Millisecond
+	l.RetryAttempts = 0
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	servers[0].Close()
+	servers[1].Close()
+	select {
+	case err := <-l.Done():
+		if err != grt.ErrLockLost {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("hold was not lost")
+	}
+	if err := l.Unlock(); err != grt.ErrLockLost {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiLockNotifiedByAnyInstance(t *testing.T) {
+	servers, pools := multiLockNodes(t, 3)
+	// Releases cannot be announced by the first instance.
+	servers[0].Close()
+	holder := grt.NewMultiLock(pools, "multilock")
+	if err := holder.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if err := holder.Unlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	// The default backoff is up to an Expiry, far longer than the release.
+	waiter := grt.NewMultiLock(pools, "multilock")
+	waiter.Expiry = 10 * time.Second
+	start := time.Now()
+	if err := waiter.LockWait(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal(elapsed)
+	}
+	if err := waiter.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,200 @@
+package grt
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// MultiQueue retrieves jobs from whichever of several queues has work, so
+// that a worker idle on one queue can help drain another. Not thread-safe.
+type MultiQueue struct {
+	queues []*JobQueue
+	// Indexes into queues, each appearing as often as the queue's weight,
+	// interleaved.
+	schedule []int
+	// How long Get waits for a job to be submitted before checking all of
+	// the queues again. Jobs queued other than by Submit or SubmitAll, eg.
+	// resubmitted or delayed jobs falling due, may wait up to this long to be
+	// noticed.
+	PollInterval time.Duration
+	// Position in schedule of the queue to try first.
+	next int
+}
+
+// WeightedQueue is a queue for NewWeightedMultiQueue, and how many jobs to
+// take from it relative to the other queues while they all have work.
+type WeightedQueue struct {
+	Queue  *JobQueue
+	Weight int
+}
+
+// NewMultiQueue creates a MultiQueue retrieving jobs from queues, which keep
+// their own options. Jobs are retrieved, and completed or resubmitted,
+// exactly as if by the queue they came from.
+func NewMultiQueue(queues ...*JobQueue) *MultiQueue {
+	weighted := make([]WeightedQueue, len(queues))
+	for i, queue := range queues {
+		weighted[i] = WeightedQueue{Queue: queue, Weight: 1}
+	}
+	return NewWeightedMultiQueue(weighted...)
+}
+
+// NewWeightedMultiQueue creates a MultiQueue that, while every queue has
+// work, takes jobs from each in proportion to its weight. A weight of less
+// than one counts as one.
+//
+//	m := grt.NewWeightedMultiQueue(
+//		grt.WeightedQueue{Queue: critical, Weight: 5},
+//		grt.WeightedQueue{Queue: normal, Weight: 3},
+//		grt.WeightedQueue{Queue: low, Weight: 1},
+//	)
+func NewWeightedMultiQueue(queues ...WeightedQueue) *MultiQueue {
+	m := &MultiQueue{PollInterval: time.Second}
+	weights := make([]int, len(queues))
+	for i, queue := range queues {
+		m.queues = append(m.queues, queue.Queue)
+		weights[i] = queue.Weight
+	}
+	m.schedule = weightedSchedule(weights)
+	return m
+}
+
+// weightedSchedule interleaves the indexes of weights, each appearing as
+// often as its weight, with smooth weighted round-robin: the index with the
+// most credit is taken next, so heavier indexes are spread out rather than
+// bunched together.
+func weightedSchedule(weights []int) []int {
+	total := 0
+	for i, weight := range weights {
+		if weight < 1 {
+			weights[i] = 1
+		}
+		total += weights[i]
+	}
+	credit := make([]int, len(weights))
+	schedule := make([]int, 0, total)
+	for len(schedule) < total {
+		best := 0
+		for i, weight := range weights {
+			credit[i] += weight
+			if credit[i] > credit[best] {
+				best = i
+			}
+		}
+		credit[best] -= total
+		schedule = append(schedule, best)
+	}
+	return schedule
+}
+
+// Get some work from any of the queues, blocking until a job is available.
+// Work.Queue is the name of the queue it came from.
+//
+// Queues are tried in their weighted order, starting after the one that last
+// had work, so that a busy queue does not starve the others.
+//
+// While every queue is empty, Get waits on a single subscription to all of
+// their submissions if the queues share a pool, so that one connection is
+// used however many queues there are and jobs are noticed as soon as they are
+// submitted. Otherwise it blocks on each queue in turn for PollInterval.
+func (m *MultiQueue) Get(v interface{}) (*Work, error) {
+	return m.GetContext(context.Background(), v)
+}
+
+// GetContext is like Get, but returns ctx.Err() if ctx is done before a job
+// arrives. The context is checked at least every PollInterval.
+func (m *MultiQueue) GetContext(ctx context.Context, v interface{}) (*Work, error) {
+	if len(m.queues) == 0 {
+		return nil, errors.New("no queues to get work from")
+	}
+	for _, queue := range m.queues {
+		if err := queue.checkOptions(); err != nil {
+			return nil, err
+		}
+	}
+	op := startOperation("MultiQueue.Get")
+	defer op.end()
+	var submitted *notifications
+	subscribed := false
+	defer func() {
+		if submitted != nil {
+			submitted.close()
+		}
+	}()
+	for {
+		if work, err := m.tryGet(op, v); work != nil || err != nil {
+			return work, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		timeout := m.PollInterval
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = minDuration(timeout, time.Until(deadline))
+		}
+		// Check again straight after subscribing, in case a job was
+		// submitted in between.
+		if !subscribed {
+			subscribed = true
+			if submitted = m.subscribe(); submitted != nil {
+				continue
+			}
+		}
+		if submitted != nil {
+			submitted.wait(ctx, timeout)
+			continue
+		}
+		// Block on each queue in turn, returning periodically to check the
+		// others.
+		queue := m.queues[m.schedule[m.next]]
+		m.next = (m.next + 1) % len(m.schedule)
+		work, err := queue.getWait(op, v, timeout)
+		if work != nil || err != nil {
+			return work, err
+		}
+	}
+}
+
+// tryGet tries each queue once without blocking, in weighted order from
+// next, returning the first job found.
+func (m *MultiQueue) tryGet(op *operation, v interface{}) (*Work, error) {
+	tried := make([]bool, len(m.queues))
+	for i := range m.schedule {
+		position := (m.next + i) % len(m.schedule)
+		index := m.schedule[position]
+		if tried[index] {
+			continue
+		}
+		tried[index] = true
+		work, err := m.queues[index].get(op, v, 0)
+		if work != nil || err != nil {
+			m.next = (position + 1) % len(m.schedule)
+			return work, err
+		}
+	}
+	return nil, nil
+}
+
+// subscribe subscribes to submissions to every queue, or returns nil if the
+// queues do not share a pool that can subscribe.
+func (m *MultiQueue) subscribe() *notifications {
+	pool := m.queues[0].pool
+	channels := make([]string, len(m.queues))
+	for i, queue := range m.queues {
+		if queue.pool != pool {
+			return nil
+		}
+		channels[i] = submittedChannel(queue.Queue)
+	}
+	if isSingleConn(pool) {
+		return nil
+	}
+	return subscribeNotifications(pool, "MultiQueue.Get", channels...)
+}
+
+// submittedChannel is announced on by Submit and SubmitAll when they queue
+// jobs.
+func submittedChannel(queue string) string {
+	return queue + ":submitted"
+}
@@ -0,0 +1,117 @@
+package grt_test
+
+import (
+	"context"
+	"github.com/alecthomas/grt"
+	"testing"
+	"time"
+)
+
+func TestMultiQueueWakesOnSubmit(t *testing.T) {
+	s, pool := newPool(t)
+	a, b := grt.NewJobQueue(pool, "a"), grt.NewJobQueue(pool, "b")
+	m := grt.NewMultiQueue(a, b)
+	// Long enough that only the submission could wake the consumer in time.
+	m.PollInterval = 10 * time.Second
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := grt.NewJobQueue(pool, "b").Submit("job"); err != nil {
+			t.Error(err)
+		}
+	}()
+	start := time.Now()
+	var job string
+	w, err := m.Get(&job)
+	if err != nil || job != "job" || w.Queue != "b" {
+		t.Fatal(w, job, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("woken after %s", elapsed)
+	}
+	// The job is in progress on the queue it came from.
+	if processing, err := s.List("b:processing"); err != nil || len(processing) != 1 {
+		t.Fatal(processing, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := b.Len(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+}
+
+func TestMultiQueueCrashedWorker(t *testing.T) {
+	_, pool := newPool(t)
+	a, b := grt.NewJobQueue(pool, "a"), grt.NewJobQueue(pool, "b")
+	if err := b.Submit("job"); err != nil {
+		t.Fatal(err)
+	}
+	// The worker retrieves the job and dies without completing it.
+	if _, err := grt.NewMultiQueue(a, b).Get(nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := b.Len(); n != 1 || err != nil {
+		t.Fatal("job lost", n, err)
+	}
+	if err := b.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	var job string
+	w, err := b.TryGet(&job)
+	if err != nil || w == nil || job != "job" {
+		t.Fatal(w, job, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiQueueRotation(t *testing.T) {
+	_, pool := newPool(t)
+	a, b := grt.NewJobQueue(pool, "a"), grt.NewJobQueue(pool, "b")
+	submitJobs(t, a, "a", 3)
+	submitJobs(t, b, "b", 3)
+	m := grt.NewMultiQueue(a, b)
+	queues := []string{}
+	for i := 0; i < 6; i++ {
+		w, err := m.Get(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queues = append(queues, w.Queue)
+		if err := w.Complete(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < len(queues); i++ {
+		if queues[i] == queues[i-1] {
+			t.Fatalf("a busy queue starved the other: %v", queues)
+		}
+	}
+}
+
+func TestMultiQueueSeparatePools(t *testing.T) {
+	_, poolA := newPool(t)
+	_, poolB := newPool(t)
+	a, b := grt.NewJobQueue(poolA, "a"), grt.NewJobQueue(poolB, "b")
+	m := grt.NewMultiQueue(a, b)
+	m.PollInterval = 50 * time.Millisecond
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := b.Submit("job"); err != nil {
+			t.Error(err)
+		}
+	}()
+	w, err := m.Get(nil)
+	if err != nil || w.Queue != "b" {
+		t.Fatal(w, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := m.GetContext(ctx, nil); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,105 @@
+package grt
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"time"
+)
+
+// Namespace prefixes the Redis keys of the queues, locks, schedulers and
+// other primitives created through it with its name and a colon, so that
+// applications or environments sharing one Redis do not collide, eg.
+// grt.Namespace("app1:prod"). The empty namespace prefixes nothing.
+//
+// Typed queues take the namespace as an option: see WithPrefix.
+type Namespace string
+
+// WithPrefix prefixes the queue's Redis keys, and so its Queue name, with
+// prefix and a colon. Namespace.NewJobQueue applies it.
+func WithPrefix(prefix string) Option {
+	return func(c *JobQueue) { c.prefix = prefix }
+}
+
+// Key returns key within the namespace.
+func (n Namespace) Key(key string) string {
+	if n == "" {
+		return key
+	}
+	return string(n) + ":" + key
+}
+
+// NewJobQueue creates a queue within the namespace. See NewJobQueue.
+func (n Namespace) NewJobQueue(pool *redis.Pool, queue string, options ...Option) *JobQueue {
+	return NewJobQueue(pool, queue, append([]Option{WithPrefix(string(n))}, options...)...)
+}
+
+// ListQueues returns the names of the queues within the namespace, sorted and
+// without its prefix. Queues in namespaces nested within it, eg. "prod:jobs"
+// within the empty namespace, are not listed. See ListQueues.
+func (n Namespace) ListQueues(ctx context.Context, pool *redis.Pool) ([]string, error) {
+	queues, err := listQueues(ctx, pool, n.Key(""))
+	if err != nil {
+		return nil, err
+	}
+	own := []string{}
+	for _, queue := range queues {
+		if !strings.Contains(queue, ":") {
+			own = append(own, queue)
+		}
+	}
+	return own, nil
+}
+
+// NewLock creates a lock within the namespace. See NewLock.
+func (n Namespace) NewLock(pool *redis.Pool, key string) *Lock {
+	return NewLock(pool, n.Key(key))
+}
+
+// NewRWLock creates a reader/writer lock within the namespace. See NewRWLock.
+func (n Namespace) NewRWLock(pool *redis.Pool, key string) *RWLock {
+	return NewRWLock(pool, n.Key(key))
+}
+
+// NewSemaphore creates a semaphore within the namespace. See NewSemaphore.
+func (n Namespace) NewSemaphore(pool *redis.Pool, key string, limit int) *Semaphore {
+	return NewSemaphore(pool, n.Key(key), limit)
+}
+
+// NewLeaderElector creates a leader elector within the namespace. See
+// NewLeaderElector.
+func (n Namespace) NewLeaderElector(pool *redis.Pool, key string, identity string) *LeaderElector {
+	return NewLeaderElector(pool, n.Key(key), identity)
+}
+
+// NewRateLimiter creates a rate limiter within the namespace. See
+// NewRateLimiter.
+func (n Namespace) NewRateLimiter(pool *redis.Pool, key string, rate float64, burst int) *RateLimiter {
+	return NewRateLimiter(pool, n.Key(key), rate, burst)
+}
+
+// NewLimiter creates a keyed rate limiter within the namespace. See
+// NewLimiter.
+func (n Namespace) NewLimiter(pool *redis.Pool, prefix string, limit int, window time.Duration) *Limiter {
+	return NewLimiter(pool, n.Key(prefix), limit, window)
+}
+
+// NewScheduler creates a Scheduler within the namespace. See NewScheduler.
+func (n Namespace) NewScheduler(pool *redis.Pool, key string) *Scheduler {
+	return NewScheduler(pool, n.Key(key))
+}
+
+// NewCounter creates a counter within the namespace. See NewCounter.
+func (n Namespace) NewCounter(pool *redis.Pool, key string) *Counter {
+	return NewCounter(pool, n.Key(key))
+}
+
+// NewGauge creates a gauge within the namespace. See NewGauge.
+func (n Namespace) NewGauge(pool *redis.Pool, key string) *Gauge {
+	return NewGauge(pool, n.Key(key))
+}
+
+// NewOnce creates a once guard within the namespace. See NewOnce.
+func (n Namespace) NewOnce(pool *redis.Pool, prefix string) *Once {
+	return NewOnce(pool, n.Key(prefix))
+}
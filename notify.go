@@ -0,0 +1,93 @@
+package grt
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"sync"
+	"time"
+)
+
+// notifications receives messages published to a channel, such as a lock's
+// releases, without their content.
+type notifications struct {
+	conns    []redis.PubSubConn
+	notified chan struct{}
+	done     sync.WaitGroup
+}
+
+// subscribeNotifications subscribes to channels on a connection of its own,
+// or returns nil if it cannot, in which case waiters just poll.
+func subscribeNotifications(pool *redis.Pool, op string, channels ...string) *notifications {
+	return subscribeNotificationsAll([]*redis.Pool{pool}, op, channels...)
+}
+
+// subscribeNotificationsAll subscribes to channels on a connection of its own
+// to each of pools, notifying of messages received from any of them. Pools
+// that cannot be subscribed to are skipped, and nil is returned if none can.
+func subscribeNotificationsAll(pools []*redis.Pool, op string, channels ...string) *notifications {
+	args := make([]interface{}, len(channels))
+	for i, channel := range channels {
+		args[i] = channel
+	}
+	s := &notifications{notified: make(chan struct{}, 1)}
+	for _, pool := range pools {
+		conn := redis.PubSubConn{Conn: getConn(pool, op)}
+		if err := conn.Subscribe(args...); err != nil {
+			conn.Close()
+			continue
+		}
+		s.conns = append(s.conns, conn)
+		s.done.Add(1)
+		go s.receive(conn)
+	}
+	if len(s.conns) == 0 {
+		return nil
+	}
+	return s
+}
+
+// receive forwards the messages received on conn until it is unsubscribed.
+func (s *notifications) receive(conn redis.PubSubConn) {
+	defer s.done.Done()
+	for {
+		switch v := conn.Receive().(type) {
+		case redis.Message:
+			select {
+			case s.notified <- struct{}{}:
+			default:
+			}
+		case redis.Subscription:
+			if v.Count == 0 {
+				return
+			}
+		case error:
+			return
+		}
+	}
+}
+
+// wait until a message is received, delay passes or ctx is done. A nil
+// notifications just sleeps.
+func (s *notifications) wait(ctx context.Context, delay time.Duration) {
+	var notified chan struct{}
+	if s != nil {
+		notified = s.notified
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-notified:
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+func (s *notifications) close() {
+	for _, conn := range s.conns {
+		conn.Unsubscribe()
+	}
+	s.done.Wait()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,141 @@
+package grt
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"log/slog"
+	"time"
+)
+
+var (
+	// ErrAlreadyDone is returned by Once.Do when the function has already
+	// been run successfully for the key within its TTL.
+	ErrAlreadyDone = errors.New("already done")
+	// ErrAlreadyRunning is returned by Once.Do when the function is being
+	// run for the key elsewhere.
+	ErrAlreadyRunning = errors.New("already running")
+)
+
+// Value of a Once key whose function has completed successfully.
+const onceDone = "done"
+
+// Once is a Redis-based guard that runs a function at most once per key
+// across all clients using the same Prefix, eg. for one-time migrations and
+// notifications.
+type Once struct {
+	pool *redis.Pool
+	// Prepended, with a colon, to each key to form its Redis key.
+	Prefix string
+	// Receives failures to release claims. Defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// NewOnce creates a new Redis once guard.
+func NewOnce(pool *redis.Pool, prefix string) *Once {
+	return &Once{pool: pool, Prefix: prefix}
+}
+
+// Do runs fn unless it has already been run successfully for key within ttl,
+// returning ErrAlreadyDone, or is being run for key elsewhere, returning
+// ErrAlreadyRunning. Otherwise it returns fn's error, or an error marking key
+// done after fn succeeded, in which case the claim still prevents fn being
+// run again until ttl has passed.
+//
+// Key is claimed with SET NX for ttl while fn runs, and once fn succeeds is
+// marked done for the rest of ttl. If fn fails or panics the claim is
+// released, so that fn may be run again. If this client dies while running
+// fn, the claim holds until ttl has passed, so fn may have run partly or not
+// at all. ttl should comfortably exceed the time fn takes: if it passes
+// while fn runs, fn may be run again elsewhere. ttl is rounded up to whole
+// milliseconds, and is at least one.
+func (o *Once) Do(key string, ttl time.Duration, fn func() error) error {
+	op := startOperation("Once.Do")
+	defer op.end()
+	claim := randomKey("running:")
+	if err := o.claim(op, key, claim, ttl); err != nil {
+		return err
+	}
+	completed := false
+	defer func() {
+		if !completed {
+			o.release(op, key, claim)
+		}
+	}()
+	if err := fn(); err != nil {
+		return err
+	}
+	completed = true
+	r := op.conn(o.pool)
+	defer r.Close()
+	_, err := onceDoneScript.do(r, o.key(key), claim, ttlMillis(ttl))
+	return err
+}
+
+func (o *Once) claim(op *operation, key, claim string, ttl time.Duration) error {
+	r := op.conn(o.pool)
+	defer r.Close()
+	_, err := onceClaimScript.do(r, o.key(key), claim, ttlMillis(ttl))
+	return err
+}
+
+// release deletes a claim after fn failed, logging any error as fn's is
+// returned.
+func (o *Once) release(op *operation, key, claim string) {
+	r := op.conn(o.pool)
+	defer r.Close()
+	if _, err := onceReleaseScript.do(r, o.key(key), claim); err != nil {
+		lockLogger(o.Logger).Warn("Failed to release once claim", "key", o.key(key), "error", err)
+	}
+}
+
+func (o *Once) key(key string) string {
+	return o.Prefix + ":" + key
+}
+
+// ttlMillis returns ttl in milliseconds for PX, rounded up so that a TTL
+// under a millisecond does not become zero, which SET rejects.
+func ttlMillis(ttl time.Duration) int64 {
+	ms := int64((ttl + time.Millisecond - 1) / time.Millisecond)
+	if ms < 1 {
+		return 1
+	}
+	return ms
+}
+
+// KEYS: once key. ARGV: claim, TTL in milliseconds. Sets the key to the claim
+// unless it is done or claimed already.
+var onceClaimScript = newLuaScript("once_claim", 1, 1, `
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+  return {0}
+end
+if redis.call("GET", KEYS[1]) == "`+onceDone+`" then
+  return {9} -- statusAlreadyDone
+end
+return {10} -- statusAlreadyRunning
+`)
+
+// KEYS: once key. ARGV: claim, TTL in milliseconds. Marks the key done for
+// the remainder of the claim's TTL, or for the whole TTL if the claim
+// expired, unless another client has claimed it since.
+var onceDoneScript = newLuaScript("once_done", 1, 1, `
+local value = redis.call("GET", KEYS[1])
+if value == ARGV[1] then
+  local ttl = redis.call("PTTL", KEYS[1])
+  if ttl > 0 then
+    redis.call("SET", KEYS[1], "`+onceDone+`", "PX", ttl)
+    return {0}
+  end
+end
+if not value then
+  redis.call("SET", KEYS[1], "`+onceDone+`", "PX", ARGV[2])
+end
+return {0}
+`)
+
+// KEYS: once key. ARGV: claim. Deletes the key if it holds the claim.
+var onceReleaseScript = newLuaScript("once_release", 1, 1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+  redis.call("DEL", KEYS[1])
+end
+return {0}
+`)
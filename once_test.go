@@ -0,0 +1,100 @@
+package grt_test
+
+import (
+	"errors"
+	"github.com/alecthomas/grt"
+	"testing"
+	"time"
+)
+
+func TestOnce(t *testing.T) {
+	s, pool := newPool(t)
+	o := grt.NewOnce(pool, "once")
+	runs := 0
+	err := o.Do("k", time.Minute, func() error {
+		runs++
+		if !s.Exists("once:k") {
+			t.Fatal("key not claimed while running")
+		}
+		err := o.Do("k", time.Minute, func() error { runs++; return nil })
+		if !errors.Is(err, grt.ErrAlreadyRunning) {
+			t.Fatalf("expected ErrAlreadyRunning, got %v", err)
+		}
+		return nil
+	})
+	if err != nil || runs != 1 {
+		t.Fatalf("expected one run, got %d: %v", runs, err)
+	}
+	if got, _ := s.Get("once:k"); got != "done" {
+		t.Fatalf("expected key marked done, got %q", got)
+	}
+	if ttl := s.TTL("once:k"); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("expected done key to expire within the TTL, got %s", ttl)
+	}
+	err = o.Do("k", time.Minute, func() error { runs++; return nil })
+	if !errors.Is(err, grt.ErrAlreadyDone) || runs != 1 {
+		t.Fatalf("expected ErrAlreadyDone without a run, got %d: %v", runs, err)
+	}
+
+	// Once the TTL has passed, fn runs again.
+	s.FastForward(time.Minute)
+	if err := o.Do("k", time.Minute, func() error { runs++; return nil }); err != nil || runs != 2 {
+		t.Fatalf("expected a second run after expiry, got %d: %v", runs, err)
+	}
+}
+
+func TestOnceFailureReleasesClaim(t *testing.T) {
+	s, pool := newPool(t)
+	o := grt.NewOnce(pool, "once")
+	boom := errors.New("boom")
+	if err := o.Do("k", time.Minute, func() error { return boom }); err != boom {
+		t.Fatalf("expected fn's error, got %v", err)
+	}
+	if s.Exists("once:k") {
+		t.Fatal("claim not released after failure")
+	}
+	func() {
+		defer func() { recover() }()
+		o.Do("k", time.Minute, func() error { panic("boom") })
+	}()
+	if s.Exists("once:k") {
+		t.Fatal("claim not released after panic")
+	}
+	runs := 0
+	if err := o.Do("k", time.Minute, func() error { runs++; return nil }); err != nil || runs != 1 {
+		t.Fatalf("expected a run after the failures, got %d: %v", runs, err)
+	}
+}
+
+func TestOnceClaimExpiresWhileRunning(t *testing.T) {
+	s, pool := newPool(t)
+	o := grt.NewOnce(pool, "once")
+	err := o.Do("k", time.Minute, func() error {
+		s.FastForward(time.Minute)
+		if s.Exists("once:k") {
+			t.Fatal("expected claim to have expired")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The expired claim is marked done for the whole TTL.
+	if got, _ := s.Get("once:k"); got != "done" {
+		t.Fatalf("expected key marked done, got %q", got)
+	}
+	if ttl := s.TTL("once:k"); ttl != time.Minute {
+		t.Fatalf("expected a full TTL, got %s", ttl)
+	}
+}
+
+func TestOnceSubMillisecondTTL(t *testing.T) {
+	s, pool := newPool(t)
+	o := grt.NewOnce(pool, "once")
+	if err := o.Do("k", time.Microsecond, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := s.TTL("once:k"); ttl != time.Millisecond {
+		t.Fatalf("expected the TTL rounded up to 1ms, got %s", ttl)
+	}
+}
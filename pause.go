@@ -0,0 +1,51 @@
+package grt
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// How often Get checks whether a paused queue has been resumed.
+const pausePollInterval = time.Second
+
+// errPaused is returned by pop when the queue is paused.
+var errPaused = errors.New("queue paused")
+
+// Pause stops jobs being retrieved from the queue by any instance until
+// Resume is called. Submissions are still accepted, and jobs in progress are
+// unaffected.
+//
+// While the queue is paused Get waits, and TryGet returns no job. Waiting
+// instances notice Resume within a second.
+func (c *JobQueue) Pause() error {
+	r := getConn(c.pool, "JobQueue.Pause")
+	defer r.Close()
+	_, err := r.Do("SET", pausedKey(c.Queue), 1)
+	return err
+}
+
+// Resume allows jobs to be retrieved from a paused queue.
+func (c *JobQueue) Resume() error {
+	r := getConn(c.pool, "JobQueue.Resume")
+	defer r.Close()
+	_, err := r.Do("DEL", pausedKey(c.Queue))
+	return err
+}
+
+// IsPaused returns true if the queue has been paused with Pause.
+func (c *JobQueue) IsPaused() (bool, error) {
+	r := getConn(c.pool, "JobQueue.IsPaused")
+	defer r.Close()
+	return redis.Bool(r.Do("EXISTS", pausedKey(c.Queue)))
+}
+
+// pausedWait returns how long Get waits, given wait, before checking again
+// whether a paused queue has been resumed.
+func pausedWait(wait time.Duration) time.Duration {
+	return minDuration(wait, pausePollInterval)
+}
+
+func pausedKey(queue string) string {
+	return queue + ":paused"
+}
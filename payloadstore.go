@@ -0,0 +1,126 @@
+package grt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	// ErrPayloadNotFound is returned by a PayloadStore when a reference does
+	// not exist. A job whose payload is not found is moved to the dead letters.
+	ErrPayloadNotFound = errors.New("payload not found")
+)
+
+// payloadRefPrefix marks a payload hash entry as a reference to an
+// externally stored payload. Encoded JSON can never start with a NUL byte.
+const payloadRefPrefix = "\x00grt:ref:"
+
+// PayloadStore stores large job payloads outside Redis.
+//
+// An implementation backed by S3 or GCS would typically Put each payload as
+// an object named after key in a dedicated bucket, return the object name as
+// the reference, and map a missing object to ErrPayloadNotFound in Get.
+type PayloadStore interface {
+	// Put stores data and returns a reference that can be used to retrieve it.
+	Put(key string, data []byte) (ref string, err error)
+	// Get retrieves the data for a reference.
+	Get(ref string) ([]byte, error)
+	// Delete removes the data for a reference.
+	Delete(ref string) error
+}
+
+// PayloadStreamer can be implemented by a PayloadStore to stream payloads
+// to Work.PayloadReader rather than buffering them in memory.
+type PayloadStreamer interface {
+	Open(ref string) (io.ReadCloser, error)
+}
+
+// WithPayloadStore offloads payloads larger than threshold bytes to store,
+// writing only a reference into Redis. Offloaded payloads are fetched
+// transparently by Get and deleted by Complete.
+//
+// Note that the queue key of a job is its full encoded payload unless the
+// job implements JobQueueKeyer, so large jobs should implement it.
+func WithPayloadStore(store PayloadStore, threshold int) Option {
+	return func(c *JobQueue) {
+		c.payloadStore = store
+		c.payloadThreshold = threshold
+	}
+}
+
+// offload stores payload externally if it exceeds the configured threshold,
+// returning the reference record to write into Redis in its place.
+//
+// Each call stores the payload under a new name, so that a submission that
+// turns out to be a duplicate can delete what it stored without touching the
+// payload of the job already queued.
+func (c *JobQueue) offload(key, payload []byte) (record []byte, ref string, err error) {
+	if c.payloadStore == nil || len(payload) <= c.payloadThreshold {
+		return payload, "", nil
+	}
+	sum := sha256.Sum256(key)
+	ref, err = c.payloadStore.Put(c.Queue+"/"+hex.EncodeToString(sum[:])+"/"+randomKey(""), payload)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not offload payload: %w", err)
+	}
+	return []byte(payloadRefPrefix + ref), ref, nil
+}
+
+// payloadRef returns the external reference in a payload record, if any.
+func payloadRef(record []byte) string {
+	_, record = splitVersion(record)
+	if !bytes.HasPrefix(record, []byte(payloadRefPrefix)) {
+		return ""
+	}
+	return string(record[len(payloadRefPrefix):])
+}
+
+// MemoryPayloadStore is an in-memory PayloadStore, for testing.
+type MemoryPayloadStore struct {
+	lock     sync.Mutex
+	payloads map[string][]byte
+}
+
+// NewMemoryPayloadStore creates a new in-memory PayloadStore.
+func NewMemoryPayloadStore() *MemoryPayloadStore {
+	return &MemoryPayloadStore{payloads: map[string][]byte{}}
+}
+
+// Put implements PayloadStore.
+func (m *MemoryPayloadStore) Put(key string, data []byte) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.payloads[key] = append([]byte(nil), data...)
+	return key, nil
+}
+
+// Get implements PayloadStore.
+func (m *MemoryPayloadStore) Get(ref string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	data, ok := m.payloads[ref]
+	if !ok {
+		return nil, ErrPayloadNotFound
+	}
+	return data, nil
+}
+
+// Delete implements PayloadStore.
+func (m *MemoryPayloadStore) Delete(ref string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.payloads, ref)
+	return nil
+}
+
+// Len returns the number of stored payloads.
+func (m *MemoryPayloadStore) Len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.payloads)
+}
@@ -0,0 +1,128 @@
+package grt_test
+
+import (
+	"errors"
+	"github.com/alecthomas/grt"
+	"strings"
+	"testing"
+)
+
+// losingStore is a PayloadStore that has lost every object put into it.
+type losingStore struct {
+	*grt.MemoryPayloadStore
+}
+
+func (losingStore) Get(ref string) ([]byte, error) {
+	return nil, grt.ErrPayloadNotFound
+}
+
+func TestPayloadStoreThreshold(t *testing.T) {
+	s, pool := newPool(t)
+	store := grt.NewMemoryPayloadStore()
+	q := grt.NewJobQueue(pool, "offload", grt.WithPayloadStore(store, 100))
+	big := strings.Repeat("x", 200)
+	for _, job := range []string{"small", big} {
+		if err := q.Submit(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.Len() != 1 {
+		t.Fatalf("%d payloads offloaded, want 1", store.Len())
+	}
+	if record := s.HGet("offload:payload", `"`+big+`"`); strings.Contains(record, big) {
+		t.Fatal("offloaded payload was also written to Redis")
+	}
+	for _, want := range []string{"small", big} {
+		var job string
+		w, err := q.Get(&job)
+		if err != nil || job != want {
+			t.Fatal(job, err)
+		}
+		if err := w.Complete(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPayloadStoreLifecycle(t *testing.T) {
+	_, pool := newPool(t)
+	store := grt.NewMemoryPayloadStore()
+	q := grt.NewJobQueue(pool, "offload", grt.WithPayloadStore(store, 100))
+	q.MaxAttempts = 1
+	big := func(c string) string { return strings.Repeat(c, 200) }
+	for _, job := range []string{big("a"), big("b"), big("c")} {
+		if err := q.Submit(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var job string
+	w, err := q.Get(&job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if store.Len() != 2 {
+		t.Fatalf("Complete left %d payloads, want 2", store.Len())
+	}
+
+	if cancelled, err := q.Cancel(big("b")); !cancelled || err != nil {
+		t.Fatal(cancelled, err)
+	}
+	if store.Len() != 1 {
+		t.Fatalf("Cancel left %d payloads, want 1", store.Len())
+	}
+
+	w, err = q.Get(&job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Resubmit(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := q.DeadLen(); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	if store.Len() != 1 {
+		t.Fatal("dead letters must keep their payloads")
+	}
+	if _, err := q.PurgeDead(); err != nil {
+		t.Fatal(err)
+	}
+	if store.Len() != 0 {
+		t.Fatalf("PurgeDead left %d payloads", store.Len())
+	}
+}
+
+func TestPayloadStoreMissingObject(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "offload", grt.WithPayloadStore(losingStore{grt.NewMemoryPayloadStore()}, 100))
+	var reason error
+	q.OnDeadLetter = func(w *grt.Work, err error) { reason = err }
+	big := strings.Repeat("x", 200)
+	if err := q.Submit(big); err != nil {
+		t.Fatal(err)
+	}
+	var job string
+	_, err := q.TryGet(&job)
+	var decodeErr *grt.PayloadDecodeError
+	if !errors.As(err, &decodeErr) || !errors.Is(err, grt.ErrPayloadNotFound) {
+		t.Fatal(err)
+	}
+	if !errors.Is(reason, grt.ErrPayloadNotFound) {
+		t.Fatal(reason)
+	}
+	// The job is not retried.
+	if w, err := q.TryGet(&job); w != nil || err != nil {
+		t.Fatal(w, err)
+	}
+	description, err := q.DescribeJob(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if description.State != grt.JobDead || len(description.History) != 1 || description.History[0].Error != "payload not found" {
+		t.Fatalf("%+v", description)
+	}
+}
@@ -0,0 +1,164 @@
+package grt
+
+import (
+	"context"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"strings"
+)
+
+// Commands required by each feature, including those called from Lua
+// scripts, which are subject to ACLs too.
+var featureCommands = map[Feature][]string{
+	FeatureJobQueue: {
+		"BRPOPLPUSH", "DEL", "EVAL", "EVALSHA", "EXEC", "EXISTS", "GET", "HDEL",
+		"HEXISTS", "HGET", "HGETALL", "HINCRBY", "HKEYS", "HLEN", "HMGET", "HSCAN", "HSET",
+		"HSETNX", "INCR", "INFO", "LINDEX", "LLEN", "LPOS", "LPUSH", "LRANGE", "LREM",
+		"LTRIM", "MULTI", "PERSIST", "PEXPIRE", "PING", "PUBLISH", "RENAME", "RPOPLPUSH", "RPUSH",
+		"SCRIPT|LOAD", "SET", "SUBSCRIBE", "TIME", "TYPE", "UNSUBSCRIBE", "ZADD", "ZCARD", "ZRANGE",
+		"ZRANGEBYSCORE", "ZREM", "ZSCORE",
+	},
+	FeatureLock: {
+		"DEL", "EVAL", "EVALSHA", "EXISTS", "GET", "HGET", "HMGET", "HSET", "INCR", "PEXPIRE", "PTTL",
+		"PUBLISH", "SET", "SUBSCRIBE", "TIME", "UNSUBSCRIBE", "ZADD", "ZCARD", "ZCOUNT", "ZRANGE", "ZREM",
+		"ZREMRANGEBYSCORE", "ZSCORE",
+	},
+	FeatureAdmin:         {"CONFIG|GET", "INFO", "PING", "SCAN"},
+	FeatureSidekiqBridge: {"ZRANGEBYSCORE", "ZREM"},
+}
+
+// RequiredCommands returns the sorted list of Redis commands needed by the
+// given features (all features if none are given), suitable for generating
+// an ACL. Subcommands are given as "COMMAND|subcommand".
+func RequiredCommands(features ...Feature) []string {
+	if len(features) == 0 {
+		features = allFeatures
+	}
+	seen := map[string]bool{}
+	commands := []string{}
+	for _, feature := range features {
+		for _, command := range featureCommands[feature] {
+			if !seen[command] {
+				seen[command] = true
+				commands = append(commands, command)
+			}
+		}
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// PermissionError is returned by VerifyPermissions, listing every required
+// command the connection is not permitted to run.
+type PermissionError struct {
+	Missing []string
+}
+
+func (p *PermissionError) Error() string {
+	return fmt.Sprintf("missing permission for Redis commands: %s", strings.Join(p.Missing, ", "))
+}
+
+// VerifyPermissions probes every command required by the given features
+// (all features if none are given) against throwaway keys under
+// "grt:permcheck:", returning a *PermissionError listing every command
+// rejected with NOPERM.
+//
+// Only command permissions are verified. ACL key patterns must separately
+// allow access to the queue and lock keys.
+func VerifyPermissions(ctx context.Context, pool *redis.Pool, features ...Feature) error {
+	r := getConn(pool, "VerifyPermissions")
+	defer r.Close()
+	key := randomKey("grt:permcheck:")
+	defer r.Do("DEL", key, key+":dst")
+	missing := []string{}
+	for _, command := range RequiredCommands(features...) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := probeCommand(r, command, key); err != nil && strings.HasPrefix(err.Error(), "NOPERM") {
+			missing = append(missing, command)
+		}
+	}
+	if len(missing) > 0 {
+		return &PermissionError{Missing: missing}
+	}
+	return nil
+}
+
+// probeCommand runs a harmless invocation of command against key. Errors
+// other than NOPERM are irrelevant to the caller.
+func probeCommand(r redis.Conn, command string, key string) error {
+	var err error
+	switch command {
+	case "BRPOPLPUSH":
+		r.Do("LPUSH", key, "probe")
+		_, err = r.Do(command, key, key+":dst", 1)
+	case "RENAME", "RPOPLPUSH":
+		_, err = r.Do(command, key, key+":dst")
+	case "DEL", "EXISTS", "GET", "LLEN", "PERSIST", "PTTL", "TYPE", "ZCARD":
+		_, err = r.Do(command, key)
+	case "HDEL", "HEXISTS", "HGET", "HMGET":
+		_, err = r.Do(command, key+":hash", "probe")
+	case "HSCAN":
+		_, err = r.Do(command, key+":hash", 0)
+	case "SCAN":
+		_, err = r.Do(command, 0, "MATCH", key, "COUNT", 1)
+	case "HGETALL", "HKEYS", "HLEN":
+		_, err = r.Do(command, key+":hash")
+	case "HINCRBY":
+		_, err = r.Do(command, key+":hash", "probe", 0)
+	case "HSET", "HSETNX":
+		_, err = r.Do(command, key+":hash", "probe", "probe")
+		r.Do("DEL", key+":hash")
+	case "INCR":
+		_, err = r.Do(command, key+":counter")
+		r.Do("DEL", key+":counter")
+	case "LRANGE", "LTRIM":
+		_, err = r.Do(command, key, 0, -1)
+	case "LINDEX":
+		_, err = r.Do(command, key, -1)
+	case "LPOS", "LPUSH", "RPUSH":
+		_, err = r.Do(command, key, "probe")
+	case "LREM":
+		_, err = r.Do(command, key, 0, "probe")
+	case "PEXPIRE":
+		_, err = r.Do(command, key, 1000)
+	case "PUBLISH":
+		_, err = r.Do(command, key, "probe")
+	case "SUBSCRIBE":
+		r.Send(command, key)
+		r.Send("UNSUBSCRIBE", key)
+		r.Flush()
+		_, err = r.Receive()
+		r.Receive()
+	case "SET":
+		_, err = r.Do(command, key, "probe", "PX", 1000)
+	case "EVAL":
+		_, err = r.Do(command, "return 1", 0)
+	case "EVALSHA":
+		_, err = r.Do(command, "0000000000000000000000000000000000000000", 0)
+	case "MULTI":
+		if _, err = r.Do(command); err == nil {
+			r.Do("DISCARD")
+		}
+	case "EXEC":
+		r.Do("MULTI")
+		_, err = r.Do(command)
+	case "ZRANGE":
+		_, err = r.Do(command, key, 0, 0)
+	case "ZCOUNT", "ZRANGEBYSCORE", "ZREMRANGEBYSCORE":
+		_, err = r.Do(command, key, "-inf", "+inf")
+	case "ZREM", "ZSCORE":
+		_, err = r.Do(command, key, "probe")
+	case "ZADD":
+		_, err = r.Do(command, key, 0, "probe")
+	case "SCRIPT|LOAD":
+		_, err = r.Do("SCRIPT", "LOAD", "return 1")
+	case "CONFIG|GET":
+		_, err = r.Do("CONFIG", "GET", "maxmemory-policy")
+	default:
+		_, err = r.Do(command)
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package grt_test
+
+import (
+	"context"
+	"errors"
+	"github.com/alecthomas/grt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// aclConn rejects denied commands, given as "COMMAND" or
+// "COMMAND|subcommand", as a Redis ACL would.
+type aclConn struct {
+	redis.Conn
+	denied map[string]bool
+}
+
+func (a *aclConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	name := strings.ToUpper(cmd)
+	if len(args) > 0 {
+		if sub, ok := args[0].(string); ok && a.denied[name+"|"+strings.ToUpper(sub)] {
+			return nil, redis.Error("NOPERM this user has no permissions to run the '" + strings.ToLower(name+"|"+sub) + "' command")
+		}
+	}
+	if a.denied[name] {
+		return nil, redis.Error("NOPERM this user has no permissions to run the '" + strings.ToLower(name) + "' command")
+	}
+	return a.Conn.Do(cmd, args...)
+}
+
+func newACLPool(t *testing.T, denied ...string) *redis.Pool {
+	s := miniredis.RunT(t)
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", s.Addr())
+		if err != nil {
+			return nil, err
+		}
+		acl := &aclConn{Conn: conn, denied: map[string]bool{}}
+		for _, command := range denied {
+			acl.denied[command] = true
+		}
+		return acl, nil
+	}}
+	t.Cleanup(func() { pool.Close() })
+	return pool
+}
+
+func TestRequiredCommands(t *testing.T) {
+	if got := grt.RequiredCommands(grt.FeatureAdmin); !reflect.DeepEqual(got, []string{"CONFIG|GET", "INFO", "PING", "SCAN"}) {
+		t.Fatal(got)
+	}
+	all := grt.RequiredCommands()
+	if !sort.StringsAreSorted(all) {
+		t.Fatal("not sorted", all)
+	}
+	seen := map[string]bool{}
+	for _, command := range all {
+		if seen[command] {
+			t.Fatalf("%s listed twice", command)
+		}
+		seen[command] = true
+	}
+	for _, command := range append(grt.RequiredCommands(grt.FeatureJobQueue), grt.RequiredCommands(grt.FeatureLock)...) {
+		if !seen[command] {
+			t.Fatalf("%s missing from all features", command)
+		}
+	}
+}
+
+func TestVerifyPermissions(t *testing.T) {
+	tests := []struct {
+		name     string
+		features []grt.Feature
+		denied   []string
+		missing  []string
+	}{
+		{"Permitted", nil, nil, nil},
+		{"Denied", nil, []string{"EVALSHA", "BRPOPLPUSH", "CONFIG|GET", "SCRIPT|LOAD"},
+			[]string{"BRPOPLPUSH", "CONFIG|GET", "EVALSHA", "SCRIPT|LOAD"}},
+		{"OtherFeature", []grt.Feature{grt.FeatureLock}, []string{"BRPOPLPUSH", "CONFIG|GET"}, nil},
+		{"LockOnly", []grt.Feature{grt.FeatureLock}, []string{"PTTL", "BRPOPLPUSH"}, []string{"PTTL"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := grt.VerifyPermissions(context.Background(), newACLPool(t, test.denied...), test.features...)
+			if test.missing == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var permErr *grt.PermissionError
+			if !errors.As(err, &permErr) {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(permErr.Missing, test.missing) {
+				t.Fatalf("missing %v, want %v", permErr.Missing, test.missing)
+			}
+			if want := "missing permission for Redis commands: " + strings.Join(test.missing, ", "); err.Error() != want {
+				t.Fatal(err)
+			}
+		})
+	}
+}
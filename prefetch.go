@@ -0,0 +1,189 @@
+package grt
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// WithPrefetch makes Get and its variants retrieve up to n waiting jobs in a
+// single round trip, buffering them in the JobQueue and handing them out one
+// at a time, so that retrieving small jobs costs one round trip per n rather
+// than one each. When nothing is waiting, Get blocks for a single job as
+// usual.
+//
+// Retrieving and completing a small job then costs one round trip rather
+// than two. The target is at least 1.5 times the jobs per second of a queue
+// without prefetching, for n of 10 or more, as measured by BenchmarkPrefetch;
+// beyond that, Complete's round trip dominates and larger n gains little.
+//
+// Buffered jobs are in progress as far as Redis is concerned: their attempt
+// is counted and their visibility deadline set when they are prefetched, and
+// a deadline more than half gone is extended as the job is handed out. Close
+// returns jobs still buffered to the front of their waiting lists, uncounted;
+// those of a process that dies are recovered by Cleanup or the reaper like
+// any other in-progress job. Jobs of any priority submitted after a prefetch
+// wait for the buffer to be handed out, so keep n small relative to the rate
+// jobs are processed.
+func WithPrefetch(n int) Option {
+	return func(c *JobQueue) {
+		c.prefetch = n
+		c.prefetched = &prefetchBuffer{}
+	}
+}
+
+// prefetchBuffer holds jobs retrieved by Get ahead of being handed out.
+type prefetchBuffer struct {
+	lock   sync.Mutex
+	jobs   []*prefetchedJob
+	closed bool
+}
+
+type prefetchedJob struct {
+	work      *Work
+	cancelled bool
+	err       error
+	at        time.Time
+}
+
+// nextPrefetched returns the next buffered job, refilling the buffer with
+// waiting jobs if it is empty. work is nil if none are waiting or the rate
+// limit allows none.
+func (c *JobQueue) nextPrefetched(op *operation) (work *Work, cancelled bool, err error) {
+	for {
+		job, err := c.takePrefetched(op)
+		if job == nil || err != nil {
+			return nil, false, err
+		}
+		if job.err == nil && c.visibilityTimeout > 0 && time.Since(job.at) > c.visibilityTimeout/2 {
+			if err := job.work.Extend(c.visibilityTimeout); err == ErrWorkExpired {
+				// The reaper has returned the job to the queue.
+				c.log().Warn("Prefetched job expired before it was handed out", "queue", c.Queue, "key", string(job.work.key))
+				continue
+			} else if err != nil {
+				c.log().Error("Failed to extend prefetched job", "queue", c.Queue, "key", string(job.work.key), "error", err)
+			}
+		}
+		return job.work, job.cancelled, job.err
+	}
+}
+
+// takePrefetched removes the next job from the buffer, refilling it first if
+// it is empty.
+func (c *JobQueue) takePrefetched(op *operation) (*prefetchedJob, error) {
+	b := c.prefetched
+	b.lock.Lock()
+	if len(b.jobs) > 0 {
+		job := b.jobs[0]
+		b.jobs = b.jobs[1:]
+		b.lock.Unlock()
+		return job, nil
+	}
+	b.lock.Unlock()
+	jobs, err := c.fetchPrefetch(op)
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		if err := c.unprefetch(jobs); err != nil {
+			c.log().Error("Failed to return prefetched jobs to the queue", "queue", c.Queue, "error", err)
+		}
+		return nil, ErrQueueClosed
+	}
+	// Jobs buffered meanwhile by a concurrent Get are handed out first.
+	b.jobs = append(b.jobs, jobs[1:]...)
+	b.lock.Unlock()
+	return jobs[0], nil
+}
+
+// fetchPrefetch retrieves up to the prefetch size of waiting jobs without
+// blocking.
+func (c *JobQueue) fetchPrefetch(op *operation) ([]*prefetchedJob, error) {
+	n, _, err := c.takeJobTokens(c.prefetch)
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	r := op.conn(c.pool)
+	reply, err := c.popJobs(r, n)
+	r.Close()
+	if err != nil {
+		c.refundJobTokens(n)
+		return nil, err
+	}
+	c.refundJobTokens(n - (len(reply)-2)/8)
+	now := time.Now()
+	jobs := []*prefetchedJob{}
+	for i := 2; i+8 <= len(reply); i += 8 {
+		work, cancelled, err := c.popped(reply[i : i+8])
+		if work == nil {
+			if errors.Is(err, ErrPayloadMissing) {
+				c.log().Warn("Discarded job without a payload", "queue", c.Queue, "error", err)
+			} else {
+				c.log().Error("Failed to prefetch job", "queue", c.Queue, "error", err)
+			}
+			continue
+		}
+		jobs = append(jobs, &prefetchedJob{work: work, cancelled: cancelled, err: err, at: now})
+	}
+	return jobs, nil
+}
+
+// returnPrefetched returns buffered jobs to the queue and stops further
+// buffering, as the queue is closed.
+func (c *JobQueue) returnPrefetched() error {
+	b := c.prefetched
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	jobs := b.jobs
+	b.jobs = nil
+	b.closed = true
+	b.lock.Unlock()
+	if len(jobs) == 0 {
+		return nil
+	}
+	if err := c.unprefetch(jobs); err != nil {
+		return err
+	}
+	c.log().Info("Returned prefetched jobs to the queue", "queue", c.Queue, "count", len(jobs))
+	return nil
+}
+
+// unprefetch returns jobs to the front of their waiting lists, in order, as
+// though they had never been retrieved.
+func (c *JobQueue) unprefetch(jobs []*prefetchedJob) error {
+	args := []interface{}{c.Queue + ":processing", c.Queue + ":deadlines", c.Queue + ":attempts",
+		c.priorityList(PriorityHigh), c.Queue, c.priorityList(PriorityLow)}
+	for _, job := range jobs {
+		args = append(args, job.work.key, int(job.work.priority))
+	}
+	r := getConn(c.pool, "JobQueue.Close")
+	defer r.Close()
+	_, err := unprefetchScript.do(r, args...)
+	return err
+}
+
+// KEYS: processing list, deadlines sorted set, attempts hash, waiting lists
+// (high, normal, low). ARGV: each job's key and priority, in the order they
+// were retrieved.
+//
+// Jobs still in progress are pushed back to the front of their waiting lists
+// with their attempt uncounted. Jobs no longer in progress, eg. reaped, are
+// left alone.
+var unprefetchScript = newLuaScript("unprefetch", 1, 6, `
+local lists = {["1"] = KEYS[4], ["0"] = KEYS[5], ["-1"] = KEYS[6]}
+for i = #ARGV - 2, 1, -2 do
+  local key = ARGV[i]
+  if redis.call("LREM", KEYS[1], 1, key) == 1 then
+    redis.call("ZREM", KEYS[2], key)
+    if redis.call("HINCRBY", KEYS[3], key, -1) <= 0 then
+      redis.call("HDEL", KEYS[3], key)
+    end
+    redis.call("RPUSH", lists[ARGV[i + 1]] or KEYS[5], key)
+  end
+end
+return {0}
+`)
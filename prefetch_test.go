@@ -0,0 +1,122 @@
+package grt_test
+
+import (
+	"fmt"
+	"github.com/alecthomas/grt"
+	"testing"
+	"time"
+)
+
+func TestPrefetch(t *testing.T) {
+	s, pool := newPool(t)
+	fetches := 0
+	defer grt.ObserveCommands(func(op string, n int) {
+		if op == "JobQueue.Get" && n > 0 {
+			fetches++
+		}
+	})()
+	q := grt.NewJobQueue(pool, "prefetch", grt.WithPrefetch(5))
+	keys := submitJobs(t, q, "job", 7)
+	for i := 0; i < 3; i++ {
+		var job string
+		w, err := q.Get(&job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("job%d", i); job != want {
+			t.Fatalf("got %s, want %s", job, want)
+		}
+		if err := w.Complete(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("%d round trips to retrieve 3 jobs", fetches)
+	}
+	// The two jobs still buffered are in progress as far as Redis is
+	// concerned.
+	if processing, err := s.List("prefetch:processing"); err != nil || len(processing) != 2 {
+		t.Fatal(processing, err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists("prefetch:processing") {
+		t.Fatal("buffered jobs were not returned on Close")
+	}
+	if _, err := q.TryGet(nil); err != grt.ErrQueueClosed {
+		t.Fatal(err)
+	}
+	// Returned jobs are retrieved next, in order, their attempt uncounted.
+	other := grt.NewJobQueue(pool, "prefetch")
+	for _, key := range keys[3:] {
+		var job string
+		w, err := other.TryGet(&job)
+		if err != nil || w == nil {
+			t.Fatal(w, err)
+		}
+		if `"`+job+`"` != key || w.Attempts() != 1 {
+			t.Fatalf("got %s on attempt %d, want %s", job, w.Attempts(), key)
+		}
+		if err := w.Complete(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPrefetchReaped(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "prefetch", grt.WithPrefetch(3), grt.WithVisibilityTimeout(100*time.Millisecond))
+	submitJobs(t, q, "job", 2)
+	w, err := q.TryGet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	// A job left in the buffer past its deadline is reclaimed like any other
+	// in-progress job.
+	time.Sleep(150 * time.Millisecond)
+	if n, err := q.ReapExpired(); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	var job string
+	w, err = q.TryGet(&job)
+	if err != nil || w == nil || job != "job1" {
+		t.Fatal(w, job, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkPrefetch(b *testing.B) {
+	for _, n := range []int{0, 10, 100} {
+		b.Run(fmt.Sprintf("Prefetch%d", n), func(b *testing.B) {
+			_, pool := newPool(b)
+			options := []grt.Option{}
+			if n > 0 {
+				options = append(options, grt.WithPrefetch(n))
+			}
+			q := grt.NewJobQueue(pool, "prefetch", options...)
+			jobs := make([]interface{}, b.N)
+			for i := range jobs {
+				jobs[i] = i
+			}
+			if _, err := q.SubmitAll(jobs); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w, err := q.Get(nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Complete(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package grt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrPrioritiesDisabled is returned by SubmitWithPriority on a queue not
+	// created WithPriorities.
+	ErrPrioritiesDisabled = errors.New("priorities are not enabled")
+)
+
+// Priority of a job submitted with SubmitWithPriority.
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+const (
+	// Every this many Gets, lists are tried lowest priority first, so that
+	// low priority jobs are not starved by a steady stream of high priority
+	// ones.
+	priorityStarvationInterval = 10
+	// How long an idle Get blocks waiting for a high priority job before
+	// checking the other priorities again.
+	priorityPollInterval = time.Second
+)
+
+// WithPriorities enables SubmitWithPriority. High and low priority jobs are
+// queued on their own lists, <queue>:high and <queue>:low, sharing the
+// queue's payload hash. Every instance of the queue must agree.
+//
+// Get returns the highest priority job waiting, except that every tenth Get
+// prefers the lowest so low priority jobs are never starved. While the queue
+// is idle Get blocks on the high priority list only, so a normal or low
+// priority job submitted to an idle queue may wait up to a second to be
+// picked up.
+//
+// Jobs returned to the queue by Resubmit keep their priority, but those
+// recovered by Cleanup or ReapExpired, and those submitted by Transfer, with
+// a delay, or with Requeue, are queued at normal priority.
+func WithPriorities() Option {
+	return func(c *JobQueue) { c.priorities = true }
+}
+
+// SubmitWithPriority submits a job at priority p. The unavailable fallback is
+// not used.
+func (c *JobQueue) SubmitWithPriority(job interface{}, p Priority) error {
+	if p != PriorityNormal && !c.priorities {
+		return fmt.Errorf("%w on queue %s", ErrPrioritiesDisabled, c.Queue)
+	}
+	return c.submit(context.Background(), job, 0, p, c.jobTTL)
+}
+
+// Priority returns the priority the job was queued at.
+func (w *Work) Priority() Priority {
+	return w.priority
+}
+
+// priorityList returns the list jobs of priority p wait on.
+func (c *JobQueue) priorityList(p Priority) string {
+	switch p {
+	case PriorityHigh:
+		return c.Queue + ":high"
+	case PriorityLow:
+		return c.Queue + ":low"
+	default:
+		return c.Queue
+	}
+}
+
+// waitingLists returns the lists jobs wait on, highest priority first.
+func (c *JobQueue) waitingLists() []string {
+	if !c.priorities {
+		return []string{c.Queue}
+	}
+	return []string{c.priorityList(PriorityHigh), c.Queue, c.priorityList(PriorityLow)}
+}
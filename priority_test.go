@@ -0,0 +1,165 @@
+package grt_test
+
+import (
+	"errors"
+	"github.com/alecthomas/grt"
+	"testing"
+	"time"
+)
+
+// next retrieves the next job without blocking and completes it, returning
+// it and the priority it was queued at.
+func next(t *testing.T, q *grt.JobQueue) (string, grt.Priority) {
+	t.Helper()
+	var job string
+	w, err := q.TryGet(&job)
+	if err != nil || w == nil {
+		t.Fatal(w, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	return job, w.Priority()
+}
+
+func TestPriorityOrder(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "priority", grt.WithPriorities())
+	if err := q.SubmitWithPriority("low", grt.PriorityLow); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Submit("normal"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SubmitWithPriority("high", grt.PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	for list, want := range map[string]string{"priority:high": `"high"`, "priority": `"normal"`, "priority:low": `"low"`} {
+		if keys, err := s.List(list); err != nil || len(keys) != 1 || keys[0] != want {
+			t.Fatal(list, keys, err)
+		}
+	}
+	// Jobs are deduplicated across priorities.
+	if err := q.SubmitWithPriority("high", grt.PriorityLow); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	if n, err := q.Len(); n != 3 || err != nil {
+		t.Fatal(n, err)
+	}
+	for _, job := range []string{"low", "normal", "high"} {
+		if queued, err := q.IsQueued(job); !queued || err != nil {
+			t.Fatal(job, queued, err)
+		}
+	}
+	if d, err := q.DescribeJob("high"); err != nil || d.State != grt.JobWaiting || d.Priority != "high" {
+		t.Fatalf("%+v %v", d, err)
+	}
+	for _, want := range []grt.Priority{grt.PriorityHigh, grt.PriorityNormal, grt.PriorityLow} {
+		if job, priority := next(t, q); priority != want || job != want.String() {
+			t.Fatal(job, priority)
+		}
+	}
+}
+
+func TestPriorityResubmit(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "priority", grt.WithPriorities())
+	for _, job := range []string{"a", "b"} {
+		if err := q.SubmitWithPriority(job, grt.PriorityLow); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := q.TryGet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Resubmit(); err != nil {
+		t.Fatal(err)
+	}
+	// The resubmitted job keeps its priority.
+	if err := q.Submit("normal"); err != nil {
+		t.Fatal(err)
+	}
+	if job, priority := next(t, q); job != "normal" || priority != grt.PriorityNormal {
+		t.Fatal(job, priority)
+	}
+	for i := 0; i < 2; i++ {
+		if _, priority := next(t, q); priority != grt.PriorityLow {
+			t.Fatal(priority)
+		}
+	}
+	// Cleanup recovers in-progress jobs at normal priority.
+	if err := q.SubmitWithPriority("high", grt.PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.TryGet(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if job, priority := next(t, q); job != "high" || priority != grt.PriorityNormal {
+		t.Fatal(job, priority)
+	}
+}
+
+func TestPriorityStarvation(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "priority", grt.WithPriorities())
+	for i := 0; i < 12; i++ {
+		if err := q.SubmitWithPriority(i, grt.PriorityHigh); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.SubmitWithPriority("starved", grt.PriorityLow); err != nil {
+		t.Fatal(err)
+	}
+	// One in ten Gets prefers the lowest priority.
+	for i := 0; i < 10; i++ {
+		var job interface{}
+		w, err := q.TryGet(&job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Complete(); err != nil {
+			t.Fatal(err)
+		}
+		if job == "starved" {
+			return
+		}
+	}
+	t.Fatal("low priority job starved")
+}
+
+func TestPriorityBlockingGet(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "priority", grt.WithPriorities())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := q.SubmitWithPriority("late", grt.PriorityLow); err != nil {
+			t.Error(err)
+		}
+	}()
+	// An idle Get blocks on the high priority list, checking the others
+	// every second.
+	start := time.Now()
+	var job string
+	w, err := q.Get(&job)
+	if err != nil || job != "late" || time.Since(start) > 1500*time.Millisecond {
+		t.Fatal(job, time.Since(start), err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrioritiesDisabled(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "priority")
+	if err := q.SubmitWithPriority("a", grt.PriorityHigh); !errors.Is(err, grt.ErrPrioritiesDisabled) {
+		t.Fatal(err)
+	}
+	if err := q.SubmitWithPriority("a", grt.PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+}
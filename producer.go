@@ -0,0 +1,104 @@
+package grt
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// Maximum number of producer labels recorded with each job.
+	maxProducerLabels = 16
+	// Maximum length of a producer label value.
+	maxProducerLabelLen = 128
+)
+
+// Producer identifies the service that submitted a job.
+type Producer struct {
+	Service  string            `json:"service"`
+	Instance string            `json:"instance"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	// Trace context of the submission, recorded by the queue's Tracer.
+	Trace map[string]string `json:"trace,omitempty"`
+	// Headers of the submission's context, set with ContextWithHeaders.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// WithProducer sets the service name recorded with every job this queue
+// submits. It defaults to the executable's name.
+func WithProducer(service string) Option {
+	return func(c *JobQueue) { c.producer.Service = service }
+}
+
+// WithProducerLabels adds free-form labels, such as a deploy ID, to the
+// producer recorded with every job this queue submits. At most 16 labels are
+// kept (the first in sorted order) and values are truncated to 128 bytes.
+func WithProducerLabels(labels map[string]string) Option {
+	return func(c *JobQueue) { c.producer.Labels = truncateLabels(labels) }
+}
+
+// truncateLabels keeps at most maxProducerLabels of labels, the first in
+// sorted order, with values truncated to maxProducerLabelLen bytes.
+func truncateLabels(labels map[string]string) map[string]string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) > maxProducerLabels {
+		keys = keys[:maxProducerLabels]
+	}
+	truncated := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value := labels[key]
+		if len(value) > maxProducerLabelLen {
+			value = value[:maxProducerLabelLen]
+		}
+		truncated[key] = value
+	}
+	return truncated
+}
+
+func defaultProducer() Producer {
+	return Producer{Service: filepath.Base(os.Args[0]), Instance: workerID}
+}
+
+// producerRecord is the encoded producer stored with each job, with the
+// job's trace context and headers if any.
+func (c *JobQueue) producerRecord(trace map[string]string, headers map[string]string) []byte {
+	producer := c.producer
+	producer.Trace = trace
+	producer.Headers = headers
+	record, _ := json.Marshal(producer)
+	return record
+}
+
+// decodeProducer decodes a producer hash entry, returning nil if there is
+// none.
+func decodeProducer(reply interface{}) *Producer {
+	record, ok := reply.([]byte)
+	if !ok {
+		return nil
+	}
+	producer := &Producer{}
+	if err := json.Unmarshal(record, producer); err != nil {
+		return nil
+	}
+	return producer
+}
+
+// Producer returns the service that submitted the job, or nil if it was not
+// recorded.
+func (w *Work) Producer() (*Producer, error) {
+	if w.replay != nil {
+		return nil, nil
+	}
+	r := getConn(w.pool, "Work.Producer")
+	defer r.Close()
+	reply, err := r.Do("HGET", w.Queue+":producer", w.key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeProducer(reply), nil
+}
@@ -0,0 +1,95 @@
+package grt_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/alecthomas/grt"
+	"strings"
+	"testing"
+)
+
+func TestProducer(t *testing.T) {
+	_, pool := newPool(t)
+	billing := grt.NewJobQueue(pool, "producer", grt.WithProducer("billing-api"),
+		grt.WithProducerLabels(map[string]string{"deploy": "bad", "note": strings.Repeat("x", 500)}))
+	billing.MaxAttempts = 1
+	search := grt.NewJobQueue(pool, "producer", grt.WithProducer("search"))
+	for i := 0; i < 5; i++ {
+		if err := billing.Submit(fmt.Sprintf("billing%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := search.Submit(fmt.Sprintf("search%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := describe(t, billing, "billing0")
+	if d.Producer == nil || d.Producer.Service != "billing-api" || d.Producer.Instance == "" ||
+		d.Producer.Labels["deploy"] != "bad" || len(d.Producer.Labels["note"]) != 128 {
+		t.Fatalf("%+v", d.Producer)
+	}
+	if d := describe(t, billing, "search0"); d.Producer == nil || d.Producer.Service != "search" || d.Producer.Labels != nil {
+		t.Fatalf("%+v", d.Producer)
+	}
+
+	// The dead letter keeps its producer.
+	w, err := billing.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if producer, err := w.Producer(); err != nil || producer.Service != "billing-api" {
+		t.Fatal(producer, err)
+	}
+	if err := w.Resubmit(); err != nil {
+		t.Fatal(err)
+	}
+	if d := describe(t, billing, "billing0"); d.State != grt.JobDead || d.Producer == nil || d.Producer.Service != "billing-api" {
+		t.Fatalf("%+v", d)
+	}
+
+	report, err := search.CancelWhere(context.Background(), func(key, payload []byte) bool { return true }, grt.CancelOptions{Producer: "billing-api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Waiting != 4 {
+		t.Fatalf("%+v", report)
+	}
+	for _, key := range report.Sample {
+		if !strings.HasPrefix(string(key), `"billing`) {
+			t.Fatal(string(key))
+		}
+	}
+	if n, err := search.Len(); n != 5 || err != nil {
+		t.Fatal(n, err)
+	}
+	for i := 0; i < 5; i++ {
+		if queued, err := search.IsQueued(fmt.Sprintf("search%d", i)); !queued || err != nil {
+			t.Fatal(i, queued, err)
+		}
+	}
+	// The dead letter is not a waiting job.
+	if d := describe(t, billing, "billing0"); d.State != grt.JobDead {
+		t.Fatalf("%+v", d)
+	}
+}
+
+func TestProducerDefault(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "producer")
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	if d := describe(t, q, "a"); d.Producer == nil || d.Producer.Service == "" || d.Producer.Instance == "" {
+		t.Fatalf("%+v", d.Producer)
+	}
+	// Completed jobs leave no producer behind.
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if d := describe(t, q, "a"); d.Producer != nil {
+		t.Fatalf("%+v", d.Producer)
+	}
+}
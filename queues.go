@@ -0,0 +1,62 @@
+package grt
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"strings"
+)
+
+// ListQueues returns the names of the queues in Redis, sorted. A queue is
+// found once any instance has used it, by its "<queue>:options" hash.
+//
+// Keys are found with SCAN, so the whole keyspace is walked, a page at a
+// time.
+func ListQueues(ctx context.Context, pool *redis.Pool) ([]string, error) {
+	return listQueues(ctx, pool, "")
+}
+
+// listQueues returns the names of the queues whose names start with prefix,
+// without it.
+func listQueues(ctx context.Context, pool *redis.Pool, prefix string) ([]string, error) {
+	r := getConn(pool, "ListQueues")
+	defer r.Close()
+	queues := []string{}
+	cursor := "0"
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		reply, err := redis.Values(r.Do("SCAN", cursor, "MATCH", escapeGlob(prefix)+"*:options", "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		keys, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			queues = append(queues, strings.TrimPrefix(strings.TrimSuffix(key, ":options"), prefix))
+		}
+		if cursor, err = redis.String(reply[0], nil); err != nil {
+			return nil, err
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	sort.Strings(queues)
+	return queues, nil
+}
+
+// escapeGlob escapes the characters of s that are special in SCAN patterns.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
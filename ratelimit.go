@@ -0,0 +1,183 @@
+package grt
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"math"
+	"strconv"
+	"time"
+)
+
+// RateLimiter is a Redis-based token bucket, limiting the rate of events
+// across all clients sharing its key.
+//
+// The bucket holds up to Burst tokens and is refilled at Rate tokens per
+// second. Each event takes a token.
+type RateLimiter struct {
+	pool *redis.Pool
+	Key  string
+	// Tokens added per second.
+	Rate float64
+	// Maximum number of tokens the bucket holds, and so the largest burst of
+	// events allowed after a quiet period.
+	Burst int
+}
+
+// NewRateLimiter creates a new Redis token bucket allowing rate events per
+// second, in bursts of up to burst.
+func NewRateLimiter(pool *redis.Pool, key string, rate float64, burst int) *RateLimiter {
+	return &RateLimiter{pool: pool, Key: key, Rate: rate, Burst: burst}
+}
+
+// Allow takes a token if one is available, returning false otherwise.
+func (l *RateLimiter) Allow() (bool, error) {
+	granted, _, err := l.take(1)
+	return granted == 1, err
+}
+
+// Wait takes a token, waiting until one is available or ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		granted, retry, err := l.take(1)
+		if err != nil || granted == 1 {
+			return err
+		}
+		timer := time.NewTimer(retry)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// take takes up to n tokens, returning how many were granted and, if fewer
+// than n, how long until the next token is added.
+func (l *RateLimiter) take(n int) (granted int, retry time.Duration, err error) {
+	r := getConn(l.pool, "RateLimiter.Take")
+	defer r.Close()
+	reply, err := rateTakeScript.do(r, l.Key, l.rate(), l.Burst, n, takeAvailable)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(reply[0].(int64)), time.Duration(reply[1].(int64)) * time.Millisecond, nil
+}
+
+// refund returns n unused tokens to the bucket.
+func (l *RateLimiter) refund(n int) error {
+	if n < 1 {
+		return nil
+	}
+	r := getConn(l.pool, "RateLimiter.Refund")
+	defer r.Close()
+	_, err := rateRefundScript.do(r, l.Key, l.Burst, n)
+	return err
+}
+
+func (l *RateLimiter) rate() string {
+	return formatRate(l.Rate)
+}
+
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(math.Max(rate, 0), 'g', -1, 64)
+}
+
+// How rateTakeScript takes tokens.
+const (
+	// Take as many of the tokens wanted as are available.
+	takeAvailable = iota
+	// Take all of the tokens wanted, or none.
+	takeAll
+	// Take all of the tokens wanted, leaving the bucket in debt if need be.
+	takeReserve
+)
+
+// WithRateLimit limits how fast jobs are retrieved from the queue, across
+// all instances sharing the limit, to rate per second in bursts of up to
+// burst. While the limit is reached, Get waits and TryGet returns no job.
+func WithRateLimit(rate float64, burst int) Option {
+	return func(c *JobQueue) { c.rateLimiter = NewRateLimiter(c.pool, "", rate, burst) }
+}
+
+// takeJobTokens takes up to n tokens from the queue's rate limit, if any,
+// returning how many jobs may be retrieved and, if none, how long until one
+// may.
+func (c *JobQueue) takeJobTokens(n int) (int, time.Duration, error) {
+	if c.rateLimiter == nil {
+		return n, 0, nil
+	}
+	granted, retry, err := c.rateLimiter.take(n)
+	if err != nil {
+		return 0, 0, err
+	}
+	if granted == 0 && retry <= 0 {
+		// A zero rate never refills.
+		retry = pausePollInterval
+	}
+	return granted, retry, nil
+}
+
+// refundJobTokens returns tokens taken for jobs that were not retrieved.
+func (c *JobQueue) refundJobTokens(n int) {
+	if c.rateLimiter == nil {
+		return
+	}
+	if err := c.rateLimiter.refund(n); err != nil {
+		c.log().Warn("Failed to refund rate limit tokens", "queue", c.Queue, "error", err)
+	}
+}
+
+func rateLimitKey(queue string) string {
+	return queue + ":ratelimit"
+}
+
+// KEYS: bucket hash. ARGV: rate per second, burst, tokens wanted, how to take
+// them (takeAvailable, takeAll or takeReserve). The bucket is refilled for
+// the time since it was last updated. Returns the number of tokens granted,
+// and the milliseconds until the tokens wanted are available (or, when
+// reserving, until the bucket is out of debt), or 0 if the rate is zero.
+var rateTakeScript = newLuaScript("rate_take", 1, 1, `
+redis.replicate_commands()
+local now = redis.call("TIME")
+local ms = now[1] * 1000 + math.floor(now[2] / 1000)
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local wanted = tonumber(ARGV[3])
+local mode = tonumber(ARGV[4])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "at")
+local tokens = tonumber(bucket[1]) or burst
+local at = tonumber(bucket[2]) or ms
+if ms > at then
+  tokens = math.min(burst, tokens + (ms - at) * rate / 1000)
+end
+local granted = math.min(math.floor(tokens), wanted)
+if mode == 1 and granted < wanted then
+  granted = 0
+elseif mode == 2 then
+  granted = wanted
+end
+tokens = tokens - granted
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "at", ms)
+local retry = 0
+if rate > 0 then
+  if mode == 2 then
+    retry = math.max(0, math.ceil(-tokens * 1000 / rate))
+  elseif granted < wanted then
+    retry = math.ceil((wanted - granted - tokens) * 1000 / rate)
+  end
+  -- A bucket left alone this long is full, as if it did not exist.
+  redis.call("PEXPIRE", KEYS[1], math.ceil((burst - math.min(tokens, 0)) * 1000 / rate) + 1000)
+end
+return {0, granted, retry}
+`)
+
+// KEYS: bucket hash. ARGV: burst, tokens to return.
+var rateRefundScript = newLuaScript("rate_refund", 1, 1, `
+local tokens = tonumber(redis.call("HGET", KEYS[1], "tokens"))
+if tokens then
+  tokens = math.min(tonumber(ARGV[1]), tokens + tonumber(ARGV[2]))
+  redis.call("HSET", KEYS[1], "tokens", tostring(tokens))
+end
+return {0}
+`)
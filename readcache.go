@@ -0,0 +1,110 @@
+package grt
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WithReadCache enables in-process caching of idempotent reads (Len,
+// IsQueued and Stats) for ttl. Concurrent calls for the same read share one Redis
+// round trip, and results are reused until they expire.
+//
+// Use Uncached() for reads that must observe the latest state.
+func WithReadCache(ttl time.Duration) Option {
+	return func(c *JobQueue) {
+		c.readCache = &readCache{ttl: ttl, entries: map[string]*readCacheEntry{}}
+	}
+}
+
+// Uncached returns a view of the queue that bypasses the read cache.
+func (c *JobQueue) Uncached() *JobQueue {
+	uncached := *c
+	uncached.readCache = nil
+	return &uncached
+}
+
+// ReadCacheStats returns the number of reads served from the read cache and
+// the number that went to Redis.
+func (c *JobQueue) ReadCacheStats() (hits, misses uint64) {
+	if c.readCache == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&c.readCache.hits), atomic.LoadUint64(&c.readCache.misses)
+}
+
+// cached performs read through the read cache, if enabled.
+func (c *JobQueue) cached(key string, read func() (interface{}, error)) (interface{}, error) {
+	if c.readCache == nil {
+		return read()
+	}
+	return c.readCache.do(key, read)
+}
+
+type readCache struct {
+	ttl          time.Duration
+	hits, misses uint64
+	lock         sync.Mutex
+	entries      map[string]*readCacheEntry
+}
+
+type readCacheEntry struct {
+	done    chan struct{}
+	expires time.Time
+	value   interface{}
+	err     error
+}
+
+// Expired entries are swept when the cache grows past this many entries.
+const readCacheSweepSize = 1024
+
+func (r *readCache) do(key string, read func() (interface{}, error)) (interface{}, error) {
+	r.lock.Lock()
+	if entry, ok := r.entries[key]; ok {
+		select {
+		case <-entry.done:
+			if time.Now().Before(entry.expires) {
+				r.lock.Unlock()
+				atomic.AddUint64(&r.hits, 1)
+				return entry.value, entry.err
+			}
+		default:
+			// In flight.
+			r.lock.Unlock()
+			atomic.AddUint64(&r.hits, 1)
+			<-entry.done
+			return entry.value, entry.err
+		}
+	}
+	if len(r.entries) >= readCacheSweepSize {
+		r.sweep()
+	}
+	entry := &readCacheEntry{done: make(chan struct{})}
+	r.entries[key] = entry
+	r.lock.Unlock()
+	atomic.AddUint64(&r.misses, 1)
+
+	entry.value, entry.err = read()
+	r.lock.Lock()
+	entry.expires = time.Now().Add(r.ttl)
+	if entry.err != nil {
+		delete(r.entries, key)
+	}
+	r.lock.Unlock()
+	close(entry.done)
+	return entry.value, entry.err
+}
+
+// sweep removes expired entries. Must be called with the lock held.
+func (r *readCache) sweep() {
+	now := time.Now()
+	for key, entry := range r.entries {
+		select {
+		case <-entry.done:
+			if !now.Before(entry.expires) {
+				delete(r.entries, key)
+			}
+		default:
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package grt_test
+
+import (
+	"github.com/alecthomas/grt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadCacheCoalescesStats(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "cached", grt.WithReadCache(time.Minute))
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	var fetches int32
+	remove := grt.ObserveCommands(func(op string, n int) {
+		if op == "JobQueue.Stats" {
+			atomic.AddInt32(&fetches, 1)
+		}
+	})
+	defer remove()
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			stats, err := q.Stats()
+			if err != nil || stats.Waiting != 1 {
+				t.Error(stats, err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("%d fetches, want 1", n)
+	}
+	if hits, misses := q.ReadCacheStats(); hits != 99 || misses != 1 {
+		t.Fatal(hits, misses)
+	}
+}
+
+func TestReadCacheBypass(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "cached", grt.WithReadCache(time.Minute))
+	if queued, err := q.IsQueued("a"); queued || err != nil {
+		t.Fatal(queued, err)
+	}
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	// Submit deduplicates against Redis, not the cached answer.
+	if err := q.Submit("a"); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	if queued, err := q.IsQueued("a"); queued || err != nil {
+		t.Fatal("expected the cached answer", queued, err)
+	}
+	if queued, err := q.Uncached().IsQueued("a"); !queued || err != nil {
+		t.Fatal(queued, err)
+	}
+	if n, err := q.Len(); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+}
@@ -0,0 +1,145 @@
+package grt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	// ErrQueueRenamed is wrapped by a *QueueRenamedError.
+	ErrQueueRenamed = errors.New("queue renamed")
+	// ErrQueueExists is returned by RenameQueue if the destination queue
+	// already has data.
+	ErrQueueExists = errors.New("queue already exists")
+	// ErrGroupsPending is returned by RenameQueue while workflow groups
+	// created on the queue are in progress.
+	ErrGroupsPending = errors.New("workflow groups in progress")
+)
+
+// QueueRenamedError is returned when submitting to a queue that has been
+// renamed with RenameQueue.
+type QueueRenamedError struct {
+	Queue     string
+	RenamedTo string
+}
+
+func (q *QueueRenamedError) Error() string {
+	return fmt.Sprintf("queue %s renamed to %s", q.Queue, q.RenamedTo)
+}
+
+func (q *QueueRenamedError) Unwrap() error { return ErrQueueRenamed }
+
+// RenameQueue atomically renames every Redis structure belonging to queue
+// oldName, including per-job state, to newName. It refuses with
+// ErrQueueExists if any destination key already exists, and with
+// ErrGroupsPending while a Group whose first member was submitted to the
+// queue is in progress, as its members' continuations, which may be on other
+// queues, refer to the group by the queue's name.
+//
+// A forwarding marker is left under "<oldName>:renamed", so Submits to the old
+// name from instances still running fail with a *QueueRenamedError rather than
+// recreating the old queue. Delete the marker once no instance uses the old
+// name. Consumers blocked in Get on the old name are not interrupted.
+//
+// The rename runs as a single script, so it blocks Redis for a time
+// proportional to the number of jobs in the queue.
+func RenameQueue(ctx context.Context, pool *redis.Pool, oldName, newName string) error {
+	if oldName == newName {
+		return fmt.Errorf("cannot rename queue %s to itself", oldName)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r := getConn(pool, "RenameQueue")
+	defer r.Close()
+	// Servers that do not report cluster info are assumed not to be clustered.
+	if info, err := redisInfo(r, "cluster"); err == nil && info["cluster_enabled"] == "1" {
+		return errors.New("cannot rename queue: cluster mode is not supported")
+	}
+	_, err := renameScript.do(r, renamedKey(oldName), renamedKey(newName), oldName, newName, escapeGlob(oldName)+":group:*",
+		escapeGlob(oldName)+":done:*", escapeGlob(oldName)+":results:*")
+	if errors.Is(err, ErrQueueRenamed) {
+		return queueRenamedError(r, oldName)
+	} else if errors.Is(err, ErrQueueExists) || errors.Is(err, ErrGroupsPending) {
+		return fmt.Errorf("cannot rename queue %s to %s: %w", oldName, newName, err)
+	}
+	return err
+}
+
+// KEYS: old forwarding marker, new forwarding marker. ARGV: old name, new
+// name, patterns matching the old queue's workflow groups, completion
+// tombstones and results.
+//
+// The queue's keys are derived from its name inside the script, so that jobs
+// submitted concurrently are renamed too.
+var renameScript = newLuaScript("rename", 1, 2, `
+redis.replicate_commands()
+if redis.call("EXISTS", KEYS[1]) == 1 then
+  return {2} -- statusRenamed
+end
+if #redis.call("KEYS", ARGV[3]) > 0 then
+  return {11} -- statusGroupsPending
+end
+local old, new = ARGV[1], ARGV[2]
+local keys = {old, old .. ":processing", old .. ":payload", old .. ":enqueued", old .. ":options",
+  old .. ":producer", old .. ":deadlines", old .. ":attempts", old .. ":dead",
+  old .. ":delayed", old .. ":high", old .. ":low", old .. ":pops",
+  old .. ":stats", old .. ":paused", old .. ":expiry",
+  old .. ":throughput", old .. ":ratelimit", old .. ":events"}
+local jobs = redis.call("HKEYS", old .. ":payload")
+for _, job in ipairs(jobs) do
+  table.insert(keys, old .. ":cancel:" .. job)
+  table.insert(keys, old .. ":chunks:" .. job)
+  table.insert(keys, old .. ":history:" .. job)
+  table.insert(keys, old .. ":next:" .. job)
+end
+for _, job in ipairs(redis.call("HKEYS", old .. ":dead")) do
+  table.insert(keys, old .. ":chunks:" .. job)
+  table.insert(keys, old .. ":history:" .. job)
+  table.insert(keys, old .. ":next:" .. job)
+end
+-- Tombstones and results outlive their jobs, so are found by name.
+for i = 4, 5 do
+  for _, key in ipairs(redis.call("KEYS", ARGV[i])) do
+    table.insert(keys, key)
+  end
+end
+if redis.call("EXISTS", KEYS[2]) == 1 then
+  return {3} -- statusQueueExists
+end
+for _, key in ipairs(keys) do
+  if redis.call("EXISTS", new .. string.sub(key, #old + 1)) == 1 then
+    return {3} -- statusQueueExists
+  end
+end
+local scope = redis.call("HGET", old .. ":options", "dedupe_scope")
+for _, key in ipairs(keys) do
+  if redis.call("EXISTS", key) == 1 then
+    redis.call("RENAME", key, new .. string.sub(key, #old + 1))
+  end
+end
+if scope and string.sub(scope, 1, 10) == "namespace:" then
+  local dedupe = "grt:dedupe:{" .. string.sub(scope, 11) .. "}"
+  for _, job in ipairs(jobs) do
+    redis.call("HSET", dedupe, job, new)
+  end
+end
+redis.call("SET", KEYS[1], new)
+return {0}
+`)
+
+// queueRenamedError builds the error for a renamed queue from its forwarding
+// marker.
+func queueRenamedError(r redis.Conn, queue string) error {
+	renamedTo, err := redis.String(r.Do("GET", renamedKey(queue)))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrQueueRenamed, queue)
+	}
+	return &QueueRenamedError{Queue: queue, RenamedTo: renamedTo}
+}
+
+func renamedKey(queue string) string {
+	return queue + ":renamed"
+}
@@ -0,0 +1,155 @@
+package grt_test
+
+import (
+	"context"
+	"errors"
+	"github.com/alecthomas/grt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRenameQueueUnderTraffic(t *testing.T) {
+	_, pool := newPool(t)
+	ctx := context.Background()
+	old := grt.NewJobQueue(pool, "old")
+	for i := 0; i < 10; i++ {
+		if err := old.Submit(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var held int
+	w, err := old.Get(&held)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.RequestCancel(5); err != nil {
+		t.Fatal(err)
+	}
+
+	// A producer keeps submitting to the old name until it learns of the
+	// rename.
+	// Len counts jobs in progress too.
+	var accepted int32 = 10
+	var renamed error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 10; ; i++ {
+			err := old.Submit(i)
+			if err != nil {
+				renamed = err
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+		}
+	}()
+	for atomic.LoadInt32(&accepted) < 50 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := grt.RenameQueue(ctx, pool, "old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	var forwarded *grt.QueueRenamedError
+	if !errors.As(renamed, &forwarded) || forwarded.Queue != "old" || forwarded.RenamedTo != "new" || renamed.Error() != "queue old renamed to new" {
+		t.Fatal(renamed)
+	}
+
+	q := grt.NewJobQueue(pool, "new")
+	if n, err := q.Len(); n != int(accepted) || err != nil {
+		t.Fatal(n, accepted, err)
+	}
+	if d := describe(t, q, 5); !d.CancelRequested {
+		t.Fatalf("%+v", d)
+	}
+	if d, err := q.DescribeKey(w.Key()); err != nil || d.State != grt.JobInProgress {
+		t.Fatalf("%+v %v", d, err)
+	}
+	if n, err := old.Len(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+	// New instances under the old name are refused too.
+	if err := grt.NewJobQueue(pool, "old").Submit("late"); !errors.Is(err, grt.ErrQueueRenamed) {
+		t.Fatal(err)
+	}
+	if err := grt.RenameQueue(ctx, pool, "old", "other"); !errors.Is(err, grt.ErrQueueRenamed) {
+		t.Fatal(err)
+	}
+}
+
+func TestRenameQueueRefusesExisting(t *testing.T) {
+	_, pool := newPool(t)
+	ctx := context.Background()
+	for _, name := range []string{"old", "new"} {
+		if err := grt.NewJobQueue(pool, name).Submit(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := grt.RenameQueue(ctx, pool, "old", "new"); !errors.Is(err, grt.ErrQueueExists) {
+		t.Fatal(err)
+	}
+	// Nothing was moved.
+	if n, err := grt.NewJobQueue(pool, "old").Len(); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	if err := grt.RenameQueue(ctx, pool, "old", "old"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestRenameQueueGroupsPending(t *testing.T) {
+	_, pool := newPool(t)
+	ctx := context.Background()
+	a := grt.NewJobQueue(pool, "a[1]")
+	b := grt.NewJobQueue(pool, "b")
+	if err := grt.Group([]grt.Step{{Queue: a, Job: 1}, {Queue: b, Job: 2}}, grt.Step{Queue: b, Job: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := grt.RenameQueue(ctx, pool, "a[1]", "c"); !errors.Is(err, grt.ErrGroupsPending) {
+		t.Fatal(err)
+	}
+	for _, q := range []*grt.JobQueue{a, b} {
+		w, err := q.Get(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Complete(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := grt.RenameQueue(ctx, pool, "a[1]", "c"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenameQueueResults(t *testing.T) {
+	s, pool := newPool(t)
+	ctx := context.Background()
+	q := grt.NewJobQueue(pool, "old")
+	q.DedupWindow = time.Hour
+	if err := q.Submit(1); err != nil {
+		t.Fatal(err)
+	}
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Succeed("ok"); err != nil {
+		t.Fatal(err)
+	}
+	if err := grt.RenameQueue(ctx, pool, "old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Exists("new:done:1") || !s.Exists("new:results:1") || s.Exists("old:done:1") || s.Exists("old:results:1") {
+		t.Fatal(s.Keys())
+	}
+	renamed := grt.NewJobQueue(pool, "new")
+	if err := renamed.Submit(1); !errors.Is(err, grt.ErrRecentlyCompleted) {
+		t.Fatal(err)
+	}
+	var result string
+	if err := renamed.WaitResult(ctx, 1, &result); err != nil || result != "ok" {
+		t.Fatal(result, err)
+	}
+}
@@ -0,0 +1,168 @@
+package grt
+
+import (
+	"context"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// How often SubmitAndWait and WaitResult check for a result, in case they
+// missed the notification of it.
+const resultPollInterval = time.Second
+
+// Prefixes of stored results.
+const (
+	resultSucceeded = '+'
+	resultFailed    = '-'
+)
+
+// JobError is a failure reported by a worker with Work.Fail, as returned by
+// SubmitAndWait.
+type JobError struct {
+	Message string
+}
+
+func (j *JobError) Error() string {
+	return "job failed: " + j.Message
+}
+
+// SubmitAndWait submits job and waits until a worker reports its outcome with
+// Work.Succeed or Work.Fail, or ctx is done. A successful result is decoded
+// into result, unless it is nil, and a failure is returned as a *JobError.
+//
+// If an identical job is already queued, SubmitAndWait waits for its outcome
+// instead. Jobs finalized without reporting an outcome, eg. with Complete,
+// leave SubmitAndWait waiting until ctx is done.
+func (c *JobQueue) SubmitAndWait(ctx context.Context, job interface{}, result interface{}) error {
+	key, _, err := c.marshal(job)
+	if err != nil {
+		return err
+	}
+	op := startOperation("JobQueue.SubmitAndWait")
+	defer op.end()
+	// Subscribe before submitting so that the notification cannot be missed.
+	var notified *notifications
+	if !isSingleConn(c.pool) {
+		if notified = subscribeNotifications(c.pool, "JobQueue.SubmitAndWait", resultKey(c.Queue, key)); notified != nil {
+			defer notified.close()
+		}
+	}
+	// A result left by an earlier run is discarded only if the job is
+	// enqueued, as otherwise it may be the outcome of the queued job that
+	// another caller is waiting for.
+	if err := c.submitJob(ctx, job, 0, PriorityNormal, c.jobTTL, true); err != nil && !errors.Is(err, ErrAlreadyQueued) {
+		return err
+	}
+	return c.waitResult(ctx, op, key, notified, result)
+}
+
+// WaitResult waits until a worker reports the outcome of job, submitted
+// separately, with Work.Succeed or Work.Fail, or ctx is done. The outcome is
+// returned as by SubmitAndWait.
+//
+// An outcome reported within ResultTTL before the call is returned
+// immediately, including one from an earlier run of the same job.
+func (c *JobQueue) WaitResult(ctx context.Context, job interface{}, result interface{}) error {
+	key, _, err := c.marshal(job)
+	if err != nil {
+		return err
+	}
+	op := startOperation("JobQueue.WaitResult")
+	defer op.end()
+	var notified *notifications
+	if !isSingleConn(c.pool) {
+		if notified = subscribeNotifications(c.pool, "JobQueue.WaitResult", resultKey(c.Queue, key)); notified != nil {
+			defer notified.close()
+		}
+	}
+	return c.waitResult(ctx, op, key, notified, result)
+}
+
+// waitResult polls for the result of the job with key, retrying early when
+// notified of it.
+func (c *JobQueue) waitResult(ctx context.Context, op *operation, key []byte, notified *notifications, result interface{}) error {
+	interval := resultPollInterval
+	if isSingleConn(c.pool) {
+		interval = singleConnPollInterval
+	}
+	for {
+		record, err := c.result(op, key)
+		if err != nil {
+			return err
+		}
+		if record != nil {
+			return c.decodeResult(record, result)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		notified.wait(ctx, interval)
+	}
+}
+
+// result returns the stored result of a job, or nil if there is none.
+func (c *JobQueue) result(op *operation, key []byte) ([]byte, error) {
+	r := op.conn(c.pool)
+	defer r.Close()
+	record, err := redis.Bytes(r.Do("GET", resultKey(c.Queue, key)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return record, err
+}
+
+func (c *JobQueue) decodeResult(record []byte, result interface{}) error {
+	if len(record) == 0 {
+		return errors.New("empty result")
+	}
+	if record[0] == resultFailed {
+		return &JobError{Message: string(record[1:])}
+	}
+	if result == nil {
+		return nil
+	}
+	return c.codec.Unmarshal(record[1:], result)
+}
+
+// Succeed completes the job, reporting result to SubmitAndWait. Concurrency
+// safe.
+func (w *Work) Succeed(result interface{}) error {
+	data, err := w.queue.codec.Marshal(result)
+	if err != nil {
+		return err
+	}
+	w.checkFinalize()
+	return w.completed(w.markFinalized(WorkCompleted, w.complete(append([]byte{resultSucceeded}, data...), nil)))
+}
+
+// Fail completes the job, reporting err to SubmitAndWait as a *JobError,
+// whose message is empty if err is nil. Use ResubmitWithError instead if the
+// job should be retried. Concurrency safe.
+func (w *Work) Fail(err error) error {
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+	w.checkFinalize()
+	return w.failed(err, w.markFinalized(WorkCompleted, w.complete(append([]byte{resultFailed}, message...), nil)))
+}
+
+// KEYS: as for submitScript, then the job's result. ARGV: as for
+// submitScript.
+//
+// The result is deleted only if the job is enqueued.
+var submitClearingResultScript = newLuaScript("submit_clearing_result", 1, 10, `
+local function submit()
+`+submitLua+`
+end
+local reply = submit()
+if reply[1] == 0 then
+  redis.call("DEL", KEYS[10])
+end
+return reply
+`)
+
+func resultKey(queue string, key []byte) string {
+	return queue + ":results:" + string(key)
+}
@@ -0,0 +1,113 @@
+package grt_test
+
+import (
+	"context"
+	"errors"
+	"github.com/alecthomas/grt"
+	"testing"
+	"time"
+)
+
+func TestSubmitAndWait(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "results")
+	worker := grt.NewJobQueue(pool, "results")
+	go func() {
+		for i := 0; i < 2; i++ {
+			var job string
+			w, err := worker.Get(&job)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if job == "fail" {
+				err = w.Fail(errors.New("boom"))
+			} else {
+				err = w.Succeed(map[string]string{"url": "/" + job})
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var result map[string]string
+	start := time.Now()
+	if err := q.SubmitAndWait(ctx, "report", &result); err != nil {
+		t.Fatal(err)
+	}
+	if result["url"] != "/report" {
+		t.Fatal(result)
+	}
+	// Notified of the result rather than polling for it.
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+	var jobErr *grt.JobError
+	if err := q.SubmitAndWait(ctx, "fail", nil); !errors.As(err, &jobErr) || jobErr.Message != "boom" {
+		t.Fatal(err)
+	}
+	if ttl := s.TTL(`results:results:"fail"`); ttl <= 0 {
+		t.Fatal(ttl)
+	}
+	short, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := q.SubmitAndWait(short, "orphan", nil); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+}
+
+func TestSubmitAndWaitStaleResult(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "results")
+	// The result of an earlier run of a job that is no longer queued is
+	// discarded when it is submitted again.
+	s.Set(`results:results:"stale"`, `+"old"`)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := q.SubmitAndWait(ctx, "stale", nil); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+}
+
+func TestSubmitAndWaitShared(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "results")
+	if err := q.Submit("shared"); err != nil {
+		t.Fatal(err)
+	}
+	// A result not yet read by whoever is waiting for the queued job is not
+	// discarded by another caller joining the wait.
+	s.Set(`results:results:"shared"`, `+"new"`)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var result string
+	if err := q.SubmitAndWait(ctx, "shared", &result); err != nil || result != "new" {
+		t.Fatal(result, err)
+	}
+	if !s.Exists(`results:results:"shared"`) {
+		t.Fatal("result was discarded")
+	}
+}
+
+func TestFailWithoutError(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "results")
+	go func() {
+		w, err := q.Get(nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := w.Fail(nil); err != nil {
+			t.Error(err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var jobErr *grt.JobError
+	if err := q.SubmitAndWait(ctx, "job", nil); !errors.As(err, &jobErr) || jobErr.Message != "" {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,55 @@
+package grt
+
+import (
+	"time"
+)
+
+// retryDelay returns how long the job waits before its next attempt, or zero
+// if it is requeued immediately.
+func (w *Work) retryDelay() time.Duration {
+	if w.queue.RetryBackoff == nil {
+		return 0
+	}
+	return w.queue.RetryBackoff.Next(w.attempts - 1)
+}
+
+// retry moves the job to the queue's delayed jobs, due after delay, recording
+// message in its history if it is not empty. If checksum is not empty the
+// job's payload must still match it.
+func (w *Work) retry(delay time.Duration, message, checksum string) error {
+	r := getConn(w.pool, "Work.Resubmit")
+	defer r.Close()
+	_, err := retryScript.do(r, w.Queue+":processing", w.Queue+":delayed", historyKey(w.Queue, w.key), w.Queue+":payload",
+		w.Queue+":deadlines", w.Queue+":stats", w.key, delay.Milliseconds(), workerID, message, resubmitHistoryLen, checksum)
+	if err != nil {
+		return err
+	}
+	w.queue.log().Debug("Delayed retry of job", "queue", w.Queue, "key", string(w.key), "attempts", w.attempts, "delay", delay)
+	return nil
+}
+
+// KEYS: processing list, delayed sorted set, history list, payload hash,
+// deadlines sorted set, stats hash. ARGV: key, delay in milliseconds, worker,
+// error or "", history length, payload checksum to verify or "".
+var retryScript = newLuaScript("retry", 1, 6, `
+redis.replicate_commands()
+if ARGV[6] ~= "" then
+  local record = redis.call("HGET", KEYS[4], ARGV[1])
+  if not record or redis.sha1hex(record) ~= ARGV[6] then
+    return {4} -- statusPayloadChanged
+  end
+end
+local now = redis.call("TIME")
+local at = now[1] * 1000 + math.floor(now[2] / 1000)
+redis.call("LREM", KEYS[1], 0, ARGV[1])
+redis.call("ZREM", KEYS[5], ARGV[1])
+redis.call("ZADD", KEYS[2], at + tonumber(ARGV[2]), ARGV[1])
+if ARGV[4] == "" then
+  redis.call("HINCRBY", KEYS[6], "resubmitted", 1)
+else
+  redis.call("HINCRBY", KEYS[6], "failed", 1)
+  redis.call("RPUSH", KEYS[3], cjson.encode({at = at, worker = ARGV[3], error = ARGV[4]}))
+  redis.call("LTRIM", KEYS[3], -tonumber(ARGV[5]), -1)
+end
+return {0}
+`)
@@ -0,0 +1,238 @@
+package grt
+
+import (
+	"errors"
+	"github.com/alecthomas/grt/backoff"
+	"github.com/garyburd/redigo/redis"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrCircuitOpen is returned instead of attempting a round trip while the
+	// circuit breaker of the pool's RetryPolicy is open.
+	ErrCircuitOpen = errors.New("circuit open")
+)
+
+// Prefixes of Redis error replies that are worth retrying: the server is
+// loading its dataset, failing over, or busy running a script.
+var retryableReplies = []string{"LOADING ", "READONLY ", "MASTERDOWN ", "TRYAGAIN ", "CLUSTERDOWN ", "BUSY "}
+
+// retryPolicies records the policies registered with SetRetryPolicy.
+var retryPolicies sync.Map
+
+// RetryPolicy retries Redis round trips that fail with transient errors, and
+// stops attempting them while Redis is unavailable. Register one for a pool
+// with SetRetryPolicy, after which it applies to every round trip made
+// through the pool by JobQueue, Lock and the other primitives.
+//
+// A round trip is a command, or a pipeline or transaction of commands sent
+// together; it is retried in full on a fresh connection from the pool. A
+// round trip whose reply was lost may already have been applied, so a retried
+// write may be applied twice: eg. a retried Submit can return
+// ErrAlreadyQueued for a job it did queue. Pipelines read with Receive, such
+// as subscriptions, are not retried.
+//
+// A RetryPolicy must not be copied or shared between pools once registered.
+type RetryPolicy struct {
+	// Attempts at each round trip, including the first. Defaults to 3.
+	Attempts int
+	// Backoff between attempts. Defaults to exponential from 50ms, capped at
+	// a second, with jitter.
+	Backoff backoff.Backoff
+	// Retryable returns true if a round trip that failed with err should be
+	// retried. Defaults to IsRetryable.
+	Retryable func(err error) bool
+	// The circuit breaker opens after this many consecutive round trips
+	// have failed with retryable errors, after retrying. Zero disables it.
+	// While it is open, round trips fail immediately with ErrCircuitOpen
+	// until BreakerCoolDown has passed, when one is let through to test
+	// Redis: if it succeeds the breaker closes, otherwise it opens again.
+	BreakerThreshold int
+	// Defaults to 5 seconds.
+	BreakerCoolDown time.Duration
+	// Receives the circuit breaker opening and closing. Defaults to
+	// slog.Default().
+	Logger *slog.Logger
+
+	lock     sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+	probing  bool
+}
+
+// SetRetryPolicy applies policy to every round trip made through pool. A nil
+// policy removes the pool's policy, as does closing the pool's
+// DefaultRuntime.
+func SetRetryPolicy(pool *redis.Pool, policy *RetryPolicy) {
+	if policy == nil {
+		retryPolicies.Delete(pool)
+		return
+	}
+	retryPolicies.Store(pool, policy)
+}
+
+func retryPolicy(pool *redis.Pool) *RetryPolicy {
+	policy, ok := retryPolicies.Load(pool)
+	if !ok {
+		return nil
+	}
+	return policy.(*RetryPolicy)
+}
+
+// IsRetryable returns true if err indicates Redis could not be reached, or
+// replied that it is temporarily unable to serve the command, eg. while
+// loading its dataset or failing over.
+func IsRetryable(err error) bool {
+	if isConnectionError(err) {
+		return true
+	}
+	var reply redis.Error
+	if !errors.As(err, &reply) {
+		return false
+	}
+	for _, prefix := range retryableReplies {
+		if strings.HasPrefix(string(reply), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Health returns ErrCircuitOpen while the circuit breaker is open, and nil
+// otherwise, without a round trip, eg. for readiness probes.
+func (p *RetryPolicy) Health() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.open {
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+func (p *RetryPolicy) attempts() int {
+	if p.Attempts <= 0 {
+		return 3
+	}
+	return p.Attempts
+}
+
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	if p.Backoff == nil {
+		return backoff.Exponential{Base: 50 * time.Millisecond, Max: time.Second, Jitter: 0.5}.Next(attempt)
+	}
+	return p.Backoff.Next(attempt)
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable == nil {
+		return IsRetryable(err)
+	}
+	return p.Retryable(err)
+}
+
+func (p *RetryPolicy) coolDown() time.Duration {
+	if p.BreakerCoolDown <= 0 {
+		return 5 * time.Second
+	}
+	return p.BreakerCoolDown
+}
+
+// allow returns ErrCircuitOpen if a round trip may not be attempted.
+func (p *RetryPolicy) allow() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.open {
+		return nil
+	}
+	if p.probing || time.Since(p.openedAt) < p.coolDown() {
+		return ErrCircuitOpen
+	}
+	p.probing = true
+	return nil
+}
+
+// record updates the circuit breaker with the outcome of a round trip.
+func (p *RetryPolicy) record(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.probing = false
+	if err == nil || !p.retryable(err) {
+		if p.open {
+			lockLogger(p.Logger).Info("Redis reachable again, closing circuit breaker")
+		}
+		p.failures = 0
+		p.open = false
+		return
+	}
+	p.failures++
+	if p.BreakerThreshold > 0 && p.failures >= p.BreakerThreshold {
+		if !p.open {
+			lockLogger(p.Logger).Warn("Redis unavailable, opening circuit breaker", "failures", p.failures, "error", err)
+		}
+		p.open = true
+		p.openedAt = time.Now()
+	}
+}
+
+// retryingConn retries failed round trips on fresh connections from its
+// pool, replaying the commands sent since the last one.
+type retryingConn struct {
+	redis.Conn
+	pool    *redis.Pool
+	policy  *RetryPolicy
+	pending []retryCommand
+}
+
+type retryCommand struct {
+	name string
+	args []interface{}
+}
+
+func (c *retryingConn) Send(commandName string, args ...interface{}) error {
+	c.pending = append(c.pending, retryCommand{commandName, args})
+	if err := c.Conn.Send(commandName, args...); err != nil && !c.policy.retryable(err) {
+		return err
+	}
+	// A failed connection fails the Do that completes the round trip, which
+	// is then retried.
+	return nil
+}
+
+// Flush sends pending commands for their replies to be read with Receive,
+// which is not retried.
+func (c *retryingConn) Flush() error {
+	c.pending = nil
+	return c.Conn.Flush()
+}
+
+func (c *retryingConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	pending := c.pending
+	c.pending = nil
+	if err := c.policy.allow(); err != nil {
+		return nil, err
+	}
+	reply, err := c.Conn.Do(commandName, args...)
+	for attempt := 1; attempt < c.policy.attempts() && err != nil && c.policy.retryable(err); attempt++ {
+		time.Sleep(c.policy.delay(attempt - 1))
+		c.Conn.Close()
+		c.Conn = c.pool.Get()
+		reply, err = c.replay(pending, commandName, args)
+	}
+	c.policy.record(err)
+	return reply, err
+}
+
+// replay sends pending on the current connection, then the command
+// completing the round trip.
+func (c *retryingConn) replay(pending []retryCommand, commandName string, args []interface{}) (interface{}, error) {
+	for _, command := range pending {
+		if err := c.Conn.Send(command.name, command.args...); err != nil {
+			return nil, err
+		}
+	}
+	return c.Conn.Do(commandName, args...)
+}
@@ -0,0 +1,146 @@
+package grt_test
+
+import (
+	"errors"
+	"github.com/alecthomas/grt"
+	"github.com/alecthomas/grt/backoff"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{redis.Error("LOADING Redis is loading the dataset in memory"), true},
+		{redis.Error("READONLY You can't write against a read only replica."), true},
+		{redis.Error("BUSY Redis is busy running a script."), true},
+		{redis.Error("ERR wrong number of arguments"), false},
+		{io.EOF, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{errors.New("something else"), false},
+	}
+	for _, test := range tests {
+		if got := grt.IsRetryable(test.err); got != test.want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRetryPolicyServerError(t *testing.T) {
+	s, pool := newPool(t)
+	grt.SetRetryPolicy(pool, &grt.RetryPolicy{Attempts: 10, Backoff: backoff.Constant(20 * time.Millisecond)})
+	q := grt.NewJobQueue(pool, "retrypolicy")
+	s.SetError("LOADING Redis is loading the dataset in memory")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.SetError("")
+	}()
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := q.Len(); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	// Other errors are returned at once.
+	s.SetError("ERR something else")
+	defer s.SetError("")
+	start := time.Now()
+	if err := q.Submit("b"); err == nil || grt.IsRetryable(err) {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Fatal("retried", elapsed)
+	}
+}
+
+func TestRetryPolicyReconnect(t *testing.T) {
+	s, pool := restartablePool(t)
+	grt.SetRetryPolicy(pool, &grt.RetryPolicy{Attempts: 20, Backoff: backoff.Constant(20 * time.Millisecond)})
+	q := grt.NewJobQueue(pool, "retrypolicy")
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.Restart()
+	}()
+	if err := q.Submit("b"); err != nil {
+		t.Fatal(err)
+	}
+	l := grt.NewLock(pool, "retrypolicy:lock")
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetryPolicyBreaker(t *testing.T) {
+	s, pool := newPool(t)
+	policy := &grt.RetryPolicy{Attempts: 2, Backoff: backoff.Constant(time.Millisecond), BreakerThreshold: 2, BreakerCoolDown: 100 * time.Millisecond}
+	grt.SetRetryPolicy(pool, policy)
+	q := grt.NewJobQueue(pool, "retrypolicy")
+	s.SetError("READONLY You can't write against a read only replica.")
+	defer s.SetError("")
+	if err := q.Submit("a"); err == nil || errors.Is(err, grt.ErrCircuitOpen) {
+		t.Fatal(err)
+	}
+	if err := policy.Health(); err != nil {
+		t.Fatal("opened after one failure", err)
+	}
+	// Open after the threshold of consecutive failures.
+	q.Submit("a")
+	if err := policy.Health(); !errors.Is(err, grt.ErrCircuitOpen) {
+		t.Fatal(err)
+	}
+	s.SetError("")
+	if err := q.Submit("a"); !errors.Is(err, grt.ErrCircuitOpen) {
+		t.Fatal(err)
+	}
+	// Half open after the cool down: a failed probe opens it again.
+	time.Sleep(150 * time.Millisecond)
+	s.SetError("READONLY You can't write against a read only replica.")
+	if err := q.Submit("a"); err == nil || errors.Is(err, grt.ErrCircuitOpen) {
+		t.Fatal(err)
+	}
+	if err := q.Submit("a"); !errors.Is(err, grt.ErrCircuitOpen) {
+		t.Fatal(err)
+	}
+	// A successful probe closes it.
+	s.SetError("")
+	time.Sleep(150 * time.Millisecond)
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Health(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Submit("b"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetryPolicyRemovedWithRuntime(t *testing.T) {
+	s, pool := newPool(t)
+	grt.SetRetryPolicy(pool, &grt.RetryPolicy{Attempts: 10, Backoff: backoff.Constant(20 * time.Millisecond)})
+	if err := grt.DefaultRuntime(pool).Close(); err != nil {
+		t.Fatal(err)
+	}
+	q := grt.NewJobQueue(pool, "retrypolicy")
+	s.SetError("LOADING Redis is loading the dataset in memory")
+	defer s.SetError("")
+	start := time.Now()
+	if err := q.Submit("a"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Fatal("retried", elapsed)
+	}
+}
@@ -0,0 +1,314 @@
+package grt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// How long a Run worker waits after Get fails before trying again.
+const runRetryInterval = time.Second
+
+// Handler processes a job retrieved by Run. decode unmarshals the job's
+// payload into v, as Get does.
+type Handler func(ctx context.Context, work *Work, decode func(v interface{}) error) error
+
+// Run processes jobs with concurrency workers until ctx is done, calling
+// Cleanup once first. The number of workers can be changed while Run is in
+// progress with SetConcurrency, or adjusted automatically
+// WithAutoConcurrency.
+//
+// Each job is passed to handler, then completed if it returns nil or
+// resubmitted with ResubmitWithError if it returns an error. A handler that
+// panics has its job resubmitted and the panic logged. A handler may instead
+// finalize the job itself, eg. with Transfer. The handler is wrapped in any
+// middleware given WithMiddleware.
+//
+// On a queue created WithVisibilityTimeout, each worker extends its job's
+// deadline by the timeout every third of the timeout while its handler runs,
+// so that only jobs whose worker has died are reaped. The ctx passed to the
+// handler is cancelled with the cause ErrCancelRequested if cancellation of
+// its job is requested with RequestCancel; see Work.Context.
+//
+// When ctx is done, or the queue is closed, no further jobs are retrieved,
+// and Run returns once the handlers in progress have returned. Handlers
+// receive ctx, so long-running handlers can abort early and return an error
+// to resubmit their job.
+func (c *JobQueue) Run(ctx context.Context, concurrency int, handler Handler) error {
+	if err := c.Cleanup(); err != nil {
+		return err
+	}
+	if c.autoConcurrency != nil {
+		concurrency = c.autoConcurrency.clamp(concurrency)
+	}
+	run := &runState{queue: c, ctx: ctx, handler: c.wrapHandler(handler), done: make(chan struct{})}
+	c.runs.add(run)
+	defer c.runs.remove(run)
+	if c.warmup != nil {
+		c.warm(run, concurrency)
+	}
+	run.setConcurrency(concurrency)
+	if c.autoConcurrency != nil {
+		stop := c.autotune(run)
+		defer stop()
+	}
+	<-run.done
+	return nil
+}
+
+// RunStats describe the Runs in progress on a queue in this process.
+type RunStats struct {
+	// Number of workers retrieving and processing jobs.
+	Concurrency int `json:"concurrency"`
+	// Number of handlers in progress.
+	Active int `json:"active"`
+	// Whether the brake applied WithRequeueBrake is engaged, and the delay
+	// before each retrieval if so.
+	Braked     bool          `json:"braked"`
+	BrakeDelay time.Duration `json:"brake_delay,omitempty"`
+	// Resubmissions by Run per second, and the fraction of handled jobs
+	// resubmitted, over the brake's window.
+	ResubmissionRate float64 `json:"resubmission_rate,omitempty"`
+	FailureRatio     float64 `json:"failure_ratio,omitempty"`
+	// Why a Run's WithWarmup warmup did not complete, if it did not.
+	WarmupIncomplete string `json:"warmup_incomplete,omitempty"`
+}
+
+// RunStats returns the combined statistics of the queue's Runs in progress
+// in this process.
+func (c *JobQueue) RunStats() RunStats {
+	stats := RunStats{}
+	c.runs.each(func(run *runState) {
+		run.lock.Lock()
+		defer run.lock.Unlock()
+		stats.Concurrency += run.limit
+		stats.Active += run.active
+		if run.warmupErr != nil {
+			stats.WarmupIncomplete = run.warmupErr.Error()
+		}
+	})
+	if c.brake != nil {
+		c.brake.state(&stats)
+	}
+	return stats
+}
+
+// Ready returns true if a Run of the queue is in progress in this process and
+// has finished warming up WithWarmup, or given up on it, eg. for readiness
+// probes.
+func (c *JobQueue) Ready() bool {
+	ready := false
+	c.runs.each(func(run *runState) {
+		run.lock.Lock()
+		defer run.lock.Unlock()
+		ready = ready || run.workers > 0
+	})
+	return ready
+}
+
+// SetConcurrency changes the number of workers of the queue's Runs in
+// progress in this process. Workers beyond the new concurrency stop once
+// their handlers return; handlers in progress are never interrupted. With
+// WithAutoConcurrency, adjustments continue from the new concurrency.
+func (c *JobQueue) SetConcurrency(concurrency int) {
+	c.runs.each(func(run *runState) { run.setConcurrency(concurrency) })
+}
+
+// runs tracks the queue's Runs in progress.
+type runs struct {
+	lock   sync.Mutex
+	states map[*runState]bool
+}
+
+func (r *runs) add(run *runState) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.states == nil {
+		r.states = map[*runState]bool{}
+	}
+	r.states[run] = true
+}
+
+func (r *runs) remove(run *runState) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.states, run)
+}
+
+func (r *runs) each(fn func(run *runState)) {
+	r.lock.Lock()
+	states := make([]*runState, 0, len(r.states))
+	for run := range r.states {
+		states = append(states, run)
+	}
+	r.lock.Unlock()
+	for _, run := range states {
+		fn(run)
+	}
+}
+
+// runState is a Run in progress: a pool of workers resized by
+// setConcurrency.
+type runState struct {
+	queue   *JobQueue
+	ctx     context.Context
+	handler Handler
+
+	lock sync.Mutex
+	// Number of workers wanted and running, and of handlers in progress.
+	limit   int
+	workers int
+	active  int
+	// Why warming up failed, if it did.
+	warmupErr error
+	// Closed once the last worker has stopped, after which no more are
+	// started.
+	done chan struct{}
+}
+
+// setConcurrency starts workers until there are concurrency of them. Excess
+// workers stop before retrieving their next job.
+func (r *runState) setConcurrency(concurrency int) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.limit = concurrency
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+	for r.workers < r.limit {
+		r.workers++
+		go r.work()
+	}
+}
+
+// concurrency returns the number of workers wanted.
+func (r *runState) concurrency() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.limit
+}
+
+// retire stops the calling worker if there are more than wanted, or always if
+// force is true, returning true if it should return.
+func (r *runState) retire(force bool) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !force && r.workers <= r.limit {
+		return false
+	}
+	r.workers--
+	if r.workers == 0 {
+		close(r.done)
+	}
+	return true
+}
+
+func (r *runState) work() {
+	c := r.queue
+	for !r.retire(false) {
+		if c.brake != nil {
+			if delay := c.brake.pause(c); delay > 0 {
+				select {
+				case <-r.ctx.Done():
+				case <-time.After(delay):
+				}
+			}
+		}
+		work, err := c.GetContext(r.ctx, nil)
+		if (r.ctx.Err() != nil || errors.Is(err, ErrQueueClosed)) && work == nil {
+			r.retire(true)
+			return
+		}
+		if err != nil {
+			c.log().Error("Failed to get a job", "queue", c.Queue, "error", err)
+			select {
+			case <-r.ctx.Done():
+				r.retire(true)
+				return
+			case <-time.After(runRetryInterval):
+			}
+			continue
+		}
+		r.lock.Lock()
+		r.active++
+		r.lock.Unlock()
+		c.runHandler(r.ctx, work, r.handler)
+		r.lock.Lock()
+		r.active--
+		r.lock.Unlock()
+	}
+}
+
+// runHandler calls handler with work, then completes or resubmits it unless
+// the handler already has.
+// runWorkers processes the jobs get retrieves with concurrency workers until
+// ctx is done, for queues other than JobQueue that share its configuration.
+// A worker whose get fails tries again after runRetryInterval.
+func (c *JobQueue) runWorkers(ctx context.Context, concurrency int, handler Handler, get func(ctx context.Context, v interface{}) (*Work, error)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	handler = c.wrapHandler(handler)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				work, err := get(ctx, nil)
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					c.log().Error("Failed to get job", "queue", c.Queue, "error", err)
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(runRetryInterval):
+					}
+					continue
+				}
+				c.runHandler(ctx, work, handler)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (c *JobQueue) runHandler(ctx context.Context, work *Work, handler Handler) {
+	var err error
+	// The job is kept alive until the handler returns, even once ctx is done.
+	ctx, stop := work.Context(ctx)
+	defer func() {
+		stop()
+		if p := recover(); p != nil {
+			c.log().Error("Handler panicked", "queue", c.Queue, "key", string(work.key), "panic", p, "stack", string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", p)
+		}
+		if work.isFinalized() {
+			return
+		}
+		if c.brake != nil {
+			c.brake.record(err != nil)
+		}
+		if dropped, derr := work.dropUndecodable(err); dropped {
+			err = derr
+		} else if err != nil {
+			err = work.ResubmitWithError(err)
+		} else {
+			err = work.Complete()
+		}
+		if err != nil {
+			c.log().Error("Failed to finalize job", "queue", c.Queue, "key", string(work.key), "error", err)
+		}
+	}()
+	err = handler(ctx, work, work.decode)
+}
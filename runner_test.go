@@ -0,0 +1,171 @@
+package grt_test
+
+import (
+	"context"
+	"errors"
+	"github.com/alecthomas/grt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runUntil runs q with handler until stop is closed, returning Run's error.
+func runUntil(q *grt.JobQueue, concurrency int, stop <-chan struct{}, handler func(ctx context.Context, w *grt.Work, decode func(interface{}) error) error) <-chan error {
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		<-stop
+		cancel()
+	}()
+	go func() { errs <- q.Run(ctx, concurrency, handler) }()
+	return errs
+}
+
+func TestRunOutcomes(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "runner")
+	for _, job := range []string{"ok", "fail", "panic"} {
+		if err := q.Submit(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var lock sync.Mutex
+	attempts := map[string]int{}
+	finished := make(chan struct{})
+	stop := make(chan struct{})
+	errs := runUntil(q, 2, stop, func(ctx context.Context, w *grt.Work, decode func(interface{}) error) error {
+		var job string
+		if err := decode(&job); err != nil {
+			return err
+		}
+		lock.Lock()
+		attempts[job]++
+		attempt := attempts[job]
+		if attempts["ok"] == 1 && attempts["fail"] == 2 && attempts["panic"] == 2 {
+			close(finished)
+		}
+		lock.Unlock()
+		switch {
+		case job == "fail" && attempt == 1:
+			return errors.New("failed")
+		case job == "panic" && attempt == 1:
+			panic("boom")
+		}
+		return nil
+	})
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal(attempts)
+	}
+	close(stop)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	// Failed and panicking jobs were resubmitted rather than completed, then
+	// completed on their second attempt.
+	if n, err := q.Len(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+	if attempts["ok"] != 1 {
+		t.Fatal(attempts)
+	}
+}
+
+func TestRunDrainsOnCancel(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "runner")
+	for _, job := range []string{"slow", "queued"} {
+		if err := q.Submit(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	started := make(chan struct{})
+	var completed int32
+	stop := make(chan struct{})
+	errs := runUntil(q, 1, stop, func(ctx context.Context, w *grt.Work, decode func(interface{}) error) error {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		atomic.AddInt32(&completed, 1)
+		return nil
+	})
+	<-started
+	close(stop)
+	start := time.Now()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	// The handler in flight finishes, and no further jobs are retrieved.
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatal("returned before the handler finished", elapsed)
+	}
+	if n := atomic.LoadInt32(&completed); n != 1 {
+		t.Fatal(n)
+	}
+	var job string
+	w, err := q.TryGet(&job)
+	if err != nil || job != "queued" {
+		t.Fatal(job, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunCleansUp(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "runner")
+	if err := q.Submit("stranded"); err != nil {
+		t.Fatal(err)
+	}
+	// A previous runner crashed with the job in progress.
+	if _, err := q.Get(nil); err != nil {
+		t.Fatal(err)
+	}
+	handled := make(chan string, 1)
+	run(t, q, 1, func(ctx context.Context, w *grt.Work, decode func(interface{}) error) error {
+		var job string
+		err := decode(&job)
+		handled <- job
+		return err
+	})
+	select {
+	case job := <-handled:
+		if job != "stranded" {
+			t.Fatal(job)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stranded job not recovered")
+	}
+}
+
+func TestRunConcurrency(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "runner")
+	for i := 0; i < 20; i++ {
+		if err := q.Submit(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var active, peak, handled int32
+	var wg sync.WaitGroup
+	wg.Add(20)
+	run(t, q, 4, func(ctx context.Context, w *grt.Work, decode func(interface{}) error) error {
+		defer wg.Done()
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			if p := atomic.LoadInt32(&peak); n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&handled, 1)
+		return nil
+	})
+	wg.Wait()
+	if peak != 4 || handled != 20 {
+		t.Fatal(peak, handled)
+	}
+}
@@ -0,0 +1,174 @@
+package grt
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"sync"
+	"time"
+)
+
+// defaultRuntimes holds the Runtime shared by queues created without
+// WithRuntime, per pool.
+var defaultRuntimes sync.Map
+
+// Runtime runs the periodic background work of the queues using it, such as
+// SLO sampling and fallback probes, on a single goroutine.
+//
+// However many queues share a Runtime, it runs at most one goroutine, only
+// while it has work scheduled, and tasks run one at a time so background work
+// holds at most one pool connection at once. A slow task delays the others.
+//
+// Queues created without WithRuntime share a default Runtime per pool. Lock
+// heartbeats are not run by a Runtime, so that they cannot be delayed.
+type Runtime struct {
+	pool    *redis.Pool
+	lock    sync.Mutex
+	tasks   map[*task]bool
+	wake    chan struct{}
+	running bool
+	closed  bool
+	loop    sync.WaitGroup
+}
+
+// task is a function run periodically by a Runtime until it returns false or
+// is cancelled.
+type task struct {
+	interval time.Duration
+	next     time.Time
+	fn       func() bool
+	// Held while fn runs.
+	run sync.Mutex
+}
+
+// NewRuntime creates a Runtime for queues on pool to share with WithRuntime.
+func NewRuntime(pool *redis.Pool) *Runtime {
+	return &Runtime{
+		pool:  pool,
+		tasks: map[*task]bool{},
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// WithRuntime runs the queue's background work on rt rather than the pool's
+// default Runtime.
+func WithRuntime(rt *Runtime) Option {
+	return func(c *JobQueue) { c.runtime = rt }
+}
+
+func defaultRuntime(pool *redis.Pool) *Runtime {
+	rt, _ := defaultRuntimes.LoadOrStore(pool, NewRuntime(pool))
+	return rt.(*Runtime)
+}
+
+// DefaultRuntime returns the Runtime shared by queues on pool created without
+// WithRuntime. Close it when done with the pool, eg. before closing the pool,
+// to stop their background work and release the state grt keeps for the
+// pool, such as its RetryPolicy.
+func DefaultRuntime(pool *redis.Pool) *Runtime {
+	return defaultRuntime(pool)
+}
+
+// Close stops all background work scheduled on the Runtime, waiting for any
+// task in progress to finish. Queues using a closed Runtime do no further
+// background work.
+//
+// Closing a pool's DefaultRuntime also removes the pool's RetryPolicy; queues
+// created on the pool afterwards share a new default Runtime.
+func (rt *Runtime) Close() error {
+	rt.lock.Lock()
+	rt.closed = true
+	rt.tasks = map[*task]bool{}
+	rt.lock.Unlock()
+	rt.poke()
+	rt.loop.Wait()
+	if defaultRuntimes.CompareAndDelete(rt.pool, rt) {
+		retryPolicies.Delete(rt.pool)
+		fractionalTimeoutPools.Delete(rt.pool)
+	}
+	return nil
+}
+
+// schedule runs fn every interval until it returns false or cancel is
+// called. cancel waits for a run in progress to finish.
+func (rt *Runtime) schedule(interval time.Duration, fn func() bool) (cancel func()) {
+	t := &task{interval: interval, next: time.Now().Add(interval), fn: fn}
+	rt.lock.Lock()
+	if rt.closed {
+		rt.lock.Unlock()
+		return func() {}
+	}
+	rt.tasks[t] = true
+	if !rt.running {
+		rt.running = true
+		rt.loop.Add(1)
+		go rt.run()
+	}
+	rt.lock.Unlock()
+	rt.poke()
+	return func() {
+		rt.lock.Lock()
+		delete(rt.tasks, t)
+		rt.lock.Unlock()
+		t.run.Lock()
+		t.run.Unlock()
+	}
+}
+
+func (rt *Runtime) poke() {
+	select {
+	case rt.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run executes tasks as they fall due, exiting when none remain.
+func (rt *Runtime) run() {
+	defer rt.loop.Done()
+	for {
+		rt.lock.Lock()
+		if len(rt.tasks) == 0 {
+			rt.running = false
+			rt.lock.Unlock()
+			return
+		}
+		now := time.Now()
+		var due []*task
+		var next time.Time
+		for t := range rt.tasks {
+			if !t.next.After(now) {
+				due = append(due, t)
+			} else if next.IsZero() || t.next.Before(next) {
+				next = t.next
+			}
+		}
+		rt.lock.Unlock()
+		if len(due) == 0 {
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-timer.C:
+			case <-rt.wake:
+			}
+			timer.Stop()
+			continue
+		}
+		for _, t := range due {
+			rt.runTask(t)
+		}
+	}
+}
+
+func (rt *Runtime) runTask(t *task) {
+	t.run.Lock()
+	defer t.run.Unlock()
+	rt.lock.Lock()
+	scheduled := rt.tasks[t]
+	t.next = time.Now().Add(t.interval)
+	rt.lock.Unlock()
+	if !scheduled {
+		return
+	}
+	if !t.fn() {
+		rt.lock.Lock()
+		delete(rt.tasks, t)
+		rt.lock.Unlock()
+	}
+}
@@ -0,0 +1,148 @@
+package grt_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/alecthomas/grt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"log/slog"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// grtGoroutines counts goroutines running the package's code, as opposed to
+// the tests' or miniredis's.
+func grtGoroutines() int {
+	buf := make([]byte, 1<<20)
+	n := 0
+	for _, g := range strings.Split(string(buf[:runtime.Stack(buf, true)]), "\n\n") {
+		if strings.Contains(g, "github.com/alecthomas/grt.") {
+			n++
+		}
+	}
+	return n
+}
+
+// waitForGoroutines waits for grtGoroutines to return want more than base,
+// the count before the test started, which includes goroutines left behind
+// by other tests' queues.
+func waitForGoroutines(t *testing.T, base, want int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for grtGoroutines()-base != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines, want %d", grtGoroutines()-base, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// countingPool returns a pool that counts the connections it dials.
+func countingPool(t *testing.T) (*miniredis.Miniredis, *redis.Pool, *int32) {
+	s := miniredis.RunT(t)
+	var dials int32
+	pool := &redis.Pool{
+		MaxIdle: 10,
+		Dial: func() (redis.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return redis.Dial("tcp", s.Addr())
+		},
+	}
+	t.Cleanup(func() { pool.Close() })
+	return s, pool, &dials
+}
+
+func TestRuntimeBounded(t *testing.T) {
+	base := grtGoroutines()
+	_, pool, dials := countingPool(t)
+	var breaches int32
+	queues := []*grt.JobQueue{}
+	for i := 0; i < 50; i++ {
+		q := grt.NewJobQueue(pool, fmt.Sprintf("runtime%d", i),
+			grt.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+			grt.WithEvents(),
+			grt.WithVisibilityTimeout(20*time.Millisecond),
+			grt.WithReaper(10*time.Millisecond),
+			grt.WithSLO(time.Hour, 1),
+			grt.OnSLOBreach(10*time.Millisecond, func(grt.SLOReport) { atomic.AddInt32(&breaches, 1) }))
+		queues = append(queues, q)
+		if err := q.SubmitAfter("later", time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		for _, job := range []string{"leased", "waiting"} {
+			if err := q.Submit(job); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The lease expires, for the reaper to reclaim.
+		if _, err := q.Get(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&breaches) < 50 {
+		if time.Now().After(deadline) {
+			t.Fatal(breaches)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, q := range queues {
+		if waiting, _, err := q.Waiting("", 10); err != nil || len(waiting) != 2 {
+			t.Fatalf("%s: %v %v", q.Queue, waiting, err)
+		}
+	}
+	// All the queues' background work runs on one goroutine, holding at most
+	// one connection.
+	waitForGoroutines(t, base, 1)
+	// The test's own operations account for two.
+	if n := atomic.LoadInt32(dials); n > 3 {
+		t.Fatal(n)
+	}
+	// The leased Work is never finalized, so Close would wait for it.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, q := range queues {
+		if err := q.CloseContext(ctx); err != context.Canceled {
+			t.Fatal(err)
+		}
+	}
+	waitForGoroutines(t, base, 0)
+}
+
+func TestRuntimeClose(t *testing.T) {
+	base := grtGoroutines()
+	_, pool := newPool(t)
+	rt := grt.NewRuntime(pool)
+	q := grt.NewJobQueue(pool, "runtime", grt.WithRuntime(rt),
+		grt.WithVisibilityTimeout(20*time.Millisecond), grt.WithReaper(10*time.Millisecond))
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	defer w.Complete()
+	waitForGoroutines(t, base, 1)
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing runs once Close returns, so the expired lease is not reaped.
+	if n := grtGoroutines() - base; n != 0 {
+		t.Fatal(n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if inProgress, _, err := q.InProgress("", 10); err != nil || len(inProgress) != 1 {
+		t.Fatal(inProgress, err)
+	}
+	// The pool's default Runtime is unaffected.
+	other := grt.NewJobQueue(pool, "other", grt.WithReaper(10*time.Millisecond))
+	defer other.Close()
+	waitForGoroutines(t, base, 1)
+}
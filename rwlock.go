@@ -0,0 +1,267 @@
+package grt
+
+import (
+	"github.com/alecthomas/grt/backoff"
+	"github.com/garyburd/redigo/redis"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// RWLock is a Redis-based reader/writer lock. Any number of readers, or a
+// single writer, may hold it at once.
+//
+// Each reader is a member of a sorted set scored by its expiry, renewed by
+// its own heartbeat, so a reader that dies without calling RUnlock releases
+// its share of the lock after Expiry without affecting other readers. A
+// waiting writer blocks new readers, so that it is not starved.
+//
+// The lock's keys are Key, Key+":readers" and Key+":waiting". In a Redis
+// Cluster, Key should contain a hash tag so that they share a slot.
+//
+// Like sync.RWMutex, an RWLock may be shared between goroutines.
+type RWLock struct {
+	pool *redis.Pool
+	Key  string
+	// Set the expiry time.
+	Expiry time.Duration
+	// Backoff between acquisition attempts, which are also retried as soon
+	// as a holder releases the lock. Defaults to waiting Expiry between
+	// attempts.
+	Backoff backoff.Backoff
+	// Number of times a failed renewal is retried, RetryDelay apart, before
+	// the hold is declared lost.
+	RetryAttempts int
+	RetryDelay    time.Duration
+	// Receives lost holds. Defaults to slog.Default().
+	Logger *slog.Logger
+	// Held for the duration of a write hold.
+	writing sync.Mutex
+	writer  *lockHold
+	lock    sync.Mutex
+	readers []*lockHold
+}
+
+// NewRWLock creates a new Redis reader/writer lock.
+func NewRWLock(pool *redis.Pool, key string) *RWLock {
+	if strictEnabled() {
+		registerStrictLock(key)
+	}
+	return &RWLock{
+		pool:          pool,
+		Key:           key,
+		Expiry:        time.Second * 2,
+		RetryAttempts: 3,
+		RetryDelay:    time.Millisecond * 100,
+	}
+}
+
+// RLock acquires the lock for reading, waiting while it is held or awaited
+// by a writer. Returns nil if the lock is acquired, or any Redis error.
+func (l *RWLock) RLock() error {
+	return l.RLockWait(time.Hour * 100000)
+}
+
+// RLockWait acquires the lock for reading. Returns nil if the lock is
+// acquired, ErrLockTimeout if the timeout is reached, or any Redis error.
+func (l *RWLock) RLockWait(wait time.Duration) error {
+	op := startOperation("RWLock.RLock")
+	defer op.end()
+	token := randomKey("")
+	err := waitForLockTimeout(wait, l.pool, l.Key, l.backoff(), func() (bool, error) {
+		r := op.conn(l.pool)
+		defer r.Close()
+		reply, err := rlockScript.do(r, l.Key, l.readersKey(), l.waitingKey(), token, l.expiryMillis())
+		if err != nil {
+			return false, err
+		}
+		return reply[0].(int64) == 1, nil
+	})
+	if err != nil {
+		return err
+	}
+	hold := newLockHold(token)
+	l.lock.Lock()
+	l.readers = append(l.readers, hold)
+	l.lock.Unlock()
+	go hold.heartbeat(lockLogger(l.Logger), l.Key, l.Expiry/4, func() error {
+		return renewWithRetries(l.RetryAttempts, l.RetryDelay, func() error {
+			r := getConn(l.pool, "RWLock.heartbeat")
+			defer r.Close()
+			_, err := rrenewScript.do(r, l.readersKey(), token, l.expiryMillis())
+			return err
+		})
+	})
+	return nil
+}
+
+// RUnlock releases a read hold of the lock. Returns ErrLockLost if it had
+// expired, or ErrNotLocked if the lock is not held for reading.
+func (l *RWLock) RUnlock() error {
+	l.lock.Lock()
+	if len(l.readers) == 0 {
+		l.lock.Unlock()
+		return ErrNotLocked
+	}
+	hold := l.readers[len(l.readers)-1]
+	l.readers = l.readers[:len(l.readers)-1]
+	l.lock.Unlock()
+	hold.release()
+	r := getConn(l.pool, "RWLock.RUnlock")
+	defer r.Close()
+	_, err := runlockScript.do(r, l.readersKey(), hold.token, lockReleasedChannel(l.Key))
+	return err
+}
+
+// Lock acquires the lock for writing, waiting until there are no readers or
+// other writers. Returns nil if the lock is acquired, or any Redis error.
+func (l *RWLock) Lock() error {
+	return l.LockWait(time.Hour * 100000)
+}
+
+// LockWait acquires the lock for writing. Returns nil if the lock is
+// acquired, ErrLockTimeout if the timeout is reached, or any Redis error.
+func (l *RWLock) LockWait(wait time.Duration) error {
+	l.writing.Lock()
+	op := startOperation("RWLock.Lock")
+	defer op.end()
+	token := randomKey("")
+	attempt := 0
+	err := waitForLockTimeout(wait, l.pool, l.Key, l.backoff(), func() (bool, error) {
+		r := op.conn(l.pool)
+		defer r.Close()
+		// The writer's claim on the lock outlives the backoff before its
+		// next attempt, so readers cannot slip in between them.
+		claim := l.Expiry + l.backoff().Next(attempt)
+		attempt++
+		reply, err := wlockScript.do(r, l.Key, l.readersKey(), l.waitingKey(), token, l.expiryMillis(),
+			claim.Nanoseconds()/1000000)
+		if err != nil {
+			return false, err
+		}
+		return reply[0].(int64) == 1, nil
+	})
+	if err != nil {
+		// Withdraw the claim so readers can proceed.
+		r := op.conn(l.pool)
+		releaseScript.do(r, l.waitingKey(), token, lockReleasedChannel(l.Key))
+		r.Close()
+		l.writing.Unlock()
+		return err
+	}
+	hold := newLockHold(token)
+	l.lock.Lock()
+	l.writer = hold
+	l.lock.Unlock()
+	go hold.heartbeat(lockLogger(l.Logger), l.Key, l.Expiry/4, func() error {
+		return renewWithRetries(l.RetryAttempts, l.RetryDelay, func() error {
+			r := getConn(l.pool, "RWLock.heartbeat")
+			defer r.Close()
+			_, err := renewScript.do(r, l.Key, token, l.expiryMillis())
+			return err
+		})
+	})
+	return nil
+}
+
+// Unlock releases a write hold of the lock. Returns ErrLockLost if it had
+// expired and been acquired by another client, or ErrNotLocked if the lock
+// is not held for writing.
+func (l *RWLock) Unlock() error {
+	l.lock.Lock()
+	hold := l.writer
+	l.writer = nil
+	l.lock.Unlock()
+	if hold == nil {
+		return ErrNotLocked
+	}
+	defer l.writing.Unlock()
+	hold.release()
+	r := getConn(l.pool, "RWLock.Unlock")
+	defer r.Close()
+	_, err := releaseScript.do(r, l.Key, hold.token, lockReleasedChannel(l.Key))
+	return err
+}
+
+func (l *RWLock) backoff() backoff.Backoff {
+	if l.Backoff != nil {
+		return l.Backoff
+	}
+	return backoff.Constant(l.Expiry)
+}
+
+func (l *RWLock) expiryMillis() int64 {
+	return l.Expiry.Nanoseconds() / 1000000
+}
+
+func (l *RWLock) readersKey() string {
+	return l.Key + ":readers"
+}
+
+func (l *RWLock) waitingKey() string {
+	return l.Key + ":waiting"
+}
+
+// KEYS: writer, readers sorted set, waiting writer. ARGV: token, expiry in
+// milliseconds. Returns 1 if the read lock was acquired.
+var rlockScript = newLuaScript("rlock", 1, 3, `
+redis.replicate_commands()
+if redis.call("EXISTS", KEYS[1]) == 1 or redis.call("EXISTS", KEYS[3]) == 1 then
+  return {0, 0}
+end
+local now = redis.call("TIME")
+local ms = now[1] * 1000 + math.floor(now[2] / 1000)
+redis.call("ZADD", KEYS[2], ms + ARGV[2], ARGV[1])
+redis.call("PEXPIRE", KEYS[2], ARGV[2])
+return {0, 1}
+`)
+
+// KEYS: sorted set of holders scored by expiry. ARGV: token, expiry in
+// milliseconds. Also renews Semaphore leases.
+var rrenewScript = newLuaScript("rrenew", 1, 1, `
+redis.replicate_commands()
+local now = redis.call("TIME")
+local ms = now[1] * 1000 + math.floor(now[2] / 1000)
+local deadline = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not deadline or tonumber(deadline) < ms then
+  redis.call("ZREM", KEYS[1], ARGV[1])
+  return {7} -- statusLockLost
+end
+redis.call("ZADD", KEYS[1], ms + ARGV[2], ARGV[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return {0}
+`)
+
+// KEYS: sorted set of holders. ARGV: token, release notification channel.
+// Also releases Semaphore leases.
+var runlockScript = newLuaScript("runlock", 1, 1, `
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+  return {7} -- statusLockLost
+end
+redis.call("PUBLISH", ARGV[2], "")
+return {0}
+`)
+
+// KEYS: writer, readers sorted set, waiting writer. ARGV: token, expiry in
+// milliseconds, expiry of the waiting writer's claim in milliseconds. Expired
+// readers are discarded. Returns 1 if the write lock was acquired, otherwise
+// claims the lock for this writer if no other writer is waiting.
+var wlockScript = newLuaScript("wlock", 1, 3, `
+redis.replicate_commands()
+local now = redis.call("TIME")
+local ms = now[1] * 1000 + math.floor(now[2] / 1000)
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ms - 1)
+local waiting = redis.call("GET", KEYS[3])
+if redis.call("EXISTS", KEYS[1]) == 1 or redis.call("ZCARD", KEYS[2]) > 0 then
+  if not waiting or waiting == ARGV[1] then
+    redis.call("SET", KEYS[3], ARGV[1], "PX", ARGV[3])
+  end
+  return {0, 0}
+end
+if waiting and waiting ~= ARGV[1] then
+  return {0, 0}
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+redis.call("DEL", KEYS[3])
+return {0, 1}
+`)
@@ -0,0 +1,124 @@
+package grt_test
+
+import (
+	"github.com/alecthomas/grt"
+	"github.com/garyburd/redigo/redis"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newRWLock(pool *redis.Pool) *grt.RWLock {
+	l := grt.NewRWLock(pool, "rwlock")
+	l.Expiry = 400 * time.Millisecond
+	return l
+}
+
+func TestRWLockConcurrentReaders(t *testing.T) {
+	_, pool := newPool(t)
+	var readers, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l := newRWLock(pool)
+			if err := l.RLockWait(time.Second); err != nil {
+				t.Error(err)
+				return
+			}
+			n := atomic.AddInt32(&readers, 1)
+			for {
+				if p := atomic.LoadInt32(&peak); n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(100 * time.Millisecond)
+			atomic.AddInt32(&readers, -1)
+			if err := l.RUnlock(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if peak != 5 {
+		t.Fatal("readers were serialised", peak)
+	}
+}
+
+func TestRWLockWriterExcludesReaders(t *testing.T) {
+	s, pool := newPool(t)
+	reader, writer := newRWLock(pool), newRWLock(pool)
+	if err := reader.RLock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.LockWait(100 * time.Millisecond); err != grt.ErrLockTimeout {
+		t.Fatal(err)
+	}
+	// A waiting writer blocks new readers, so it cannot be starved.
+	acquired := make(chan error, 1)
+	go func() { acquired <- writer.Lock() }()
+	time.Sleep(50 * time.Millisecond)
+	if err := newRWLock(pool).RLockWait(100 * time.Millisecond); err != grt.ErrLockTimeout {
+		t.Fatal("reader overtook a waiting writer", err)
+	}
+	start := time.Now()
+	if err := reader.RUnlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+	if err := reader.RLockWait(100 * time.Millisecond); err != grt.ErrLockTimeout {
+		t.Fatal(err)
+	}
+	if err := writer.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Unlock(); err != grt.ErrNotLocked {
+		t.Fatal(err)
+	}
+	if s.Exists("rwlock:waiting") {
+		t.Fatal("writer's claim left behind")
+	}
+	if err := reader.RLock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.RUnlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRWLockDeadReader(t *testing.T) {
+	s, pool := newPool(t)
+	live := newRWLock(pool)
+	if err := live.RLock(); err != nil {
+		t.Fatal(err)
+	}
+	// A reader that died without RUnlock leaves a share that is no longer
+	// renewed.
+	s.ZAdd("rwlock:readers", float64(time.Now().Add(200*time.Millisecond).UnixMilli()), "dead")
+	writer := newRWLock(pool)
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- writer.LockWait(2 * time.Second) }()
+	time.Sleep(50 * time.Millisecond)
+	if err := live.RUnlock(); err != nil {
+		t.Fatal(err)
+	}
+	// The live reader's share is released at once, and the dead one's when
+	// it expires.
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Fatal(elapsed)
+	}
+	if err := writer.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
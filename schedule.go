@@ -0,0 +1,174 @@
+package grt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule determines when a recurring job registered with a Scheduler runs.
+type Schedule interface {
+	// Next returns the first occurrence after t, or the zero time if there
+	// is none.
+	Next(t time.Time) time.Time
+}
+
+// Every returns a Schedule recurring every d, aligned to multiples of d since
+// the Unix epoch so that every process agrees on its occurrences.
+func Every(d time.Duration) Schedule {
+	return interval(d)
+}
+
+type interval time.Duration
+
+func (i interval) Next(t time.Time) time.Time {
+	if i <= 0 {
+		return time.Time{}
+	}
+	return t.Truncate(time.Duration(i)).Add(time.Duration(i))
+}
+
+func (i interval) String() string {
+	return "every " + time.Duration(i).String()
+}
+
+// cronDescriptors are shorthands for common cron expressions.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a standard five field cron expression, "minute hour
+// day-of-month month day-of-week", into a Schedule. Fields accept "*",
+// values, ranges ("1-5"), steps ("*/15", "0-30/10") and lists of these
+// ("1,15"). Day of week is 0-7, where 0 and 7 are Sunday. As in cron, if both
+// day fields are restricted, a day matching either runs. The descriptors
+// @yearly, @monthly, @weekly, @daily and @hourly are also accepted.
+//
+// Occurrences are computed in the location of the time passed to Next.
+func ParseCron(expr string) (Schedule, error) {
+	spec := expr
+	if descriptor, ok := cronDescriptors[strings.TrimSpace(expr)]; ok {
+		spec = descriptor
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q: expected 5 fields, got %d", expr, len(fields))
+	}
+	c := &cron{expr: expr}
+	var err error
+	bounds := []struct {
+		field    *uint64
+		min, max int
+	}{{&c.minute, 0, 59}, {&c.hour, 0, 23}, {&c.dom, 1, 31}, {&c.month, 1, 12}, {&c.dow, 0, 7}}
+	for i, b := range bounds {
+		if *b.field, err = parseCronField(fields[i], b.min, b.max); err != nil {
+			return nil, fmt.Errorf("cron expression %q: %w", expr, err)
+		}
+	}
+	// Sunday may be written as 7.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	// As in cron, a day field starting with "*" does not restrict the other.
+	c.anyDOM = strings.HasPrefix(fields[2], "*")
+	c.anyDOW = strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+// MustParseCron is like ParseCron but panics if expr is invalid.
+func MustParseCron(expr string) Schedule {
+	schedule, err := ParseCron(expr)
+	if err != nil {
+		panic(err)
+	}
+	return schedule
+}
+
+// cron is a parsed cron expression, with a bit set for each value each field
+// matches.
+type cron struct {
+	expr                          string
+	minute, hour, dom, month, dow uint64
+	anyDOM, anyDOW                bool
+}
+
+func (c *cron) String() string {
+	return c.expr
+}
+
+func (c *cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// An expression such as "0 0 30 2 *" never matches.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.anyDOM || c.anyDOW {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// parseCronField returns a bit set of the values from min to max matched by
+// field.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rng = part[:i]
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if step > 1 {
+				// "5/10" means from 5 to the maximum.
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
@@ -0,0 +1,160 @@
+package grt_test
+
+import (
+	"context"
+	"github.com/alecthomas/grt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	// A Monday.
+	monday := time.Date(2024, 1, 1, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"*/15 * * * *", monday, time.Date(2024, 1, 1, 10, 15, 0, 0, time.UTC)},
+		{"5,10 10 * * *", monday, time.Date(2024, 1, 1, 10, 10, 0, 0, time.UTC)},
+		// A step without a range runs from the value to the maximum.
+		{"5/10 * * * *", monday, time.Date(2024, 1, 1, 10, 15, 0, 0, time.UTC)},
+		{"5/10 * * * *", time.Date(2024, 1, 1, 10, 55, 0, 0, time.UTC), time.Date(2024, 1, 1, 11, 5, 0, 0, time.UTC)},
+		{"0-30/10 9-17 * * 1-5", time.Date(2024, 1, 1, 17, 30, 0, 0, time.UTC), time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2024, 1, 5, 12, 0, 0, 0, time.UTC), time.Date(2024, 1, 8, 9, 0, 0, 0, time.UTC)},
+		// Sunday may be written as 0 or 7.
+		{"0 12 * * 0", monday, time.Date(2024, 1, 7, 12, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", monday, time.Date(2024, 1, 7, 12, 0, 0, 0, time.UTC)},
+		// With both day fields restricted, either matches: Friday the 5th
+		// comes before the 13th, and Saturday the 13th after Friday the
+		// 12th.
+		{"0 0 13 * 5", monday, time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2024, 1, 12, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 13, 0, 0, 0, 0, time.UTC)},
+		// With one restricted, it alone applies.
+		{"0 0 13 * *", monday, time.Date(2024, 1, 13, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 5", monday, time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", monday, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", monday, time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"@daily", monday, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"@midnight", monday, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", monday, time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", monday, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", monday, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@annually", monday, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// December rolls over into the next year.
+		{"0 0 1 * *", time.Date(2024, 12, 15, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 12 * 1 *", time.Date(2024, 12, 31, 23, 59, 0, 0, time.UTC), time.Date(2025, 1, 1, 12, 30, 0, 0, time.UTC)},
+		{"59 23 31 12 *", time.Date(2024, 12, 31, 23, 59, 0, 0, time.UTC), time.Date(2025, 12, 31, 23, 59, 0, 0, time.UTC)},
+		// Never matches.
+		{"0 0 30 2 *", monday, time.Time{}},
+	}
+	for _, test := range tests {
+		schedule, err := grt.ParseCron(test.expr)
+		if err != nil {
+			t.Fatal(test.expr, err)
+		}
+		if next := schedule.Next(test.from); !next.Equal(test.want) {
+			t.Errorf("%s after %s: %s, want %s", test.expr, test.from, next, test.want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+		"@fortnightly",
+	} {
+		if _, err := grt.ParseCron(expr); err == nil {
+			t.Errorf("%q was accepted", expr)
+		}
+	}
+}
+
+func TestEvery(t *testing.T) {
+	at := time.Date(2024, 1, 1, 10, 7, 30, 0, time.UTC)
+	if next := grt.Every(time.Hour).Next(at); !next.Equal(time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)) {
+		t.Fatal(next)
+	}
+	if next := grt.Every(0).Next(at); !next.IsZero() {
+		t.Fatal(next)
+	}
+}
+
+// occurrences is a Schedule of fixed times.
+type occurrences []time.Time
+
+func (o occurrences) Next(t time.Time) time.Time {
+	for _, at := range o {
+		if at.After(t) {
+			return at
+		}
+	}
+	return time.Time{}
+}
+
+func TestSchedulerSubmitsOnce(t *testing.T) {
+	_, pool := newPool(t)
+	var submitted int32
+	q := grt.NewJobQueue(pool, "scheduler", grt.WithHooks(grt.Hooks{
+		OnSubmit: func(string, []byte) { atomic.AddInt32(&submitted, 1) },
+	}))
+	start := time.Now()
+	schedule := occurrences{start.Add(100 * time.Millisecond), start.Add(200 * time.Millisecond), start.Add(300 * time.Millisecond)}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	schedulers := []*grt.Scheduler{}
+	for i := 0; i < 2; i++ {
+		s := grt.NewScheduler(pool, "scheduler")
+		s.PollInterval = 5 * time.Millisecond
+		if err := s.Add("job", schedule, q, "job"); err != nil {
+			t.Fatal(err)
+		}
+		schedulers = append(schedulers, s)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Run(ctx)
+		}()
+	}
+	if err := schedulers[0].Add("job", schedule, q, "other"); err == nil {
+		t.Fatal("added twice")
+	}
+	// Each occurrence is retrieved as soon as it is submitted, so that a
+	// repeat would not be hidden by deduplication.
+	runs := 0
+	for time.Since(start) < 500*time.Millisecond {
+		w, err := q.GetWait(nil, 50*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != nil {
+			runs++
+			if err := w.Complete(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	cancel()
+	wg.Wait()
+	if runs != 3 || atomic.LoadInt32(&submitted) != 3 {
+		t.Fatalf("%d runs of %d submissions, want 3", runs, submitted)
+	}
+	status, err := schedulers[1].Status("job")
+	if err != nil || status.LastRun.Before(schedule[2].Add(-time.Millisecond)) || !status.NextRun.IsZero() {
+		t.Fatalf("%+v %v", status, err)
+	}
+}
@@ -0,0 +1,169 @@
+package grt
+
+import (
+	"context"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Scheduler submits recurring jobs to queues on a Schedule. Every process
+// running a Scheduler with the same key shares its state, and only one of
+// them submits each occurrence.
+//
+// Each job's next and last run times are kept in Redis, so occurrences are
+// not repeated across restarts. Occurrences missed while no Scheduler was
+// running are submitted once, late, and the schedule resumes from then.
+//
+// A job is recorded as run only once it has been submitted, so a Scheduler
+// that crashes in between may have it submitted again; the queue's
+// deduplication discards the repeat while the first is still queued.
+type Scheduler struct {
+	pool *redis.Pool
+	Key  string
+	// How often due jobs are checked for.
+	PollInterval time.Duration
+	// Receives submission failures. Defaults to slog.Default().
+	Logger *slog.Logger
+	// Held while submitting due jobs.
+	lock    *Lock
+	entries sync.Map
+}
+
+type scheduledJob struct {
+	name     string
+	schedule Schedule
+	queue    *JobQueue
+	job      interface{}
+}
+
+// ScheduledJobStatus is the state of a job registered with a Scheduler.
+type ScheduledJobStatus struct {
+	Name string `json:"name"`
+	// When the job was last submitted, or zero if it never has been.
+	LastRun time.Time `json:"last_run"`
+	// When the job will next be submitted, or zero if it has not yet been
+	// scheduled.
+	NextRun time.Time `json:"next_run"`
+}
+
+// NewScheduler creates a Scheduler whose state is kept under key.
+func NewScheduler(pool *redis.Pool, key string) *Scheduler {
+	return &Scheduler{
+		pool:         pool,
+		Key:          key,
+		PollInterval: time.Second,
+		lock:         NewLock(pool, key+":lock"),
+	}
+}
+
+// Add registers job to be submitted to queue on schedule, under a name
+// unique within the Scheduler. Every process should register the same jobs.
+//
+// Parse cron expressions with ParseCron, or use Every for a fixed interval.
+func (s *Scheduler) Add(name string, schedule Schedule, queue *JobQueue, job interface{}) error {
+	if _, loaded := s.entries.LoadOrStore(name, &scheduledJob{name: name, schedule: schedule, queue: queue, job: job}); loaded {
+		return fmt.Errorf("scheduled job %q already added", name)
+	}
+	return nil
+}
+
+// Run submits jobs as they fall due until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.tick(); err != nil {
+			lockLogger(s.Logger).Error("Scheduler failed", "key", s.Key, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// tick submits any due jobs, if no other process is doing so.
+func (s *Scheduler) tick() error {
+	if locked, err := s.lock.TryLock(); err != nil || !locked {
+		return err
+	}
+	defer s.lock.Unlock()
+	op := startOperation("Scheduler.tick")
+	defer op.end()
+	r := op.conn(s.pool)
+	next, err := redis.Int64Map(r.Do("HGETALL", s.nextKey()))
+	r.Close()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	s.entries.Range(func(_, value interface{}) bool {
+		entry := value.(*scheduledJob)
+		due, scheduled := next[entry.name]
+		if scheduled && time.UnixMilli(due).After(now) {
+			return true
+		}
+		if scheduled {
+			if err := entry.queue.Submit(entry.job); err != nil && err != ErrAlreadyQueued {
+				lockLogger(s.Logger).Error("Failed to submit scheduled job", "key", s.Key, "name", entry.name, "error", err)
+				return true
+			}
+		}
+		if err := s.record(op, entry, now, scheduled); err != nil {
+			lockLogger(s.Logger).Error("Failed to record scheduled job", "key", s.Key, "name", entry.name, "error", err)
+		}
+		return true
+	})
+	return nil
+}
+
+// record schedules entry's next run after now, and its last run as now if it
+// ran.
+func (s *Scheduler) record(op *operation, entry *scheduledJob, now time.Time, ran bool) error {
+	r := op.conn(s.pool)
+	defer r.Close()
+	r.Send("MULTI")
+	if ran {
+		r.Send("HSET", s.lastKey(), entry.name, now.UnixMilli())
+	}
+	if next := entry.schedule.Next(now); next.IsZero() {
+		r.Send("HDEL", s.nextKey(), entry.name)
+	} else {
+		r.Send("HSET", s.nextKey(), entry.name, next.UnixMilli())
+	}
+	_, err := r.Do("EXEC")
+	return err
+}
+
+// Status returns the last and next run times of the job registered under
+// name.
+func (s *Scheduler) Status(name string) (ScheduledJobStatus, error) {
+	r := getConn(s.pool, "Scheduler.Status")
+	defer r.Close()
+	r.Send("HGET", s.lastKey(), name)
+	r.Send("HGET", s.nextKey(), name)
+	replies, err := redis.Values(r.Do(""))
+	if err != nil {
+		return ScheduledJobStatus{}, err
+	}
+	status := ScheduledJobStatus{Name: name}
+	if last, err := redis.Int64(replies[0], nil); err == nil {
+		status.LastRun = time.UnixMilli(last)
+	}
+	if next, err := redis.Int64(replies[1], nil); err == nil {
+		status.NextRun = time.UnixMilli(next)
+	}
+	return status, nil
+}
+
+func (s *Scheduler) nextKey() string {
+	return s.Key + ":next"
+}
+
+func (s *Scheduler) lastKey() string {
+	return s.Key + ":last"
+}
@@ -0,0 +1,175 @@
+package grt
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrScriptVersion is wrapped by a ScriptError when a script was written
+	// for a different Redis layout than the one in use.
+	ErrScriptVersion = errors.New("script version mismatch")
+)
+
+// Status codes returned by scripts as the first element of their reply for
+// expected conditions.
+const (
+	statusOK = iota
+	statusDuplicate
+	statusRenamed
+	statusQueueExists
+	statusPayloadChanged
+	statusExpired
+	statusNotFound
+	statusLockLost
+	statusRecentlyCompleted
+	statusAlreadyDone
+	statusAlreadyRunning
+	statusGroupsPending
+)
+
+// scriptStatusErrors maps script status codes to the errors returned to
+// callers.
+var scriptStatusErrors = map[int64]error{
+	statusDuplicate:         ErrAlreadyQueued,
+	statusRenamed:           ErrQueueRenamed,
+	statusQueueExists:       ErrQueueExists,
+	statusPayloadChanged:    ErrPayloadChanged,
+	statusExpired:           ErrWorkExpired,
+	statusNotFound:          ErrJobNotFound,
+	statusLockLost:          ErrLockLost,
+	statusRecentlyCompleted: ErrRecentlyCompleted,
+	statusAlreadyDone:       ErrAlreadyDone,
+	statusAlreadyRunning:    ErrAlreadyRunning,
+	statusGroupsPending:     ErrGroupsPending,
+}
+
+// ScriptError is returned when a Lua script fails unexpectedly.
+type ScriptError struct {
+	// Logical name of the script.
+	Script string
+	Keys   []string
+	Err    error
+}
+
+func (e *ScriptError) Error() string {
+	msg := fmt.Sprintf("script %s failed on keys %s: %s", e.Script, strings.Join(e.Keys, ", "), e.Err)
+	if errors.Is(e.Err, ErrScriptVersion) {
+		msg += " (run SCRIPT FLUSH, or upgrade all clients of this queue)"
+	}
+	return msg
+}
+
+func (e *ScriptError) Unwrap() error { return e.Err }
+
+// scripts is every Lua script used by the package, for preloading.
+var (
+	scriptsLock sync.Mutex
+	scripts     []*luaScript
+)
+
+// luaScript is a Lua script with a logical name and the Redis layout version
+// it was written for.
+//
+// Scripts receive the layout version as their final argument and refuse to
+// run if it does not match, and return a table whose first element is a
+// status code. A version suffixed with "+" asks the script to append the
+// number of Redis commands it issued to its reply, for command counting.
+type luaScript struct {
+	name   string
+	keys   int
+	script *redis.Script
+}
+
+// newLuaScript creates a script from body, which runs with redis.call and
+// redis.pcall counting the commands it issues.
+func newLuaScript(name string, version int, keys int, body string) *luaScript {
+	src := fmt.Sprintf(`local SCRIPT_VERSION = %d
+local version, counted = string.match(tostring(ARGV[#ARGV]), "^(%%d+)(%%+?)$")
+if version ~= tostring(SCRIPT_VERSION) then
+  return redis.error_reply("GRT_VERSION script version " .. SCRIPT_VERSION .. " does not match layout version " .. tostring(ARGV[#ARGV]))
+end
+local commands = 0
+local redis_call, redis_pcall = redis.call, redis.pcall
+local redis = setmetatable({
+  call = function(...) commands = commands + 1 return redis_call(...) end,
+  pcall = function(...) commands = commands + 1 return redis_pcall(...) end,
+}, {__index = redis})
+local function script()
+`, version) + body + `
+end
+local reply = script()
+if counted == "+" and type(reply) == "table" and reply.err == nil then
+  table.insert(reply, commands)
+end
+return reply
+`
+	script := &luaScript{name: name, keys: keys, script: redis.NewScript(keys, src)}
+	scriptsLock.Lock()
+	scripts = append(scripts, script)
+	scriptsLock.Unlock()
+	return script
+}
+
+// version returns the layout version argument passed to the script, asking
+// it to count its commands if r counts them towards an operation.
+func (s *luaScript) version(r redis.Conn) interface{} {
+	if _, ok := r.(*countingConn); ok {
+		return strconv.Itoa(schemaVersion) + "+"
+	}
+	return schemaVersion
+}
+
+// do runs the script, returning the reply values following the status code.
+func (s *luaScript) do(r redis.Conn, keysAndArgs ...interface{}) ([]interface{}, error) {
+	reply, err := redis.Values(s.script.Do(r, append(keysAndArgs, s.version(r))...))
+	if err != nil {
+		return nil, s.wrap(err, keysAndArgs)
+	}
+	if counter, ok := r.(*countingConn); ok && len(reply) > 0 {
+		commands, _ := redis.Int(reply[len(reply)-1], nil)
+		counter.operation.add(commands)
+		reply = reply[:len(reply)-1]
+	}
+	if len(reply) == 0 {
+		return nil, s.wrap(errors.New("empty reply"), keysAndArgs)
+	}
+	status, err := redis.Int64(reply[0], nil)
+	if err != nil {
+		return nil, s.wrap(err, keysAndArgs)
+	}
+	if status != statusOK {
+		if err, ok := scriptStatusErrors[status]; ok {
+			return nil, err
+		}
+		return nil, s.wrap(fmt.Errorf("unknown status %d", status), keysAndArgs)
+	}
+	return reply[1:], nil
+}
+
+// send queues the script with EVAL rather than EVALSHA, for use within MULTI,
+// where a script missing from the server's cache could not be loaded and
+// retried. Its reply is read with EXEC, or with Do("") in a pipeline; a
+// counting connection takes the command count from the end of the reply,
+// where callers reading it by index from the front do not see it.
+func (s *luaScript) send(r redis.Conn, keysAndArgs ...interface{}) error {
+	if counter, ok := r.(*countingConn); ok {
+		return counter.sendScript(s.script, append(keysAndArgs, s.version(r))...)
+	}
+	return s.script.Send(r, append(keysAndArgs, schemaVersion)...)
+}
+
+func (s *luaScript) wrap(err error, keysAndArgs []interface{}) error {
+	if i := strings.Index(err.Error(), "GRT_VERSION "); i >= 0 {
+		err = fmt.Errorf("%w: %s", ErrScriptVersion, err.Error()[i+len("GRT_VERSION "):])
+	}
+	keys := make([]string, s.keys)
+	for i := range keys {
+		keys[i] = fmt.Sprint(keysAndArgs[i])
+	}
+	return &ScriptError{Script: s.name, Keys: keys, Err: err}
+}
@@ -0,0 +1,31 @@
+package grt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestScriptVersionMismatch(t *testing.T) {
+	_, pool := newTestPool(t)
+	// A script cached by a client written for another layout.
+	script := newLuaScript("stale", schemaVersion+1, 1, `return {0}`)
+	t.Cleanup(func() {
+		scriptsLock.Lock()
+		defer scriptsLock.Unlock()
+		scripts = scripts[:len(scripts)-1]
+	})
+	r := pool.Get()
+	defer r.Close()
+	_, err := script.do(r, "jobs")
+	if !errors.Is(err, ErrScriptVersion) {
+		t.Fatal(err)
+	}
+	var scriptErr *ScriptError
+	if !errors.As(err, &scriptErr) || scriptErr.Script != "stale" || len(scriptErr.Keys) != 1 || scriptErr.Keys[0] != "jobs" {
+		t.Fatal(err)
+	}
+	if message := err.Error(); !strings.Contains(message, "does not match layout version") || !strings.HasSuffix(message, "(run SCRIPT FLUSH, or upgrade all clients of this queue)") {
+		t.Fatal(message)
+	}
+}
@@ -0,0 +1,92 @@
+package grt_test
+
+import (
+	"errors"
+	"github.com/alecthomas/grt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScriptStatusErrors(t *testing.T) {
+	s, pool := newPool(t)
+	tests := []struct {
+		name string
+		run  func() error
+		want error
+	}{
+		{"Duplicate", func() error {
+			q := grt.NewJobQueue(pool, "duplicate")
+			if err := q.Submit("a"); err != nil {
+				return err
+			}
+			return q.Submit("a")
+		}, grt.ErrAlreadyQueued},
+		{"NotFound", func() error {
+			return grt.NewJobQueue(pool, "notfound").Requeue([]byte(`"a"`))
+		}, grt.ErrJobNotFound},
+		{"NotOwner", func() error {
+			lock := grt.NewLock(pool, "notowner")
+			if err := lock.Lock(); err != nil {
+				return err
+			}
+			if err := s.Set("notowner", "another holder"); err != nil {
+				return err
+			}
+			return lock.Unlock()
+		}, grt.ErrLockLost},
+		{"OverCapacity", func() error {
+			once := grt.NewOnce(pool, "once")
+			started, release := make(chan struct{}), make(chan struct{})
+			go once.Do("a", time.Minute, func() error {
+				close(started)
+				<-release
+				return nil
+			})
+			<-started
+			defer close(release)
+			return once.Do("a", time.Minute, func() error { return nil })
+		}, grt.ErrAlreadyRunning},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.run()
+			if !errors.Is(err, test.want) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+			// Expected conditions are reported as they are, without any
+			// script details.
+			if err.Error() != test.want.Error() {
+				t.Fatal(err)
+			}
+			var scriptErr *grt.ScriptError
+			if errors.As(err, &scriptErr) {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestScriptFailure(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "broken")
+	if err := s.Set("broken:payload", "not a hash"); err != nil {
+		t.Fatal(err)
+	}
+	err := q.Submit("a")
+	var scriptErr *grt.ScriptError
+	if !errors.As(err, &scriptErr) {
+		t.Fatalf("%T: %v", err, err)
+	}
+	if scriptErr.Script != "submit" || len(scriptErr.Keys) == 0 {
+		t.Fatalf("%+v", scriptErr)
+	}
+	message := err.Error()
+	if !strings.HasPrefix(message, "script submit failed on keys broken") || !strings.Contains(message, "broken:payload") ||
+		!strings.Contains(message, "WRONGTYPE") {
+		t.Fatal(message)
+	}
+	if errors.Is(err, grt.ErrScriptVersion) || strings.Contains(message, "SCRIPT FLUSH") {
+		t.Fatal(message)
+	}
+}
@@ -0,0 +1,311 @@
+package grt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"time"
+)
+
+// Feature is a group of grt functionality whose Redis requirements can be
+// verified.
+type Feature int
+
+// Features that can be verified by SelfTest and VerifyPermissions.
+const (
+	FeatureJobQueue Feature = iota
+	// FeatureLock covers Lock, RWLock, Semaphore, RateLimiter and Limiter.
+	FeatureLock
+	// FeatureAdmin covers the diagnostic commands used by SelfTest and
+	// ListQueues.
+	FeatureAdmin
+	// FeatureSidekiqBridge covers SidekiqBridge, in addition to
+	// FeatureJobQueue.
+	FeatureSidekiqBridge
+)
+
+var allFeatures = []Feature{FeatureJobQueue, FeatureLock, FeatureAdmin, FeatureSidekiqBridge}
+
+// CheckStatus is the outcome of a single self-test check.
+type CheckStatus int
+
+// Check outcomes, in increasing order of severity.
+const (
+	CheckPass CheckStatus = iota
+	CheckWarn
+	CheckFail
+)
+
+func (s CheckStatus) String() string {
+	switch s {
+	case CheckPass:
+		return "pass"
+	case CheckWarn:
+		return "warn"
+	case CheckFail:
+		return "fail"
+	}
+	return fmt.Sprintf("CheckStatus(%d)", int(s))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s CheckStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// CheckResult is the result of a single self-test check.
+type CheckResult struct {
+	Name   string      `json:"name"`
+	Status CheckStatus `json:"status"`
+	Detail string      `json:"detail,omitempty"`
+}
+
+// Report is the result of SelfTest.
+type Report struct {
+	Checks []CheckResult `json:"checks"`
+}
+
+// Status returns the most severe status of all checks.
+func (r Report) Status() CheckStatus {
+	status := CheckPass
+	for _, check := range r.Checks {
+		if check.Status > status {
+			status = check.Status
+		}
+	}
+	return status
+}
+
+func (r Report) String() string {
+	lines := []string{}
+	for _, check := range r.Checks {
+		line := fmt.Sprintf("%s: %s", check.Status, check.Name)
+		if check.Detail != "" {
+			line += " (" + check.Detail + ")"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r *Report) add(name string, status CheckStatus, detail string, args ...interface{}) {
+	r.Checks = append(r.Checks, CheckResult{Name: name, Status: status, Detail: fmt.Sprintf(detail, args...)})
+}
+
+// SelfTest probes a Redis deployment for its suitability for the given
+// features (all features if none are given).
+//
+// It checks the eviction policy, persistence, cluster mode, scripting
+// support and baseline latency, and exercises each feature against
+// throwaway keys under "grt:selftest:". An error is returned only if Redis
+// cannot be reached at all; individual problems are reported in the Report.
+func SelfTest(ctx context.Context, pool *redis.Pool, features ...Feature) (Report, error) {
+	report := Report{}
+	if len(features) == 0 {
+		features = allFeatures
+	}
+	r := getConn(pool, "SelfTest")
+	defer r.Close()
+	if _, err := r.Do("PING"); err != nil {
+		return report, err
+	}
+	checks := []func(redis.Conn, *Report){selfTestLatency, selfTestEviction, selfTestPersistence, selfTestCluster, selfTestScripting}
+	for _, feature := range features {
+		switch feature {
+		case FeatureJobQueue:
+			checks = append(checks, func(_ redis.Conn, report *Report) { selfTestJobQueue(pool, report) }, selfTestBlocking)
+		case FeatureLock:
+			checks = append(checks, func(_ redis.Conn, report *Report) { selfTestLock(pool, report) })
+		}
+	}
+	for _, check := range checks {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		check(r, &report)
+	}
+	return report, nil
+}
+
+// MustSelfTest runs SelfTest and panics if Redis is unreachable or any check
+// fails. Warnings are ignored. Intended as a startup gate.
+func MustSelfTest(ctx context.Context, pool *redis.Pool, features ...Feature) Report {
+	report, err := SelfTest(ctx, pool, features...)
+	if err != nil {
+		panic("grt: self-test failed: " + err.Error())
+	}
+	if report.Status() == CheckFail {
+		panic("grt: self-test failed:\n" + report.String())
+	}
+	return report
+}
+
+// Latency above which a warning is reported.
+const selfTestMaxLatency = time.Millisecond * 5
+
+func selfTestLatency(r redis.Conn, report *Report) {
+	const pings = 10
+	start := time.Now()
+	for i := 0; i < pings; i++ {
+		if _, err := r.Do("PING"); err != nil {
+			report.add("latency", CheckFail, "%s", err)
+			return
+		}
+	}
+	latency := time.Since(start) / pings
+	if latency > selfTestMaxLatency {
+		report.add("latency", CheckWarn, "mean round trip %s exceeds %s", latency, selfTestMaxLatency)
+		return
+	}
+	report.add("latency", CheckPass, "mean round trip %s", latency)
+}
+
+func selfTestEviction(r redis.Conn, report *Report) {
+	values, err := redis.Strings(r.Do("CONFIG", "GET", "maxmemory-policy"))
+	if err != nil || len(values) != 2 {
+		report.add("maxmemory-policy", CheckWarn, "could not read maxmemory-policy: %v", err)
+		return
+	}
+	policy := values[1]
+	switch {
+	case policy == "noeviction":
+		report.add("maxmemory-policy", CheckPass, "%s", policy)
+	case strings.HasPrefix(policy, "allkeys-"):
+		report.add("maxmemory-policy", CheckFail, "%s may evict queue and lock keys, use noeviction", policy)
+	default:
+		report.add("maxmemory-policy", CheckWarn, "%s may evict keys with an expiry, use noeviction", policy)
+	}
+}
+
+func selfTestPersistence(r redis.Conn, report *Report) {
+	info, err := redisInfo(r, "persistence")
+	if err != nil {
+		report.add("persistence", CheckWarn, "could not read persistence info: %s", err)
+		return
+	}
+	if info["aof_enabled"] == "1" {
+		report.add("persistence", CheckPass, "AOF enabled")
+		return
+	}
+	save, err := redis.Strings(r.Do("CONFIG", "GET", "save"))
+	if err == nil && len(save) == 2 && save[1] != "" {
+		report.add("persistence", CheckWarn, "RDB snapshots only, jobs submitted since the last snapshot may be lost")
+		return
+	}
+	report.add("persistence", CheckWarn, "persistence appears to be disabled, all jobs will be lost on restart")
+}
+
+func selfTestCluster(r redis.Conn, report *Report) {
+	info, err := redisInfo(r, "cluster")
+	if err != nil {
+		report.add("cluster", CheckWarn, "could not read cluster info: %s", err)
+		return
+	}
+	if info["cluster_enabled"] == "1" {
+		report.add("cluster", CheckFail, "cluster mode is not supported, queue keys span multiple slots")
+		return
+	}
+	report.add("cluster", CheckPass, "")
+}
+
+func selfTestScripting(r redis.Conn, report *Report) {
+	v, err := redis.Int(r.Do("EVAL", "return 1", 0))
+	if err != nil || v != 1 {
+		report.add("scripting", CheckWarn, "Lua scripting unavailable: %v", err)
+		return
+	}
+	report.add("scripting", CheckPass, "")
+}
+
+func selfTestJobQueue(pool *redis.Pool, report *Report) {
+	queue := selfTestKey()
+	defer selfTestCleanup(pool, queue, queue+":processing", queue+":payload")
+	c := NewJobQueue(pool, queue)
+	err := c.Submit("probe")
+	var v string
+	var work *Work
+	if err == nil {
+		work, err = c.Get(&v)
+	}
+	if err == nil {
+		err = work.Complete()
+	}
+	if err == nil && v != "probe" {
+		err = fmt.Errorf("round-tripped job %q does not match", v)
+	}
+	if err != nil {
+		report.add("job queue", CheckFail, "%s", err)
+		return
+	}
+	report.add("job queue", CheckPass, "")
+}
+
+func selfTestBlocking(r redis.Conn, report *Report) {
+	src, dst := selfTestKey(), selfTestKey()
+	defer r.Do("DEL", src, dst)
+	_, err := r.Do("LPUSH", src, "probe")
+	var v string
+	if err == nil {
+		v, err = redis.String(r.Do("BRPOPLPUSH", src, dst, 1))
+	}
+	if err != nil {
+		report.add("blocking commands", CheckFail, "BRPOPLPUSH failed, check any proxy supports blocking commands: %s", err)
+		return
+	}
+	if v != "probe" {
+		report.add("blocking commands", CheckFail, "BRPOPLPUSH returned %q", v)
+		return
+	}
+	report.add("blocking commands", CheckPass, "")
+}
+
+func selfTestLock(pool *redis.Pool, report *Report) {
+	key := selfTestKey()
+	defer selfTestCleanup(pool, key)
+	lock := NewLock(pool, key)
+	if err := lock.LockWait(lock.Expiry); err != nil {
+		report.add("lock", CheckFail, "%s", err)
+		return
+	}
+	lock.Unlock()
+	report.add("lock", CheckPass, "")
+}
+
+func selfTestKey() string {
+	return randomKey("grt:selftest:")
+}
+
+// randomKey returns a unique key with the given prefix.
+func randomKey(prefix string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+func selfTestCleanup(pool *redis.Pool, keys ...string) {
+	r := getConn(pool, "SelfTest")
+	defer r.Close()
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	r.Do("DEL", args...)
+}
+
+// redisInfo returns the fields of an INFO section.
+func redisInfo(r redis.Conn, section string) (map[string]string, error) {
+	text, err := redis.String(r.Do("INFO", section))
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]string{}
+	for _, line := range strings.Split(text, "\n") {
+		if parts := strings.SplitN(strings.TrimSpace(line), ":", 2); len(parts) == 2 {
+			info[parts[0]] = parts[1]
+		}
+	}
+	return info, nil
+}
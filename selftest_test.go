@@ -0,0 +1,131 @@
+package grt_test
+
+import (
+	"context"
+	"errors"
+	"github.com/alecthomas/grt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"testing"
+)
+
+// deploymentConn answers CONFIG GET and INFO as a Redis deployment with the
+// given settings would, optionally failing blocking commands as some proxies
+// do, and passes everything else through.
+type deploymentConn struct {
+	redis.Conn
+	config       map[string]string
+	info         map[string]string
+	noBlocking   bool
+	noScripting  bool
+	configDenied bool
+}
+
+func (d *deploymentConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	switch {
+	case cmd == "CONFIG" && len(args) == 2 && args[0] == "GET":
+		if d.configDenied {
+			return nil, redis.Error("NOPERM this user has no permissions to run the 'config|get' command")
+		}
+		name := args[1].(string)
+		return []interface{}{[]byte(name), []byte(d.config[name])}, nil
+	case cmd == "INFO" && len(args) == 1:
+		return []byte(d.info[args[0].(string)]), nil
+	case cmd == "BRPOPLPUSH" && d.noBlocking:
+		return nil, redis.Error("ERR command not supported by proxy")
+	case cmd == "EVAL" && d.noScripting && len(args) > 0 && args[0] == "return 1":
+		return nil, redis.Error("ERR unknown command 'EVAL'")
+	}
+	return d.Conn.Do(cmd, args...)
+}
+
+func TestSelfTestChecks(t *testing.T) {
+	healthy := func() *deploymentConn {
+		return &deploymentConn{
+			config: map[string]string{"maxmemory-policy": "noeviction", "save": ""},
+			info: map[string]string{
+				"persistence": "# Persistence\r\naof_enabled:1\r\n",
+				"cluster":     "# Cluster\r\ncluster_enabled:0\r\n",
+			},
+		}
+	}
+	tests := []struct {
+		name   string
+		modify func(d *deploymentConn)
+		check  string
+		status grt.CheckStatus
+	}{
+		{"Healthy", func(d *deploymentConn) {}, "", grt.CheckPass},
+		{"AllKeysEviction", func(d *deploymentConn) { d.config["maxmemory-policy"] = "allkeys-lru" }, "maxmemory-policy", grt.CheckFail},
+		{"VolatileEviction", func(d *deploymentConn) { d.config["maxmemory-policy"] = "volatile-lru" }, "maxmemory-policy", grt.CheckWarn},
+		{"ConfigDenied", func(d *deploymentConn) { d.configDenied = true }, "maxmemory-policy", grt.CheckWarn},
+		{"SnapshotsOnly", func(d *deploymentConn) {
+			d.info["persistence"] = "aof_enabled:0\r\n"
+			d.config["save"] = "3600 1"
+		}, "persistence", grt.CheckWarn},
+		{"NoPersistence", func(d *deploymentConn) { d.info["persistence"] = "aof_enabled:0\r\n" }, "persistence", grt.CheckWarn},
+		{"Cluster", func(d *deploymentConn) { d.info["cluster"] = "cluster_enabled:1\r\n" }, "cluster", grt.CheckFail},
+		{"NoScripting", func(d *deploymentConn) { d.noScripting = true }, "scripting", grt.CheckWarn},
+		{"ProxyBreaksBlocking", func(d *deploymentConn) { d.noBlocking = true }, "blocking commands", grt.CheckFail},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := miniredis.RunT(t)
+			deployment := healthy()
+			test.modify(deployment)
+			pool := &redis.Pool{Dial: func() (redis.Conn, error) {
+				conn, err := redis.Dial("tcp", s.Addr())
+				if err != nil {
+					return nil, err
+				}
+				d := *deployment
+				d.Conn = conn
+				return &d, nil
+			}}
+			defer pool.Close()
+			report, err := grt.SelfTest(context.Background(), pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, check := range report.Checks {
+				want := grt.CheckPass
+				if check.Name == test.check {
+					want = test.status
+				}
+				// Latency depends on the machine running the tests.
+				if check.Name != "latency" && check.Status != want {
+					t.Errorf("%s: %s (%s), want %s", check.Name, check.Status, check.Detail, want)
+				}
+			}
+			if test.check != "" && !strings.Contains(report.String(), test.check) {
+				t.Fatalf("no %s check in\n%s", test.check, report)
+			}
+		})
+	}
+}
+
+func TestSelfTestFeatures(t *testing.T) {
+	_, pool := newPool(t)
+	report, err := grt.SelfTest(context.Background(), pool, grt.FeatureLock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, check := range report.Checks {
+		names = append(names, check.Name)
+	}
+	if got := strings.Join(names, ","); got != "latency,maxmemory-policy,persistence,cluster,scripting,lock" {
+		t.Fatal(got)
+	}
+}
+
+func TestMustSelfTest(t *testing.T) {
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return nil, errors.New("unreachable") }}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("MustSelfTest did not panic")
+		}
+	}()
+	grt.MustSelfTest(context.Background(), pool)
+}
@@ -0,0 +1,160 @@
+package grt
+
+import (
+	"context"
+	"github.com/alecthomas/grt/backoff"
+	"github.com/garyburd/redigo/redis"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// Semaphore is a Redis-based counting semaphore, limiting how many holders
+// across all clients may hold it at once.
+//
+// Each holder has a lease in a sorted set scored by its expiry, renewed by
+// its own heartbeat, so a holder that dies without releasing frees its slot
+// after Expiry. Expired leases are pruned by the next Acquire.
+type Semaphore struct {
+	pool *redis.Pool
+	Key  string
+	// Maximum number of concurrent holders.
+	Limit int
+	// Set the expiry time of leases.
+	Expiry time.Duration
+	// Backoff between acquisition attempts, which are also retried as soon
+	// as a holder releases a lease. Defaults to waiting Expiry between
+	// attempts.
+	Backoff backoff.Backoff
+	// Number of times a failed renewal is retried, RetryDelay apart, before
+	// the lease is declared lost.
+	RetryAttempts int
+	RetryDelay    time.Duration
+	// Receives lost holds. Defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// NewSemaphore creates a new Redis semaphore allowing up to limit holders.
+func NewSemaphore(pool *redis.Pool, key string, limit int) *Semaphore {
+	if strictEnabled() {
+		registerStrictLock(key)
+	}
+	return &Semaphore{
+		pool:          pool,
+		Key:           key,
+		Limit:         limit,
+		Expiry:        time.Second * 2,
+		RetryAttempts: 3,
+		RetryDelay:    time.Millisecond * 100,
+	}
+}
+
+// Acquire a lease on the semaphore, waiting until one is available or ctx is
+// done. The returned release function must be called to release the lease,
+// and returns ErrLockLost if it had expired, or ErrNotLocked if it was already
+// released.
+func (s *Semaphore) Acquire(ctx context.Context) (release func() error, err error) {
+	op := startOperation("Semaphore.Acquire")
+	defer op.end()
+	token := randomKey("")
+	err = waitForLock(ctx, s.pool, s.Key, s.backoff(), func() (bool, error) {
+		return s.acquire(op, token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.start(token), nil
+}
+
+// TryAcquire attempts once to acquire a lease on the semaphore, without
+// waiting. release is nil if none was available, and otherwise must be called
+// as with Acquire.
+func (s *Semaphore) TryAcquire() (release func() error, err error) {
+	op := startOperation("Semaphore.TryAcquire")
+	defer op.end()
+	token := randomKey("")
+	acquired, err := s.acquire(op, token)
+	if err != nil || !acquired {
+		return nil, err
+	}
+	return s.start(token), nil
+}
+
+func (s *Semaphore) acquire(op *operation, token string) (bool, error) {
+	r := op.conn(s.pool)
+	defer r.Close()
+	reply, err := semaphoreAcquireScript.do(r, s.Key, token, s.Limit, s.Expiry.Nanoseconds()/1000000)
+	if err != nil {
+		return false, err
+	}
+	return reply[0].(int64) == 1, nil
+}
+
+// start renews a newly acquired lease until the returned release function is
+// called.
+func (s *Semaphore) start(token string) (release func() error) {
+	hold := newLockHold(token)
+	go hold.heartbeat(lockLogger(s.Logger), s.Key, s.Expiry/4, func() error {
+		return renewWithRetries(s.RetryAttempts, s.RetryDelay, func() error {
+			r := getConn(s.pool, "Semaphore.heartbeat")
+			defer r.Close()
+			_, err := rrenewScript.do(r, s.Key, token, s.Expiry.Nanoseconds()/1000000)
+			return err
+		})
+	})
+	var released int32
+	return func() error {
+		if !atomic.CompareAndSwapInt32(&released, 0, 1) {
+			return ErrNotLocked
+		}
+		hold.release()
+		r := getConn(s.pool, "Semaphore.Release")
+		defer r.Close()
+		_, err := runlockScript.do(r, s.Key, token, lockReleasedChannel(s.Key))
+		return err
+	}
+}
+
+// Available returns the number of leases that can currently be acquired.
+func (s *Semaphore) Available() (int, error) {
+	r := getConn(s.pool, "Semaphore.Available")
+	defer r.Close()
+	reply, err := semaphoreHeldScript.do(r, s.Key)
+	if err != nil {
+		return 0, err
+	}
+	available := s.Limit - int(reply[0].(int64))
+	if available < 0 {
+		available = 0
+	}
+	return available, nil
+}
+
+func (s *Semaphore) backoff() backoff.Backoff {
+	if s.Backoff != nil {
+		return s.Backoff
+	}
+	return backoff.Constant(s.Expiry)
+}
+
+// KEYS: leases sorted set. ARGV: token, limit, expiry in milliseconds.
+// Expired leases are discarded. Returns 1 if a lease was acquired.
+var semaphoreAcquireScript = newLuaScript("semaphore_acquire", 1, 1, `
+redis.replicate_commands()
+local now = redis.call("TIME")
+local ms = now[1] * 1000 + math.floor(now[2] / 1000)
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ms - 1)
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[2]) then
+  return {0, 0}
+end
+redis.call("ZADD", KEYS[1], ms + ARGV[3], ARGV[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return {0, 1}
+`)
+
+// KEYS: leases sorted set. Returns the number of unexpired leases.
+var semaphoreHeldScript = newLuaScript("semaphore_held", 1, 1, `
+local now = redis.call("TIME")
+local ms = now[1] * 1000 + math.floor(now[2] / 1000)
+return {0, redis.call("ZCOUNT", KEYS[1], ms, "+inf")}
+`)
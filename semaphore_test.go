@@ -0,0 +1,115 @@
+package grt_test
+
+import (
+	"context"
+	"github.com/alecthomas/grt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSemaphoreLimit(t *testing.T) {
+	_, pool := newPool(t)
+	sem := grt.NewSemaphore(pool, "semaphore", 3)
+	if n, err := sem.Available(); n != 3 || err != nil {
+		t.Fatal(n, err)
+	}
+	var holders, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := sem.Acquire(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			n := atomic.AddInt32(&holders, 1)
+			for {
+				if p := atomic.LoadInt32(&peak); n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&holders, -1)
+			if err := release(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if peak != 3 {
+		t.Fatal("peak holders", peak)
+	}
+	if n, err := sem.Available(); n != 3 || err != nil {
+		t.Fatal(n, err)
+	}
+}
+
+func TestSemaphoreFull(t *testing.T) {
+	_, pool := newPool(t)
+	sem := grt.NewSemaphore(pool, "semaphore", 2)
+	releases := []func() error{}
+	for i := 0; i < 2; i++ {
+		release, err := sem.Acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, release)
+	}
+	if n, err := sem.Available(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := sem.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if release, err := sem.TryAcquire(); release != nil || err != nil {
+		t.Fatal(err)
+	}
+	if err := releases[0](); err != nil {
+		t.Fatal(err)
+	}
+	if err := releases[0](); err != grt.ErrNotLocked {
+		t.Fatal(err)
+	}
+	release, err := sem.TryAcquire()
+	if release == nil || err != nil {
+		t.Fatal(err)
+	}
+	for _, release := range []func() error{release, releases[1]} {
+		if err := release(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSemaphoreCrashedHolders(t *testing.T) {
+	s, pool := newPool(t)
+	sem := grt.NewSemaphore(pool, "semaphore", 3)
+	// Waiters retry every Expiry.
+	sem.Expiry = 400 * time.Millisecond
+	// Holders that crashed leave leases that are no longer renewed.
+	deadline := float64(time.Now().Add(200 * time.Millisecond).UnixMilli())
+	for _, holder := range []string{"dead1", "dead2", "dead3"} {
+		s.ZAdd("semaphore", deadline, holder)
+	}
+	start := time.Now()
+	release, err := sem.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Fatal(elapsed)
+	}
+	// Their leases were pruned by the acquisition.
+	if n, err := sem.Available(); n != 2 || err != nil {
+		t.Fatal(n, err)
+	}
+	if err := release(); err != nil {
+		t.Fatal(err)
+	}
+}
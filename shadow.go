@@ -0,0 +1,370 @@
+package grt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Number of mirrored operations a ShadowQueue buffers for its shadow
+	// before dropping them.
+	shadowBufferSize = 1024
+	// How often a ShadowQueue compares its queues.
+	shadowCompareInterval = 10 * time.Second
+	// Number of recently submitted jobs whose membership is compared.
+	shadowSampleSize = 16
+)
+
+// Divergence is a difference in behaviour between a ShadowQueue's primary
+// and shadow.
+type Divergence struct {
+	// What diverged: "submit" if a mirrored Submit had a different outcome,
+	// "retrieve" if a job retrieved from the primary was not retrieved from
+	// the shadow in its place, "len" if the number of waiting jobs differed,
+	// or "membership" if a recently submitted job was queued in one but not
+	// the other.
+	Kind string
+	// The job concerned, for "submit" and "membership", or its key for
+	// "retrieve".
+	Job interface{}
+	// What the primary and shadow reported.
+	Primary string
+	Shadow  string
+}
+
+func (d Divergence) String() string {
+	if d.Job == nil {
+		return fmt.Sprintf("%s: primary %s, shadow %s", d.Kind, d.Primary, d.Shadow)
+	}
+	return fmt.Sprintf("%s of %v: primary %s, shadow %s", d.Kind, d.Job, d.Primary, d.Shadow)
+}
+
+// ShadowQueue is a Queue that mirrors the traffic of a primary queue to a
+// shadow, eg. a queue with a different backend or options, and reports where
+// their behaviour diverges, to verify a migration against production traffic.
+// Create with NewShadowQueue.
+//
+// The primary is authoritative: every call is answered by it alone, and
+// retrieval only ever returns its jobs. Submits, retrievals and their Work
+// being finalized are mirrored to the shadow asynchronously, in order,
+// through a bounded buffer, so the shadow never adds more than an enqueue to
+// the primary's latency; operations arriving while the buffer is full are
+// dropped and counted by Dropped, after which the queues are expected to
+// diverge. Both queues must key jobs alike, eg. with a JobQueueKeyer when
+// only one uses WithHashedKeys.
+//
+// Every ten seconds, and on Compare, the queues' lengths and the membership
+// of recently submitted jobs are compared once the shadow has caught up.
+type ShadowQueue struct {
+	primary Queue
+	shadow  Queue
+	report  func(Divergence)
+
+	ops     chan shadowOp
+	dropped int64
+	done    chan struct{}
+	stopped chan struct{}
+
+	lock sync.Mutex
+	// Recently submitted jobs, for membership comparison.
+	recent []interface{}
+	// Shadow Work retrieved in step with the primary's, by key.
+	pending map[string]*Work
+}
+
+var _ Queue = &ShadowQueue{}
+
+// shadowOp is an operation mirrored to the shadow.
+type shadowOp struct {
+	submit   func(q Queue) error
+	job      interface{}
+	err      error
+	retrieve bool
+	key      []byte
+	outcome  WorkOutcome
+	compare  *shadowComparison
+}
+
+// shadowComparison is the primary's side of a comparison, completed by the
+// mirror once the shadow has caught up.
+type shadowComparison struct {
+	len     int
+	lenErr  error
+	jobs    []interface{}
+	queued  []bool
+	checked chan struct{}
+}
+
+// NewShadowQueue mirrors primary's traffic to shadow until Close is called,
+// calling report from a background goroutine with each divergence found.
+func NewShadowQueue(primary, shadow Queue, report func(Divergence)) *ShadowQueue {
+	s := &ShadowQueue{
+		primary: primary,
+		shadow:  shadow,
+		report:  report,
+		ops:     make(chan shadowOp, shadowBufferSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		pending: map[string]*Work{},
+	}
+	go s.mirror()
+	return s
+}
+
+// Close stops mirroring and comparing, once the operations already buffered
+// have been mirrored. It does not close either queue.
+func (s *ShadowQueue) Close() error {
+	close(s.done)
+	<-s.stopped
+	return nil
+}
+
+// Dropped returns the number of operations dropped because the buffer was
+// full.
+func (s *ShadowQueue) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Compare compares the queues once the shadow has caught up with the
+// operations mirrored so far, reporting any divergence before returning.
+func (s *ShadowQueue) Compare() {
+	comparison := s.comparison()
+	select {
+	case s.ops <- shadowOp{compare: comparison}:
+	case <-s.stopped:
+		return
+	}
+	select {
+	case <-comparison.checked:
+	case <-s.stopped:
+	}
+}
+
+// comparison samples the primary.
+func (s *ShadowQueue) comparison() *shadowComparison {
+	c := &shadowComparison{checked: make(chan struct{})}
+	c.len, c.lenErr = s.primary.Len()
+	s.lock.Lock()
+	c.jobs = append(c.jobs, s.recent...)
+	s.lock.Unlock()
+	c.queued = make([]bool, len(c.jobs))
+	for i, job := range c.jobs {
+		c.queued[i], _ = s.primary.IsQueued(job)
+	}
+	return c
+}
+
+// enqueue buffers op for the shadow, dropping it if the buffer is full.
+func (s *ShadowQueue) enqueue(op shadowOp) {
+	select {
+	case s.ops <- op:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+func (s *ShadowQueue) mirror() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(shadowCompareInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case op := <-s.ops:
+			s.apply(op)
+		case <-ticker.C:
+			s.enqueue(shadowOp{compare: s.comparison()})
+		case <-s.done:
+			for {
+				select {
+				case op := <-s.ops:
+					s.apply(op)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// apply mirrors op to the shadow, reporting any divergence.
+func (s *ShadowQueue) apply(op shadowOp) {
+	switch {
+	case op.submit != nil:
+		err := op.submit(s.shadow)
+		if primary, shadow := submitOutcome(op.err), submitOutcome(err); primary != shadow {
+			s.report(Divergence{Kind: "submit", Job: op.job, Primary: primary, Shadow: shadow})
+		}
+	case op.retrieve:
+		work, err := s.shadow.TryGet(nil)
+		switch {
+		case err != nil:
+			s.report(Divergence{Kind: "retrieve", Job: string(op.key), Primary: "retrieved", Shadow: err.Error()})
+		case work == nil:
+			s.report(Divergence{Kind: "retrieve", Job: string(op.key), Primary: "retrieved", Shadow: "nothing waiting"})
+		default:
+			s.pending[string(work.Key())] = work
+		}
+	case op.compare != nil:
+		s.compare(op.compare)
+	default:
+		s.finalize(op.key, op.outcome)
+	}
+}
+
+// finalize finalizes the shadow's Work for key as the primary's was.
+func (s *ShadowQueue) finalize(key []byte, outcome WorkOutcome) {
+	work, ok := s.pending[string(key)]
+	if !ok {
+		s.report(Divergence{Kind: "retrieve", Job: string(key), Primary: "retrieved", Shadow: "not retrieved"})
+		return
+	}
+	delete(s.pending, string(key))
+	if outcome == WorkResubmitted {
+		work.Resubmit()
+	} else {
+		work.Complete()
+	}
+}
+
+func (s *ShadowQueue) compare(c *shadowComparison) {
+	defer close(c.checked)
+	if n, err := s.shadow.Len(); c.lenErr == nil && err == nil && n != c.len {
+		s.report(Divergence{Kind: "len", Primary: fmt.Sprint(c.len), Shadow: fmt.Sprint(n)})
+	}
+	for i, job := range c.jobs {
+		if queued, err := s.shadow.IsQueued(job); err == nil && queued != c.queued[i] {
+			s.report(Divergence{Kind: "membership", Job: job, Primary: queuedString(c.queued[i]), Shadow: queuedString(queued)})
+		}
+	}
+}
+
+func queuedString(queued bool) string {
+	if queued {
+		return "queued"
+	}
+	return "not queued"
+}
+
+// submitOutcome describes the outcome of a Submit for comparison.
+func submitOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "submitted"
+	case errors.Is(err, ErrAlreadyQueued):
+		return "already queued"
+	case errors.Is(err, ErrRecentlyCompleted):
+		return "recently completed"
+	}
+	return "failed: " + err.Error()
+}
+
+// submitted mirrors a Submit to the primary that returned err, unless it
+// failed for reasons of its own, eg. Redis being unavailable.
+func (s *ShadowQueue) submitted(job interface{}, err error, submit func(q Queue) error) error {
+	if err != nil && !errors.Is(err, ErrAlreadyQueued) && !errors.Is(err, ErrRecentlyCompleted) {
+		return err
+	}
+	if err == nil {
+		s.lock.Lock()
+		s.recent = append(s.recent, job)
+		if len(s.recent) > shadowSampleSize {
+			s.recent = s.recent[1:]
+		}
+		s.lock.Unlock()
+	}
+	s.enqueue(shadowOp{submit: submit, job: job, err: err})
+	return err
+}
+
+// retrieved mirrors the retrieval of work from the primary, and arranges for
+// its finalization to be mirrored.
+func (s *ShadowQueue) retrieved(work *Work, err error) (*Work, error) {
+	if work == nil {
+		return work, err
+	}
+	key := work.Key()
+	s.enqueue(shadowOp{retrieve: true, key: key})
+	work.lock.Lock()
+	work.onFinalize = func(outcome WorkOutcome) {
+		if outcome != WorkPending {
+			s.enqueue(shadowOp{key: key, outcome: outcome})
+		}
+	}
+	work.lock.Unlock()
+	return work, err
+}
+
+// Submit submits job to the primary, mirroring it to the shadow.
+func (s *ShadowQueue) Submit(job interface{}) error {
+	return s.submitted(job, s.primary.Submit(job), func(q Queue) error { return q.Submit(job) })
+}
+
+// SubmitContext submits job to the primary with ctx, mirroring it to the
+// shadow.
+func (s *ShadowQueue) SubmitContext(ctx context.Context, job interface{}) error {
+	// The shadow's Submit is not bound to ctx, which may be done by the time
+	// it is mirrored.
+	return s.submitted(job, s.primary.SubmitContext(ctx, job), func(q Queue) error { return q.Submit(job) })
+}
+
+// SubmitAt submits a delayed job to the primary, mirroring it to the shadow.
+func (s *ShadowQueue) SubmitAt(job interface{}, at time.Time) error {
+	return s.submitted(job, s.primary.SubmitAt(job, at), func(q Queue) error { return q.SubmitAt(job, at) })
+}
+
+// SubmitAfter submits a delayed job to the primary, mirroring it to the
+// shadow.
+func (s *ShadowQueue) SubmitAfter(job interface{}, d time.Duration) error {
+	return s.submitted(job, s.primary.SubmitAfter(job, d), func(q Queue) error { return q.SubmitAfter(job, d) })
+}
+
+// SubmitWithTTL submits a job with a TTL to the primary, mirroring it to the
+// shadow.
+func (s *ShadowQueue) SubmitWithTTL(job interface{}, ttl time.Duration) error {
+	return s.submitted(job, s.primary.SubmitWithTTL(job, ttl), func(q Queue) error { return q.SubmitWithTTL(job, ttl) })
+}
+
+// Get retrieves a job from the primary. See JobQueue.Get.
+func (s *ShadowQueue) Get(v interface{}) (*Work, error) {
+	return s.retrieved(s.primary.Get(v))
+}
+
+// TryGet retrieves a job from the primary without waiting. See
+// JobQueue.TryGet.
+func (s *ShadowQueue) TryGet(v interface{}) (*Work, error) {
+	return s.retrieved(s.primary.TryGet(v))
+}
+
+// GetWait retrieves a job from the primary, waiting at most timeout. See
+// JobQueue.GetWait.
+func (s *ShadowQueue) GetWait(v interface{}, timeout time.Duration) (*Work, error) {
+	return s.retrieved(s.primary.GetWait(v, timeout))
+}
+
+// GetContext retrieves a job from the primary, waiting until ctx is done. See
+// JobQueue.GetContext.
+func (s *ShadowQueue) GetContext(ctx context.Context, v interface{}) (*Work, error) {
+	return s.retrieved(s.primary.GetContext(ctx, v))
+}
+
+// Len returns the length of the primary.
+func (s *ShadowQueue) Len() (int, error) {
+	return s.primary.Len()
+}
+
+// IsQueued checks whether job is queued or in progress on the primary.
+func (s *ShadowQueue) IsQueued(job interface{}) (bool, error) {
+	return s.primary.IsQueued(job)
+}
+
+// Run runs the primary's Run, mirroring each job its workers retrieve.
+func (s *ShadowQueue) Run(ctx context.Context, concurrency int, handler Handler) error {
+	return s.primary.Run(ctx, concurrency, func(ctx context.Context, work *Work, decode func(v interface{}) error) error {
+		s.retrieved(work, nil)
+		return handler(ctx, work, decode)
+	})
+}
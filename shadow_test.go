@@ -0,0 +1,155 @@
+package grt_test
+
+import (
+	"errors"
+	"github.com/alecthomas/grt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyQueue silently drops every third Submit and fails every fifth.
+type lossyQueue struct {
+	*grt.MemoryJobQueue
+	n int
+}
+
+func (q *lossyQueue) Submit(job interface{}) error {
+	q.n++
+	switch {
+	case q.n%3 == 0:
+		return nil
+	case q.n%5 == 0:
+		return errors.New("shadow unavailable")
+	}
+	return q.MemoryJobQueue.Submit(job)
+}
+
+// stalledQueue blocks every Submit until released.
+type stalledQueue struct {
+	*grt.MemoryJobQueue
+	release chan struct{}
+}
+
+func (q *stalledQueue) Submit(job interface{}) error {
+	<-q.release
+	return q.MemoryJobQueue.Submit(job)
+}
+
+// divergences collects reported divergences by kind.
+type divergences struct {
+	lock  sync.Mutex
+	kinds map[string]int
+}
+
+func (d *divergences) report(divergence grt.Divergence) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.kinds == nil {
+		d.kinds = map[string]int{}
+	}
+	d.kinds[divergence.Kind]++
+}
+
+func (d *divergences) count(kind string) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.kinds[kind]
+}
+
+func TestShadowQueueDetectsDivergence(t *testing.T) {
+	primary := grt.NewMemoryJobQueue("primary")
+	found := &divergences{}
+	s := grt.NewShadowQueue(primary, &lossyQueue{MemoryJobQueue: grt.NewMemoryJobQueue("shadow")}, found.report)
+	defer s.Close()
+	for i := 0; i < 6; i++ {
+		if err := s.Submit(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Submit(1); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	s.Compare()
+	for i := 0; i < 6; i++ {
+		var job int
+		w, err := s.TryGet(&job)
+		if err != nil || job != i {
+			t.Fatal(job, err)
+		}
+		if err := w.Complete(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Compare()
+	if n, err := primary.Len(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+	for _, kind := range []string{"submit", "len", "membership", "retrieve"} {
+		if found.count(kind) == 0 {
+			t.Errorf("no %s divergence reported: %v", kind, found.kinds)
+		}
+	}
+}
+
+func TestShadowQueueAgrees(t *testing.T) {
+	s := grt.NewShadowQueue(grt.NewMemoryJobQueue("primary"), grt.NewMemoryJobQueue("shadow"), func(d grt.Divergence) { t.Error(d) })
+	defer s.Close()
+	for i := 0; i < 5; i++ {
+		if err := s.Submit(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Submit(2); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	w, err := s.TryGet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Resubmit(); err != nil {
+		t.Fatal(err)
+	}
+	w, err = s.TryGet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	s.Compare()
+}
+
+func TestShadowQueueStalledShadow(t *testing.T) {
+	primary := grt.NewMemoryJobQueue("primary")
+	shadow := &stalledQueue{MemoryJobQueue: grt.NewMemoryJobQueue("shadow"), release: make(chan struct{})}
+	s := grt.NewShadowQueue(primary, shadow, func(grt.Divergence) {})
+	const jobs = 5000
+	start := time.Now()
+	for i := 0; i < jobs; i++ {
+		if err := s.Submit(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("submits took %s behind a stalled shadow", elapsed)
+	}
+	if n, err := primary.Len(); n != jobs || err != nil {
+		t.Fatal(n, err)
+	}
+	if s.Dropped() == 0 {
+		t.Fatal("no operations were dropped")
+	}
+	close(shadow.release)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var job int
+	w, err := primary.TryGet(&job)
+	if err != nil || job != 0 {
+		t.Fatal(job, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
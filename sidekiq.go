@@ -0,0 +1,117 @@
+package grt
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// SidekiqBridge consumes jobs from a Sidekiq queue, so that Go workers can
+// drain queues written by Ruby services. It is read-only: jobs cannot be
+// submitted through it.
+//
+// Jobs are moved atomically from Sidekiq's list to a processing list managed
+// by grt ("queue:<name>:processing"), so a crashed worker does not lose them;
+// call Cleanup on startup to return them to Sidekiq's list. Scheduled jobs
+// and Sidekiq retries for the queue are promoted to the list when due.
+//
+// Sidekiq's retry and dead sets are otherwise not managed: Work.Resubmit
+// returns a job to the end of Sidekiq's list for immediate retry, and
+// Work.Complete discards it.
+type SidekiqBridge struct {
+	queue *JobQueue
+	name  string
+	// How often scheduled jobs are promoted while waiting for work.
+	PollInterval time.Duration
+}
+
+// NewSidekiqBridge creates a bridge consuming the Sidekiq queue named
+// sidekiqQueue (without Sidekiq's "queue:" prefix).
+func NewSidekiqBridge(pool *redis.Pool, sidekiqQueue string) *SidekiqBridge {
+	return &SidekiqBridge{
+		queue:        NewJobQueue(pool, "queue:"+sidekiqQueue),
+		name:         sidekiqQueue,
+		PollInterval: time.Second * 5,
+	}
+}
+
+// Cleanup returns jobs abandoned by crashed workers to Sidekiq's list.
+func (s *SidekiqBridge) Cleanup() error {
+	return s.queue.Cleanup()
+}
+
+// Get the next job from the Sidekiq queue, decoding its arguments array into
+// v if it is not nil. The raw Sidekiq job is available from
+// Work.PayloadReader().
+func (s *SidekiqBridge) Get(v interface{}) (*Work, error) {
+	c := s.queue
+	for {
+		raw, err := s.pop()
+		if err == redis.ErrNil {
+			if isSingleConn(c.pool) {
+				time.Sleep(singleConnPollInterval)
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		work := &Work{pool: c.pool, Queue: c.Queue, key: raw, queue: c, record: raw}
+		if v != nil {
+			var job struct {
+				Args json.RawMessage `json:"args"`
+			}
+			if err = json.Unmarshal(raw, &job); err == nil {
+				err = json.Unmarshal(job.Args, v)
+			}
+		}
+		if err != nil {
+			if rerr := work.Resubmit(); rerr != nil {
+				return nil, fmt.Errorf("could not decode Sidekiq job arguments: %w (could not resubmit %s: %s)", err, work, rerr)
+			}
+			return nil, fmt.Errorf("could not decode Sidekiq job arguments: %w", err)
+		}
+		return work, nil
+	}
+}
+
+// pop promotes due jobs then waits up to PollInterval for a job, or does not
+// wait at all on a single connection pool, returning redis.ErrNil if there is
+// none.
+func (s *SidekiqBridge) pop() ([]byte, error) {
+	c := s.queue
+	r := getConn(c.pool, "SidekiqBridge.Get")
+	defer r.Close()
+	if _, err := sidekiqPromoteScript.do(r, "schedule", "retry", c.Queue, s.name); err != nil {
+		return nil, err
+	}
+	if isSingleConn(c.pool) {
+		return redis.Bytes(r.Do("RPOPLPUSH", c.Queue, c.Queue+":processing"))
+	}
+	poll := int(s.PollInterval / time.Second)
+	if poll < 1 {
+		poll = 1
+	}
+	return redis.Bytes(r.Do("BRPOPLPUSH", c.Queue, c.Queue+":processing", poll))
+}
+
+// KEYS: schedule set, retry set, queue list. ARGV: queue name.
+//
+// Members of the sets are Sidekiq jobs scored by the time they are due.
+// Sidekiq's own scheduler may be promoting concurrently; only the process
+// that removes a job from its set pushes it.
+var sidekiqPromoteScript = newLuaScript("sidekiq_promote", 1, 3, `
+redis.replicate_commands()
+local now = redis.call("TIME")
+local due = tonumber(now[1]) + tonumber(now[2]) / 1000000
+for i = 1, 2 do
+  local jobs = redis.call("ZRANGEBYSCORE", KEYS[i], "-inf", due, "LIMIT", 0, 100)
+  for _, raw in ipairs(jobs) do
+    local ok, job = pcall(cjson.decode, raw)
+    if ok and job.queue == ARGV[1] and redis.call("ZREM", KEYS[i], raw) == 1 then
+      redis.call("LPUSH", KEYS[3], raw)
+    end
+  end
+end
+return {0}
+`)
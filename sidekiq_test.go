@@ -0,0 +1,136 @@
+package grt_test
+
+import (
+	"bytes"
+	"github.com/alecthomas/grt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sidekiqFixture returns a job as stored by Sidekiq, from testdata/sidekiq.
+func sidekiqFixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "sidekiq", name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bytes.TrimSpace(data))
+}
+
+func TestSidekiqBridge(t *testing.T) {
+	s, pool := newPool(t)
+	enqueued := sidekiqFixture(t, "enqueued")
+	s.Lpush("queue:default", enqueued)
+	bridge := grt.NewSidekiqBridge(pool, "default")
+	var args []interface{}
+	w, err := bridge.Get(&args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 2 || args[0] != "bob" || args[1] != float64(5) {
+		t.Fatal(args)
+	}
+	// The raw Sidekiq job is available as is.
+	rc, err := w.PayloadReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := &bytes.Buffer{}
+	raw.ReadFrom(rc)
+	rc.Close()
+	if raw.String() != enqueued {
+		t.Fatal(raw)
+	}
+	if processing, _ := s.List("queue:default:processing"); len(processing) != 1 || s.Exists("queue:default") {
+		t.Fatal(processing)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists("queue:default:processing") || s.Exists("queue:default") {
+		t.Fatal(s.Keys())
+	}
+}
+
+func TestSidekiqBridgeCrashRecovery(t *testing.T) {
+	s, pool := newPool(t)
+	s.Lpush("queue:default", sidekiqFixture(t, "enqueued"))
+	bridge := grt.NewSidekiqBridge(pool, "default")
+	if _, err := bridge.Get(nil); err != nil {
+		t.Fatal(err)
+	}
+	// The worker crashes before finishing; a new one cleans up on startup.
+	if err := grt.NewSidekiqBridge(pool, "default").Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	var args []interface{}
+	w, err := bridge.Get(&args)
+	if err != nil || args[0] != "bob" {
+		t.Fatal(args, err)
+	}
+	if err := w.Resubmit(); err != nil {
+		t.Fatal(err)
+	}
+	if w, err = bridge.Get(&args); err != nil || args[0] != "bob" {
+		t.Fatal(args, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSidekiqBridgePromotesDueJobs(t *testing.T) {
+	s, pool := newPool(t)
+	s.ZAdd("schedule", 1, sidekiqFixture(t, "scheduled"))
+	s.ZAdd("schedule", 1, sidekiqFixture(t, "other-queue"))
+	s.ZAdd("retry", 1, sidekiqFixture(t, "retry"))
+	notDue := float64(time.Now().Add(time.Hour).Unix())
+	s.ZAdd("schedule", notDue, `{"retry":true,"queue":"default","class":"HardWorker","args":["future",0],"jid":"f0"}`)
+	bridge := grt.NewSidekiqBridge(pool, "default")
+	got := map[interface{}]bool{}
+	for i := 0; i < 2; i++ {
+		var args []interface{}
+		w, err := bridge.Get(&args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[args[0]] = true
+		if err := w.Complete(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !got["later"] || !got["flaky"] {
+		t.Fatal(got)
+	}
+	// Jobs for other queues, and those not yet due, are left to Sidekiq.
+	if scheduled, _ := s.ZMembers("schedule"); len(scheduled) != 2 {
+		t.Fatal(scheduled)
+	}
+	if retries, _ := s.ZMembers("retry"); len(retries) != 0 {
+		t.Fatal(retries)
+	}
+}
+
+func TestSidekiqBridgeUndecodable(t *testing.T) {
+	s, pool := newPool(t)
+	s.Lpush("queue:mailers", sidekiqFixture(t, "other-queue"))
+	bridge := grt.NewSidekiqBridge(pool, "mailers")
+	var args []string
+	if _, err := bridge.Get(&args); err == nil {
+		t.Fatal("expected a decoding error")
+	}
+	// The job is returned to Sidekiq's list rather than lost.
+	if queued, _ := s.List("queue:mailers"); len(queued) != 1 || s.Exists("queue:mailers:processing") {
+		t.Fatal(queued)
+	}
+	var mail []map[string]int
+	w, err := bridge.Get(&mail)
+	if err != nil || mail[0]["user_id"] != 42 {
+		t.Fatal(mail, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,48 @@
+package grt
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"sync"
+	"time"
+)
+
+// How often blocking operations poll on a single connection pool.
+const singleConnPollInterval = 100 * time.Millisecond
+
+// singleConnPools records pools created by NewSingleConnPool.
+var singleConnPools sync.Map
+
+// NewSingleConnPool wraps a single connection in a pool, for tools and tests
+// that have exactly one connection to Redis.
+//
+// Operations are serialised over the connection: each waits until no other
+// operation is using it. Blocking operations (JobQueue.Get and
+// SidekiqBridge.Get) poll instead of blocking so they do not starve other
+// callers, at the cost of up to 100ms of added latency per job, and every
+// operation's latency includes the time spent waiting for the connection.
+// Throughput is limited to one round trip at a time across the process.
+//
+// The connection is not closed by the pool. SelfTest is not supported.
+func NewSingleConnPool(conn redis.Conn) *redis.Pool {
+	shared := &sharedConn{Conn: conn}
+	pool := &redis.Pool{
+		MaxIdle:   1,
+		MaxActive: 1,
+		Wait:      true,
+		Dial:      func() (redis.Conn, error) { return shared, nil },
+	}
+	singleConnPools.Store(pool, true)
+	return pool
+}
+
+func isSingleConn(pool *redis.Pool) bool {
+	_, ok := singleConnPools.Load(pool)
+	return ok
+}
+
+// sharedConn is a connection the pool does not own.
+type sharedConn struct {
+	redis.Conn
+}
+
+func (s *sharedConn) Close() error { return nil }
@@ -0,0 +1,138 @@
+package grt_test
+
+import (
+	"fmt"
+	"github.com/alecthomas/grt"
+	"github.com/garyburd/redigo/redis"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newSingleConnPool(t *testing.T) *redis.Pool {
+	s, _ := newPool(t)
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return grt.NewSingleConnPool(conn)
+}
+
+func TestSingleConnCycle(t *testing.T) {
+	pool := newSingleConnPool(t)
+	q := grt.NewJobQueue(pool, "single")
+	if w, err := q.TryGet(nil); w != nil || err != nil {
+		t.Fatal(w, err)
+	}
+	// A lock renewed in the background shares the connection throughout.
+	lock := grt.NewLock(pool, "single-lock")
+	lock.Expiry = 100 * time.Millisecond
+	if err := lock.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	const jobs = 50
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < jobs; i++ {
+			if err := q.Submit(fmt.Sprint(i)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	var seenLock sync.Mutex
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				seenLock.Lock()
+				finished := len(seen) == jobs
+				seenLock.Unlock()
+				if finished {
+					return
+				}
+				var job string
+				w, err := q.TryGet(&job)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if w == nil {
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				if err := w.Complete(); err != nil {
+					t.Error(err)
+					return
+				}
+				seenLock.Lock()
+				seen[job] = true
+				seenLock.Unlock()
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlocked")
+	}
+	if !lock.Held() {
+		t.Fatal("lock was lost while the connection was shared")
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := q.Len(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+}
+
+func TestSingleConnBlockingGet(t *testing.T) {
+	pool := newSingleConnPool(t)
+	q := grt.NewJobQueue(pool, "single")
+	got := make(chan string, 1)
+	go func() {
+		var job string
+		w, err := q.Get(&job)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := w.Complete(); err != nil {
+			t.Error(err)
+		}
+		got <- job
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// Get polls rather than holding the connection, so other operations
+	// proceed while it waits.
+	start := time.Now()
+	if n, err := q.Len(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+	if err := q.Submit("blocking"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("starved by Get for", elapsed)
+	}
+	select {
+	case job := <-got:
+		if job != "blocking" {
+			t.Fatal(job)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get did not receive the job")
+	}
+}
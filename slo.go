@@ -0,0 +1,203 @@
+package grt
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SLOTrend is the direction a queue's backlog is moving in.
+type SLOTrend int
+
+// SLO trends.
+const (
+	SLOSteady SLOTrend = iota
+	SLOImproving
+	SLOWorsening
+)
+
+func (t SLOTrend) String() string {
+	switch t {
+	case SLOSteady:
+		return "steady"
+	case SLOImproving:
+		return "improving"
+	case SLOWorsening:
+		return "worsening"
+	}
+	return fmt.Sprintf("SLOTrend(%d)", int(t))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t SLOTrend) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// SLOReport compares a queue's backlog against its service level objectives.
+type SLOReport struct {
+	// Number of jobs waiting to be processed.
+	Depth int `json:"depth"`
+	// Age of the oldest waiting job, measured from its first submission.
+	OldestAge  time.Duration `json:"oldest_age"`
+	MaxDepth   int           `json:"max_depth"`
+	MaxLatency time.Duration `json:"max_latency"`
+	Breached   bool          `json:"breached"`
+	// Trend over recent samples.
+	Trend SLOTrend `json:"trend"`
+}
+
+const (
+	// Number of samples kept for computing the trend.
+	sloSamples = 8
+	// Number of consecutive samples required to change breach state.
+	sloDebounce = 2
+)
+
+type slo struct {
+	maxLatency time.Duration
+	maxDepth   int
+	interval   time.Duration
+	onBreach   func(SLOReport)
+
+	lock    sync.Mutex
+	samples []SLOReport
+	// Breach state last notified, and the number of consecutive samples
+	// that disagreed with it.
+	breached bool
+	streak   int
+}
+
+// WithSLO sets service level objectives for the queue: the oldest waiting
+// job should be no older than maxQueueLatency, and no more than maxDepth
+// jobs should be waiting. Zero disables either objective. Use
+// JobQueue.SLOStatus to evaluate them.
+func WithSLO(maxQueueLatency time.Duration, maxDepth int) Option {
+	return func(c *JobQueue) {
+		if c.slo == nil {
+			c.slo = &slo{}
+		}
+		c.slo.maxLatency = maxQueueLatency
+		c.slo.maxDepth = maxDepth
+	}
+}
+
+// OnSLOBreach samples the queue's SLO status every interval in the
+// background, calling fn when the objectives set by WithSLO are first
+// breached and when they recover. A state change must persist for two
+// consecutive samples before fn is called. Call Close to stop sampling.
+func OnSLOBreach(interval time.Duration, fn func(SLOReport)) Option {
+	return func(c *JobQueue) {
+		if c.slo == nil {
+			c.slo = &slo{}
+		}
+		c.slo.interval = interval
+		c.slo.onBreach = fn
+	}
+}
+
+// SLOStatus evaluates the queue's backlog against the objectives set with
+// WithSLO, and records the sample for trend calculation.
+func (c *JobQueue) SLOStatus() (SLOReport, error) {
+	if c.slo == nil {
+		return SLOReport{}, fmt.Errorf("no SLO configured for queue %s", c.Queue)
+	}
+	r := getConn(c.pool, "JobQueue.SLOStatus")
+	defer r.Close()
+	reply, err := oldestScript.do(r, c.Queue+":enqueued", c.Queue, c.priorityList(PriorityHigh), c.priorityList(PriorityLow))
+	if err != nil {
+		return SLOReport{}, err
+	}
+	depth, age := reply[0].(int64), reply[1].(int64)
+	report := SLOReport{
+		Depth:      int(depth),
+		MaxDepth:   c.slo.maxDepth,
+		MaxLatency: c.slo.maxLatency,
+	}
+	if age > 0 {
+		report.OldestAge = time.Duration(age) * time.Millisecond
+	}
+	report.Breached = (report.MaxDepth > 0 && report.Depth > report.MaxDepth) ||
+		(report.MaxLatency > 0 && report.OldestAge > report.MaxLatency)
+	return c.slo.record(report), nil
+}
+
+// KEYS: enqueued-at hash, waiting lists. Returns the total depth and the age
+// in milliseconds of the oldest waiting job, or -1 if unknown.
+var oldestScript = newLuaScript("oldest", 1, 4, `
+local depth, oldest = 0, nil
+for i = 2, #KEYS do
+  depth = depth + redis.call("LLEN", KEYS[i])
+  local key = redis.call("LINDEX", KEYS[i], -1)
+  local enqueued = key and redis.call("HGET", KEYS[1], key)
+  if enqueued and (not oldest or tonumber(enqueued) < oldest) then
+    oldest = tonumber(enqueued)
+  end
+end
+if not oldest then
+  return {0, depth, -1}
+end
+local now = redis.call("TIME")
+return {0, depth, now[1] * 1000 + math.floor(now[2] / 1000) - oldest}
+`)
+
+// record adds report to the samples and fills in its trend.
+func (s *slo) record(report SLOReport) SLOReport {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.samples) > 0 {
+		first := s.samples[0]
+		switch {
+		case report.Depth >= first.Depth && report.OldestAge >= first.OldestAge &&
+			(report.Depth > first.Depth || report.OldestAge > first.OldestAge):
+			report.Trend = SLOWorsening
+		case report.Depth <= first.Depth && report.OldestAge <= first.OldestAge &&
+			(report.Depth < first.Depth || report.OldestAge < first.OldestAge):
+			report.Trend = SLOImproving
+		}
+	}
+	s.samples = append(s.samples, report)
+	if len(s.samples) > sloSamples {
+		s.samples = s.samples[1:]
+	}
+	return report
+}
+
+// transition returns true if report changes the debounced breach state.
+func (s *slo) transition(report SLOReport) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if report.Breached == s.breached {
+		s.streak = 0
+		return false
+	}
+	s.streak++
+	if s.streak < sloDebounce {
+		return false
+	}
+	s.breached = report.Breached
+	s.streak = 0
+	return true
+}
+
+// startSLOSampler starts sampling the SLO in the background if a breach
+// callback is configured.
+func (c *JobQueue) startSLOSampler() {
+	if c.slo == nil || c.slo.onBreach == nil {
+		return
+	}
+	c.schedule(c.slo.interval, func() bool {
+		c.sampleSLO()
+		return true
+	})
+}
+
+// sampleSLO evaluates the SLO, calling the breach callback on a transition.
+func (c *JobQueue) sampleSLO() {
+	report, err := c.SLOStatus()
+	if err != nil {
+		return
+	}
+	if c.slo.transition(report) {
+		c.slo.onBreach(report)
+	}
+}
@@ -0,0 +1,121 @@
+package grt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSLODebounce(t *testing.T) {
+	s := &slo{}
+	breached, ok := SLOReport{Breached: true}, SLOReport{}
+	for i, test := range []struct {
+		report SLOReport
+		notify bool
+	}{
+		{ok, false},
+		{breached, false},
+		// A single breached sample is a blip.
+		{ok, false},
+		{breached, false},
+		{breached, true},
+		{breached, false},
+		{ok, false},
+		{ok, true},
+		{ok, false},
+	} {
+		if notify := s.transition(test.report); notify != test.notify {
+			t.Fatalf("sample %d: notified %v, want %v", i, notify, test.notify)
+		}
+	}
+}
+
+func TestSLOTrend(t *testing.T) {
+	s := &slo{}
+	for i, test := range []struct {
+		depth int
+		trend SLOTrend
+	}{
+		{5, SLOSteady},
+		{6, SLOWorsening},
+		{5, SLOSteady},
+		{3, SLOImproving},
+	} {
+		if report := s.record(SLOReport{Depth: test.depth}); report.Trend != test.trend {
+			t.Fatalf("sample %d: %s, want %s", i, report.Trend, test.trend)
+		}
+	}
+	// The trend is measured over a bounded window of samples.
+	for i := 0; i < 2*sloSamples; i++ {
+		s.record(SLOReport{Depth: 1})
+	}
+	if report := s.record(SLOReport{Depth: 1}); report.Trend != SLOSteady || len(s.samples) != sloSamples {
+		t.Fatal(report.Trend, len(s.samples))
+	}
+}
+
+func TestSLOBreachAndRecovery(t *testing.T) {
+	s, pool := newTestPool(t)
+	now := time.Now()
+	s.SetTime(now)
+	var notified []SLOReport
+	q := NewJobQueue(pool, "slo", WithSLO(time.Minute, 2), OnSLOBreach(time.Hour, func(r SLOReport) { notified = append(notified, r) }))
+	defer q.Close()
+	sample := func(n int) {
+		for i := 0; i < n; i++ {
+			q.sampleSLO()
+		}
+	}
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	sample(2)
+	if len(notified) != 0 {
+		t.Fatal(notified)
+	}
+
+	// The oldest job falls behind by Redis's clock.
+	now = now.Add(2 * time.Minute)
+	s.SetTime(now)
+	sample(1)
+	if len(notified) != 0 {
+		t.Fatal("notified before the breach persisted", notified)
+	}
+	sample(1)
+	if len(notified) != 1 || !notified[0].Breached || notified[0].OldestAge < 2*time.Minute || notified[0].Depth != 1 {
+		t.Fatalf("%+v", notified)
+	}
+	sample(3)
+	if len(notified) != 1 {
+		t.Fatal("notified again while breached", notified)
+	}
+
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	sample(2)
+	if len(notified) != 2 || notified[1].Breached {
+		t.Fatalf("%+v", notified)
+	}
+
+	// Depth is an objective too.
+	for _, job := range []string{"b", "c", "d"} {
+		if err := q.Submit(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := q.SLOStatus()
+	if err != nil || !report.Breached || report.Depth != 3 || report.Trend != SLOWorsening {
+		t.Fatalf("%+v %v", report, err)
+	}
+}
+
+func TestSLOStatusUnconfigured(t *testing.T) {
+	_, pool := newTestPool(t)
+	if _, err := NewJobQueue(pool, "slo").SLOStatus(); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,103 @@
+package grt
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// Minutes over which QueueStats.Throughput is averaged.
+const throughputWindow = 5
+
+// QueueStats are a queue's current job counts and lifetime totals, for
+// monitoring.
+type QueueStats struct {
+	// Jobs waiting to be retrieved, across all priorities.
+	Waiting    int `json:"waiting"`
+	Processing int `json:"processing"`
+	// Delayed jobs not yet due.
+	Delayed int `json:"delayed"`
+	Dead    int `json:"dead"`
+	// Age of the oldest waiting job, or zero if there is none or it was
+	// submitted before enqueue times were recorded.
+	OldestAge time.Duration `json:"oldest_age"`
+	// Totals since the queue was created. Failed counts resubmissions with
+	// ResubmitWithError, and Resubmitted all others.
+	Completed    int64 `json:"completed"`
+	Resubmitted  int64 `json:"resubmitted"`
+	Failed       int64 `json:"failed"`
+	DeadLettered int64 `json:"dead_lettered"`
+	// Jobs completed per minute, averaged over the last five whole minutes
+	// by the Redis server's clock.
+	Throughput float64 `json:"throughput"`
+	// Whether the queue has been paused with Pause.
+	Paused bool `json:"paused"`
+}
+
+// Stats returns the queue's statistics, in two round trips. Counts are read
+// separately and may not be mutually consistent.
+func (c *JobQueue) Stats() (QueueStats, error) {
+	v, err := c.cached("stats", func() (interface{}, error) { return c.stats() })
+	if err != nil {
+		return QueueStats{}, err
+	}
+	return v.(QueueStats), nil
+}
+
+func (c *JobQueue) stats() (QueueStats, error) {
+	r := getConn(c.pool, "JobQueue.Stats")
+	defer r.Close()
+	reply, err := oldestScript.do(r, c.Queue+":enqueued", c.Queue, c.priorityList(PriorityHigh), c.priorityList(PriorityLow))
+	if err != nil {
+		return QueueStats{}, err
+	}
+	depth, age := reply[0].(int64), reply[1].(int64)
+	stats := QueueStats{Waiting: int(depth)}
+	if age > 0 {
+		stats.OldestAge = time.Duration(age) * time.Millisecond
+	}
+	r.Send("LLEN", c.Queue+":processing")
+	r.Send("ZCARD", c.Queue+":delayed")
+	r.Send("HLEN", deadKey(c.Queue))
+	r.Send("HGETALL", c.Queue+":stats")
+	counterWindowScript.send(r, throughputKey(c.Queue), throughputWindow)
+	r.Send("EXISTS", pausedKey(c.Queue))
+	replies, err := redis.Values(r.Do(""))
+	if err != nil {
+		return QueueStats{}, err
+	}
+	stats.Processing, _ = redis.Int(replies[0], nil)
+	stats.Delayed, _ = redis.Int(replies[1], nil)
+	stats.Dead, _ = redis.Int(replies[2], nil)
+	totals, err := redis.Int64Map(replies[3], nil)
+	if err != nil {
+		return QueueStats{}, err
+	}
+	stats.Completed = totals["completed"]
+	stats.Resubmitted = totals["resubmitted"]
+	stats.Failed = totals["failed"]
+	stats.DeadLettered = totals["dead_lettered"]
+	window, err := redis.Int64s(replies[4], nil)
+	if err != nil {
+		return QueueStats{}, err
+	}
+	stats.Throughput = float64(window[1]) / throughputWindow
+	stats.Paused, _ = redis.Bool(replies[5], nil)
+	return stats, nil
+}
+
+// throughputKey is the queue's Counter of completed jobs.
+func throughputKey(queue string) string {
+	return queue + ":throughput"
+}
+
+// throughput counts the queue's completed jobs.
+func (c *JobQueue) throughput() *Counter {
+	return NewCounter(c.pool, throughputKey(c.Queue))
+}
+
+// EnqueuedAt returns when the job was first submitted, by the Redis server's
+// clock, or the zero time if it was submitted by a version that did not
+// record it.
+func (w *Work) EnqueuedAt() time.Time {
+	return w.enqueuedAt
+}
@@ -0,0 +1,93 @@
+package grt_test
+
+import (
+	"errors"
+	"github.com/alecthomas/grt"
+	"testing"
+	"time"
+)
+
+// take retrieves the next job without blocking.
+func take(t *testing.T, q *grt.JobQueue) *grt.Work {
+	t.Helper()
+	w, err := q.TryGet(nil)
+	if err != nil || w == nil {
+		t.Fatal(w, err)
+	}
+	return w
+}
+
+func TestStats(t *testing.T) {
+	s, pool := newPool(t)
+	now := time.Now()
+	s.SetTime(now)
+	q := grt.NewJobQueue(pool, "stats", grt.WithPriorities())
+	q.MaxAttempts = 2
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SubmitWithPriority("b", grt.PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SubmitAfter("c", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	s.SetTime(now.Add(time.Minute))
+	stats, err := q.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Waiting != 2 || stats.Delayed != 1 || stats.OldestAge != time.Minute {
+		t.Fatalf("%+v", stats)
+	}
+
+	w := take(t, q)
+	if w.Attempts() != 1 || !w.EnqueuedAt().Equal(now.Truncate(time.Millisecond)) {
+		t.Fatal(w.Attempts(), w.EnqueuedAt())
+	}
+	if err := w.Resubmit(); err != nil {
+		t.Fatal(err)
+	}
+	// The resubmitted job uses up its attempts, and is dead-lettered.
+	if err := take(t, q).ResubmitWithError(errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := take(t, q).ResubmitWithError(errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+	w = take(t, q)
+	stats, err = q.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Waiting != 0 || stats.Processing != 1 || stats.Delayed != 1 || stats.Dead != 1 ||
+		stats.Completed != 0 || stats.Resubmitted != 1 || stats.Failed != 1 || stats.DeadLettered != 1 {
+		t.Fatalf("%+v", stats)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err := q.Stats(); err != nil || stats.Completed != 1 || stats.Processing != 0 {
+		t.Fatalf("%+v %v", stats, err)
+	}
+}
+
+func TestStatsLegacyJobs(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "stats")
+	// A job submitted before enqueue times were recorded.
+	s.Lpush("stats", `"old"`)
+	s.HSet("stats:payload", `"old"`, `"old"`)
+	stats, err := q.Stats()
+	if err != nil || stats.Waiting != 1 || stats.OldestAge != 0 {
+		t.Fatalf("%+v %v", stats, err)
+	}
+	var job string
+	w, err := q.TryGet(&job)
+	if err != nil || job != "old" || !w.EnqueuedAt().IsZero() || w.Attempts() != 1 {
+		t.Fatal(job, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,189 @@
+package grt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"strconv"
+	"time"
+)
+
+// chunksRecordPrefix marks a payload hash entry as the manifest of a payload
+// stored in chunks by SubmitStream. It is followed by the chunk count.
+const chunksRecordPrefix = "\x00grt:chunks:"
+
+// Chunks of an incomplete SubmitStream expire after this long.
+const partialStreamTTL = time.Hour
+
+// SubmitStream submits a job whose payload is read from payload, with an
+// explicit queue key. The payload is stored in StreamChunkSize chunks and is
+// never held in memory in full, by either the producer or a consumer using
+// Work.PayloadReader().
+//
+// Chunks are uploaded to a key of their own, with an expiry, so a failed or
+// interrupted submission is cleaned up by Redis. They are moved into place
+// atomically as the job is enqueued, so of concurrent submissions with the
+// same key exactly one succeeds, with its own payload, and the others return
+// ErrAlreadyQueued without disturbing it.
+func (c *JobQueue) SubmitStream(key []byte, payload io.Reader) error {
+	if err := c.checkOptions(); err != nil {
+		return err
+	}
+	r := getConn(c.pool, "JobQueue.SubmitStream")
+	defer r.Close()
+	// Checked up front to avoid uploading a duplicate, and again when the
+	// job is enqueued.
+	if queued, err := c.isQueued(r, key); err != nil {
+		return err
+	} else if queued {
+		return ErrAlreadyQueued
+	}
+	if c.dedupeNamespace != "" {
+		if claimed, err := redis.Bool(c.read(r, "HEXISTS", c.dedupeKey(), key)); err != nil {
+			return err
+		} else if claimed {
+			return ErrAlreadyQueued
+		}
+	}
+	upload := uploadKey(c.Queue, key)
+	buf := make([]byte, c.StreamChunkSize)
+	n := 0
+	for {
+		read, err := io.ReadFull(payload, buf)
+		if read > 0 {
+			r.Send("HSET", upload, n, buf[:read])
+			if _, err := r.Do("PEXPIRE", upload, partialStreamTTL.Nanoseconds()/1000000); err != nil {
+				return err
+			}
+			n++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			r.Do("DEL", upload)
+			return err
+		}
+	}
+
+	record := c.versionRecord([]byte(chunksRecordPrefix + strconv.Itoa(n)))
+	_, err := submitStreamScript.do(r, c.Queue, c.Queue+":payload", c.Queue+":enqueued", c.dedupeKey(), renamedKey(c.Queue),
+		c.Queue+":producer", c.Queue+":delayed", doneKey(c.Queue, key), expiryKey(c.Queue), upload, chunksKey(c.Queue, key),
+		key, record, c.Queue, c.producerRecord(nil, nil), 0, c.jobTTL.Milliseconds())
+	if err != nil {
+		r.Do("DEL", upload)
+	}
+	if errors.Is(err, ErrQueueRenamed) {
+		return queueRenamedError(r, c.Queue)
+	}
+	return err
+}
+
+// KEYS: as for submitScript, then the chunks uploaded by this submission and
+// the job's chunks key. ARGV: as for submitScript.
+//
+// The uploaded chunks become the job's only if it is enqueued.
+var submitStreamScript = newLuaScript("submit_stream", 1, 11, `
+local function submit()
+`+submitLua+`
+end
+local reply = submit()
+if reply[1] == 0 then
+  if redis.call("EXISTS", KEYS[10]) == 1 then
+    redis.call("RENAME", KEYS[10], KEYS[11])
+    redis.call("PERSIST", KEYS[11])
+  else
+    redis.call("DEL", KEYS[11])
+  end
+end
+return reply
+`)
+
+// PayloadReader returns a reader over the job's raw encoded payload.
+//
+// Payloads submitted with SubmitStream are read a chunk at a time, and
+// payloads offloaded to a PayloadStore implementing PayloadStreamer are
+// streamed from the store, so neither is held in memory in full.
+//
+// The payload is returned as stored, without applying any migrations, but
+// decompressed if it was compressed WithCompression.
+func (w *Work) PayloadReader() (io.ReadCloser, error) {
+	_, record := splitVersion(w.record)
+	store := w.queue.payloadStore
+	if ref := payloadRef(record); ref != "" {
+		if store == nil {
+			return nil, fmt.Errorf("payload %q is stored externally but no PayloadStore is configured", ref)
+		}
+		if streamer, ok := store.(PayloadStreamer); ok {
+			return streamer.Open(ref)
+		}
+		payload, err := store.Get(ref)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch offloaded payload %q: %w", ref, err)
+		}
+		return io.NopCloser(bytes.NewReader(payload)), nil
+	}
+	if bytes.HasPrefix(record, []byte(chunksRecordPrefix)) {
+		n, err := strconv.Atoi(string(record[len(chunksRecordPrefix):]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk manifest %q: %w", record, err)
+		}
+		return &chunkReader{pool: w.pool, key: chunksKey(w.Queue, w.key), chunks: n}, nil
+	}
+	if bytes.HasPrefix(record, []byte(compressedRecordPrefix)) {
+		payload, err := w.queue.decompress(record)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(payload)), nil
+	}
+	return io.NopCloser(bytes.NewReader(record)), nil
+}
+
+// chunkReader reads a chunked payload one chunk at a time.
+type chunkReader struct {
+	pool   *redis.Pool
+	key    string
+	chunks int
+	next   int
+	buf    []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.next >= c.chunks {
+			return 0, io.EOF
+		}
+		r := getConn(c.pool, "Work.PayloadReader")
+		chunk, err := redis.Bytes(r.Do("HGET", c.key, c.next))
+		r.Close()
+		if err == redis.ErrNil {
+			return 0, fmt.Errorf("chunk %d of %s is missing", c.next, c.key)
+		} else if err != nil {
+			return 0, err
+		}
+		c.buf = chunk
+		c.next++
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *chunkReader) Close() error {
+	c.buf = nil
+	c.next = c.chunks
+	return nil
+}
+
+func chunksKey(queue string, key []byte) string {
+	return queue + ":chunks:" + string(key)
+}
+
+// uploadKey returns a new key for a SubmitStream of key to upload its chunks
+// to.
+func uploadKey(queue string, key []byte) string {
+	return queue + ":upload:" + randomKey("") + ":" + string(key)
+}
@@ -0,0 +1,217 @@
+package grt_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"github.com/alecthomas/grt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/garyburd/redigo/redis"
+	"hash"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+const (
+	streamSize = 50 << 20
+	// Allows for a few chunks in flight and garbage awaiting collection.
+	streamCeiling = 16 << 20
+)
+
+// syntheticPayload reads n pseudo-random bytes without holding them.
+type syntheticPayload struct {
+	n     int
+	state uint32
+}
+
+func (s *syntheticPayload) Read(p []byte) (int, error) {
+	if s.n == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > s.n {
+		p = p[:s.n]
+	}
+	for i := range p {
+		s.state = s.state*1664525 + 1013904223
+		p[i] = byte(s.state >> 24)
+	}
+	s.n -= len(p)
+	return len(p), nil
+}
+
+// heapPeak tracks the largest heap growth over a baseline, sampled as bytes
+// pass through it.
+type heapPeak struct {
+	baseline  uint64
+	peak      uint64
+	unsampled int
+}
+
+// newHeapPeak starts tracking heap growth until the test ends, collecting
+// garbage aggressively so that the heap reflects what is retained.
+func newHeapPeak(t *testing.T) *heapPeak {
+	gcPercent := debug.SetGCPercent(10)
+	t.Cleanup(func() { debug.SetGCPercent(gcPercent) })
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return &heapPeak{baseline: stats.HeapAlloc}
+}
+
+// sample records the current heap growth every megabyte of n.
+func (h *heapPeak) sample(n int) {
+	h.unsampled += n
+	if h.unsampled < 1<<20 {
+		return
+	}
+	h.unsampled = 0
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	if stats.HeapAlloc > h.baseline && stats.HeapAlloc-h.baseline > h.peak {
+		h.peak = stats.HeapAlloc - h.baseline
+	}
+}
+
+type sampledReader struct {
+	io.Reader
+	peak *heapPeak
+}
+
+func (s sampledReader) Read(p []byte) (int, error) {
+	n, err := s.Reader.Read(p)
+	s.peak.sample(n)
+	return n, err
+}
+
+type sampledWriter struct {
+	hash.Hash
+	peak *heapPeak
+}
+
+func (s sampledWriter) Write(p []byte) (int, error) {
+	s.peak.sample(len(p))
+	return s.Hash.Write(p)
+}
+
+// discardingConn stores only the length of each chunk uploaded by
+// SubmitStream, so that the in-process Redis does not account for the
+// producer's memory.
+type discardingConn struct {
+	redis.Conn
+}
+
+func (d discardingConn) Send(cmd string, args ...interface{}) error {
+	if cmd == "HSET" && strings.Contains(args[0].(string), ":upload:") {
+		args = []interface{}{args[0], args[1], len(args[2].([]byte))}
+	}
+	return d.Conn.Send(cmd, args...)
+}
+
+func TestSubmitStreamMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams 50MB")
+	}
+	s := miniredis.RunT(t)
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", s.Addr())
+		return discardingConn{conn}, err
+	}}
+	defer pool.Close()
+	q := grt.NewJobQueue(pool, "stream")
+	producer := newHeapPeak(t)
+	if err := q.SubmitStream([]byte("large"), sampledReader{&syntheticPayload{n: streamSize}, producer}); err != nil {
+		t.Fatal(err)
+	}
+	if producer.peak > streamCeiling {
+		t.Fatalf("producer heap grew by %dMB", producer.peak>>20)
+	}
+	if n, err := q.Len(); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+}
+
+func TestStreamLargePayload(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams 50MB")
+	}
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "stream")
+	want := sha256.New()
+	if _, err := io.Copy(want, &syntheticPayload{n: streamSize}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SubmitStream([]byte("large"), &syntheticPayload{n: streamSize}); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := w.PayloadReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer := newHeapPeak(t)
+	got := sampledWriter{sha256.New(), consumer}
+	n, err := io.Copy(got, rc)
+	if err != nil || n != streamSize {
+		t.Fatal(n, err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if consumer.peak > streamCeiling {
+		t.Fatalf("consumer heap grew by %dMB", consumer.peak>>20)
+	}
+	if !bytes.Equal(got.Sum(nil), want.Sum(nil)) {
+		t.Fatal("payload was corrupted")
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPayloadReaderInline(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "stream")
+	if err := q.Submit("small"); err != nil {
+		t.Fatal(err)
+	}
+	var job string
+	w, err := q.Get(&job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := w.PayloadReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	var decoded string
+	if err := (grt.JSONCodec{}).DecodeFrom(rc, &decoded); err != nil || decoded != job {
+		t.Fatal(decoded, err)
+	}
+}
+
+func TestSubmitStreamInterrupted(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "stream")
+	q.StreamChunkSize = 1024
+	failing := io.MultiReader(&syntheticPayload{n: 4096}, iotest.ErrReader(errors.New("connection reset")))
+	if err := q.SubmitStream([]byte("partial"), failing); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n, err := q.Len(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+	for _, key := range s.Keys() {
+		if strings.Contains(key, ":upload:") || strings.Contains(key, ":chunks:") {
+			t.Fatalf("partial upload left behind in %s", key)
+		}
+	}
+}
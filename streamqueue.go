@@ -0,0 +1,493 @@
+package grt
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// Consumer group through which a StreamJobQueue's jobs are retrieved.
+const streamGroup = "grt"
+
+// Longest a StreamJobQueue waiting for a job blocks in XREADGROUP before
+// checking for delayed jobs that have fallen due and for ctx being done.
+const streamPollInterval = time.Second
+
+// WithStreams makes NewQueue create a StreamJobQueue rather than a JobQueue.
+// It has no effect on NewJobQueue.
+func WithStreams() Option {
+	return func(c *JobQueue) { c.streams = true }
+}
+
+// NewQueue creates a Redis-based Queue configured with options: a
+// StreamJobQueue if they include WithStreams, otherwise a JobQueue. Code
+// written against Queue can so switch backends without other changes.
+func NewQueue(pool *redis.Pool, queue string, options ...Option) Queue {
+	probe := &JobQueue{}
+	for _, option := range options {
+		option(probe)
+	}
+	if probe.streams {
+		return NewStreamJobQueue(pool, queue, options...)
+	}
+	return NewJobQueue(pool, queue, options...)
+}
+
+// StreamJobQueue is a Queue built on a Redis stream and consumer group, as an
+// alternative to JobQueue's lists. Jobs are added to the stream with XADD and
+// retrieved with XREADGROUP, so Redis tracks which consumer each job in
+// progress was delivered to in the group's pending entries, and acknowledged
+// with XACK when finalized. On a queue created WithVisibilityTimeout, a job
+// left in progress for longer than the timeout is claimed by the next Get
+// with XAUTOCLAIM, so the jobs of a consumer that died are retried without a
+// reaper. Create with NewStreamJobQueue, or NewQueue WithStreams.
+//
+// Jobs are keyed, deduplicated, decoded and passed through middleware and
+// hooks as a JobQueue created with the same options would. Options specific
+// to JobQueue's layout, such as priorities, payload stores and dedupe
+// namespaces, have no effect, and Work retrieved from a StreamJobQueue cannot
+// be extended, cancelled or transferred to another queue: Transfer removes
+// the job without submitting it to the target. A job must therefore be
+// finalized within the visibility timeout, or it may be retrieved again.
+//
+// The stream is kept at "<queue>:stream", and jobs' payloads and state in
+// hashes below it. The stream and JobQueue layouts are independent: a
+// StreamJobQueue and a JobQueue with the same name do not share jobs.
+type StreamJobQueue struct {
+	pool  *redis.Pool
+	Queue string
+	// Work resubmitted after this many attempts is moved to the dead letters.
+	// Zero is unlimited.
+	MaxAttempts int
+	// Supplies codec, keying, middleware and hooks.
+	config *JobQueue
+}
+
+// NewStreamJobQueue creates a Redis stream-based queue configured with
+// options.
+func NewStreamJobQueue(pool *redis.Pool, queue string, options ...Option) *StreamJobQueue {
+	config := &JobQueue{pool: pool, Queue: queue, codec: JSONCodec{}, clock: &clock{now: time.Now}, background: &background{}, options: &optionsCheck{}}
+	for _, option := range options {
+		option(config)
+	}
+	if config.clusterKeys {
+		config.Queue = clusterQueueName(queue)
+	}
+	config.Queue = Namespace(config.prefix).Key(config.Queue)
+	return &StreamJobQueue{pool: pool, Queue: config.Queue, config: config}
+}
+
+// keys returns the keys passed to the queue's scripts: the stream, then the
+// payload, enqueue time, attempts and expiry hashes, the delayed sorted set
+// and the dead letters set.
+func (q *StreamJobQueue) keys() []interface{} {
+	stream := q.Queue + ":stream"
+	return []interface{}{stream, stream + ":payload", stream + ":enqueued", stream + ":attempts",
+		stream + ":expiry", stream + ":delayed", stream + ":dead"}
+}
+
+// Submit a job, returning ErrAlreadyQueued if an identical job is waiting,
+// delayed or in progress. An identical dead-lettered job is replaced.
+func (q *StreamJobQueue) Submit(job interface{}) error {
+	return q.submit(job, 0, q.config.jobTTL)
+}
+
+// SubmitContext is Submit. Trace context is not recorded.
+func (q *StreamJobQueue) SubmitContext(ctx context.Context, job interface{}) error {
+	return q.submit(job, 0, q.config.jobTTL)
+}
+
+// SubmitAt submits a job that will not be retrieved before at.
+func (q *StreamJobQueue) SubmitAt(job interface{}, at time.Time) error {
+	return q.submit(job, time.Until(at), q.config.jobTTL)
+}
+
+// SubmitAfter submits a job that will not be retrieved until d has elapsed.
+func (q *StreamJobQueue) SubmitAfter(job interface{}, d time.Duration) error {
+	return q.submit(job, d, q.config.jobTTL)
+}
+
+// SubmitWithTTL submits a job that is discarded, or dead-lettered on a queue
+// created WithExpiredDeadLetter, if it is not retrieved within ttl.
+func (q *StreamJobQueue) SubmitWithTTL(job interface{}, ttl time.Duration) error {
+	return q.submit(job, 0, ttl)
+}
+
+func (q *StreamJobQueue) submit(job interface{}, delay time.Duration, ttl time.Duration) error {
+	key, payload, err := q.config.marshal(job)
+	if err != nil {
+		return err
+	}
+	r := getConn(q.pool, "StreamJobQueue.Submit")
+	defer r.Close()
+	args := append(q.keys(), streamGroup, key, payload, delay.Milliseconds(), ttl.Milliseconds())
+	if _, err := streamSubmitScript.do(r, args...); err != nil {
+		return err
+	}
+	q.config.submitted(key)
+	return nil
+}
+
+// Get retrieves the next job, waiting until one is available.
+func (q *StreamJobQueue) Get(v interface{}) (*Work, error) {
+	return q.GetContext(context.Background(), v)
+}
+
+// TryGet retrieves the next job, or returns a nil Work if none is waiting.
+func (q *StreamJobQueue) TryGet(v interface{}) (*Work, error) {
+	work, _, err := q.pop()
+	if err != nil {
+		return nil, err
+	}
+	return acceptWork(work, v)
+}
+
+// GetWait retrieves the next job, waiting at most timeout for one.
+func (q *StreamJobQueue) GetWait(v interface{}, timeout time.Duration) (*Work, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	work, err := q.GetContext(ctx, v)
+	if err == context.DeadlineExceeded {
+		return nil, nil
+	}
+	return work, err
+}
+
+// GetContext retrieves the next job, waiting until one is available or ctx
+// is done. While waiting it blocks in XREADGROUP for up to a second at a
+// time, or until the next delayed job is due.
+func (q *StreamJobQueue) GetContext(ctx context.Context, v interface{}) (*Work, error) {
+	for {
+		work, due, err := q.pop()
+		if err != nil {
+			return nil, err
+		}
+		if work != nil {
+			return acceptWork(work, v)
+		}
+		block := streamPollInterval
+		if due > 0 && due < block {
+			block = due
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < block {
+			block = time.Until(deadline)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if work, err = q.wait(block); err != nil {
+			return nil, err
+		} else if work != nil {
+			return acceptWork(work, v)
+		}
+	}
+}
+
+// pop moves the next job to in progress, after adding any delayed jobs that
+// have fallen due to the stream and discarding any expired ones. If none is
+// waiting, it returns how long until the next delayed job is due, if any.
+func (q *StreamJobQueue) pop() (work *Work, due time.Duration, err error) {
+	r := getConn(q.pool, "StreamJobQueue.Get")
+	defer r.Close()
+	args := append(q.keys(), streamGroup, workerID, q.config.deadLetterExpired, q.config.visibilityTimeout.Milliseconds())
+	reply, err := streamPopScript.do(r, args...)
+	if err != nil || len(reply) == 0 {
+		return nil, 0, err
+	}
+	if len(reply) == 1 {
+		ms, err := redis.Int64(reply[0], nil)
+		return nil, time.Duration(ms) * time.Millisecond, err
+	}
+	work, err = q.work(reply)
+	return work, 0, err
+}
+
+// wait blocks for up to block for a job to be added to the stream, and moves
+// it to in progress. work is nil if none was added, or it had expired.
+func (q *StreamJobQueue) wait(block time.Duration) (*Work, error) {
+	if block < time.Millisecond {
+		block = time.Millisecond
+	}
+	r := getConn(q.pool, "StreamJobQueue.Get")
+	defer r.Close()
+	keys := q.keys()
+	streams, err := redis.Values(r.Do("XREADGROUP", "GROUP", streamGroup, workerID, "COUNT", 1,
+		"BLOCK", block.Milliseconds(), "STREAMS", keys[0], ">"))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// A single stream of a single entry: [[stream, [[id, [field, key]]]]].
+	var (
+		stream  []interface{}
+		entries []interface{}
+		entry   []interface{}
+		fields  [][]byte
+	)
+	if _, err := redis.Scan(streams, &stream); err != nil {
+		return nil, err
+	}
+	if _, err := redis.Scan(stream, nil, &entries); err != nil {
+		return nil, err
+	}
+	if _, err := redis.Scan(entries, &entry); err != nil {
+		return nil, err
+	}
+	if fields, err = redis.ByteSlices(entry[1], nil); err != nil || len(fields) < 2 {
+		return nil, err
+	}
+	args := append(keys, streamGroup, q.config.deadLetterExpired, entry[0], fields[1])
+	reply, err := streamTakeScript.do(r, args...)
+	if err != nil || len(reply) == 0 {
+		return nil, err
+	}
+	return q.work(reply)
+}
+
+// work returns the Work for a job taken by a script, whose reply is its entry
+// ID, key, payload, attempts and enqueue time in milliseconds.
+func (q *StreamJobQueue) work(reply []interface{}) (*Work, error) {
+	var (
+		id, key, payload []byte
+		attempts         int
+		enqueued         int64
+	)
+	if _, err := redis.Scan(reply, &id, &key, &payload, &attempts, &enqueued); err != nil {
+		return nil, err
+	}
+	return &Work{
+		Queue:      q.Queue,
+		key:        key,
+		queue:      q.config,
+		record:     payload,
+		attempts:   attempts,
+		enqueuedAt: time.UnixMilli(enqueued),
+		replay:     &replayState{finalized: func(outcome WorkOutcome) error { return q.finalize(id, key, outcome) }},
+	}, nil
+}
+
+// finalize acknowledges the job's entry and applies outcome to it.
+func (q *StreamJobQueue) finalize(id, key []byte, outcome WorkOutcome) error {
+	r := getConn(q.pool, "StreamJobQueue.finalize")
+	defer r.Close()
+	args := append(q.keys(), streamGroup, id, key, outcome == WorkResubmitted, q.MaxAttempts)
+	reply, err := streamFinalizeScript.do(r, args...)
+	if err != nil {
+		return err
+	}
+	if dead, _ := redis.Bool(reply[0], nil); dead {
+		q.config.log().Warn("Moved job to dead letters", "queue", q.Queue, "key", string(key), "attempts", q.MaxAttempts)
+	}
+	return nil
+}
+
+// Len returns the number of jobs waiting, delayed or in progress, as
+// JobQueue.Len does. Dead-lettered jobs are not counted.
+func (q *StreamJobQueue) Len() (int, error) {
+	r := getConn(q.pool, "StreamJobQueue.Len")
+	defer r.Close()
+	keys := q.keys()
+	r.Send("MULTI")
+	r.Send("HLEN", keys[1])
+	r.Send("SCARD", keys[6])
+	var jobs, dead int
+	reply, err := redis.Values(r.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := redis.Scan(reply, &jobs, &dead); err != nil {
+		return 0, err
+	}
+	return jobs - dead, nil
+}
+
+// IsQueued returns true if an identical job is waiting, delayed or in
+// progress.
+func (q *StreamJobQueue) IsQueued(job interface{}) (bool, error) {
+	key, _, err := q.config.marshal(job)
+	if err != nil {
+		return false, err
+	}
+	r := getConn(q.pool, "StreamJobQueue.IsQueued")
+	defer r.Close()
+	keys := q.keys()
+	r.Send("MULTI")
+	r.Send("HEXISTS", keys[1], key)
+	r.Send("SISMEMBER", keys[6], key)
+	var queued, dead bool
+	reply, err := redis.Values(r.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+	if _, err := redis.Scan(reply, &queued, &dead); err != nil {
+		return false, err
+	}
+	return queued && !dead, nil
+}
+
+// DeadLen returns the number of jobs moved to the dead letters after
+// MaxAttempts attempts, or because their TTL passed on a queue created
+// WithExpiredDeadLetter.
+func (q *StreamJobQueue) DeadLen() (int, error) {
+	r := getConn(q.pool, "StreamJobQueue.DeadLen")
+	defer r.Close()
+	return redis.Int(r.Do("SCARD", q.keys()[6]))
+}
+
+// Run processes jobs with concurrency workers until ctx is done, as
+// JobQueue.Run does.
+func (q *StreamJobQueue) Run(ctx context.Context, concurrency int, handler Handler) error {
+	q.config.runWorkers(ctx, concurrency, handler, q.GetContext)
+	return nil
+}
+
+// streamLua defines the functions shared by the stream scripts, which take
+// the keys returned by StreamJobQueue.keys.
+const streamLua = `
+-- Creates the group with the stream, so that it sees every entry.
+local function create_group(group)
+  if redis.call("EXISTS", KEYS[1]) == 0 then
+    redis.call("XGROUP", "CREATE", KEYS[1], group, "0", "MKSTREAM")
+  end
+end
+local function now_ms()
+  local now = redis.call("TIME")
+  return tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+end
+-- Returns the job of an entry delivered to the group, counting the attempt,
+-- or nil after acknowledging and deleting the entry if its job was removed
+-- or has expired.
+local function take(group, dead_letter_expired, id, key, now)
+  local payload = redis.call("HGET", KEYS[2], key)
+  local expiry = tonumber(redis.call("HGET", KEYS[5], key))
+  if payload and not (expiry and expiry <= now) then
+    local attempts = redis.call("HINCRBY", KEYS[4], key, 1)
+    return {0, id, key, payload, attempts, redis.call("HGET", KEYS[3], key) or 0}
+  end
+  redis.call("XACK", KEYS[1], group, id)
+  redis.call("XDEL", KEYS[1], id)
+  if payload then
+    redis.call("HDEL", KEYS[5], key)
+    if dead_letter_expired == "1" then
+      redis.call("SADD", KEYS[7], key)
+    else
+      redis.call("HDEL", KEYS[2], key)
+      redis.call("HDEL", KEYS[3], key)
+      redis.call("HDEL", KEYS[4], key)
+    end
+  end
+  return nil
+end
+`
+
+// KEYS: see streamLua. ARGV: group, key, payload, delay in milliseconds, TTL
+// in milliseconds.
+//
+// Adds the job to the stream, creating the group with it, or to the delayed
+// set if delay is positive, unless it is already queued. A dead-lettered job
+// is replaced.
+var streamSubmitScript = newLuaScript("stream_submit", 1, 7, `
+redis.replicate_commands()
+`+streamLua+`
+if redis.call("HEXISTS", KEYS[2], ARGV[2]) == 1 and redis.call("SREM", KEYS[7], ARGV[2]) == 0 then
+  return {1} -- statusDuplicate
+end
+local now = now_ms()
+local due = now + math.max(tonumber(ARGV[4]), 0)
+redis.call("HSET", KEYS[2], ARGV[2], ARGV[3])
+redis.call("HSET", KEYS[3], ARGV[2], now)
+redis.call("HDEL", KEYS[4], ARGV[2])
+if tonumber(ARGV[5]) > 0 then
+  redis.call("HSET", KEYS[5], ARGV[2], due + tonumber(ARGV[5]))
+else
+  redis.call("HDEL", KEYS[5], ARGV[2])
+end
+if due > now then
+  redis.call("ZADD", KEYS[6], due, ARGV[2])
+else
+  create_group(ARGV[1])
+  redis.call("XADD", KEYS[1], "*", "key", ARGV[2])
+end
+return {0}
+`)
+
+// KEYS: see streamLua. ARGV: group, consumer, whether to dead-letter expired
+// jobs, visibility timeout in milliseconds.
+//
+// Creates the group if the stream does not exist yet, adds delayed jobs that
+// have fallen due to the stream, then takes the first job left idle in
+// progress for longer than the visibility timeout, if positive, or else the
+// next job not yet delivered to the group. Returns the job, or if none is
+// waiting, the milliseconds until the next delayed job is due, if any.
+var streamPopScript = newLuaScript("stream_pop", 1, 7, `
+redis.replicate_commands()
+`+streamLua+`
+create_group(ARGV[1])
+local now = now_ms()
+for _, key in ipairs(redis.call("ZRANGEBYSCORE", KEYS[6], "-inf", now)) do
+  redis.call("ZREM", KEYS[6], key)
+  redis.call("XADD", KEYS[1], "*", "key", key)
+end
+while true do
+  local entry
+  if tonumber(ARGV[4]) > 0 then
+    entry = redis.call("XAUTOCLAIM", KEYS[1], ARGV[1], ARGV[2], ARGV[4], "0-0", "COUNT", 1)[2][1]
+  end
+  if not entry then
+    local read = redis.call("XREADGROUP", "GROUP", ARGV[1], ARGV[2], "COUNT", 1, "STREAMS", KEYS[1], ">")
+    if not read or not read[1] then
+      break
+    end
+    entry = read[1][2][1]
+  end
+  local job = take(ARGV[1], ARGV[3], entry[1], entry[2][2], now)
+  if job then
+    return job
+  end
+end
+local next = redis.call("ZRANGE", KEYS[6], 0, 0, "WITHSCORES")
+if next[2] then
+  return {0, tonumber(next[2]) - now}
+end
+return {0}
+`)
+
+// KEYS: see streamLua. ARGV: group, whether to dead-letter expired jobs, entry
+// ID, key.
+//
+// Takes the job of an entry delivered to the group by a blocking XREADGROUP.
+var streamTakeScript = newLuaScript("stream_take", 1, 7, `
+redis.replicate_commands()
+`+streamLua+`
+return take(ARGV[1], ARGV[2], ARGV[3], ARGV[4], now_ms()) or {0}
+`)
+
+// KEYS: see streamLua. ARGV: group, entry ID, key, whether the job is
+// resubmitted, maximum attempts.
+//
+// Acknowledges and deletes the job's entry, unless another consumer has
+// finalized it since it was reclaimed. A completed job is removed. A
+// resubmitted job is added to the stream again, or moved to the dead letters
+// once it has used up its attempts, which returns 1.
+var streamFinalizeScript = newLuaScript("stream_finalize", 1, 7, `
+redis.replicate_commands()
+if redis.call("XACK", KEYS[1], ARGV[1], ARGV[2]) == 0 then
+  return {0, 0}
+end
+redis.call("XDEL", KEYS[1], ARGV[2])
+if ARGV[4] == "1" then
+  local max = tonumber(ARGV[5])
+  if max == 0 or tonumber(redis.call("HGET", KEYS[4], ARGV[3]) or 0) < max then
+    redis.call("XADD", KEYS[1], "*", "key", ARGV[3])
+    return {0, 0}
+  end
+  redis.call("HDEL", KEYS[5], ARGV[3])
+  redis.call("SADD", KEYS[7], ARGV[3])
+  return {0, 1}
+end
+for i = 2, 5 do
+  redis.call("HDEL", KEYS[i], ARGV[3])
+end
+return {0, 0}
+`)
@@ -0,0 +1,212 @@
+package grt_test
+
+import (
+	"context"
+	"github.com/alecthomas/grt"
+	"github.com/garyburd/redigo/redis"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewQueueWithStreams(t *testing.T) {
+	_, pool := newPool(t)
+	if _, ok := grt.NewQueue(pool, "q").(*grt.JobQueue); !ok {
+		t.Fatal("expected a JobQueue by default")
+	}
+	q, ok := grt.NewQueue(pool, "q", grt.WithStreams(), grt.WithPrefix("ns")).(*grt.StreamJobQueue)
+	if !ok {
+		t.Fatal("expected a StreamJobQueue WithStreams")
+	}
+	if q.Queue != "ns:q" {
+		t.Fatalf("expected the namespace to apply, got %q", q.Queue)
+	}
+}
+
+func TestStreamJobQueueBlockingGet(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewStreamJobQueue(pool, "stream")
+	got := make(chan string)
+	go func() {
+		var job string
+		w, err := q.GetWait(&job, 5*time.Second)
+		if err != nil || w == nil {
+			t.Error(w, err)
+		}
+		got <- job
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := q.Submit("job"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case job := <-got:
+		if job != "job" {
+			t.Fatalf("expected the job submitted, got %q", job)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a blocked Get to receive the job")
+	}
+	// The job is pending in the consumer group until finalized.
+	r := pool.Get()
+	defer r.Close()
+	pending, err := redis.Values(r.Do("XPENDING", "stream:stream", "grt"))
+	if err != nil || len(pending) == 0 {
+		t.Fatal(pending, err)
+	}
+	if n, _ := redis.Int(pending[0], nil); n != 1 {
+		t.Fatalf("expected one pending entry, got %d", n)
+	}
+}
+
+func TestStreamJobQueueReclaim(t *testing.T) {
+	s, pool := newPool(t)
+	now := time.Unix(1700000000, 0)
+	s.SetTime(now)
+	q := grt.NewStreamJobQueue(pool, "stream", grt.WithVisibilityTimeout(time.Minute))
+	if err := q.Submit("job"); err != nil {
+		t.Fatal(err)
+	}
+	first, err := q.TryGet(nil)
+	if err != nil || first == nil {
+		t.Fatal(first, err)
+	}
+	if w, err := q.TryGet(nil); w != nil || err != nil {
+		t.Fatalf("expected no job while the first is in progress, got %v: %v", w, err)
+	}
+
+	// Once left idle for the visibility timeout, the job is claimed again.
+	s.SetTime(now.Add(2 * time.Minute))
+	second, err := q.TryGet(nil)
+	if err != nil || second == nil {
+		t.Fatalf("expected the idle job to be reclaimed, got %v: %v", second, err)
+	}
+	if second.Attempts() != 2 {
+		t.Fatalf("expected a second attempt, got %d", second.Attempts())
+	}
+	if err := second.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	// Finalizing the first delivery afterwards has no effect.
+	if err := first.Resubmit(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := q.Len(); n != 0 || err != nil {
+		t.Fatalf("expected an empty queue, got %d: %v", n, err)
+	}
+}
+
+func TestStreamJobQueueDeadLetter(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewStreamJobQueue(pool, "stream")
+	q.MaxAttempts = 2
+	if err := q.Submit("job"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		w, err := q.TryGet(nil)
+		if err != nil || w == nil {
+			t.Fatal(i, w, err)
+		}
+		if err := w.Resubmit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w, err := q.TryGet(nil); w != nil || err != nil {
+		t.Fatalf("expected the job to be dead-lettered, got %v: %v", w, err)
+	}
+	if n, _ := q.DeadLen(); n != 1 {
+		t.Fatalf("expected one dead letter, got %d", n)
+	}
+	if n, _ := q.Len(); n != 0 {
+		t.Fatalf("expected dead letters not to be counted, got %d", n)
+	}
+	if queued, _ := q.IsQueued("job"); queued {
+		t.Fatal("expected a dead-lettered job not to be queued")
+	}
+
+	// Submitting the job again replaces the dead letter.
+	if err := q.Submit("job"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := q.TryGet(nil)
+	if err != nil || w == nil || w.Attempts() != 1 {
+		t.Fatal(w, err)
+	}
+	if n, _ := q.DeadLen(); n != 0 {
+		t.Fatalf("expected the dead letter to be replaced, got %d", n)
+	}
+}
+
+func TestStreamJobQueueDelayedAndExpired(t *testing.T) {
+	s, pool := newPool(t)
+	now := time.Unix(1700000000, 0)
+	s.SetTime(now)
+	q := grt.NewStreamJobQueue(pool, "stream", grt.WithExpiredDeadLetter())
+	if err := q.SubmitAfter("later", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SubmitWithTTL("brief", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	s.SetTime(now.Add(30 * time.Second))
+	if err := q.SubmitAfter("sooner", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	s.SetTime(now.Add(2 * time.Minute))
+	// The expired job is dead-lettered, and delayed jobs are retrieved in the
+	// order they fell due.
+	for _, want := range []string{"sooner", "later"} {
+		var job string
+		w, err := q.TryGet(&job)
+		if err != nil || w == nil || job != want {
+			t.Fatalf("expected %q, got %q: %v", want, job, err)
+		}
+	}
+	if n, _ := q.DeadLen(); n != 1 {
+		t.Fatalf("expected the expired job to be dead-lettered, got %d", n)
+	}
+}
+
+func TestStreamJobQueueRun(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewStreamJobQueue(pool, "stream")
+	for _, job := range []string{"a", "b", "c"} {
+		if err := q.Submit(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	lock := sync.Mutex{}
+	seen := map[string]bool{}
+	done := make(chan error)
+	go func() {
+		done <- q.Run(ctx, 2, func(ctx context.Context, work *grt.Work, decode func(v interface{}) error) error {
+			var job string
+			if err := decode(&job); err != nil {
+				return err
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			seen[job] = true
+			if len(seen) == 3 {
+				cancel()
+			}
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Run to return once ctx was cancelled")
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected every job to be handled, got %v", seen)
+	}
+	if n, err := q.Len(); n != 0 || err != nil {
+		t.Fatalf("expected handled jobs to be completed, got %d: %v", n, err)
+	}
+}
@@ -0,0 +1,189 @@
+package grt
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"runtime"
+	"sync"
+)
+
+var (
+	// ErrZeroJob is returned by Submit in strict mode when a nil or
+	// zero-value job is submitted.
+	ErrZeroJob = errors.New("nil or zero-value job")
+)
+
+// StrictReporter receives strict mode violations detected asynchronously,
+// such as leaked Work. testing.TB satisfies this interface.
+type StrictReporter interface {
+	Errorf(format string, args ...interface{})
+}
+
+var strictMode struct {
+	sync.Mutex
+	enabled  bool
+	reporter StrictReporter
+	// Configuration of every strict queue and the key of every strict lock
+	// created in this process.
+	queues map[string]QueueDescription
+	locks  map[string]bool
+}
+
+// StrictMode enables strict mode for all queues and locks created until the
+// returned function is called. It is intended for tests and staging.
+//
+// In strict mode misuse that is otherwise silent becomes an error or panic:
+//
+//   - Submit rejects nil and zero-value jobs with ErrZeroJob.
+//   - Work that is garbage collected without being completed or resubmitted
+//     is reported to reporter (or logged if it is nil).
+//   - Completing or resubmitting Work twice panics.
+//   - Unlocking a Lock that is not held panics.
+//   - Creating two queues with the same name but different options, or a
+//     queue and a lock whose keys collide, panics.
+//
+// Strict mode also enables test hooks such as Work.AbandonForTest.
+func StrictMode(reporter StrictReporter) (restore func()) {
+	strictMode.Lock()
+	defer strictMode.Unlock()
+	strictMode.enabled = true
+	strictMode.reporter = reporter
+	strictMode.queues = map[string]QueueDescription{}
+	strictMode.locks = map[string]bool{}
+	return func() {
+		strictMode.Lock()
+		defer strictMode.Unlock()
+		strictMode.enabled = false
+		strictMode.reporter = nil
+	}
+}
+
+// WithStrict enables strict mode for a single queue. See StrictMode.
+func WithStrict() Option {
+	return func(c *JobQueue) { c.strict = true }
+}
+
+func strictEnabled() bool {
+	strictMode.Lock()
+	defer strictMode.Unlock()
+	return strictMode.enabled
+}
+
+func strictReport(format string, args ...interface{}) {
+	strictMode.Lock()
+	reporter := strictMode.reporter
+	strictMode.Unlock()
+	if reporter != nil {
+		reporter.Errorf(format, args...)
+	} else {
+		slog.Default().Error(fmt.Sprintf(format, args...))
+	}
+}
+
+// registerStrictQueue records a strict queue's configuration, panicking if it
+// conflicts with a queue or lock created earlier.
+func registerStrictQueue(c *JobQueue) {
+	strictMode.Lock()
+	defer strictMode.Unlock()
+	if strictMode.queues == nil {
+		strictMode.queues = map[string]QueueDescription{}
+	}
+	description := c.Describe()
+	keys := description.Keys
+	for _, key := range []string{keys.Waiting, keys.Processing, keys.Payload} {
+		if strictMode.locks[key] {
+			panic(fmt.Sprintf("grt: strict mode: queue %q key %q collides with a lock", c.Queue, key))
+		}
+	}
+	if existing, ok := strictMode.queues[c.Queue]; ok && !reflect.DeepEqual(existing, description) {
+		panic(fmt.Sprintf("grt: strict mode: queue %q created with conflicting options: %+v and %+v", c.Queue, existing, description))
+	}
+	strictMode.queues[c.Queue] = description
+}
+
+// registerStrictLock records a strict lock's key, panicking if it collides
+// with a queue's keys.
+func registerStrictLock(key string) {
+	strictMode.Lock()
+	defer strictMode.Unlock()
+	if strictMode.locks == nil {
+		strictMode.locks = map[string]bool{}
+	}
+	for _, description := range strictMode.queues {
+		keys := description.Keys
+		if key == keys.Waiting || key == keys.Processing || key == keys.Payload {
+			panic(fmt.Sprintf("grt: strict mode: lock key %q collides with queue %q", key, description.Queue))
+		}
+	}
+	strictMode.locks[key] = true
+}
+
+// isZeroJob returns true if job is nil, a nil pointer, or a zero value.
+func isZeroJob(job interface{}) bool {
+	if job == nil {
+		return true
+	}
+	return reflect.ValueOf(job).IsZero()
+}
+
+// trackWork reports w if it is garbage collected before being finalized.
+func trackWork(w *Work) {
+	runtime.SetFinalizer(w, func(w *Work) {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		if !w.finalized {
+			strictReport("grt: strict mode: work %s was leaked without Complete, Resubmit or Transfer", w)
+		}
+	})
+}
+
+// checkFinalize panics in strict mode if w has already been completed or
+// resubmitted.
+func (w *Work) checkFinalize() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.finalized && w.strict {
+		panic(fmt.Sprintf("grt: strict mode: work %s completed or resubmitted twice", w))
+	}
+}
+
+// isFinalized returns true if w has been completed, resubmitted or
+// transferred.
+func (w *Work) isFinalized() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.finalized
+}
+
+// markFinalized marks w as finalized with outcome if err is nil.
+func (w *Work) markFinalized(outcome WorkOutcome, err error) error {
+	if err == nil {
+		w.lock.Lock()
+		first := !w.finalized
+		release := w.held && first
+		w.finalized = true
+		onFinalize := w.onFinalize
+		w.lock.Unlock()
+		if release {
+			w.queue.background.release()
+		}
+		if first && onFinalize != nil {
+			onFinalize(outcome)
+		}
+	}
+	return err
+}
+
+// AbandonForTest drops w without completing or resubmitting it, leaving Redis
+// exactly as a crashed worker would, so that recovery with Cleanup can be
+// exercised deterministically. It panics unless strict mode is enabled, so it
+// cannot be triggered in production by accident.
+func (w *Work) AbandonForTest() {
+	if !w.strict {
+		panic(fmt.Sprintf("grt: AbandonForTest called on %s outside strict mode", w))
+	}
+	w.checkFinalize()
+	w.markFinalized(WorkPending, nil)
+}
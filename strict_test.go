@@ -0,0 +1,144 @@
+package grt_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/alecthomas/grt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// reporter records strict mode violations.
+type reporter struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (r *reporter) Errorf(format string, args ...interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.messages = append(r.messages, fmt.Sprintf(format, args...))
+}
+
+func (r *reporter) reported() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.messages...)
+}
+
+func strict(t *testing.T) *reporter {
+	r := &reporter{}
+	t.Cleanup(grt.StrictMode(r))
+	return r
+}
+
+func mustPanic(t *testing.T, contains string, fn func()) {
+	t.Helper()
+	defer func() {
+		t.Helper()
+		p := recover()
+		if p == nil {
+			t.Fatal("did not panic")
+		}
+		if !strings.Contains(fmt.Sprint(p), contains) {
+			t.Fatalf("panicked with %q, want %q", p, contains)
+		}
+	}()
+	fn()
+}
+
+func TestStrictZeroJob(t *testing.T) {
+	_, pool := newPool(t)
+	strict(t)
+	q := grt.NewJobQueue(pool, "strict-zero")
+	var nilJob *struct{ ID int }
+	for _, job := range []interface{}{nil, nilJob, "", 0, struct{ ID int }{}} {
+		if err := q.Submit(job); !errors.Is(err, grt.ErrZeroJob) {
+			t.Fatalf("%#v: %v", job, err)
+		}
+	}
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStrictLeakedWork(t *testing.T) {
+	_, pool := newPool(t)
+	r := strict(t)
+	q := grt.NewJobQueue(pool, "strict-leak")
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		if _, err := q.Get(nil); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(r.reported()) == 0 && time.Now().Before(deadline) {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if messages := r.reported(); len(messages) != 1 || !strings.Contains(messages[0], "strict-leak") {
+		t.Fatal(messages)
+	}
+}
+
+func TestStrictDoubleFinalize(t *testing.T) {
+	_, pool := newPool(t)
+	strict(t)
+	q := grt.NewJobQueue(pool, "strict-finalize")
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	mustPanic(t, "completed or resubmitted twice", func() { w.Complete() })
+	mustPanic(t, "completed or resubmitted twice", func() { w.Resubmit() })
+}
+
+func TestStrictConflictingQueues(t *testing.T) {
+	_, pool := newPool(t)
+	strict(t)
+	grt.NewJobQueue(pool, "strict-conflict")
+	// Identical options are fine.
+	grt.NewJobQueue(pool, "strict-conflict")
+	mustPanic(t, "strict-conflict", func() { grt.NewJobQueue(pool, "strict-conflict", grt.WithPriorities()) })
+}
+
+func TestStrictLockKeys(t *testing.T) {
+	_, pool := newPool(t)
+	strict(t)
+	grt.NewJobQueue(pool, "strict-lock")
+	mustPanic(t, "strict-lock:payload", func() { grt.NewLock(pool, "strict-lock:payload") })
+	mustPanic(t, "unlock of unlocked lock", func() { grt.NewLock(pool, "strict-unlocked").Unlock() })
+}
+
+func TestNonStrictIsPermissive(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "permissive")
+	if err := q.Submit(""); err != nil {
+		t.Fatal(err)
+	}
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	w.Complete()
+	grt.NewJobQueue(pool, "permissive", grt.WithPriorities())
+	grt.NewLock(pool, "permissive:payload")
+	if err := grt.NewLock(pool, "unlocked").Unlock(); err != grt.ErrNotLocked {
+		t.Fatal(err)
+	}
+}
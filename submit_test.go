@@ -0,0 +1,53 @@
+package grt_test
+
+import (
+	"github.com/alecthomas/grt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSubmitConcurrently(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "submit")
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	var queued, duplicates int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			switch err := q.Submit("same"); err {
+			case nil:
+				atomic.AddInt32(&queued, 1)
+			case grt.ErrAlreadyQueued:
+				atomic.AddInt32(&duplicates, 1)
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if queued != 1 || duplicates != 49 {
+		t.Fatalf("%d queued, %d duplicates", queued, duplicates)
+	}
+	if keys, err := s.List("submit"); err != nil || len(keys) != 1 {
+		t.Fatal(keys, err)
+	}
+}
+
+func TestSubmitMarshalError(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "submit")
+	if err := q.Submit(func() {}); err == nil || err == grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	if err := q.Submit(make(chan int)); err == nil || err == grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	if s.Exists("submit") || s.Exists("submit:payload") {
+		t.Fatal(s.Keys())
+	}
+}
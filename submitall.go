@@ -0,0 +1,163 @@
+package grt
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"strings"
+)
+
+// Maximum number of jobs SubmitAll enqueues per round trip.
+const submitAllBatchSize = 500
+
+// SubmitAllError is returned by SubmitAll when some jobs could not be
+// submitted. The rest of the batch is unaffected.
+type SubmitAllError struct {
+	// Map of index in the batch to the error submitting that job.
+	Errors map[int]error
+}
+
+func (s *SubmitAllError) Error() string {
+	indexes := []int{}
+	for index := range s.Errors {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	failures := []string{}
+	for _, index := range indexes {
+		failures = append(failures, fmt.Sprintf("%d (%s)", index, s.Errors[index]))
+	}
+	return fmt.Sprintf("could not submit jobs at indexes %s", strings.Join(failures, ", "))
+}
+
+// SubmitAll submits a batch of jobs, returning how many were enqueued; the
+// rest were duplicates, recently completed (see DedupWindow) or failed. Jobs
+// are enqueued atomically in batches of 500 per round trip, rather than one
+// per job as with Submit.
+//
+// A job that cannot be encoded (or offloaded to a PayloadStore) does not
+// prevent the others being submitted, and is reported in a *SubmitAllError.
+// Any other error aborts the remainder of the batch. The unavailable fallback
+// is not used.
+func (c *JobQueue) SubmitAll(jobs []interface{}) (submitted int, err error) {
+	if err := c.checkOptions(); err != nil {
+		return 0, err
+	}
+	r := getConn(c.pool, "JobQueue.SubmitAll")
+	defer r.Close()
+	producer := c.producerRecord(nil, nil)
+	failed := map[int]error{}
+	args := []interface{}{}
+	// Offloaded payloads in the pending batch, by key.
+	refs := map[string]string{}
+	flush := func() error {
+		if len(args) == 0 {
+			return nil
+		}
+		reply, err := submitAllScript.do(r, append([]interface{}{c.Queue, c.Queue + ":payload", c.Queue + ":enqueued",
+			c.dedupeKey(), renamedKey(c.Queue), c.Queue + ":producer", expiryKey(c.Queue), c.Queue, producer, c.jobTTL.Milliseconds()}, args...)...)
+		args = args[:0]
+		batchRefs := refs
+		refs = map[string]string{}
+		if err != nil {
+			for _, ref := range batchRefs {
+				c.payloadStore.Delete(ref)
+			}
+		}
+		if errors.Is(err, ErrQueueRenamed) {
+			return queueRenamedError(r, c.Queue)
+		} else if err != nil {
+			return err
+		}
+		// The payloads of skipped jobs were not written, so their offloaded
+		// copies are not needed.
+		skipped, _ := redis.Strings(reply[1:], nil)
+		for _, key := range skipped {
+			if ref, ok := batchRefs[key]; ok {
+				c.payloadStore.Delete(ref)
+			}
+		}
+		n, err := redis.Int(reply[0], nil)
+		submitted += n
+		return err
+	}
+	for i, job := range jobs {
+		if c.strict && isZeroJob(job) {
+			failed[i] = fmt.Errorf("grt: strict mode: refusing to submit %T: %w", job, ErrZeroJob)
+			continue
+		}
+		key, payload, err := c.marshal(job)
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+		record, ref, err := c.payloadRecord(key, payload)
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+		if ref != "" {
+			if previous, ok := refs[string(key)]; ok {
+				c.payloadStore.Delete(previous)
+			}
+			refs[string(key)] = ref
+		}
+		args = append(args, key, c.versionRecord(record))
+		if len(args) == 2*submitAllBatchSize {
+			if err := flush(); err != nil {
+				return submitted, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return submitted, err
+	}
+	if len(failed) > 0 {
+		return submitted, &SubmitAllError{Errors: failed}
+	}
+	return submitted, nil
+}
+
+// KEYS: waiting list, payload hash, enqueued-at hash, dedupe hash (the
+// payload hash unless namespaced), forwarding marker, producer hash, expiry
+// sorted set. ARGV: queue, producer, TTL in milliseconds, then key and
+// payload pairs. Returns the number of jobs enqueued, followed by the keys of
+// those skipped as duplicates or recently completed. Jobs enqueued are
+// announced on the queue's submitted channel.
+var submitAllScript = newLuaScript("submit_all", 1, 7, `
+redis.replicate_commands()
+if redis.call("EXISTS", KEYS[5]) == 1 then
+  return {2} -- statusRenamed
+end
+local now = redis.call("TIME")
+local ms = now[1] * 1000 + math.floor(now[2] / 1000)
+local submitted = 0
+local skipped = {}
+local ttl = tonumber(ARGV[3])
+for i = 4, #ARGV - 2, 2 do
+  local key = ARGV[i]
+  if redis.call("EXISTS", ARGV[1] .. ":done:" .. key) == 0 and redis.call("HSETNX", KEYS[2], key, ARGV[i + 1]) == 1 then
+    if KEYS[4] ~= KEYS[2] and redis.call("HSETNX", KEYS[4], key, ARGV[1]) == 0 then
+      redis.call("HDEL", KEYS[2], key)
+      table.insert(skipped, key)
+    else
+      redis.call("LPUSH", KEYS[1], key)
+      redis.call("HSET", KEYS[3], key, ms)
+      redis.call("HSET", KEYS[6], key, ARGV[2])
+      if ttl > 0 then
+        redis.call("ZADD", KEYS[7], ms + ttl, key)
+      else
+        redis.call("ZREM", KEYS[7], key)
+      end
+      submitted = submitted + 1
+    end
+  else
+    table.insert(skipped, key)
+  end
+end
+if submitted > 0 then
+  redis.call("PUBLISH", ARGV[1] .. ":submitted", "")
+end
+return {0, submitted, unpack(skipped)}
+`)
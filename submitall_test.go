@@ -0,0 +1,84 @@
+package grt_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/alecthomas/grt"
+	"testing"
+)
+
+func TestSubmitAll(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "submitall")
+	if err := q.Submit("job3"); err != nil {
+		t.Fatal(err)
+	}
+	jobs := []interface{}{}
+	for i := 0; i < 1200; i++ {
+		jobs = append(jobs, fmt.Sprintf("job%d", i))
+	}
+	jobs = append(jobs, "job5", func() {}, make(chan int))
+	submitted, err := q.SubmitAll(jobs)
+	// job3 was already queued, and job5 is in the batch twice.
+	if submitted != 1199 {
+		t.Fatal(submitted, err)
+	}
+	var failed *grt.SubmitAllError
+	if !errors.As(err, &failed) || len(failed.Errors) != 2 || failed.Errors[1201] == nil || failed.Errors[1202] == nil {
+		t.Fatal(err)
+	}
+	if keys, err := s.List("submitall"); err != nil || len(keys) != 1200 {
+		t.Fatal(len(keys), err)
+	}
+	var job string
+	w, err := q.TryGet(&job)
+	if err != nil || job != "job3" {
+		t.Fatal(job, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := q.DescribeJob("job7")
+	if err != nil || d.State != grt.JobWaiting || d.EnqueuedAt == nil {
+		t.Fatalf("%+v %v", d, err)
+	}
+}
+
+func TestSubmitAllEmpty(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "submitall")
+	if submitted, err := q.SubmitAll(nil); submitted != 0 || err != nil {
+		t.Fatal(submitted, err)
+	}
+}
+
+// benchmarkJobs returns 1000 jobs not submitted by earlier iterations.
+func benchmarkJobs(iteration int) []interface{} {
+	jobs := []interface{}{}
+	for i := 0; i < 1000; i++ {
+		jobs = append(jobs, fmt.Sprintf("%d-%d", iteration, i))
+	}
+	return jobs
+}
+
+func BenchmarkSubmitLoop(b *testing.B) {
+	_, pool := newPool(b)
+	q := grt.NewJobQueue(pool, "submitall")
+	for i := 0; i < b.N; i++ {
+		for _, job := range benchmarkJobs(i) {
+			if err := q.Submit(job); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkSubmitAll(b *testing.B) {
+	_, pool := newPool(b)
+	q := grt.NewJobQueue(pool, "submitall")
+	for i := 0; i < b.N; i++ {
+		if _, err := q.SubmitAll(benchmarkJobs(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
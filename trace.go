@@ -0,0 +1,51 @@
+package grt
+
+import (
+	"context"
+	"fmt"
+)
+
+// Tracer creates spans for jobs as they are submitted and processed, and
+// carries trace context from one to the other with the job. The tracing
+// package implements it with OpenTelemetry.
+type Tracer interface {
+	// StartSubmit starts a span for submitting the job with key to queue on
+	// behalf of ctx. It returns the trace context to record with the job,
+	// and a function ending the span with the submission's result.
+	StartSubmit(ctx context.Context, queue string, key []byte) (carrier map[string]string, end func(err error))
+	// StartProcess starts a span for handling work, continuing the trace in
+	// carrier, which is nil if none was recorded. It returns the context to
+	// pass to the handler, and a function ending the span with the handler's
+	// result.
+	StartProcess(ctx context.Context, work *Work, carrier map[string]string) (context.Context, func(err error))
+}
+
+// WithTracer traces jobs with tracer. Submissions made with SubmitContext
+// record the trace context of their ctx in the job's Producer, and Run
+// continues it in the context passed to the handler. Other Submit variants
+// are traced without a parent.
+func WithTracer(tracer Tracer) Option {
+	return func(c *JobQueue) { c.tracer = tracer }
+}
+
+// traceHandler wraps handler in a span continuing the trace of each job's
+// submission.
+func (c *JobQueue) traceHandler(handler Handler) Handler {
+	return func(ctx context.Context, work *Work, decode func(v interface{}) error) (err error) {
+		var carrier map[string]string
+		if producer, err := work.Producer(); err != nil {
+			c.log().Warn("Could not read trace context", "queue", c.Queue, "key", string(work.key), "error", err)
+		} else if producer != nil {
+			carrier = producer.Trace
+		}
+		ctx, end := c.tracer.StartProcess(ctx, work, carrier)
+		defer func() {
+			if p := recover(); p != nil {
+				end(fmt.Errorf("panic: %v", p))
+				panic(p)
+			}
+			end(err)
+		}()
+		return handler(ctx, work, decode)
+	}
+}
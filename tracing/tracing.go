@@ -0,0 +1,124 @@
+// Package tracing traces grt jobs with OpenTelemetry, so that a request that
+// submits a job can be followed through its processing:
+//
+//	jobs := grt.NewJobQueue(pool, "jobs", grt.WithTracer(tracing.New()))
+//	err := jobs.SubmitContext(ctx, job)
+//
+// Submissions get a producer span, a child of the span in the submitter's
+// context, and handlers run by Run get a consumer span continuing the same
+// trace. Trace context is carried with the job using the configured
+// propagator, eg. as a W3C traceparent.
+//
+// ObserveCommands records the Redis commands issued by each grt operation as
+// an OpenTelemetry histogram.
+package tracing
+
+import (
+	"context"
+	"github.com/alecthomas/grt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/alecthomas/grt/tracing"
+
+// Tracer is a grt.Tracer using OpenTelemetry. Create with New.
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// Option configures a Tracer.
+type Option func(*Tracer)
+
+// WithTracerProvider creates spans with provider rather than the global
+// provider.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(t *Tracer) { t.tracer = provider.Tracer(instrumentationName) }
+}
+
+// WithPropagator carries trace context with jobs using propagator rather than
+// the global propagator.
+func WithPropagator(propagator propagation.TextMapPropagator) Option {
+	return func(t *Tracer) { t.propagator = propagator }
+}
+
+// New creates a Tracer using the global OpenTelemetry tracer provider and
+// propagator unless configured otherwise.
+func New(options ...Option) *Tracer {
+	t := &Tracer{
+		tracer:     otel.Tracer(instrumentationName),
+		propagator: otel.GetTextMapPropagator(),
+	}
+	for _, option := range options {
+		option(t)
+	}
+	return t
+}
+
+// StartSubmit implements grt.Tracer.
+func (t *Tracer) StartSubmit(ctx context.Context, queue string, key []byte) (map[string]string, func(error)) {
+	ctx, span := t.tracer.Start(ctx, queue+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attributes(queue, key, "publish")...))
+	carrier := propagation.MapCarrier{}
+	t.propagator.Inject(ctx, carrier)
+	return carrier, func(err error) {
+		// A duplicate submission leaves the job queued.
+		if err != nil && err != grt.ErrAlreadyQueued {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// StartProcess implements grt.Tracer.
+func (t *Tracer) StartProcess(ctx context.Context, work *grt.Work, carrier map[string]string) (context.Context, func(error)) {
+	ctx = t.propagator.Extract(ctx, propagation.MapCarrier(carrier))
+	ctx, span := t.tracer.Start(ctx, work.Queue+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attributes(work.Queue, work.Key(), "process")...),
+		trace.WithAttributes(attribute.Int("grt.job.attempts", work.Attempts())))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// ObserveCommands records the number of Redis commands issued by each grt
+// operation in this process in the grt.redis.commands histogram of provider,
+// or of the global meter provider if it is nil, with the operation, eg.
+// "JobQueue.Submit", as its grt.operation attribute. Recording stops when the
+// returned function is called. See grt.ObserveCommands.
+func ObserveCommands(provider metric.MeterProvider) (remove func(), err error) {
+	if provider == nil {
+		provider = otel.GetMeterProvider()
+	}
+	histogram, err := provider.Meter(instrumentationName).Int64Histogram("grt.redis.commands",
+		metric.WithDescription("Redis commands issued per operation, counting commands run by scripts."),
+		metric.WithUnit("{command}"))
+	if err != nil {
+		return nil, err
+	}
+	return grt.ObserveCommands(func(op string, commands int) {
+		histogram.Record(context.Background(), int64(commands), metric.WithAttributes(attribute.String("grt.operation", op)))
+	}), nil
+}
+
+// attributes follow the OpenTelemetry messaging semantic conventions.
+func attributes(queue string, key []byte, operation string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("messaging.system", "grt"),
+		attribute.String("messaging.destination.name", queue),
+		attribute.String("messaging.operation", operation),
+		attribute.String("messaging.message.id", string(key)),
+	}
+}
@@ -0,0 +1,122 @@
+package grt
+
+// Transfer atomically completes the job and submits transformedJob to target
+// as its continuation, eg. to move a job to a queue served by a different
+// class of worker part way through processing.
+//
+// The continuation is queued on target under this job's key, regardless of
+// transformedJob's own key, so it remains identifiable as the same job.
+// Returns ErrAlreadyQueued, leaving this job in progress, if target already
+// has a job with the same key. The continuation expires after target's
+// WithJobTTL, if it has one.
+//
+// The job's attempt count carries over, so the continuation's first
+// retrieval from target counts as its next attempt and target's MaxAttempts
+// applies to the job as a whole. An EventTransferred is published on this
+// queue.
+//
+// Like Complete and Resubmit, Transfer finalizes the Work. Concurrency safe.
+func (w *Work) Transfer(target *JobQueue, transformedJob interface{}) error {
+	w.checkFinalize()
+	return w.transferred(w.markFinalized(WorkTransferred, w.transfer(target, transformedJob)))
+}
+
+// transferred publishes an EventTransferred if err, the result of
+// transferring the job, is nil, and returns err.
+func (w *Work) transferred(err error) error {
+	if err == nil && w.replay == nil {
+		w.queue.publishEvent(EventTransferred, w.key, nil)
+	}
+	return err
+}
+
+func (w *Work) transfer(target *JobQueue, transformedJob interface{}) error {
+	if w.replay != nil {
+		return w.replay.finalize(WorkTransferred)
+	}
+	_, payload, err := target.marshal(transformedJob)
+	if err != nil {
+		return err
+	}
+	if err := target.checkOptions(); err != nil {
+		return err
+	}
+	payload, ref, err := target.payloadRecord(w.key, payload)
+	if err != nil {
+		return err
+	}
+	r := getConn(w.pool, "Work.Transfer")
+	defer r.Close()
+	source := w.queue
+	_, err = transferScript.do(r,
+		source.Queue+":processing", source.Queue+":payload", source.Queue+":enqueued",
+		cancelKey(source.Queue, w.key), chunksKey(source.Queue, w.key), source.dedupeKey(),
+		target.Queue, target.Queue+":payload", target.Queue+":enqueued", target.dedupeKey(),
+		historyKey(source.Queue, w.key), source.Queue+":producer", target.Queue+":producer",
+		source.Queue+":deadlines", source.Queue+":attempts", target.Queue+":attempts", w.key, target.versionRecord(payload), target.Queue, source.Queue,
+		target.jobTTL.Milliseconds())
+	if err != nil {
+		if ref != "" {
+			target.payloadStore.Delete(ref)
+		}
+		return err
+	}
+	if ref := payloadRef(w.record); ref != "" && source.payloadStore != nil {
+		return source.payloadStore.Delete(ref)
+	}
+	return nil
+}
+
+// KEYS: source processing list, payload hash, enqueued-at hash, cancel key,
+// chunks key, dedupe hash; target waiting list, payload hash, enqueued-at
+// hash, dedupe hash; source history list; source and target producer hashes;
+// source deadlines sorted set and attempts hash; target attempts hash. ARGV: key, target payload,
+// target queue, source queue, target TTL in milliseconds.
+//
+// If both queues share a dedupe namespace the job's claim carries over, as
+// do the job's original producer, attempt count and workflow continuation.
+var transferScript = newLuaScript("transfer", 1, 16, `
+redis.replicate_commands()
+if redis.call("HEXISTS", KEYS[8], ARGV[1]) == 1 then
+  return {1} -- statusDuplicate
+end
+if KEYS[10] ~= KEYS[8] and KEYS[10] ~= KEYS[6] and redis.call("HEXISTS", KEYS[10], ARGV[1]) == 1 then
+  return {1} -- statusDuplicate
+end
+local producer = redis.call("HGET", KEYS[12], ARGV[1])
+local attempts = redis.call("HGET", KEYS[15], ARGV[1])
+redis.call("HDEL", KEYS[12], ARGV[1])
+redis.call("LREM", KEYS[1], 0, ARGV[1])
+redis.call("ZREM", KEYS[14], ARGV[1])
+redis.call("HDEL", KEYS[15], ARGV[1])
+redis.call("HDEL", KEYS[2], ARGV[1])
+redis.call("HDEL", KEYS[3], ARGV[1])
+redis.call("DEL", KEYS[4], KEYS[5], KEYS[11])
+if KEYS[6] ~= KEYS[2] then
+  redis.call("HDEL", KEYS[6], ARGV[1])
+end
+redis.call("HSET", KEYS[8], ARGV[1], ARGV[2])
+if KEYS[10] ~= KEYS[8] then
+  redis.call("HSET", KEYS[10], ARGV[1], ARGV[3])
+end
+redis.call("LPUSH", KEYS[7], ARGV[1])
+redis.call("ZREM", ARGV[4] .. ":expiry", ARGV[1])
+local now = redis.call("TIME")
+local ms = now[1] * 1000 + math.floor(now[2] / 1000)
+redis.call("HSET", KEYS[9], ARGV[1], ms)
+if tonumber(ARGV[5]) > 0 then
+  redis.call("ZADD", ARGV[3] .. ":expiry", ms + tonumber(ARGV[5]), ARGV[1])
+else
+  redis.call("ZREM", ARGV[3] .. ":expiry", ARGV[1])
+end
+if producer then
+  redis.call("HSET", KEYS[13], ARGV[1], producer)
+end
+if attempts then
+  redis.call("HSET", KEYS[16], ARGV[1], attempts)
+end
+if redis.call("EXISTS", ARGV[4] .. ":next:" .. ARGV[1]) == 1 then
+  redis.call("RENAME", ARGV[4] .. ":next:" .. ARGV[1], ARGV[3] .. ":next:" .. ARGV[1])
+end
+return {0}
+`)
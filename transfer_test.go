@@ -0,0 +1,137 @@
+package grt_test
+
+import (
+	"context"
+	"errors"
+	"github.com/alecthomas/grt"
+	"strings"
+	"testing"
+	"time"
+)
+
+type renderJob struct {
+	ID  string
+	GPU bool
+}
+
+func TestTransfer(t *testing.T) {
+	s, pool := newPool(t)
+	cpu := grt.NewJobQueue(pool, "cpu", grt.WithEvents())
+	gpu := grt.NewJobQueue(pool, "gpu")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := cpu.Watch(ctx)
+	// Give Watch time to subscribe.
+	time.Sleep(50 * time.Millisecond)
+
+	if err := cpu.Submit(renderJob{ID: "frame"}); err != nil {
+		t.Fatal(err)
+	}
+	var job renderJob
+	w, err := cpu.Get(&job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ResubmitWithError(errors.New("needs a GPU")); err != nil {
+		t.Fatal(err)
+	}
+	if w, err = cpu.Get(&job); err != nil {
+		t.Fatal(err)
+	}
+	key := w.Key()
+	if err := w.Transfer(gpu, renderJob{ID: "frame", GPU: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The continuation keeps the original key, and its attempts.
+	d, err := gpu.DescribeKey(key)
+	if err != nil || d.State != grt.JobWaiting || d.Attempts != 2 {
+		t.Fatalf("%+v %v", d, err)
+	}
+	if w, err = gpu.Get(&job); err != nil {
+		t.Fatal(err)
+	}
+	if !job.GPU || string(w.Key()) != string(key) {
+		t.Fatal(job, string(w.Key()))
+	}
+	if d, err := gpu.DescribeKey(key); err != nil || d.Attempts != 3 {
+		t.Fatalf("%+v %v", d, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The source has no residue of the job.
+	if d, err := cpu.DescribeKey(key); err != nil || d.State != grt.JobNotFound || d.Attempts != 0 || len(d.History) != 0 {
+		t.Fatalf("%+v %v", d, err)
+	}
+	for _, k := range s.Keys() {
+		if strings.HasPrefix(k, "cpu:") && k != "cpu:options" && k != "cpu:stats" {
+			t.Errorf("%s left behind: %v", k, s.Dump())
+		}
+	}
+
+	want := []grt.EventType{grt.EventSubmitted, grt.EventStarted, grt.EventFailed, grt.EventStarted, grt.EventTransferred}
+	for i, eventType := range want {
+		select {
+		case event := <-events:
+			if event.Type != eventType || string(event.Key) != string(key) {
+				t.Fatalf("event %d: %+v, want %s", i, event, eventType)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d: timed out waiting for %s", i, eventType)
+		}
+	}
+}
+
+func TestTransferDuplicate(t *testing.T) {
+	_, pool := newPool(t)
+	cpu := grt.NewJobQueue(pool, "cpu")
+	gpu := grt.NewJobQueue(pool, "gpu")
+	for _, q := range []*grt.JobQueue{cpu, gpu} {
+		if err := q.Submit(renderJob{ID: "frame"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := cpu.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Transfer(gpu, renderJob{ID: "frame", GPU: true}); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	// The job is still in progress on the source, so may be finalized there.
+	if d, err := cpu.DescribeKey(w.Key()); err != nil || d.State != grt.JobInProgress {
+		t.Fatalf("%+v %v", d, err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransferDedupeNamespace(t *testing.T) {
+	eu, us := regionalQueues(t)
+	if err := eu.Submit("record"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := eu.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Transfer(us, "record"); err != nil {
+		t.Fatal(err)
+	}
+	// The namespace claim moved with the job.
+	if err := eu.Submit("record"); err != grt.ErrAlreadyQueued {
+		t.Fatal(err)
+	}
+	if w, err = us.Get(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if err := eu.Submit("record"); err != nil {
+		t.Fatal(err)
+	}
+}
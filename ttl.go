@@ -0,0 +1,147 @@
+package grt
+
+import (
+	"context"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+var (
+	// ErrJobExpired is passed to OnDeadLetter for a job dead-lettered because
+	// its TTL passed before it was processed (see WithExpiredDeadLetter).
+	ErrJobExpired = errors.New("job expired")
+)
+
+// Maximum number of expired jobs ExpireJobs removes per round trip.
+const expireBatchSize = 100
+
+// WithJobTTL gives every job submitted to the queue, other than with
+// SubmitWithTTL, a TTL of ttl. See SubmitWithTTL.
+func WithJobTTL(ttl time.Duration) Option {
+	return func(c *JobQueue) { c.jobTTL = ttl }
+}
+
+// WithExpiredDeadLetter moves jobs whose TTL has passed to the dead letters,
+// passing ErrJobExpired to OnDeadLetter, rather than discarding them.
+// Requeued dead letters no longer expire.
+func WithExpiredDeadLetter() Option {
+	return func(c *JobQueue) { c.deadLetterExpired = true }
+}
+
+// SubmitWithTTL submits a job that is worthless if it is not processed within
+// ttl, eg. a one-time password. Once ttl has passed, Get discards the job
+// instead of returning it, and so does ExpireJobs if it is still waiting; a
+// job already in progress is left to its worker. A ttl of zero or less never
+// expires, overriding WithJobTTL.
+//
+// The job is discarded as though cancelled, abandoning any workflow it is
+// part of, or moved to the dead letters on a queue created
+// WithExpiredDeadLetter. The TTL of a delayed job runs from when it is due.
+func (c *JobQueue) SubmitWithTTL(job interface{}, ttl time.Duration) error {
+	return c.submit(context.Background(), job, 0, PriorityNormal, ttl)
+}
+
+// expiryKey is the sorted set of jobs with a TTL, scored by when they expire
+// in milliseconds since the epoch.
+func expiryKey(queue string) string {
+	return queue + ":expiry"
+}
+
+// dropExpired discards a retrieved job whose TTL has passed, or moves it to
+// the dead letters if the queue was created WithExpiredDeadLetter.
+func (c *JobQueue) dropExpired(w *Work) error {
+	if c.deadLetterExpired {
+		w.checkFinalize()
+		return w.markFinalized(WorkResubmitted, w.deadLetter(ErrJobExpired.Error(), ErrJobExpired))
+	}
+	w.discarded = true
+	if err := w.Complete(); err != nil {
+		return err
+	}
+	c.log().Info("Discarded expired job", "queue", c.Queue, "key", string(w.key))
+	return nil
+}
+
+// ExpireJobs removes waiting and delayed jobs whose TTL has passed from the
+// queue, discarding or dead-lettering them as Get would, and returns how many
+// there were. WithReaper calls it periodically; otherwise expired jobs are
+// only removed when they reach the front of the queue.
+func (c *JobQueue) ExpireJobs() (int, error) {
+	r := getConn(c.pool, "JobQueue.ExpireJobs")
+	defer r.Close()
+	total, offset := 0, 0
+	for {
+		reply, err := expireScript.do(r, expiryKey(c.Queue), c.Queue+":payload", c.Queue+":processing", c.Queue+":delayed",
+			c.priorityList(PriorityHigh), c.Queue, c.priorityList(PriorityLow), c.Queue+":attempts", c.Queue+":enqueued",
+			c.Queue, offset, expireBatchSize)
+		if err != nil {
+			return total, err
+		}
+		scanned, _ := redis.Int(reply[0], nil)
+		skipped, _ := redis.Int(reply[1], nil)
+		// Jobs in progress stay in the expiry set until they are finalized.
+		offset += skipped
+		for i := 2; i+7 <= len(reply); i += 7 {
+			key, err := redis.Bytes(reply[i], nil)
+			if err != nil {
+				return total, err
+			}
+			work, _, err := c.fetched(key, PriorityNormal, reply[i+1:i+7])
+			if err != nil {
+				return total, err
+			}
+			if err := c.dropExpired(work); err != nil {
+				return total, err
+			}
+			total++
+		}
+		if scanned < expireBatchSize {
+			break
+		}
+	}
+	if total > 0 {
+		c.log().Info("Removed expired jobs from the queue", "queue", c.Queue, "count", total)
+	}
+	return total, nil
+}
+
+// KEYS: expiry sorted set, payload hash, processing list, delayed sorted set,
+// waiting lists (high, normal, low), attempts hash, enqueued-at hash. ARGV:
+// queue, offset into the expired jobs, maximum number to process.
+//
+// Expired jobs that are waiting or delayed are moved to the processing list
+// to be finalized by the caller. Returns the number of expired jobs scanned,
+// the number skipped because they are in progress, then for each job moved
+// its key and the job as fetchJobLua would return it.
+var expireScript = newLuaScript("expire", 1, 9, `
+redis.replicate_commands()
+local now = redis.call("TIME")
+local ms = now[1] * 1000 + math.floor(now[2] / 1000)
+local expired = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ms, "LIMIT", tonumber(ARGV[2]), tonumber(ARGV[3]))
+local reply, skipped = {0, #expired, 0}, 0
+for _, key in ipairs(expired) do
+  local record = redis.call("HGET", KEYS[2], key)
+  if not record then
+    redis.call("ZREM", KEYS[1], key)
+  else
+    local removed = redis.call("ZREM", KEYS[4], key) == 1
+    for i = 5, 7 do
+      if not removed and redis.call("LREM", KEYS[i], 1, key) == 1 then
+        removed = true
+      end
+    end
+    if removed then
+      redis.call("LPUSH", KEYS[3], key)
+      local chained = redis.call("EXISTS", ARGV[1] .. ":next:" .. key)
+      for _, value in ipairs({key, record, 0, redis.call("HGET", KEYS[8], key), redis.call("HGET", KEYS[9], key), chained, 1}) do
+        table.insert(reply, value)
+      end
+    else
+      skipped = skipped + 1
+    end
+  end
+end
+reply[3] = skipped
+return reply
+`)
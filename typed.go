@@ -0,0 +1,111 @@
+package grt
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// TypedJobQueue is a JobQueue whose jobs are all of type T. Its Submit and Get
+// methods take and return T rather than interface{}, so submitting or
+// decoding the wrong type is a compile-time error.
+//
+// The embedded JobQueue's other methods remain available, untyped.
+type TypedJobQueue[T any] struct {
+	*JobQueue
+}
+
+// TypedWork is a job of type T retrieved from a TypedJobQueue.
+type TypedWork[T any] struct {
+	*Work
+	// The decoded job.
+	Job T
+}
+
+// NewTypedJobQueue creates a new Redis-based job queue of jobs of type T. See
+// NewJobQueue.
+func NewTypedJobQueue[T any](pool *redis.Pool, queue string, options ...Option) *TypedJobQueue[T] {
+	return &TypedJobQueue[T]{JobQueue: NewJobQueue(pool, queue, options...)}
+}
+
+// Submit a job. See JobQueue.Submit.
+func (q *TypedJobQueue[T]) Submit(job T) error {
+	return q.JobQueue.Submit(job)
+}
+
+// SubmitWithPriority submits a job at priority p. See
+// JobQueue.SubmitWithPriority.
+func (q *TypedJobQueue[T]) SubmitWithPriority(job T, p Priority) error {
+	return q.JobQueue.SubmitWithPriority(job, p)
+}
+
+// SubmitAt submits a job that will not be retrieved before at. See
+// JobQueue.SubmitAt.
+func (q *TypedJobQueue[T]) SubmitAt(job T, at time.Time) error {
+	return q.JobQueue.SubmitAt(job, at)
+}
+
+// SubmitAfter submits a job that will not be retrieved until d has elapsed.
+// See JobQueue.SubmitAt.
+func (q *TypedJobQueue[T]) SubmitAfter(job T, d time.Duration) error {
+	return q.JobQueue.SubmitAfter(job, d)
+}
+
+// IsQueued checks whether a job is queued or in progress. See
+// JobQueue.IsQueued.
+func (q *TypedJobQueue[T]) IsQueued(job T) (bool, error) {
+	return q.JobQueue.IsQueued(job)
+}
+
+// Cancel removes a waiting or delayed job. See JobQueue.Cancel.
+func (q *TypedJobQueue[T]) Cancel(job T) (bool, error) {
+	return q.JobQueue.Cancel(job)
+}
+
+// Get some work, blocking until a job is available. See JobQueue.Get.
+func (q *TypedJobQueue[T]) Get() (*TypedWork[T], error) {
+	return typedWork[T](q.JobQueue.Get)
+}
+
+// TryGet is a non-blocking Get, returning nil if no job is waiting. See
+// JobQueue.TryGet.
+func (q *TypedJobQueue[T]) TryGet() (*TypedWork[T], error) {
+	return typedWork[T](q.JobQueue.TryGet)
+}
+
+// GetWait is like Get, but returns nil if no job arrives within timeout. See
+// JobQueue.GetWait.
+func (q *TypedJobQueue[T]) GetWait(timeout time.Duration) (*TypedWork[T], error) {
+	return typedWork[T](func(v interface{}) (*Work, error) { return q.JobQueue.GetWait(v, timeout) })
+}
+
+// GetContext is like Get, but returns ctx.Err() if ctx is done before a job
+// arrives. See JobQueue.GetContext.
+func (q *TypedJobQueue[T]) GetContext(ctx context.Context) (*TypedWork[T], error) {
+	return typedWork[T](func(v interface{}) (*Work, error) { return q.JobQueue.GetContext(ctx, v) })
+}
+
+// GetBatch retrieves up to n jobs, blocking until at least one is available.
+// See JobQueue.GetBatch.
+func (q *TypedJobQueue[T]) GetBatch(n int) ([]*TypedWork[T], error) {
+	works, values, err := q.JobQueue.GetBatch(n, func() interface{} { return new(T) })
+	if err != nil {
+		return nil, err
+	}
+	typed := make([]*TypedWork[T], len(works))
+	for i, work := range works {
+		typed[i] = &TypedWork[T]{Work: work, Job: *values[i].(*T)}
+	}
+	return typed, nil
+}
+
+// typedWork decodes the job retrieved by get into a TypedWork.
+func typedWork[T any](get func(v interface{}) (*Work, error)) (*TypedWork[T], error) {
+	work := &TypedWork[T]{}
+	w, err := get(&work.Job)
+	if w == nil || err != nil {
+		return nil, err
+	}
+	work.Work = w
+	return work, nil
+}
@@ -0,0 +1,188 @@
+package grt
+
+import (
+	"context"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+var (
+	// ErrWorkExpired is returned by Work.Extend if the job's visibility
+	// timeout has already expired and it has been returned to the queue.
+	ErrWorkExpired = errors.New("work visibility timeout expired")
+)
+
+// Maximum number of expired jobs ReapExpired returns to the queue per round
+// trip.
+const reapBatchSize = 100
+
+// WithVisibilityTimeout gives jobs retrieved by Get a deadline of timeout,
+// after which ReapExpired returns them to the queue as though their worker
+// had crashed. Long-running handlers can push the deadline out with
+// Work.Extend.
+//
+// The timeout should comfortably exceed the longest processing time, as a job
+// reaped while its worker is still processing it will be processed twice. A
+// worker that crashes between retrieving a job and recording its deadline
+// leaves the job for Cleanup, as without a visibility timeout.
+func WithVisibilityTimeout(timeout time.Duration) Option {
+	return func(c *JobQueue) { c.visibilityTimeout = timeout }
+}
+
+// WithReaper calls ReapExpired and ExpireJobs on the queue every interval in
+// the background. Only one instance of a queue needs a reaper, but more are
+// harmless.
+func WithReaper(interval time.Duration) Option {
+	return func(c *JobQueue) { c.reapInterval = interval }
+}
+
+// startReaper schedules ReapExpired and ExpireJobs if WithReaper was given.
+func (c *JobQueue) startReaper() {
+	if c.reapInterval <= 0 {
+		return
+	}
+	c.schedule(c.reapInterval, func() bool {
+		if _, err := c.ReapExpired(); err != nil {
+			c.log().Error("Failed to reap expired jobs", "queue", c.Queue, "error", err)
+		}
+		if _, err := c.ExpireJobs(); err != nil {
+			c.log().Error("Failed to remove expired jobs", "queue", c.Queue, "error", err)
+		}
+		return true
+	})
+}
+
+// ReapExpired returns in-progress jobs whose visibility timeout has expired
+// to the queue, returning how many there were. Jobs are only given deadlines
+// by instances created WithVisibilityTimeout.
+func (c *JobQueue) ReapExpired() (int, error) {
+	r := getConn(c.pool, "JobQueue.ReapExpired")
+	defer r.Close()
+	total := 0
+	for {
+		reply, err := reapScript.do(r, c.Queue+":deadlines", c.Queue+":processing", c.Queue, reapBatchSize)
+		if err != nil {
+			return total, err
+		}
+		values, err := redis.Ints(reply, nil)
+		if err != nil {
+			return total, err
+		}
+		total += values[1]
+		if values[0] < reapBatchSize {
+			break
+		}
+	}
+	if total > 0 {
+		c.log().Info("Returned expired jobs to the queue", "queue", c.Queue, "count", total)
+	}
+	return total, nil
+}
+
+// Extend sets the job's visibility deadline to d from now, returning
+// ErrWorkExpired if it has already expired. It has no effect unless the queue
+// was created WithVisibilityTimeout. Concurrency safe.
+func (w *Work) Extend(d time.Duration) error {
+	if w.replay != nil || w.queue.visibilityTimeout <= 0 {
+		return nil
+	}
+	r := getConn(w.pool, "Work.Extend")
+	defer r.Close()
+	_, err := deadlineScript.do(r, w.Queue+":deadlines", w.key, d.Milliseconds(), "XX")
+	return err
+}
+
+// KeepAlive extends the job's visibility deadline by the queue's visibility
+// timeout every third of it in the background, until ctx is done, the Work is
+// finalized or stop is called, so that the reaper only reclaims jobs whose
+// workers have died. stop waits for an extension in progress. It has no
+// effect unless the queue was created WithVisibilityTimeout. Run keeps its
+// jobs alive itself, with Context.
+func (w *Work) KeepAlive(ctx context.Context) (stop func()) {
+	if w.replay != nil || w.queue.visibilityTimeout <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		w.keepAlive(ctx, nil)
+	}()
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
+
+// keepAlive extends the job's deadline every third of the visibility
+// timeout until ctx is done, and if cancel is not nil, calls it with
+// ErrCancelRequested once cancellation of the job is requested.
+func (w *Work) keepAlive(ctx context.Context, cancel context.CancelCauseFunc) {
+	c := w.queue
+	interval := cancelPollInterval
+	if c.visibilityTimeout > 0 {
+		interval = c.visibilityTimeout / 3
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if w.isFinalized() {
+			return
+		}
+		if c.visibilityTimeout > 0 {
+			if err := w.Extend(c.visibilityTimeout); err == ErrWorkExpired {
+				c.log().Warn("Job expired while being processed", "queue", c.Queue, "key", string(w.key))
+				return
+			} else if err != nil {
+				c.log().Error("Failed to extend job", "queue", c.Queue, "key", string(w.key), "error", err)
+			}
+		}
+		if cancel == nil {
+			continue
+		}
+		if cancelled, err := w.Cancelled(); err != nil {
+			c.log().Error("Failed to check for cancellation", "queue", c.Queue, "key", string(w.key), "error", err)
+		} else if cancelled {
+			c.log().Info("Cancelling job in progress", "queue", c.Queue, "key", string(w.key))
+			cancel(ErrCancelRequested)
+			cancel = nil
+		}
+	}
+}
+
+// KEYS: deadlines sorted set. ARGV: key, timeout in milliseconds, "XX" to
+// only update an existing deadline.
+var deadlineScript = newLuaScript("deadline", 1, 1, `
+redis.replicate_commands()
+if ARGV[3] == "XX" and not redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+  return {5} -- statusExpired
+end
+local now = redis.call("TIME")
+redis.call("ZADD", KEYS[1], now[1] * 1000 + math.floor(now[2] / 1000) + tonumber(ARGV[2]), ARGV[1])
+return {0}
+`)
+
+// KEYS: deadlines sorted set, processing list, waiting list. ARGV: maximum
+// number of deadlines to process. Returns the number of deadlines that
+// expired and the number of jobs returned to the queue.
+var reapScript = newLuaScript("reap", 1, 3, `
+redis.replicate_commands()
+local now = redis.call("TIME")
+local ms = now[1] * 1000 + math.floor(now[2] / 1000)
+local expired = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ms, "LIMIT", 0, tonumber(ARGV[1]))
+local reaped = 0
+for _, key in ipairs(expired) do
+  redis.call("ZREM", KEYS[1], key)
+  if redis.call("LREM", KEYS[2], 0, key) > 0 then
+    redis.call("LPUSH", KEYS[3], key)
+    reaped = reaped + 1
+  end
+end
+return {0, #expired, reaped}
+`)
@@ -0,0 +1,127 @@
+package grt_test
+
+import (
+	"context"
+	"github.com/alecthomas/grt"
+	"testing"
+	"time"
+)
+
+// crashed retrieves a job from a worker's queue instance and closes it
+// without finalizing the Work, as though the worker had been killed.
+func crashed(t *testing.T, q *grt.JobQueue) {
+	t.Helper()
+	if _, err := q.Get(nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.CloseContext(ctx)
+}
+
+func TestVisibilityTimeoutReclaimsCrashedWork(t *testing.T) {
+	_, pool := newPool(t)
+	producer := grt.NewJobQueue(pool, "visibility")
+	if err := producer.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	crashed(t, grt.NewJobQueue(pool, "visibility", grt.WithVisibilityTimeout(100*time.Millisecond)))
+	survivor := grt.NewJobQueue(pool, "visibility", grt.WithVisibilityTimeout(100*time.Millisecond), grt.WithReaper(10*time.Millisecond))
+	defer survivor.Close()
+	start := time.Now()
+	var job string
+	w, err := survivor.GetWait(&job, 2*time.Second)
+	if err != nil || w == nil || job != "a" {
+		t.Fatal(w, job, err)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVisibilityTimeoutExtend(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "visibility", grt.WithVisibilityTimeout(50*time.Millisecond))
+	for _, job := range []string{"a", "b"} {
+		if err := q.Submit(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	extended, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := extended.Extend(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if n, err := q.ReapExpired(); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	if err := expired.Extend(time.Hour); err != grt.ErrWorkExpired {
+		t.Fatal(err)
+	}
+	// Only the extended job keeps a deadline, until it is completed.
+	if members, err := s.ZMembers("visibility:deadlines"); err != nil || len(members) != 1 || members[0] != string(extended.Key()) {
+		t.Fatal(members, err)
+	}
+	if err := extended.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists("visibility:deadlines") {
+		t.Fatal("deadline left behind")
+	}
+	if err := extended.Extend(time.Hour); err != grt.ErrWorkExpired {
+		t.Fatal(err)
+	}
+}
+
+func TestVisibilityTimeoutResubmit(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "visibility", grt.WithVisibilityTimeout(time.Minute))
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Resubmit(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists("visibility:deadlines") {
+		t.Fatal("deadline left behind")
+	}
+}
+
+func TestVisibilityTimeoutDisabled(t *testing.T) {
+	s, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "visibility")
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := q.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists("visibility:deadlines") {
+		t.Fatal("deadline recorded")
+	}
+	if n, err := q.ReapExpired(); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+	// Without a visibility timeout Extend has no effect.
+	if err := w.Extend(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+}
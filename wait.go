@@ -0,0 +1,143 @@
+package grt
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSpinInterval is the default JobQueue.SpinInterval.
+const DefaultSpinInterval = 5 * time.Millisecond
+
+// How long GetContext blocks between checks of its context.
+const contextPollInterval = time.Second
+
+// How long Get blocks between checks of whether the queue has been closed.
+const closePollInterval = time.Second
+
+// fractionalTimeoutPools caches, per pool, whether the server accepts
+// fractional blocking timeouts.
+var fractionalTimeoutPools sync.Map
+
+// GetWait is like Get, but waits at most timeout for a job, returning a nil
+// Work if none arrives.
+//
+// Redis 6.0 and later accept blocking timeouts with millisecond resolution.
+// On older servers, and on servers whose version cannot be determined, only
+// whole seconds of the timeout are spent blocked; any remainder (all of a
+// sub-second timeout) is spent polling with RPOPLPUSH every SpinInterval. Each
+// poll is a Redis command, so a 50ms timeout with the default 5ms interval may
+// cost ten round trips per call.
+func (c *JobQueue) GetWait(v interface{}, timeout time.Duration) (*Work, error) {
+	if err := c.checkOptions(); err != nil {
+		return nil, err
+	}
+	op := startOperation("JobQueue.Get")
+	defer op.end()
+	return c.getWait(op, v, timeout)
+}
+
+// GetContext is like Get, but returns ctx.Err() if ctx is done before a job
+// arrives. The context is checked between blocking waits of at most a second,
+// so cancellation may take up to that long to be noticed. A job retrieved as
+// the context is cancelled is returned rather than dropped.
+func (c *JobQueue) GetContext(ctx context.Context, v interface{}) (*Work, error) {
+	if err := c.checkOptions(); err != nil {
+		return nil, err
+	}
+	op := startOperation("JobQueue.Get")
+	defer op.end()
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		timeout := contextPollInterval
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = minDuration(timeout, time.Until(deadline))
+		}
+		work, err := c.getWait(op, v, timeout)
+		if work != nil || err != nil {
+			return work, err
+		}
+	}
+}
+
+func (c *JobQueue) getWait(op *operation, v interface{}, timeout time.Duration) (*Work, error) {
+	deadline := time.Now().Add(timeout)
+	// The first wait uses the timeout as given, so that whole seconds are
+	// not lost to the time taken to get here.
+	remaining := timeout
+	for {
+		wait := c.blockingWait(remaining)
+		work, err := c.get(op, v, wait)
+		if work != nil || err != nil {
+			return work, err
+		}
+		remaining = time.Until(deadline)
+		if remaining <= 0 {
+			return nil, nil
+		}
+		if wait == 0 {
+			time.Sleep(minDuration(c.spinInterval(), remaining))
+		}
+	}
+}
+
+// blockingWait returns how much of remaining can be spent in a blocking pop,
+// or 0 if the caller must poll.
+func (c *JobQueue) blockingWait(remaining time.Duration) time.Duration {
+	if remaining < time.Millisecond || isSingleConn(c.pool) {
+		return 0
+	}
+	if fractionalTimeouts(c.pool) {
+		return remaining.Truncate(time.Millisecond)
+	}
+	return remaining.Truncate(time.Second)
+}
+
+func (c *JobQueue) spinInterval() time.Duration {
+	if isSingleConn(c.pool) {
+		return singleConnPollInterval
+	}
+	if c.SpinInterval <= 0 {
+		return DefaultSpinInterval
+	}
+	return c.SpinInterval
+}
+
+// blockingTimeout formats a pop wait as a BRPOPLPUSH timeout.
+func blockingTimeout(wait time.Duration) string {
+	if wait%time.Second == 0 {
+		return strconv.FormatInt(int64(wait/time.Second), 10)
+	}
+	return strconv.FormatFloat(wait.Seconds(), 'f', 3, 64)
+}
+
+// fractionalTimeouts reports whether the server behind pool accepts
+// fractional blocking timeouts (Redis 6.0 or later). The result is cached
+// unless the server could not be reached.
+func fractionalTimeouts(pool *redis.Pool) bool {
+	if ok, cached := fractionalTimeoutPools.Load(pool); cached {
+		return ok.(bool)
+	}
+	r := getConn(pool, "JobQueue.GetWait")
+	info, err := redisInfo(r, "server")
+	r.Close()
+	if _, reply := err.(redis.Error); err != nil && !reply {
+		return false
+	}
+	major, _ := strconv.Atoi(strings.SplitN(info["redis_version"], ".", 2)[0])
+	ok := major >= 6
+	fractionalTimeoutPools.Store(pool, ok)
+	return ok
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
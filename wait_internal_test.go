@@ -0,0 +1,44 @@
+package grt
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetWaitFractionalTimeouts(t *testing.T) {
+	_, pool := newTestPool(t)
+	// As if the server were Redis 6.0 or later.
+	fractionalTimeoutPools.Store(pool, true)
+	defer fractionalTimeoutPools.Delete(pool)
+	q := NewJobQueue(pool, "wait")
+	var commands int64
+	defer ObserveCommands(func(op string, n int) {
+		if op == "JobQueue.Get" {
+			atomic.AddInt64(&commands, int64(n))
+		}
+	})()
+	start := time.Now()
+	if w, err := q.GetWait(nil, 300*time.Millisecond); w != nil || err != nil {
+		t.Fatal(w, err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+	// A single blocking attempt rather than some sixty polls.
+	if n := atomic.LoadInt64(&commands); n > 10 {
+		t.Fatal(n)
+	}
+}
+
+func TestBlockingTimeout(t *testing.T) {
+	for wait, want := range map[time.Duration]string{
+		2 * time.Second:         "2",
+		300 * time.Millisecond:  "0.300",
+		1500 * time.Millisecond: "1.500",
+	} {
+		if got := blockingTimeout(wait); got != want {
+			t.Errorf("%s: %s, want %s", wait, got, want)
+		}
+	}
+}
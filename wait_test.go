@@ -0,0 +1,101 @@
+package grt_test
+
+import (
+	"github.com/alecthomas/grt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// timeGetWait calls GetWait on an empty queue, returning how long it waited
+// and how many Redis commands it issued.
+func timeGetWait(t *testing.T, q *grt.JobQueue, timeout time.Duration) (time.Duration, int64) {
+	t.Helper()
+	var commands int64
+	defer grt.ObserveCommands(func(op string, n int) {
+		if op == "JobQueue.Get" {
+			atomic.AddInt64(&commands, int64(n))
+		}
+	})()
+	start := time.Now()
+	w, err := q.GetWait(nil, timeout)
+	elapsed := time.Since(start)
+	if w != nil || err != nil {
+		t.Fatal(w, err)
+	}
+	return elapsed, atomic.LoadInt64(&commands)
+}
+
+func TestGetWaitDurations(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		// Whether the wait is spent polling rather than blocked.
+		spin bool
+	}{
+		{20 * time.Millisecond, true},
+		{300 * time.Millisecond, true},
+		{2 * time.Second, false},
+	}
+	for _, test := range tests {
+		t.Run(test.timeout.String(), func(t *testing.T) {
+			_, pool := newPool(t)
+			q := grt.NewJobQueue(pool, "wait")
+			// Load the scripts, so that only retrieval attempts are counted.
+			timeGetWait(t, q, 0)
+			_, attempt := timeGetWait(t, q, 0)
+			elapsed, commands := timeGetWait(t, q, test.timeout)
+			// miniredis does not report its version, so only whole seconds
+			// are spent blocked.
+			if elapsed < test.timeout || elapsed > test.timeout+200*time.Millisecond {
+				t.Fatalf("waited %s for a %s timeout", elapsed, test.timeout)
+			}
+			if attempts := commands / attempt; test.spin && attempts < int64(test.timeout/(2*grt.DefaultSpinInterval)) {
+				t.Fatalf("%d attempts while polling", attempts)
+			} else if !test.spin && attempts != 1 {
+				t.Fatalf("%d attempts while blocked", attempts)
+			}
+		})
+	}
+}
+
+func TestGetWaitSpinInterval(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "wait")
+	q.SpinInterval = 50 * time.Millisecond
+	timeGetWait(t, q, 0)
+	_, attempt := timeGetWait(t, q, 0)
+	// Attempts at 0, 50, 100 and 120ms.
+	if _, commands := timeGetWait(t, q, 120*time.Millisecond); commands != 4*attempt {
+		t.Fatal(commands, attempt)
+	}
+}
+
+func TestGetWaitArrival(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "wait")
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		if err := q.Submit("late"); err != nil {
+			t.Error(err)
+		}
+	}()
+	start := time.Now()
+	var job string
+	w, err := q.GetWait(&job, 300*time.Millisecond)
+	if err != nil || w == nil || job != "late" {
+		t.Fatal(w, job, err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+	if err := w.Complete(); err != nil {
+		t.Fatal(err)
+	}
+	// A job already waiting is returned without waiting at all.
+	if err := q.Submit("now"); err != nil {
+		t.Fatal(err)
+	}
+	if w, err := q.GetWait(&job, 0); err != nil || w == nil || job != "now" {
+		t.Fatal(w, job, err)
+	}
+}
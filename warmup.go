@@ -0,0 +1,132 @@
+package grt
+
+import (
+	"context"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// WithWarmup warms Run up before its workers retrieve their first job: Run
+// calls Warmup with its concurrency, then fn if it is not nil, eg. to fill
+// handler caches. If warming up fails or does not finish within deadline
+// (default 30 seconds), Run logs a warning and starts anyway, and RunStats
+// reports the warmup as incomplete. Ready reports when Run has finished
+// warming up.
+func WithWarmup(deadline time.Duration, fn func(ctx context.Context) error) Option {
+	return func(c *JobQueue) {
+		if deadline <= 0 {
+			deadline = 30 * time.Second
+		}
+		c.warmup = &warmup{deadline: deadline, fn: fn}
+	}
+}
+
+type warmup struct {
+	deadline time.Duration
+	fn       func(ctx context.Context) error
+}
+
+// Warmup prepares the queue for a burst of work, so that the first jobs are
+// not slowed by cold connections or script loads. It dials up to connections
+// pool connections (which are kept if the pool's MaxIdle allows), loads every
+// Lua script the package uses, and checks that the queue's keys have the
+// expected types.
+//
+// Warmup stops when ctx is done, returning its error; the queue remains
+// usable, just not fully warm.
+func (c *JobQueue) Warmup(ctx context.Context, connections int) error {
+	if connections < 1 {
+		connections = 1
+	}
+	conns := []redis.Conn{}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < connections; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		conn := getConn(c.pool, "JobQueue.Warmup")
+		conns = append(conns, conn)
+		if _, err := conn.Do("PING"); err != nil {
+			return err
+		}
+	}
+	r := conns[0]
+	scriptsLock.Lock()
+	loading := append([]*luaScript(nil), scripts...)
+	scriptsLock.Unlock()
+	for _, script := range loading {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := script.script.Load(r); err != nil {
+			return fmt.Errorf("could not load script %s: %w", script.name, err)
+		}
+	}
+	return c.checkKeyTypes(r)
+}
+
+// checkKeyTypes verifies that none of the queue's keys are of an unexpected
+// type, eg. because another application uses the same key.
+func (c *JobQueue) checkKeyTypes(r redis.Conn) error {
+	keys := c.Describe().Keys
+	expected := []struct{ key, kind string }{
+		{keys.Waiting, "list"},
+		{keys.High, "list"},
+		{keys.Low, "list"},
+		{keys.Processing, "list"},
+		{keys.Payload, "hash"},
+		{keys.Enqueued, "hash"},
+		{keys.Producer, "hash"},
+		{keys.Deadlines, "zset"},
+		{keys.Attempts, "hash"},
+		{keys.Dead, "hash"},
+		{keys.Stats, "hash"},
+		{keys.Delayed, "zset"},
+		{keys.Options, "hash"},
+	}
+	for _, e := range expected {
+		r.Send("TYPE", e.key)
+	}
+	replies, err := redis.Strings(r.Do(""))
+	if err != nil {
+		return err
+	}
+	for i, e := range expected {
+		if replies[i] != "none" && replies[i] != e.kind {
+			return fmt.Errorf("key %s is a %s, expected a %s", e.key, replies[i], e.kind)
+		}
+	}
+	return nil
+}
+
+// warm runs the queue's warmup for run, giving up after the warmup deadline.
+func (c *JobQueue) warm(run *runState, connections int) {
+	ctx, cancel := context.WithTimeout(run.ctx, c.warmup.deadline)
+	defer cancel()
+	// Run in the background so that a hook ignoring ctx cannot hold Run up.
+	warmed := make(chan error, 1)
+	go func() {
+		err := c.Warmup(ctx, connections)
+		if err == nil && c.warmup.fn != nil {
+			err = c.warmup.fn(ctx)
+		}
+		warmed <- err
+	}()
+	var err error
+	select {
+	case err = <-warmed:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		c.log().Warn("Warmup incomplete, starting anyway", "queue", c.Queue, "error", err)
+		run.lock.Lock()
+		run.warmupErr = err
+		run.lock.Unlock()
+	}
+}
@@ -0,0 +1,40 @@
+package grt
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"testing"
+)
+
+func TestWarmupLoadsScripts(t *testing.T) {
+	_, pool := newTestPool(t)
+	q := NewJobQueue(pool, "warmup")
+	scriptsLock.Lock()
+	loaded := append([]*luaScript(nil), scripts...)
+	scriptsLock.Unlock()
+	args := redis.Args{"EXISTS"}
+	for _, script := range loaded {
+		args = append(args, script.script.Hash())
+	}
+	r := pool.Get()
+	defer r.Close()
+	cached, err := redis.Ints(r.Do("SCRIPT", args...))
+	if err != nil || cached[0] != 0 {
+		t.Fatal(cached, err)
+	}
+	if err := q.Warmup(context.Background(), 3); err != nil {
+		t.Fatal(err)
+	}
+	if cached, err = redis.Ints(r.Do("SCRIPT", args...)); err != nil {
+		t.Fatal(err)
+	}
+	for i, exists := range cached {
+		if exists != 1 {
+			t.Errorf("script %s was not loaded", loaded[i].name)
+		}
+	}
+	// The connections dialled are kept for the first jobs, alongside ours.
+	if idle := pool.IdleCount(); idle != 3 {
+		t.Fatal(idle)
+	}
+}
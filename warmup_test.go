@@ -0,0 +1,110 @@
+package grt_test
+
+import (
+	"context"
+	"errors"
+	"github.com/alecthomas/grt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWarmupKeyTypes(t *testing.T) {
+	s, pool := newPool(t)
+	s.Set("warmup:processing", "not a list")
+	err := grt.NewJobQueue(pool, "warmup").Warmup(context.Background(), 1)
+	if err == nil || err.Error() != "key warmup:processing is a string, expected a list" {
+		t.Fatal(err)
+	}
+}
+
+func TestWarmupBeforeRun(t *testing.T) {
+	_, pool := newPool(t)
+	release := make(chan struct{})
+	q := grt.NewJobQueue(pool, "warmup", grt.WithWarmup(time.Minute, func(ctx context.Context) error {
+		<-release
+		return nil
+	}))
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	handled := make(chan struct{}, 1)
+	run(t, q, 1, func(ctx context.Context, w *grt.Work, decode func(interface{}) error) error {
+		handled <- struct{}{}
+		return nil
+	})
+	time.Sleep(50 * time.Millisecond)
+	// Nothing is retrieved until warmup finishes.
+	if q.Ready() {
+		t.Fatal("ready while warming up")
+	}
+	select {
+	case <-handled:
+		t.Fatal("job handled while warming up")
+	default:
+	}
+	close(release)
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("job not handled after warmup")
+	}
+	if !q.Ready() {
+		t.Fatal("not ready after warmup")
+	}
+	if stats := q.RunStats(); stats.WarmupIncomplete != "" {
+		t.Fatalf("%+v", stats)
+	}
+}
+
+func TestWarmupDeadline(t *testing.T) {
+	_, pool := newPool(t)
+	stuck := make(chan struct{})
+	defer close(stuck)
+	q := grt.NewJobQueue(pool, "warmup", grt.WithWarmup(100*time.Millisecond, func(ctx context.Context) error {
+		// Ignores ctx, so Run has to give up on it.
+		<-stuck
+		return nil
+	}))
+	started := time.Now()
+	run(t, q, 1, func(ctx context.Context, w *grt.Work, decode func(interface{}) error) error { return nil })
+	for !q.Ready() {
+		if time.Since(started) > time.Second {
+			t.Fatal("never became ready")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if elapsed := time.Since(started); elapsed < 100*time.Millisecond {
+		t.Fatal("ready before the deadline", elapsed)
+	}
+	if stats := q.RunStats(); !strings.Contains(stats.WarmupIncomplete, context.DeadlineExceeded.Error()) {
+		t.Fatalf("%+v", stats)
+	}
+}
+
+func TestWarmupFailure(t *testing.T) {
+	_, pool := newPool(t)
+	q := grt.NewJobQueue(pool, "warmup", grt.WithWarmup(time.Minute, func(ctx context.Context) error {
+		return errors.New("cache unavailable")
+	}))
+	if q.Ready() {
+		t.Fatal("ready without a Run")
+	}
+	if err := q.Submit("a"); err != nil {
+		t.Fatal(err)
+	}
+	handled := make(chan struct{}, 1)
+	run(t, q, 1, func(ctx context.Context, w *grt.Work, decode func(interface{}) error) error {
+		handled <- struct{}{}
+		return nil
+	})
+	// The worker starts anyway.
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("job not handled after a failed warmup")
+	}
+	if stats := q.RunStats(); stats.WarmupIncomplete != "cache unavailable" || !q.Ready() {
+		t.Fatalf("%+v", stats)
+	}
+}
@@ -0,0 +1,310 @@
+// Package web serves the state of grt queues and locks over HTTP, as JSON or
+// a minimal HTML view, for mounting in an existing service:
+//
+//	http.Handle("/debug/grt/", http.StripPrefix("/debug/grt", web.New(pool, web.WithLocks("my-lock"))))
+//
+// Routes, relative to where the handler is mounted:
+//
+//	/                  Every queue's stats, and the status of each lock.
+//	/queues/<queue>    One queue's stats, configuration, in-progress work and dead letters.
+//	/locks             The status of each lock.
+//
+// Responses are JSON unless the request accepts text/html, or has
+// ?format=html. The handler is read-only.
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alecthomas/grt"
+	"github.com/garyburd/redigo/redis"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Handler serves queue and lock state. Create with New.
+type Handler struct {
+	pool   *redis.Pool
+	queues map[string]*grt.JobQueue
+	locks  []string
+	limit  int
+}
+
+// Option configures a Handler.
+type Option func(*Handler)
+
+// WithLocks reports the status of the locks at keys. Locks cannot be
+// discovered, so none are reported by default.
+func WithLocks(keys ...string) Option {
+	return func(h *Handler) { h.locks = append(h.locks, keys...) }
+}
+
+// WithQueues inspects queues through the given JobQueues, so that their
+// configuration is reported as the service has it. Other queues are inspected
+// with default options.
+func WithQueues(queues ...*grt.JobQueue) Option {
+	return func(h *Handler) {
+		for _, queue := range queues {
+			h.queues[queue.Queue] = queue
+		}
+	}
+}
+
+// WithLimit caps the number of in-progress jobs and dead letters listed per
+// queue. Defaults to 100.
+func WithLimit(n int) Option {
+	return func(h *Handler) { h.limit = n }
+}
+
+// New creates a Handler serving the queues in pool's database.
+func New(pool *redis.Pool, options ...Option) *Handler {
+	h := &Handler{pool: pool, queues: map[string]*grt.JobQueue{}, limit: 100}
+	for _, option := range options {
+		option(h)
+	}
+	return h
+}
+
+// Overview is served at the handler's root.
+type Overview struct {
+	Queues []QueueSummary  `json:"queues"`
+	Locks  []grt.LockState `json:"locks"`
+}
+
+// QueueSummary is a queue's name and stats.
+type QueueSummary struct {
+	Queue string         `json:"queue"`
+	Stats grt.QueueStats `json:"stats"`
+}
+
+// QueueDetail is served at /queues/<queue>.
+type QueueDetail struct {
+	Queue       string               `json:"queue"`
+	Stats       grt.QueueStats       `json:"stats"`
+	Description grt.QueueDescription `json:"description"`
+	InProgress  []InProgressJob      `json:"in_progress"`
+	Dead        []Job                `json:"dead"`
+	// Whether there were more in-progress jobs or dead letters than listed.
+	Truncated bool `json:"truncated"`
+}
+
+// Job is a job's key and payload. Payloads that are not valid UTF-8, or are
+// stored externally, are omitted.
+type Job struct {
+	Key     string `json:"key"`
+	Payload string `json:"payload,omitempty"`
+}
+
+// InProgressJob is a job that has been retrieved and not yet finalized.
+type InProgressJob struct {
+	Job
+	EnqueuedAt *time.Time `json:"enqueued_at,omitempty"`
+	// Time since the job was submitted.
+	Age      time.Duration `json:"age,omitempty"`
+	Deadline *time.Time    `json:"deadline,omitempty"`
+	Attempts int           `json:"attempts"`
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	var (
+		v   interface{}
+		err error
+	)
+	switch {
+	case path == "":
+		v, err = h.overview(r)
+	case path == "locks":
+		v, err = h.lockStates()
+	case strings.HasPrefix(path, "queues/") && len(path) > len("queues/"):
+		v, err = h.queue(strings.TrimPrefix(path, "queues/"))
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wantsHTML(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := page.Execute(w, newPageData(v)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func (h *Handler) overview(r *http.Request) (*Overview, error) {
+	names, err := grt.ListQueues(r.Context(), h.pool)
+	if err != nil {
+		return nil, err
+	}
+	overview := &Overview{Queues: []QueueSummary{}}
+	for _, name := range names {
+		stats, err := h.jobQueue(name).Stats()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		overview.Queues = append(overview.Queues, QueueSummary{Queue: name, Stats: stats})
+	}
+	if overview.Locks, err = h.lockStates(); err != nil {
+		return nil, err
+	}
+	return overview, nil
+}
+
+func (h *Handler) lockStates() ([]grt.LockState, error) {
+	states := []grt.LockState{}
+	for _, key := range h.locks {
+		state, err := grt.InspectLock(h.pool, key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func (h *Handler) queue(name string) (*QueueDetail, error) {
+	queue := h.jobQueue(name)
+	stats, err := queue.Stats()
+	if err != nil {
+		return nil, err
+	}
+	detail := &QueueDetail{
+		Queue:       name,
+		Stats:       stats,
+		Description: queue.Describe(),
+		InProgress:  []InProgressJob{},
+		Dead:        []Job{},
+	}
+	inProgress, next, err := queue.InProgress("", h.limit)
+	if err != nil {
+		return nil, err
+	}
+	detail.Truncated = next != ""
+	now := time.Now()
+	for _, entry := range inProgress {
+		job := InProgressJob{Job: newJob(entry)}
+		description, err := queue.DescribeKey(entry.Key)
+		if err != nil {
+			return nil, err
+		}
+		// The job may have been finalized since it was listed.
+		if description.State == grt.JobNotFound {
+			continue
+		}
+		job.EnqueuedAt, job.Deadline, job.Attempts = description.EnqueuedAt, description.Deadline, description.Attempts
+		if job.EnqueuedAt != nil {
+			job.Age = now.Sub(*job.EnqueuedAt)
+		}
+		detail.InProgress = append(detail.InProgress, job)
+	}
+	dead, next, err := queue.DeadJobs("", h.limit)
+	if err != nil {
+		return nil, err
+	}
+	detail.Truncated = detail.Truncated || next != ""
+	for _, entry := range dead {
+		detail.Dead = append(detail.Dead, newJob(entry))
+	}
+	return detail, nil
+}
+
+// jobQueue returns a JobQueue for inspecting the named queue.
+func (h *Handler) jobQueue(name string) *grt.JobQueue {
+	if queue, ok := h.queues[name]; ok {
+		return queue
+	}
+	return grt.NewJobQueue(h.pool, name)
+}
+
+func newJob(entry grt.JobEntry) Job {
+	job := Job{Key: string(entry.Key)}
+	if utf8.Valid(entry.Payload) {
+		job.Payload = string(entry.Payload)
+	}
+	return job
+}
+
+// pageData is rendered by the HTML view of any route.
+type pageData struct {
+	Queues []QueueSummary
+	Locks  []grt.LockState
+	Detail *QueueDetail
+}
+
+func newPageData(v interface{}) pageData {
+	switch v := v.(type) {
+	case *Overview:
+		return pageData{Queues: v.Queues, Locks: v.Locks}
+	case []grt.LockState:
+		return pageData{Locks: v}
+	case *QueueDetail:
+		return pageData{Queues: []QueueSummary{{Queue: v.Queue, Stats: v.Stats}}, Detail: v}
+	}
+	return pageData{}
+}
+
+func wantsHTML(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "html"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+var page = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head><title>grt</title>
+<style>body { font-family: sans-serif } table { border-collapse: collapse } td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: left }</style>
+</head>
+<body>
+{{with .Queues}}
+<h2>Queues</h2>
+<table>
+<tr><th>Queue</th><th>Waiting</th><th>Processing</th><th>Delayed</th><th>Dead</th><th>Oldest</th><th>Completed</th><th>Throughput/min</th><th>Paused</th></tr>
+{{range .}}<tr><td>{{if $.Detail}}{{.Queue}}{{else}}<a href="queues/{{.Queue}}?format=html">{{.Queue}}</a>{{end}}</td><td>{{.Stats.Waiting}}</td><td>{{.Stats.Processing}}</td><td>{{.Stats.Delayed}}</td><td>{{.Stats.Dead}}</td><td>{{.Stats.OldestAge}}</td><td>{{.Stats.Completed}}</td><td>{{printf "%.1f" .Stats.Throughput}}</td><td>{{.Stats.Paused}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{with .Detail}}
+{{if .InProgress}}
+<h2>{{.Queue}}: in progress</h2>
+<table>
+<tr><th>Key</th><th>Age</th><th>Attempts</th><th>Deadline</th></tr>
+{{range .InProgress}}<tr><td>{{.Key}}</td><td>{{.Age}}</td><td>{{.Attempts}}</td><td>{{with .Deadline}}{{.}}{{end}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{if .Dead}}
+<h2>{{.Queue}}: dead letters</h2>
+<table>
+<tr><th>Key</th></tr>
+{{range .Dead}}<tr><td>{{.Key}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{end}}
+{{with .Locks}}
+<h2>Locks</h2>
+<table>
+<tr><th>Key</th><th>Held</th><th>TTL</th></tr>
+{{range .}}<tr><td>{{.Key}}</td><td>{{.Held}}</td><td>{{.TTL}}</td></tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
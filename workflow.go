@@ -0,0 +1,297 @@
+package grt
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Step is a job to be submitted to a queue as part of a workflow.
+type Step struct {
+	Queue *JobQueue
+	Job   interface{}
+}
+
+// encodedStep is a Step encoded for submission by a script.
+type encodedStep struct {
+	queue    *JobQueue
+	key      []byte
+	record   []byte
+	producer []byte
+	// PayloadStore reference of the record, if offloaded.
+	ref string
+}
+
+func (s Step) encode() (*encodedStep, error) {
+	q := s.Queue
+	key, payload, err := q.marshal(s.Job)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.checkOptions(); err != nil {
+		return nil, err
+	}
+	record, ref, err := q.payloadRecord(key, payload)
+	if err != nil {
+		return nil, err
+	}
+	return &encodedStep{queue: q, key: key, record: q.versionRecord(record), producer: q.producerRecord(nil, nil), ref: ref}, nil
+}
+
+// args are the step's arguments to submitStep.
+func (s *encodedStep) args() []interface{} {
+	return []interface{}{s.queue.Queue, s.key, s.record, s.producer, s.queue.dedupeKey(), s.queue.jobTTL.Milliseconds()}
+}
+
+// release deletes the step's offloaded payload, if any, once it will not be
+// submitted.
+func (s *encodedStep) release() {
+	if s.ref != "" {
+		s.queue.payloadStore.Delete(s.ref)
+	}
+}
+
+// CompleteAndSubmit completes the job and submits job to next in a single
+// transaction, so that a workflow step is neither lost nor repeated if the
+// worker dies in between. If an identical job is already queued on next, the
+// job is completed without submitting another.
+//
+// Like Complete, CompleteAndSubmit finalizes the Work, unless job cannot be
+// encoded. Concurrency safe.
+func (w *Work) CompleteAndSubmit(next *JobQueue, job interface{}) error {
+	if w.replay != nil {
+		w.checkFinalize()
+		return w.completed(w.markFinalized(WorkCompleted, w.complete(nil, nil)))
+	}
+	step, err := Step{Queue: next, Job: job}.encode()
+	if err != nil {
+		return err
+	}
+	w.checkFinalize()
+	err = w.markFinalized(WorkCompleted, w.complete(nil, step))
+	if err != nil {
+		step.release()
+	}
+	return w.completed(err)
+}
+
+// Chain submits the first of steps, and records the rest so that each is
+// submitted when the one before it is completed, whether with Complete,
+// Succeed or by Run. A step that is failed with Fail, or discarded because
+// its cancellation was requested, abandons the rest of the chain; one that
+// is resubmitted or dead-lettered holds it until it is completed.
+//
+// Returns ErrAlreadyQueued, recording nothing, if the first step is already
+// queued. A later step already queued when it is reached counts as submitted,
+// and the chain continues when that job completes.
+//
+// Every step's queue must share a pool. Chains are not supported on Redis
+// Cluster.
+func Chain(steps ...Step) error {
+	if len(steps) == 0 {
+		return errors.New("no steps to chain")
+	}
+	encoded, err := encodeSteps(steps)
+	if err != nil {
+		return err
+	}
+	args := []interface{}{1, ""}
+	args = append(args, encoded[0].args()...)
+	for i := 1; i < len(encoded); i++ {
+		args = append(args, continuationKey(encoded[i-1].queue.Queue, encoded[i-1].key))
+		args = append(args, encoded[i].args()...)
+	}
+	return submitWorkflow("Chain", encoded, encoded[:1], args)
+}
+
+// Group submits members together, and callback once all of them have been
+// completed, whether with Complete, Succeed or by Run, to fan work out and
+// back in. If any member is failed with Fail or discarded because its
+// cancellation was requested, callback is never submitted.
+//
+// Members that are already queued are skipped and not waited for. Returns
+// ErrAlreadyQueued, recording nothing, if every member is.
+//
+// Every queue must share a pool. Groups are not supported on Redis Cluster.
+func Group(members []Step, callback Step) error {
+	if len(members) == 0 {
+		return errors.New("no members in group")
+	}
+	encoded, err := encodeSteps(append(append([]Step{}, members...), callback))
+	if err != nil {
+		return err
+	}
+	group := randomKey(members[0].Queue.Queue + ":group:")
+	args := []interface{}{len(members), group}
+	for _, member := range encoded[:len(members)] {
+		args = append(args, member.args()...)
+	}
+	args = append(args, group)
+	args = append(args, encoded[len(members)].args()...)
+	return submitWorkflow("Group", encoded, encoded[:len(members)], args)
+}
+
+func encodeSteps(steps []Step) ([]*encodedStep, error) {
+	encoded := make([]*encodedStep, len(steps))
+	for i, step := range steps {
+		if step.Queue.pool != steps[0].Queue.pool {
+			return nil, errors.New("workflow steps must share a pool")
+		}
+		var err error
+		if encoded[i], err = step.encode(); err != nil {
+			for _, e := range encoded[:i] {
+				e.release()
+			}
+			return nil, err
+		}
+	}
+	return encoded, nil
+}
+
+// submitWorkflow runs workflowScript with args, for steps of which submitted
+// are submitted immediately.
+func submitWorkflow(op string, steps []*encodedStep, submitted []*encodedStep, args []interface{}) error {
+	r := getConn(steps[0].queue.pool, op)
+	defer r.Close()
+	reply, err := workflowScript.do(r, args...)
+	if err != nil {
+		for _, step := range steps {
+			step.release()
+		}
+		return err
+	}
+	queued, err := redis.Ints(reply, nil)
+	if err != nil {
+		return err
+	}
+	for i, step := range submitted {
+		if queued[i] == 1 {
+			step.queue.submitted(step.key)
+		} else {
+			step.release()
+		}
+	}
+	return nil
+}
+
+// continuationKey holds the step to submit when the job with key is
+// completed: the fields of a step, or a group to count the job towards.
+func continuationKey(queue string, key []byte) string {
+	return queue + ":next:" + string(key)
+}
+
+// submitStepLua defines submitStep(), which submits an encoded step as
+// submitScript does, expiring ttl milliseconds later if ttl is positive, and
+// returns whether it was queued. A job already queued or recently completed
+// is not.
+const submitStepLua = `
+local function submitStep(queue, key, record, producer, dedupe, ttl)
+  local payload = queue .. ":payload"
+  if redis.call("EXISTS", queue .. ":done:" .. key) == 1 or redis.call("HSETNX", payload, key, record) == 0 then
+    return false
+  end
+  if dedupe ~= payload and redis.call("HSETNX", dedupe, key, queue) == 0 then
+    redis.call("HDEL", payload, key)
+    return false
+  end
+  local now = redis.call("TIME")
+  local ms = now[1] * 1000 + math.floor(now[2] / 1000)
+  redis.call("LPUSH", queue, key)
+  redis.call("HSET", queue .. ":enqueued", key, ms)
+  redis.call("HSET", queue .. ":producer", key, producer)
+  if tonumber(ttl or 0) > 0 then
+    redis.call("ZADD", queue .. ":expiry", ms + tonumber(ttl), key)
+  else
+    redis.call("ZREM", queue .. ":expiry", key)
+  end
+  redis.call("PUBLISH", queue .. ":submitted", "")
+  return true
+end
+`
+
+// ARGV: queue, key, record, producer, dedupe hash and TTL of the step.
+var stepScript = newLuaScript("step", 1, 0, `
+redis.replicate_commands()
+`+submitStepLua+`
+submitStep(ARGV[1], ARGV[2], ARGV[3], ARGV[4], ARGV[5], ARGV[6])
+return {0}
+`)
+
+// ARGV: number of steps to submit now, group key or "", then each step to
+// submit (queue, key, record, producer, dedupe hash, TTL), then each
+// continuation to record: its key, then its step.
+//
+// Continuations are only recorded if a step was submitted. With a group,
+// each submitted step counts towards it, and the group's continuation is its
+// callback. Returns whether each step was submitted.
+var workflowScript = newLuaScript("workflow", 1, 0, `
+redis.replicate_commands()
+`+submitStepLua+`
+local group = ARGV[2]
+local queued, submitted = {}, {}
+local i = 3
+for n = 1, tonumber(ARGV[1]) do
+  if submitStep(ARGV[i], ARGV[i + 1], ARGV[i + 2], ARGV[i + 3], ARGV[i + 4], ARGV[i + 5]) then
+    table.insert(queued, 1)
+    table.insert(submitted, ARGV[i] .. ":next:" .. ARGV[i + 1])
+  else
+    table.insert(queued, 0)
+  end
+  i = i + 6
+end
+if #submitted == 0 then
+  return {1} -- statusDuplicate
+end
+for j = i, #ARGV - 1, 7 do
+  redis.call("HSET", ARGV[j], "queue", ARGV[j + 1], "key", ARGV[j + 2], "record", ARGV[j + 3],
+    "producer", ARGV[j + 4], "dedupe", ARGV[j + 5], "ttl", ARGV[j + 6])
+end
+if group ~= "" then
+  for _, key in ipairs(submitted) do
+    redis.call("HSET", key, "group", group)
+  end
+  redis.call("HSET", group, "pending", #submitted)
+end
+return {0, unpack(queued)}
+`)
+
+// KEYS: continuation. ARGV: "1" to advance the workflow, or "0" to abandon
+// it.
+//
+// Advancing submits the continuation's step, or counts the job towards its
+// group and submits the group's callback once every member has completed.
+// Abandoning deletes the continuation and those of the steps that would have
+// followed it, including a group and its callback.
+var continueScript = newLuaScript("continue", 1, 1, `
+redis.replicate_commands()
+`+submitStepLua+`
+local function take(key)
+  local values = redis.call("HGETALL", key)
+  redis.call("DEL", key)
+  local fields = {}
+  for i = 1, #values, 2 do
+    fields[values[i]] = values[i + 1]
+  end
+  return fields
+end
+local step = take(KEYS[1])
+if ARGV[1] ~= "1" then
+  while step.group or step.queue do
+    if step.group then
+      step = take(step.group)
+    else
+      step = take(step.queue .. ":next:" .. step.key)
+    end
+  end
+  return {0}
+end
+if step.group then
+  if redis.call("EXISTS", step.group) == 0 or redis.call("HINCRBY", step.group, "pending", -1) > 0 then
+    return {0}
+  end
+  step = take(step.group)
+end
+if step.queue then
+  submitStep(step.queue, step.key, step.record, step.producer, step.dedupe, step.ttl)
+end
+return {0}
+`)
@@ -0,0 +1,32 @@
+// Package zstd compresses grt payloads with Zstandard, which is faster than
+// gzip at a similar ratio:
+//
+//	jobs := grt.NewJobQueue(pool, "jobs", grt.WithCompression(zstd.Compressor{}, 64<<10))
+package zstd
+
+import (
+	"github.com/klauspost/compress/zstd"
+	"sync"
+)
+
+var (
+	encoderOnce sync.Once
+	encoder     *zstd.Encoder
+	decoderOnce sync.Once
+	decoder     *zstd.Decoder
+)
+
+// Compressor is a grt.Compressor using Zstandard at its default level.
+type Compressor struct{}
+
+func (Compressor) Name() string { return "zstd" }
+
+func (Compressor) Compress(data []byte) ([]byte, error) {
+	encoderOnce.Do(func() { encoder, _ = zstd.NewWriter(nil) })
+	return encoder.EncodeAll(data, nil), nil
+}
+
+func (Compressor) Decompress(data []byte) ([]byte, error) {
+	decoderOnce.Do(func() { decoder, _ = zstd.NewReader(nil) })
+	return decoder.DecodeAll(data, nil)
+}